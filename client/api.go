@@ -0,0 +1,314 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Register 注册新用户，不会自动登录
+func (c *Client) Register(ctx context.Context, email, username, password string) (*User, error) {
+	var u User
+	in := map[string]string{"email": email, "username": username, "password": password}
+	if err := c.callJSON(ctx, http.MethodPost, "/auth/register", in, &u, false); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Login 登录并保存 token，之后的请求自动携带
+func (c *Client) Login(ctx context.Context, email, password string) (*LoginResult, error) {
+	var out struct {
+		LoginResult
+		Expires int64 `json:"expires"`
+	}
+	in := map[string]string{"email": email, "password": password}
+	if err := c.callJSON(ctx, http.MethodPost, "/auth/login", in, &out, false); err != nil {
+		return nil, err
+	}
+	c.setToken(out.Token, out.Expires)
+	res := out.LoginResult
+	if out.Expires > 0 {
+		res.ExpiresAt = time.Unix(out.Expires, 0)
+	}
+	return &res, nil
+}
+
+// Refresh 立即换一个新 token；平时不需要调用，请求前会按需自动刷新
+func (c *Client) Refresh(ctx context.Context) error {
+	var out struct {
+		Token   string `json:"token"`
+		Expires int64  `json:"expires"`
+	}
+	if err := c.callJSON(ctx, http.MethodPost, "/auth/refresh", nil, &out, true); err != nil {
+		return err
+	}
+	c.setToken(out.Token, out.Expires)
+	return nil
+}
+
+func (c *Client) Profile(ctx context.Context) (*Profile, error) {
+	var p Profile
+	if err := c.callJSON(ctx, http.MethodGet, "/user/profile", nil, &p, true); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// UpdateProfile 修改用户名；email 为空时保持不变
+func (c *Client) UpdateProfile(ctx context.Context, username, email string) (*Profile, error) {
+	var p Profile
+	in := map[string]string{"username": username, "email": email}
+	if err := c.callJSON(ctx, http.MethodPut, "/user/profile", in, &p, true); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (c *Client) ChangePassword(ctx context.Context, oldPassword, newPassword string) error {
+	in := map[string]string{"old_password": oldPassword, "new_password": newPassword}
+	return c.callJSON(ctx, http.MethodPut, "/user/password", in, nil, true)
+}
+
+// Avatar 把当前用户的头像写入 w，返回其 Content-Type
+func (c *Client) Avatar(ctx context.Context, w io.Writer) (string, error) {
+	req, err := c.authRequest(ctx, http.MethodGet, "/user/avatar", nil, "")
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.doStream(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return resp.Header.Get("Content-Type"), copyBody(w, resp)
+}
+
+// UpdateAvatar 上传头像；contentType 为空时按文件扩展名推断，必须是 image/*
+func (c *Client) UpdateAvatar(ctx context.Context, filename string, contentType string, r io.Reader) (*Profile, error) {
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	var p Profile
+	parts := []formPart{{field: "avatar", filename: filename, contentType: contentType, r: r}}
+	if err := c.multipart(ctx, http.MethodPut, "/user/avatar", parts, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// UploadFile 流式上传文件
+func (c *Client) UploadFile(ctx context.Context, filename string, r io.Reader, description string) (*UploadResult, error) {
+	return c.upload(ctx, "/files/upload", filename, r, description)
+}
+
+// UploadPublic 匿名上传，不需要登录
+func (c *Client) UploadPublic(ctx context.Context, filename string, r io.Reader, description string) (*UploadResult, error) {
+	return c.upload(ctx, "/files/public/upload", filename, r, description)
+}
+
+func (c *Client) upload(ctx context.Context, path string, filename string, r io.Reader, description string) (*UploadResult, error) {
+	var out UploadResult
+	parts := []formPart{
+		{field: "description", value: description},
+		{field: "file", filename: filename, r: r},
+	}
+	if err := c.multipart(ctx, http.MethodPost, path, parts, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *Client) ListFiles(ctx context.Context, page, size int) (*FileList, error) {
+	var out FileList
+	q := url.Values{"page": {strconv.Itoa(page)}, "size": {strconv.Itoa(size)}}
+	if err := c.callJSON(ctx, http.MethodGet, "/files?"+q.Encode(), nil, &out, true); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DownloadFile 把解密后的文件内容流式写入 w
+func (c *Client) DownloadFile(ctx context.Context, id uint, w io.Writer) (*DownloadInfo, error) {
+	req, err := c.authRequest(ctx, http.MethodGet, "/files/download/"+strconv.FormatUint(uint64(id), 10), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return c.download(req, w)
+}
+
+// DownloadArchive 把多个文件打包为 zip 流式写入 w；password 非空时使用 AES-256 加密条目
+func (c *Client) DownloadArchive(ctx context.Context, ids []uint, password string, w io.Writer) error {
+	b, err := json.Marshal(map[string]any{"file_ids": ids, "password": password})
+	if err != nil {
+		return err
+	}
+	req, err := c.authRequest(ctx, http.MethodPost, "/files/archive", bytes.NewReader(b), "application/json")
+	if err != nil {
+		return err
+	}
+	_, err = c.download(req, w)
+	return err
+}
+
+// OpenFile 从 offset 处开始下载，用于断点续传。etag 非空时作为 If-Range 发送：
+// 文件已被替换时服务器返回完整内容，此时 Download.Offset 为 0，调用方应丢弃已有部分。
+func (c *Client) OpenFile(ctx context.Context, id uint, offset int64, etag string) (*Download, error) {
+	req, err := c.authRequest(ctx, http.MethodGet, "/files/download/"+strconv.FormatUint(uint64(id), 10), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		if etag != "" {
+			req.Header.Set("If-Range", etag)
+		}
+	}
+	resp, err := c.doStream(req)
+	if err != nil {
+		return nil, err
+	}
+	return &Download{DownloadInfo: *downloadInfo(resp), Body: resp.Body}, nil
+}
+
+// ShareFile 生成限时匿名下载链接；ttl 为 0 时使用服务器默认值（24 小时）
+func (c *Client) ShareFile(ctx context.Context, id uint, ttl time.Duration) (*ShareLink, error) {
+	in := map[string]string{}
+	if ttl > 0 {
+		in["expires_in"] = ttl.String()
+	}
+	var out struct {
+		URL     string `json:"url"`
+		Expires int64  `json:"expires"`
+	}
+	if err := c.callJSON(ctx, http.MethodPost, "/files/"+strconv.FormatUint(uint64(id), 10)+"/share", in, &out, true); err != nil {
+		return nil, err
+	}
+	link, err := c.baseURL.Parse(out.URL)
+	if err != nil {
+		return nil, err
+	}
+	return &ShareLink{URL: link.String(), ExpiresAt: time.Unix(out.Expires, 0)}, nil
+}
+
+func (c *Client) download(req *http.Request, w io.Writer) (*DownloadInfo, error) {
+	resp, err := c.doStream(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return downloadInfo(resp), copyBody(w, resp)
+}
+
+func downloadInfo(resp *http.Response) *DownloadInfo {
+	info := &DownloadInfo{
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+		ETag:        resp.Header.Get("ETag"),
+	}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		info.Filename = params["filename"]
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes start-end/size
+		var start, end, size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err == nil {
+			info.Offset, info.Size = start, size
+		}
+	}
+	return info
+}
+
+// UpdateFile 替换内容和/或修改描述
+func (c *Client) UpdateFile(ctx context.Context, id uint, upd FileUpdate) (*UploadResult, error) {
+	var parts []formPart
+	if upd.Description != nil {
+		parts = append(parts, formPart{field: "description", value: *upd.Description})
+	}
+	if upd.Content != nil {
+		parts = append(parts, formPart{field: "file", filename: upd.Filename, r: upd.Content})
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("%w: nothing to update", ErrInvalidParams)
+	}
+	var out UploadResult
+	if err := c.multipart(ctx, http.MethodPut, "/files/"+strconv.FormatUint(uint64(id), 10), parts, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *Client) DeleteFile(ctx context.Context, id uint) error {
+	return c.callJSON(ctx, http.MethodDelete, "/files/"+strconv.FormatUint(uint64(id), 10), nil, nil, true)
+}
+
+type formPart struct {
+	field       string
+	value       string
+	filename    string
+	contentType string
+	r           io.Reader
+}
+
+// multipart 边读边写地发送 multipart/form-data，文件内容不会整体读入内存
+func (c *Client) multipart(ctx context.Context, method, path string, parts []formPart, out any) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	req, err := c.authRequestIfLoggedIn(ctx, method, path, pr, mw.FormDataContentType())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		pw.CloseWithError(writeParts(mw, parts))
+	}()
+	err = c.doJSON(req, out)
+	// 服务器提前返回（例如认证失败）时让写入方退出
+	pr.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+func writeParts(mw *multipart.Writer, parts []formPart) error {
+	for _, part := range parts {
+		if part.r == nil {
+			if err := mw.WriteField(part.field, part.value); err != nil {
+				return err
+			}
+			continue
+		}
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, part.field, filepath.Base(part.filename)))
+		contentType := part.contentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		h.Set("Content-Type", contentType)
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, part.r); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// authRequestIfLoggedIn 用于公共上传：有 token 就带上，没有也可以发送
+func (c *Client) authRequestIfLoggedIn(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Request, error) {
+	req, err := c.authRequest(ctx, method, path, body, contentType)
+	if err == ErrNotAuthenticated {
+		return c.newRequest(ctx, method, path, body, contentType)
+	}
+	return req, err
+}
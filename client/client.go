@@ -0,0 +1,260 @@
+// Package client 是 Secure File Box REST API 的 Go SDK。
+//
+//	c, _ := client.New("https://box.example.com")
+//	if _, err := c.Login(ctx, "me@example.com", "secret"); err != nil { ... }
+//	res, err := c.UploadFile(ctx, "report.pdf", f, "Q3 report")
+//	_, err = c.DownloadFile(ctx, res.FileID, out)
+//
+// 上传和下载都是流式的，不会把文件读进内存。token 在过期前会自动刷新；
+// 服务器返回的 {code, message} 错误被转换为 *APIError，可以用 errors.Is 与
+// ErrNotFound、ErrMalwareDetected 等比较。
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const apiPrefix = "/api/v1"
+
+type Client struct {
+	baseURL *url.URL
+	http    *http.Client
+
+	mu        sync.Mutex
+	token     string
+	issuedAt  time.Time
+	expiresAt time.Time
+	onToken   func(token string, expiresAt time.Time)
+}
+
+type Option func(*Client)
+
+// WithHTTPClient 替换默认的 http.Client（例如设置超时或自定义 Transport）
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithToken 使用已有的 token；expiresAt 为零值表示不过期
+func WithToken(token string, expiresAt time.Time) Option {
+	return func(c *Client) {
+		c.token, c.expiresAt, c.issuedAt = token, expiresAt, tokenIssuedAt(token)
+	}
+}
+
+// WithTokenCallback 在登录或刷新得到新 token 时被调用，便于调用方持久化
+func WithTokenCallback(fn func(token string, expiresAt time.Time)) Option {
+	return func(c *Client) { c.onToken = fn }
+}
+
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("base URL must be http or https: %q", baseURL)
+	}
+	c := &Client{baseURL: u, http: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Token 返回当前 token 及其过期时间
+func (c *Client) Token() (string, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token, c.expiresAt
+}
+
+func (c *Client) setToken(token string, expires int64) {
+	var expiresAt time.Time
+	if expires > 0 {
+		expiresAt = time.Unix(expires, 0)
+	}
+	c.mu.Lock()
+	c.token, c.issuedAt, c.expiresAt = token, tokenIssuedAt(token), expiresAt
+	fn := c.onToken
+	c.mu.Unlock()
+	if fn != nil {
+		fn(token, expiresAt)
+	}
+}
+
+// authToken 返回可用的 token，剩余有效期不足一半（最多 5 分钟）时先刷新
+func (c *Client) authToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == "" {
+		return "", ErrNotAuthenticated
+	}
+	if c.expiresAt.IsZero() {
+		return c.token, nil
+	}
+	margin := min(c.expiresAt.Sub(c.issuedAt)/2, 5*time.Minute)
+	if time.Until(c.expiresAt) > margin {
+		return c.token, nil
+	}
+	var out struct {
+		Token   string `json:"token"`
+		Expires int64  `json:"expires"`
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/auth/refresh", nil, "")
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if err := c.doJSON(req, &out); err != nil {
+		return "", err
+	}
+	c.token, c.issuedAt = out.Token, tokenIssuedAt(out.Token)
+	c.expiresAt = time.Time{}
+	if out.Expires > 0 {
+		c.expiresAt = time.Unix(out.Expires, 0)
+	}
+	if c.onToken != nil {
+		c.onToken(c.token, c.expiresAt)
+	}
+	return c.token, nil
+}
+
+// tokenIssuedAt 读取 JWT 中的 iat（不校验签名，只用于决定何时刷新）；读不到时用当前时间
+func tokenIssuedAt(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		var claims struct {
+			IssuedAt int64 `json:"iat"`
+		}
+		if b, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
+			if json.Unmarshal(b, &claims) == nil && claims.IssuedAt > 0 {
+				return time.Unix(claims.IssuedAt, 0)
+			}
+		}
+	}
+	return time.Now()
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Request, error) {
+	u := *c.baseURL
+	path, u.RawQuery, _ = strings.Cut(path, "?")
+	u.Path += apiPrefix + path
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// authRequest 创建带 Authorization 头的请求
+func (c *Client) authRequest(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Request, error) {
+	token, err := c.authToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, method, path, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
+
+// callJSON 发送 JSON 请求并把 data 解码到 out；auth 为 false 时不带 token
+func (c *Client) callJSON(ctx context.Context, method, path string, in any, out any, auth bool) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(b), "application/json"
+	}
+	var (
+		req *http.Request
+		err error
+	)
+	if auth {
+		req, err = c.authRequest(ctx, method, path, body, contentType)
+	} else {
+		req, err = c.newRequest(ctx, method, path, body, contentType)
+	}
+	if err != nil {
+		return err
+	}
+	return c.doJSON(req, out)
+}
+
+// doJSON 执行请求并解析 {code, message, data} 信封
+func (c *Client) doJSON(req *http.Request, out any) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		// DELETE 成功时没有响应体
+		return nil
+	}
+
+	var env struct {
+		Code    int             `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 32<<20)).Decode(&env); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return &APIError{StatusCode: resp.StatusCode, Code: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		}
+		return fmt.Errorf("decode response: %w", err)
+	}
+	if env.Code != 0 || resp.StatusCode != http.StatusOK {
+		return &APIError{StatusCode: resp.StatusCode, Code: env.Code, Message: env.Message}
+	}
+	if out == nil || len(env.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(env.Data, out)
+}
+
+// doStream 执行请求；成功时返回未读取的响应，失败时解析错误信封
+func (c *Client) doStream(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	apiErr := &APIError{StatusCode: resp.StatusCode, Code: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(apiErr)
+	return nil, apiErr
+}
+
+// copyBody 把响应体写入 w；服务器在输出中途出错时只能截断响应，这里报告为错误
+func copyBody(w io.Writer, resp *http.Response) error {
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return fmt.Errorf("%w: response truncated after %d bytes", ErrStorage, n)
+	}
+	return nil
+}
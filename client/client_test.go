@@ -0,0 +1,213 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/middleware"
+	"github.com/Kaikai20040827/graduation/internal/testserver"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// 以下测试在进程内运行 routes.RegisterAPIRoutes 装配的真实服务器（SQLite 临时库）
+
+func newTestClient(t *testing.T, srv *testserver.Server, opts ...Option) *Client {
+	t.Helper()
+	c, err := New(srv.URL, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func registerAndLogin(t *testing.T, srv *testserver.Server, name string) *Client {
+	t.Helper()
+	ctx := context.Background()
+	c := newTestClient(t, srv)
+	email, password := name+"@example.com", "Passw0rd!"+name
+	if _, err := c.Register(ctx, email, name, password); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	res, err := c.Login(ctx, email, password)
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if res.Token == "" || res.User.Email != email || res.ExpiresAt.IsZero() {
+		t.Fatalf("Login = %+v", res)
+	}
+	if token, _ := c.Token(); token != res.Token {
+		t.Fatalf("client token %q, want the login token", token)
+	}
+	return c
+}
+
+func TestLogin(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{})
+	c := registerAndLogin(t, srv, "alice")
+	p, err := c.Profile(context.Background())
+	if err != nil || p.Email != "alice@example.com" {
+		t.Fatalf("Profile = %+v, %v", p, err)
+	}
+
+	_, err = newTestClient(t, srv).Login(context.Background(), "alice@example.com", "wrong password")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Login with a wrong password = %v, want ErrUnauthorized", err)
+	}
+	_, err = newTestClient(t, srv).Login(context.Background(), "not-an-email", "x")
+	if !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("Login with an invalid email = %v, want ErrInvalidParams", err)
+	}
+	_, err = newTestClient(t, srv).Register(context.Background(), "alice@example.com", "alice2", "Passw0rd!other")
+	if !errors.Is(err, ErrRejected) {
+		t.Fatalf("Register with a taken email = %v, want ErrRejected", err)
+	}
+	if _, err := newTestClient(t, srv).Profile(context.Background()); !errors.Is(err, ErrNotAuthenticated) {
+		t.Fatalf("Profile without login = %v, want ErrNotAuthenticated", err)
+	}
+}
+
+func TestUploadDownloadRoundTrip(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{UserKeys: true})
+	c := registerAndLogin(t, srv, "alice")
+	ctx := context.Background()
+
+	content := strings.Repeat("secure file box ", 10000)
+	up, err := c.UploadFile(ctx, "notes.txt", strings.NewReader(content), "my notes")
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if up.FileID == 0 || up.Filename != "notes.txt" || up.Size != int64(len(content)) {
+		t.Fatalf("UploadFile = %+v", up)
+	}
+
+	var buf bytes.Buffer
+	info, err := c.DownloadFile(ctx, up.FileID, &buf)
+	if err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	if buf.String() != content {
+		t.Fatalf("downloaded %d bytes, want the %d uploaded", buf.Len(), len(content))
+	}
+	if info.Filename != "notes.txt" || info.ETag == "" {
+		t.Fatalf("DownloadInfo = %+v", info)
+	}
+
+	// 断点续传：从中间开始读到结尾
+	d, err := c.OpenFile(ctx, up.FileID, 100, info.ETag)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	rest, err := io.ReadAll(d.Body)
+	d.Body.Close()
+	if err != nil || d.Offset != 100 || string(rest) != content[100:] {
+		t.Fatalf("OpenFile at 100: offset %d, %d bytes, %v", d.Offset, len(rest), err)
+	}
+
+	list, err := c.ListFiles(ctx, 1, 20)
+	if err != nil || list.Total != 1 || list.Items[0].ID != up.FileID || !list.Items[0].UserKeyed {
+		t.Fatalf("ListFiles = %+v, %v", list, err)
+	}
+
+	if _, err := c.UpdateFile(ctx, up.FileID, FileUpdate{Filename: "notes.txt", Content: strings.NewReader("v2")}); err != nil {
+		t.Fatalf("UpdateFile: %v", err)
+	}
+	buf.Reset()
+	if _, err := c.DownloadFile(ctx, up.FileID, &buf); err != nil || buf.String() != "v2" {
+		t.Fatalf("download after update = %q, %v", buf.String(), err)
+	}
+
+	if err := c.DeleteFile(ctx, up.FileID); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if _, err := c.DownloadFile(ctx, up.FileID, io.Discard); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("download after delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestServerErrorsMapToSentinels(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{UserKeys: true})
+	alice := registerAndLogin(t, srv, "alice")
+	bob := registerAndLogin(t, srv, "bob")
+	ctx := context.Background()
+
+	up, err := alice.UploadFile(ctx, "a.txt", strings.NewReader("alice"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bob.DownloadFile(ctx, up.FileID, io.Discard)
+	var apiErr *APIError
+	if !errors.Is(err, ErrForbidden) || !errors.As(err, &apiErr) || apiErr.StatusCode != 403 {
+		t.Fatalf("download of another user's file = %v, want ErrForbidden", err)
+	}
+	if _, err := alice.UpdateFile(ctx, up.FileID, FileUpdate{}); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("empty update = %v, want ErrInvalidParams", err)
+	}
+
+	// 已过期的 token：客户端不知道过期时间，不会先刷新
+	expired := signedToken(t, srv, time.Now().Add(-time.Minute))
+	stale := newTestClient(t, srv, WithToken(expired, time.Time{}))
+	_, err = stale.Profile(ctx)
+	if !errors.Is(err, ErrTokenExpired) || !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("request with an expired token = %v, want ErrTokenExpired and ErrUnauthorized", err)
+	}
+}
+
+func signedToken(t *testing.T, srv *testserver.Server, expiresAt time.Time) string {
+	t.Helper()
+	claims := middleware.JWTClaims{
+		UserID: 1,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    srv.JWT.Issuer,
+			IssuedAt:  jwt.NewNumericDate(expiresAt.Add(-time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(srv.JWT.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAPIErrorUnwrap(t *testing.T) {
+	for code, want := range codeErrors {
+		err := error(&APIError{StatusCode: 400, Code: code, Message: "x"})
+		if !errors.Is(err, want) {
+			t.Errorf("code %d: errors.Is(%v) = false", code, want)
+		}
+	}
+	for message, want := range messageErrors {
+		err := error(&APIError{StatusCode: 401, Code: 401, Message: message})
+		if !errors.Is(err, want) {
+			t.Errorf("message %q: errors.Is(%v) = false", message, want)
+		}
+	}
+	tests := []struct {
+		err  *APIError
+		want []error
+		not  []error
+	}{
+		{&APIError{Code: 401, Message: "token expired"}, []error{ErrTokenExpired, ErrUnauthorized}, []error{ErrForbidden}},
+		{&APIError{Code: 403, Message: "user is disabled"}, []error{ErrUserDisabled, ErrForbidden}, []error{ErrPasswordReset}},
+		{&APIError{Code: 403, Message: "password reset required"}, []error{ErrPasswordReset, ErrForbidden}, []error{ErrUserDisabled}},
+		{&APIError{Code: 40001, Message: "invalid file id"}, []error{ErrInvalidParams}, []error{ErrServer}},
+		{&APIError{Code: 418, Message: "teapot"}, nil, []error{ErrInvalidParams, ErrServer}},
+	}
+	for _, tt := range tests {
+		for _, want := range tt.want {
+			if !errors.Is(tt.err, want) {
+				t.Errorf("%v: errors.Is(%v) = false", tt.err, want)
+			}
+		}
+		for _, not := range tt.not {
+			if errors.Is(tt.err, not) {
+				t.Errorf("%v: errors.Is(%v) = true", tt.err, not)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 与服务器 pkg.JSONError 使用的业务码一一对应，可以用 errors.Is 判断
+var (
+	ErrInvalidParams    = errors.New("invalid parameters")        // 400, 40001
+	ErrRejected         = errors.New("request rejected")          // 40002，例如邮箱已存在、旧密码错误
+	ErrMalwareDetected  = errors.New("file rejected: malware")    // 40003
+	ErrUnauthorized     = errors.New("unauthorized")              // 401
+	ErrForbidden        = errors.New("forbidden")                 // 403
+	ErrNotFound         = errors.New("not found")                 // 404
+	ErrConflict         = errors.New("conflict")                  // 409，例如保险库已被其他客户端修改
+	ErrTooLarge         = errors.New("too large or over quota")   // 413
+	ErrTooManyRequests  = errors.New("too many requests")         // 429，例如提交份额过于频繁
+	ErrServer           = errors.New("server error")              // 500, 50001
+	ErrStorage          = errors.New("storage error")             // 50002，加解密或读写存储失败
+	ErrScanUnavailable  = errors.New("virus scanner unavailable") // 50003
+	ErrTokenExpired     = errors.New("token expired")             // 401 "token expired"
+	ErrUserDisabled     = errors.New("user is disabled")          // 403 "user is disabled"
+	ErrPasswordReset    = errors.New("password reset required")   // 403 "password reset required"
+	ErrSealed           = errors.New("server is sealed")          // 503，需要先用份额解封
+	ErrNotAuthenticated = errors.New("client has no token; log in first")
+)
+
+var codeErrors = map[int]error{
+	400:   ErrInvalidParams,
+	40001: ErrInvalidParams,
+	40002: ErrRejected,
+	40003: ErrMalwareDetected,
+	401:   ErrUnauthorized,
+	403:   ErrForbidden,
+	404:   ErrNotFound,
+	409:   ErrConflict,
+	413:   ErrTooLarge,
+	429:   ErrTooManyRequests,
+	500:   ErrServer,
+	50001: ErrServer,
+	50002: ErrStorage,
+	50003: ErrScanUnavailable,
+	503:   ErrSealed,
+}
+
+// 同一个业务码下由 message 区分的更具体的错误
+var messageErrors = map[string]error{
+	"token expired":           ErrTokenExpired,
+	"user is disabled":        ErrUserDisabled,
+	"password reset required": ErrPasswordReset,
+}
+
+// APIError 是服务器返回的 {code, message} 错误
+type APIError struct {
+	StatusCode int    // HTTP 状态码
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api error %d: %s", e.Code, e.Message)
+}
+
+// Unwrap 让 errors.Is(err, client.ErrNotFound) 等判断生效
+func (e *APIError) Unwrap() []error {
+	var errs []error
+	if err, ok := messageErrors[e.Message]; ok {
+		errs = append(errs, err)
+	}
+	if err, ok := codeErrors[e.Code]; ok {
+		errs = append(errs, err)
+	}
+	return errs
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// SealStatus 查询服务器是否封存，不需要登录
+func (c *Client) SealStatus(ctx context.Context) (*SealStatus, error) {
+	var st SealStatus
+	if err := c.callJSON(ctx, http.MethodGet, "/sys/seal-status", nil, &st, false); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Unseal 提交一份主密钥份额（sfbctl key split 的输出），不需要登录。
+// 凑够 threshold 份后服务器解封，返回的 Sealed 为 false
+func (c *Client) Unseal(ctx context.Context, share string) (*SealStatus, error) {
+	return c.unseal(ctx, map[string]any{"share": share})
+}
+
+// ResetUnseal 丢弃本轮已经提交的份额，并以 share 开始新的一轮；share 无效时已提交的份额保留
+func (c *Client) ResetUnseal(ctx context.Context, share string) (*SealStatus, error) {
+	return c.unseal(ctx, map[string]any{"share": share, "reset": true})
+}
+
+func (c *Client) unseal(ctx context.Context, in map[string]any) (*SealStatus, error) {
+	var st SealStatus
+	if err := c.callJSON(ctx, http.MethodPost, "/sys/unseal", in, &st, false); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Seal 重新封存服务器，需要管理员；之后所有人都要重新登录
+func (c *Client) Seal(ctx context.Context) (*SealStatus, error) {
+	var st SealStatus
+	if err := c.callJSON(ctx, http.MethodPost, "/sys/seal", nil, &st, true); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"io"
+	"time"
+)
+
+type User struct {
+	ID                uint       `json:"id"`
+	Email             string     `json:"email"`
+	Username          string     `json:"username"`
+	Role              string     `json:"role"`
+	Disabled          bool       `json:"disabled"`
+	MustResetPassword bool       `json:"must_reset_password"`
+	AvatarUpdatedAt   *time.Time `json:"avatar_updated_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+type Profile struct {
+	ID                uint       `json:"id"`
+	Email             string     `json:"email"`
+	Username          string     `json:"username"`
+	Role              string     `json:"role"`
+	MustResetPassword bool       `json:"must_reset_password,omitempty"`
+	AvatarURL         string     `json:"avatar_url,omitempty"`
+	AvatarUpdatedAt   *time.Time `json:"avatar_updated_at,omitempty"`
+}
+
+type LoginResult struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"-"`
+	User      User      `json:"user"`
+}
+
+// SealStatus 是服务器的封存状态；Progress 为本轮已经提交的份额数
+type SealStatus struct {
+	Sealed    bool `json:"sealed"`
+	Threshold int  `json:"threshold,omitempty"`
+	Shares    int  `json:"shares,omitempty"`
+	Progress  int  `json:"progress"`
+}
+
+type File struct {
+	ID            uint       `json:"id"`
+	Filename      string     `json:"filename"`
+	Size          int64      `json:"size"`
+	Description   string     `json:"description"`
+	UploaderID    string     `json:"uploader_id"`
+	ScanStatus    string     `json:"scan_status,omitempty"`
+	ScanSignature string     `json:"scan_signature,omitempty"`
+	ScannedAt     *time.Time `json:"scanned_at,omitempty"`
+	UserKeyed     bool       `json:"user_keyed,omitempty"`
+	CustomerKeyed bool       `json:"customer_keyed,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+type FileList struct {
+	Total int64  `json:"total"`
+	Items []File `json:"items"`
+}
+
+// UploadResult 是上传和更新接口的返回值
+type UploadResult struct {
+	FileID   uint   `json:"file_id"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
+}
+
+// FileUpdate 中为 nil 的字段保持不变；Content 非 nil 时替换内容，Filename 为新文件名
+type FileUpdate struct {
+	Filename    string
+	Content     io.Reader
+	Description *string
+}
+
+// DownloadInfo 描述一次下载的响应头
+type DownloadInfo struct {
+	Filename    string
+	ContentType string
+	// Size 为整个文件的大小，未知时为 -1
+	Size int64
+	// Offset 为本次响应的第一个字节在文件中的位置；服务器忽略 Range 时为 0
+	Offset int64
+	// ETag 在文件内容被替换后改变，续传时作为 If-Range 传回
+	ETag string
+}
+
+// Download 是尚未读取的下载响应，调用方负责 Close
+type Download struct {
+	DownloadInfo
+	Body io.ReadCloser
+}
+
+type ShareLink struct {
+	URL       string
+	ExpiresAt time.Time
+}
@@ -0,0 +1,287 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+// 保险库：文件在这里用口令派生的密钥加密后再上传，服务器看不到内容和文件名。
+//
+//	v, err := c.UnlockVault(ctx, passphrase)
+//	f, err := v.Upload(ctx, "taxes.pdf", in)
+//	name, err := v.Name(f)
+//	err = v.Download(ctx, f, out)
+//
+// 忘记口令就无法恢复保险库中的文件，服务器管理员也不行。
+
+// VaultKeyMaterial 是服务器保存的 KDF 参数和包装后的保险库密钥
+type VaultKeyMaterial struct {
+	KDF        sfbcrypt.VaultKDF `json:"kdf"`
+	WrappedKey string            `json:"wrapped_key"`
+	Version    uint              `json:"version"`
+}
+
+type VaultFile struct {
+	ID        uint      `json:"id"`
+	EncName   string    `json:"enc_name"`
+	EncKey    string    `json:"enc_key"`
+	Size      int64     `json:"size"`
+	Chunks    uint32    `json:"chunks"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// VaultComplete 是上传完成的文件状态，另一种状态是 "uploading"
+const VaultComplete = "complete"
+
+// GetVaultKey 读取密钥材料；还没有创建保险库时返回 ErrNotFound
+func (c *Client) GetVaultKey(ctx context.Context) (*VaultKeyMaterial, error) {
+	var out VaultKeyMaterial
+	if err := c.callJSON(ctx, http.MethodGet, "/vault", nil, &out, true); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PutVaultKey 创建（Version 为 0）或替换密钥材料；Version 与服务器不一致时返回 ErrConflict
+func (c *Client) PutVaultKey(ctx context.Context, m *VaultKeyMaterial) (*VaultKeyMaterial, error) {
+	var out VaultKeyMaterial
+	if err := c.callJSON(ctx, http.MethodPut, "/vault", m, &out, true); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *Client) ListVaultFiles(ctx context.Context) ([]VaultFile, error) {
+	var out []VaultFile
+	if err := c.callJSON(ctx, http.MethodGet, "/vault/files", nil, &out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *Client) GetVaultFile(ctx context.Context, id uint) (*VaultFile, error) {
+	var out VaultFile
+	if err := c.callJSON(ctx, http.MethodGet, vaultFilePath(id), nil, &out, true); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateVaultFile 登记一个新文件，encName 和 encKey 由 sfbcrypt.VaultFile 生成
+func (c *Client) CreateVaultFile(ctx context.Context, encName, encKey string) (*VaultFile, error) {
+	var out VaultFile
+	in := map[string]string{"enc_name": encName, "enc_key": encKey}
+	if err := c.callJSON(ctx, http.MethodPost, "/vault/files", in, &out, true); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PutVaultChunk 上传第 index 块；index 不是服务器期望的下一块时返回 ErrConflict
+func (c *Client) PutVaultChunk(ctx context.Context, id uint, index uint32, chunk []byte) (*VaultFile, error) {
+	path := vaultFilePath(id) + "/chunks/" + strconv.FormatUint(uint64(index), 10)
+	req, err := c.authRequest(ctx, http.MethodPut, path, bytes.NewReader(chunk), "application/octet-stream")
+	if err != nil {
+		return nil, err
+	}
+	var out VaultFile
+	if err := c.doJSON(req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// OpenVaultContent 返回服务器保存的密文（SFV1），调用方负责 Close
+func (c *Client) OpenVaultContent(ctx context.Context, id uint) (io.ReadCloser, error) {
+	req, err := c.authRequest(ctx, http.MethodGet, vaultFilePath(id)+"/content", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.doStream(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) DeleteVaultFile(ctx context.Context, id uint) error {
+	return c.callJSON(ctx, http.MethodDelete, vaultFilePath(id), nil, nil, true)
+}
+
+func vaultFilePath(id uint) string {
+	return "/vault/files/" + strconv.FormatUint(uint64(id), 10)
+}
+
+// Vault 是已解锁的保险库，持有明文的保险库密钥
+type Vault struct {
+	c   *Client
+	key []byte
+}
+
+// InitVault 创建保险库：生成随机的保险库密钥，用口令派生的密钥包装后保存到服务器
+func (c *Client) InitVault(ctx context.Context, passphrase []byte) (*Vault, error) {
+	kdf, err := sfbcrypt.NewVaultKDF()
+	if err != nil {
+		return nil, err
+	}
+	key, err := sfbcrypt.NewVaultKey()
+	if err != nil {
+		return nil, err
+	}
+	m, err := wrapVaultKey(kdf, passphrase, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.PutVaultKey(ctx, m); err != nil {
+		return nil, err
+	}
+	return &Vault{c: c, key: key}, nil
+}
+
+// UnlockVault 用口令解开保险库密钥；口令错误时返回 sfbcrypt.ErrVaultPassphrase
+func (c *Client) UnlockVault(ctx context.Context, passphrase []byte) (*Vault, error) {
+	m, err := c.GetVaultKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key, err := unwrapVaultKey(m, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &Vault{c: c, key: key}, nil
+}
+
+// ChangeVaultPassphrase 用新口令和新 salt 重新包装同一个保险库密钥，文件不需要重新加密
+func (c *Client) ChangeVaultPassphrase(ctx context.Context, oldPassphrase, newPassphrase []byte) error {
+	m, err := c.GetVaultKey(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := unwrapVaultKey(m, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	kdf, err := sfbcrypt.NewVaultKDF()
+	if err != nil {
+		return err
+	}
+	next, err := wrapVaultKey(kdf, newPassphrase, key)
+	if err != nil {
+		return err
+	}
+	next.Version = m.Version
+	_, err = c.PutVaultKey(ctx, next)
+	return err
+}
+
+func wrapVaultKey(kdf *sfbcrypt.VaultKDF, passphrase []byte, key []byte) (*VaultKeyMaterial, error) {
+	kek, err := kdf.DeriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := sfbcrypt.WrapVaultKey(kek, key)
+	if err != nil {
+		return nil, err
+	}
+	return &VaultKeyMaterial{KDF: *kdf, WrappedKey: wrapped}, nil
+}
+
+// unwrapVaultKey 在派生之前检查服务器给出的 KDF 参数，DeriveKey 拒绝过弱的参数
+func unwrapVaultKey(m *VaultKeyMaterial, passphrase []byte) ([]byte, error) {
+	kek, err := m.KDF.DeriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return sfbcrypt.UnwrapVaultKey(kek, m.WrappedKey)
+}
+
+// Upload 按 sfbcrypt.VaultChunkSize 分块加密并依次上传 r，返回完成后的文件。
+// 失败时尽量删除未完成的上传，删除不掉的由服务器在一天后清理。
+func (v *Vault) Upload(ctx context.Context, name string, r io.Reader) (*VaultFile, error) {
+	file, encKey, err := sfbcrypt.NewVaultFile(v.key)
+	if err != nil {
+		return nil, err
+	}
+	encName, err := file.EncryptName(name)
+	if err != nil {
+		return nil, err
+	}
+	row, err := v.c.CreateVaultFile(ctx, encName, encKey)
+	if err != nil {
+		return nil, err
+	}
+	out, err := v.upload(ctx, file, row.ID, r)
+	if err != nil {
+		_ = v.c.DeleteVaultFile(ctx, row.ID)
+		return nil, err
+	}
+	return out, nil
+}
+
+func (v *Vault) upload(ctx context.Context, file *sfbcrypt.VaultFile, id uint, r io.Reader) (*VaultFile, error) {
+	br := bufio.NewReader(r)
+	buf := make([]byte, sfbcrypt.VaultChunkSize)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		final := err != nil
+		if !final {
+			// 恰好读满一块时看一下后面还有没有数据
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		chunk, err := file.SealChunk(index, buf[:n], final)
+		if err != nil {
+			return nil, err
+		}
+		out, err := v.c.PutVaultChunk(ctx, id, index, chunk)
+		if err != nil {
+			return nil, err
+		}
+		if final {
+			return out, nil
+		}
+	}
+}
+
+// Name 解密文件名
+func (v *Vault) Name(f *VaultFile) (string, error) {
+	file, err := sfbcrypt.OpenVaultFile(v.key, f.EncKey)
+	if err != nil {
+		return "", err
+	}
+	return file.DecryptName(f.EncName)
+}
+
+// Download 下载并解密文件内容写入 w，返回明文字节数。
+// 出错时已写入 w 的部分都通过了认证，但文件不完整。
+func (v *Vault) Download(ctx context.Context, f *VaultFile, w io.Writer) (int64, error) {
+	if f.Status != VaultComplete {
+		return 0, errors.New("vault file upload is not complete")
+	}
+	file, err := sfbcrypt.OpenVaultFile(v.key, f.EncKey)
+	if err != nil {
+		return 0, err
+	}
+	body, err := v.c.OpenVaultContent(ctx, f.ID)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	return file.Decrypt(w, body)
+}
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/testserver"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+func TestVaultRoundTrip(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{})
+	ctx := context.Background()
+	alice := registerAndLogin(t, srv, "alice")
+	bob := registerAndLogin(t, srv, "bob")
+
+	if _, err := alice.UnlockVault(ctx, []byte("pass phrase")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("UnlockVault before InitVault = %v", err)
+	}
+	v, err := alice.InitVault(ctx, []byte("pass phrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.InitVault(ctx, []byte("another")); !errors.Is(err, ErrConflict) {
+		t.Fatalf("second InitVault = %v", err)
+	}
+
+	// 恰好两整块：读满第二块后要发现已经没有数据，把它标记为最后一块
+	content := bytes.Repeat([]byte("0123456789abcdef"), 2*sfbcrypt.VaultChunkSize/16)
+	f, err := v.Upload(ctx, "taxes.pdf", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Status != VaultComplete || f.Chunks != 2 {
+		t.Fatalf("Upload = %+v", f)
+	}
+	empty, err := v.Upload(ctx, "empty.txt", bytes.NewReader(nil))
+	if err != nil || empty.Chunks != 1 {
+		t.Fatalf("empty Upload = %+v, %v", empty, err)
+	}
+
+	// 服务器只保存密文：数据库里看不到文件名
+	var row model.VaultFile
+	if err := srv.DB.First(&row, f.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(row.EncName, "taxes") || row.EncName == "" {
+		t.Fatalf("stored name %q", row.EncName)
+	}
+
+	check := func(v *Vault) {
+		t.Helper()
+		files, err := alice.ListVaultFiles(ctx)
+		if err != nil || len(files) != 2 {
+			t.Fatalf("ListVaultFiles = %d, %v", len(files), err)
+		}
+		got, err := alice.GetVaultFile(ctx, f.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name, err := v.Name(got); err != nil || name != "taxes.pdf" {
+			t.Fatalf("Name = %q, %v", name, err)
+		}
+		var out bytes.Buffer
+		if n, err := v.Download(ctx, got, &out); err != nil || n != int64(len(content)) || !bytes.Equal(out.Bytes(), content) {
+			t.Fatalf("Download = %d, %v", n, err)
+		}
+	}
+	check(v)
+
+	if _, err := alice.UnlockVault(ctx, []byte("wrong")); !errors.Is(err, sfbcrypt.ErrVaultPassphrase) {
+		t.Fatalf("UnlockVault with a wrong passphrase = %v", err)
+	}
+	if err := alice.ChangeVaultPassphrase(ctx, []byte("wrong"), []byte("new phrase")); !errors.Is(err, sfbcrypt.ErrVaultPassphrase) {
+		t.Fatalf("ChangeVaultPassphrase with a wrong passphrase = %v", err)
+	}
+	if err := alice.ChangeVaultPassphrase(ctx, []byte("pass phrase"), []byte("new phrase")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.UnlockVault(ctx, []byte("pass phrase")); !errors.Is(err, sfbcrypt.ErrVaultPassphrase) {
+		t.Fatalf("UnlockVault with the old passphrase = %v", err)
+	}
+	v, err = alice.UnlockVault(ctx, []byte("new phrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(v)
+
+	// 另一个客户端拿着旧版本修改口令会被拒绝
+	stale := &VaultKeyMaterial{KDF: *testKDF(t), WrappedKey: row.EncKey, Version: 1}
+	if _, err := alice.PutVaultKey(ctx, stale); !errors.Is(err, ErrConflict) {
+		t.Fatalf("PutVaultKey with a stale version = %v", err)
+	}
+
+	if _, err := bob.GetVaultFile(ctx, f.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("bob GetVaultFile = %v", err)
+	}
+	if _, err := bob.OpenVaultContent(ctx, f.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("bob OpenVaultContent = %v", err)
+	}
+	if err := bob.DeleteVaultFile(ctx, f.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("bob DeleteVaultFile = %v", err)
+	}
+	if err := alice.DeleteVaultFile(ctx, f.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.GetVaultFile(ctx, f.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetVaultFile after delete = %v", err)
+	}
+}
+
+func testKDF(t *testing.T) *sfbcrypt.VaultKDF {
+	t.Helper()
+	kdf, err := sfbcrypt.NewVaultKDF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kdf
+}
+
+// 服务器只能检查格式，不能验证内容，但格式不对的密钥材料和块都要拒绝
+func TestVaultServerRejects(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{})
+	ctx := context.Background()
+	c := registerAndLogin(t, srv, "alice")
+
+	vaultKey, _ := sfbcrypt.NewVaultKey()
+	file, encKey, err := sfbcrypt.NewVaultFile(vaultKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encName, _ := file.EncryptName("a.txt")
+	if _, err := c.CreateVaultFile(ctx, encName, encKey); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("CreateVaultFile before the vault exists = %v", err)
+	}
+
+	weak := testKDF(t)
+	weak.MemoryKiB = 1024
+	for name, m := range map[string]*VaultKeyMaterial{
+		"weak kdf":      {KDF: *weak, WrappedKey: encKey},
+		"plain key":     {KDF: *testKDF(t), WrappedKey: strings.Repeat("k", 64)},
+		"short wrapped": {KDF: *testKDF(t), WrappedKey: encName},
+	} {
+		if _, err := c.PutVaultKey(ctx, m); !errors.Is(err, ErrInvalidParams) {
+			t.Errorf("PutVaultKey with %s = %v", name, err)
+		}
+	}
+	if _, err := c.InitVault(ctx, []byte("pass phrase")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.CreateVaultFile(ctx, "a.txt", encKey); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("CreateVaultFile with a plaintext name = %v", err)
+	}
+	if _, err := c.CreateVaultFile(ctx, encName, encName); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("CreateVaultFile with a short key = %v", err)
+	}
+	row, err := c.CreateVaultFile(ctx, encName, encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := file.SealChunk(0, []byte("first"), false)
+	last, _ := file.SealChunk(1, []byte("last"), true)
+	badFlag := append([]byte{2}, first[1:]...)
+	if _, err := c.PutVaultChunk(ctx, row.ID, 1, last); !errors.Is(err, ErrConflict) {
+		t.Fatalf("chunk out of order = %v", err)
+	}
+	for name, chunk := range map[string][]byte{"bad flag": badFlag, "short": first[:sfbcrypt.VaultMinChunk-1]} {
+		if _, err := c.PutVaultChunk(ctx, row.ID, 0, chunk); !errors.Is(err, ErrInvalidParams) {
+			t.Errorf("%s chunk = %v", name, err)
+		}
+	}
+	if _, err := c.PutVaultChunk(ctx, row.ID, 0, first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.OpenVaultContent(ctx, row.ID); !errors.Is(err, ErrConflict) {
+		t.Fatalf("OpenVaultContent while uploading = %v", err)
+	}
+	// 重传同一块不会重复追加
+	if _, err := c.PutVaultChunk(ctx, row.ID, 0, first); !errors.Is(err, ErrConflict) {
+		t.Fatalf("chunk 0 again = %v", err)
+	}
+	done, err := c.PutVaultChunk(ctx, row.ID, 1, last)
+	if err != nil || done.Status != VaultComplete {
+		t.Fatalf("final chunk = %+v, %v", done, err)
+	}
+	extra, _ := file.SealChunk(2, []byte("extra"), true)
+	if _, err := c.PutVaultChunk(ctx, row.ID, 2, extra); !errors.Is(err, ErrConflict) {
+		t.Fatalf("chunk after the final one = %v", err)
+	}
+	body, err := c.OpenVaultContent(ctx, row.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	_, err = file.Decrypt(&out, body)
+	body.Close()
+	if err != nil || out.String() != "firstlast" {
+		t.Fatalf("stored content: %q, %v", out.String(), err)
+	}
+}
+
+// tamperTransport 改动下载的保险库密文中的一个字节，模拟被篡改的服务器
+type tamperTransport struct{}
+
+func (tamperTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || !strings.HasSuffix(req.URL.Path, "/content") || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	data[len(data)/2] ^= 1
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+// 服务器篡改密文或下发过弱的 KDF 参数时，客户端拒绝
+func TestVaultTamperedByServer(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{})
+	ctx := context.Background()
+	c := registerAndLogin(t, srv, "alice")
+	v, err := c.InitVault(ctx, []byte("pass phrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := v.Upload(ctx, "a.txt", strings.NewReader(strings.Repeat("secret ", 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, expires := c.Token()
+	tampered := newTestClient(t, srv, WithToken(token, expires), WithHTTPClient(&http.Client{Transport: tamperTransport{}}))
+	tv, err := tampered.UnlockVault(ctx, []byte("pass phrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tv.Download(ctx, f, io.Discard); !errors.Is(err, sfbcrypt.ErrIntegrity) {
+		t.Fatalf("Download of tampered content = %v", err)
+	}
+
+	if err := srv.DB.Model(&model.VaultKey{}).Where("1 = 1").Update("kdf_memory", 1024).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UnlockVault(ctx, []byte("pass phrase")); !errors.Is(err, sfbcrypt.ErrVaultKDF) {
+		t.Fatalf("UnlockVault with weak server parameters = %v", err)
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -10,9 +14,14 @@ import (
 	"github.com/Kaikai20040827/graduation/internal/config"
 	"github.com/Kaikai20040827/graduation/internal/handler"
 	"github.com/Kaikai20040827/graduation/internal/logo"
+	"github.com/Kaikai20040827/graduation/internal/middleware"
+	"github.com/Kaikai20040827/graduation/internal/migrate"
+	"github.com/Kaikai20040827/graduation/internal/model"
 	"github.com/Kaikai20040827/graduation/internal/pkg"
 	"github.com/Kaikai20040827/graduation/internal/routes"
 	"github.com/Kaikai20040827/graduation/internal/service"
+
+	"go.uber.org/zap"
 )
 
 const (
@@ -20,6 +29,13 @@ const (
 )
 
 func main() {
+	// 命令行引导管理员，优先级高于 config.yaml 中的 admin.email；密码不走命令行（会出现在 ps 和 shell 历史里），
+	// 只从 admin.password 或环境变量 ADMIN_PASSWORD 读取
+	adminEmail := flag.String("admin-email", "", "bootstrap an admin account with this email (password from ADMIN_PASSWORD)")
+	// 主密钥文件的口令：-key-passphrase-fd、SFB_KEY_PASSPHRASE 或终端提示
+	passphraseFD := flag.Int("key-passphrase-fd", -1, "read the master key file passphrase from this file descriptor")
+	flag.Parse()
+
 	logo.DrawLogo()
 	fmt.Println("-----Secure File Box-----")
 	fmt.Println("")
@@ -31,6 +47,19 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
+	if cfg.Production() && cfg.FileCrypto.KeyFile == "" {
+		log.Fatalf("Error: file_crypto.key is stored in plaintext; server.env %q requires file_crypto.key_file (see sfbctl key init)", cfg.Server.Env)
+	}
+	// 按份额拆分的主密钥不在启动时解开：服务器以封存状态启动，等保管人通过 /api/v1/sys/unseal 提交份额
+	sharedKeyFile, err := config.ReadSharedKeyFile(cfg)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if sharedKeyFile == nil {
+		if err := config.UnlockMasterKey(cfg, *passphraseFD); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
 	// fmt.Printf("(%d/5) done", )
 	// fmt.Println("")
 	fmt.Println("-----Loaded successfully-----")
@@ -44,33 +73,112 @@ func main() {
 	fmt.Println("-----Initialized logger successfully-----")
 	fmt.Println("")
 
-	// 3. DB(mysql)
+	// 3. DB(mysql/postgres/sqlite)
 	fmt.Println("-----Starting initializing database-----")
 	db, err := pkg.NewDatabase(&cfg.Database)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
+	migrator := migrate.New(db, cfg.FileCrypto.Key)
+	if err := migrator.Startup(cfg.Database.AutoMigrate); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	fmt.Printf("✓ Database schema at version %d\n", migrator.Latest())
 
 	fmt.Println("-----Initialized database successfully-----")
 	fmt.Println("")
 
 	// 4. Services
-	fmt.Println("-----Starting initializing service(UserService, FileService)-----")
+	fmt.Println("-----Starting initializing service(UserService, FileService, AuditService, WebhookService, JobService)-----")
 	userSrv := service.NewUserService(db)
+	auditSrv := service.NewAuditService(db, cfg.FileCrypto.Key)
 	_, currentFile, _, _ := runtime.Caller(0)
 	projectRoot := filepath.Dir(filepath.Dir(filepath.Dir(currentFile)))
 	storagePath := filepath.Join(projectRoot, "storage")
 	fileSrv := service.NewFileService(db, storagePath, cfg.FileCrypto.Key)
+	fileSrv.SetUserQuota(cfg.Storage.UserQuota)
+	fileSrv.SetScrubRate(cfg.Storage.ScrubRate)
+	fileSrv.SetGCGrace(cfg.Storage.GCGrace)
+	fileSrv.SetDedup(cfg.Storage.Dedup)
+	webhookSrv := service.NewWebhookService(db, cfg.Webhook, fileSrv)
+	userKeys, err := service.NewUserKeyRing(db, cfg.FileCrypto.UserKeys, cfg.FileCrypto.RecoveryPublicKey, cfg.JWT.TTL)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	userSrv.SetUserKeys(userKeys)
+	fileSrv.SetUserKeys(userKeys)
+	if cfg.FileCrypto.UserKeys {
+		fmt.Println("✓ Per-user file keys enabled")
+	}
+	s3Srv := service.NewS3Service(db, fileSrv, userSrv)
+	jobSrv := service.NewJobService(db, cfg.Jobs)
+	service.RegisterMaintenanceJobs(jobSrv, fileSrv, userSrv, s3Srv, auditSrv, webhookSrv)
+	sealSrv, err := service.NewSealService(fileSrv, auditSrv, sharedKeyFile)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	// 封存期间后台任务都需要密钥，暂停领取
+	jobSrv.PauseWhile(sealSrv.Sealed)
+	if sealSrv.Sealed() {
+		fmt.Println("✓ Server is sealed; submit key shares to /api/v1/sys/unseal")
+		sealSrv.OnUnseal(func() {
+			if err := fileSrv.BackfillOwnerTags(); err != nil && pkg.Logger != nil {
+				pkg.Logger.Error("backfill owner tags after unseal failed", zap.Error(err))
+			}
+		})
+	} else if err := fileSrv.BackfillOwnerTags(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if cfg.Scanner.Enabled {
+		scanner, err := pkg.NewClamdClient(cfg.Scanner.Address, cfg.Scanner.Timeout)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if err := scanner.Ping(); err != nil {
+			fmt.Printf("Error: ⚠ clamd not reachable at %s: %v\n", cfg.Scanner.Address, err)
+		}
+		fileSrv.SetScanner(scanner, cfg.Scanner.Action, cfg.Scanner.FailOpen)
+		fmt.Println("✓ Virus scanning enabled")
+	}
 	// fmt.Printf("(%d/2) done", )
 	// fmt.Println("")
 	fmt.Println("-----Initialized UserService and FileService successfully-----")
 	fmt.Println("")
 
+	// 引导管理员
+	if *adminEmail != "" {
+		cfg.Admin.Email = *adminEmail
+	}
+	// 读取后删除，子进程不会继承
+	_ = os.Unsetenv("ADMIN_PASSWORD")
+	if cfg.Admin.Email != "" {
+		admin, err := userSrv.EnsureAdmin(cfg.Admin.Email, cfg.Admin.Username, cfg.Admin.Password)
+		if err != nil {
+			log.Fatalf("Error: bootstrap admin failed: %v", err)
+		}
+		cfg.Admin.Password = ""
+		if admin.Role != model.RoleAdmin || admin.Disabled {
+			// 已有的账号不动：管理员降级或禁用过它，重启不能悄悄恢复
+			fmt.Printf("Error: ⚠ %s already exists and is not an active admin; left unchanged\n", admin.Email)
+		} else {
+			fmt.Printf("✓ Admin account ready: %s\n", admin.Email)
+		}
+		fmt.Println("")
+	}
+
 	// 5. Handlers
 	fmt.Println("-----Starting initializing handlers(UserService, FileService)-----")
-	authH := handler.NewAuthHandler(userSrv, &cfg.JWT)
-	userH := handler.NewUserHandler(userSrv, fileSrv)
-	fileH := handler.NewFileHandler(fileSrv)
+	authH := handler.NewAuthHandler(userSrv, auditSrv, webhookSrv, &cfg.JWT)
+	userH := handler.NewUserHandler(userSrv, fileSrv, auditSrv, webhookSrv)
+	fileH := handler.NewFileHandler(fileSrv, auditSrv, webhookSrv)
+	adminH := handler.NewAdminHandler(userSrv, fileSrv, auditSrv, webhookSrv)
+	auditH := handler.NewAuditHandler(auditSrv)
+	webhookH := handler.NewWebhookHandler(webhookSrv)
+	jobH := handler.NewJobHandler(jobSrv, auditSrv)
+	vaultH := handler.NewVaultHandler(fileSrv, auditSrv)
+	davH := handler.NewWebDAVHandler(fileH)
+	s3H := handler.NewS3Handler(s3Srv, fileH, cfg.S3.Region)
+	sealH := handler.NewSealHandler(sealSrv, auditSrv)
 	// fmt.Printf("(%d/3) done", )
 	// fmt.Println("")
 	fmt.Println("-----Initialized UserService and FileService successfully-----")
@@ -79,17 +187,66 @@ func main() {
 	// 6. Gin
 	fmt.Println("-----Starting initializing Gin framework-----")
 	r := routes.SetupRouter()
+	// 要在注册路由之前加上，才能拦住后面注册的路由
+	if err := middleware.TrustProxies(r, cfg.Server.TrustedProxies); err != nil {
+		log.Fatalf("Error: server.trusted_proxies: %v", err)
+	}
+	r.Use(middleware.SealGate(sealSrv))
 
 	fmt.Println("-----Initialized Gin framework successfully-----")
 	fmt.Println("")
 
 	// 7. 注册 API 路由（最关键）
 	fmt.Println("-----Starting initializing API-----")
-	routes.RegisterAPIRoutes(r, authH, userH, fileH, &cfg.JWT)
+	routes.RegisterAPIRoutes(r, authH, userH, fileH, adminH, auditH, webhookH, jobH, vaultH, sealH, userSrv, &cfg.JWT)
+	routes.RegisterDAVRoutes(r, davH, userSrv, &cfg.JWT)
+	routes.RegisterS3KeyRoutes(r, s3H, userSrv, &cfg.JWT)
+	if cfg.Metrics.Enabled {
+		routes.RegisterMetricsRoutes(r, handler.NewMetricsHandler(fileSrv, jobSrv, cfg.Metrics.Token))
+	}
 	fmt.Println("-----Initialized API successfully-----")
 	fmt.Println("")
 
-	// 8. 启动
+	// 8. 后台任务：webhook 投递和任务队列
+	go webhookSrv.Run(context.Background())
+	go func() {
+		if err := jobSrv.Run(context.Background()); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}()
+
+	// SFTP
+	if cfg.SFTP.Enabled {
+		hostKeyPath := cfg.SFTP.HostKey
+		if hostKeyPath == "" {
+			hostKeyPath = filepath.Join(projectRoot, "sftp_host_ed25519_key")
+		}
+		sftpSrv, err := handler.NewSFTPServer(&cfg.SFTP, hostKeyPath, userSrv, fileH)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		go func() {
+			if err := sftpSrv.ListenAndServe(context.Background()); err != nil {
+				log.Fatalf("Error: sftp server: %v", err)
+			}
+		}()
+	}
+
+	// S3
+	if cfg.S3.Enabled {
+		s3Addr := net.JoinHostPort(cfg.S3.Host, strconv.Itoa(cfg.S3.Port))
+		s3r := routes.SetupS3Router(s3H)
+		// 审计日志中的 IP 同样只采信受信任代理的 X-Forwarded-For；列表已在上面检查过
+		s3r.SetTrustedProxies(cfg.Server.TrustedProxies)
+		go func() {
+			log.Println("s3 server running at", s3Addr)
+			if err := s3r.Run(s3Addr); err != nil {
+				log.Fatalf("Error: s3 server: %v", err)
+			}
+		}()
+	}
+
+	// 9. 启动
 	port := strconv.Itoa(cfg.Server.Port)
 	host := cfg.Server.Host
 	addr := host + ":" + port
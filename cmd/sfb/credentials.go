@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// credentials 保存在 <用户配置目录>/sfb/credentials.json，权限 0600。
+// SFB_CONFIG_DIR 可以覆盖目录，便于在同一台机器上使用多个账号。
+type credentials struct {
+	Server    string    `json:"server"`
+	Email     string    `json:"email"`
+	UserID    uint      `json:"user_id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+func credentialsPath() (string, error) {
+	dir := os.Getenv("SFB_CONFIG_DIR")
+	if dir == "" {
+		base, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(base, "sfb")
+	}
+	return filepath.Join(dir, "credentials.json"), nil
+}
+
+// loadCredentials 在尚未登录时返回零值，不报错
+func loadCredentials() (*credentials, error) {
+	path, err := credentialsPath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &credentials{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var creds credentials
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, err
+	}
+	return &creds, nil
+}
+
+// save 先写临时文件再改名，避免中断时留下半个文件
+func (c *credentials) save() error {
+	path, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func removeCredentials() error {
+	path, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
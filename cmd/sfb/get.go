@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Kaikai20040827/graduation/client"
+)
+
+func cmdGet(a *app, args []string) error {
+	fset := a.flags("get")
+	out := fset.String("o", "", "output file, or directory when downloading several ids (default: current directory)")
+	force := fset.Bool("f", false, "overwrite existing files")
+	_ = fset.Parse(args)
+	ids, err := parseIDs(fset.Args())
+	if err != nil || len(ids) == 0 {
+		return errUsage("get [-o path] [-f] <id>...")
+	}
+	if err := a.login(); err != nil {
+		return err
+	}
+
+	dir, file := ".", ""
+	if *out != "" {
+		if fi, err := os.Stat(*out); err == nil && fi.IsDir() {
+			dir = *out
+		} else if len(ids) > 1 {
+			return fmt.Errorf("%s is not a directory", *out)
+		} else {
+			dir, file = filepath.Dir(*out), *out
+		}
+	}
+
+	ctx := context.Background()
+	failed := 0
+	results := []map[string]any{}
+	for _, id := range ids {
+		path, size, err := a.download(ctx, id, dir, file, *force)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "Error: %d: %v\n", id, err)
+			results = append(results, map[string]any{"id": id, "error": err.Error()})
+			continue
+		}
+		results = append(results, map[string]any{"id": id, "path": path, "size": size})
+		if !a.json {
+			fmt.Fprintf(a.out, "%d\t%s\n", id, path)
+		}
+	}
+	if a.json {
+		if err := a.encode(results); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d downloads failed", failed, len(ids))
+	}
+	return nil
+}
+
+// download 先写入 dir 下的 .sfb-<id>.part，完成后再改名。
+// 中断后再次执行会带上 Range 和 If-Range 从断点继续；服务器上的文件被替换过时从头下载。
+func (a *app) download(ctx context.Context, id uint, dir, target string, force bool) (string, int64, error) {
+	if target != "" && !force {
+		if _, err := os.Stat(target); err == nil {
+			return "", 0, fmt.Errorf("%s already exists (use -f to overwrite)", target)
+		}
+	}
+	partPath := filepath.Join(dir, fmt.Sprintf(".sfb-%d.part", id))
+	etagPath := partPath + ".etag"
+
+	var offset int64
+	var etag string
+	if fi, err := os.Stat(partPath); err == nil {
+		if b, err := os.ReadFile(etagPath); err == nil {
+			offset, etag = fi.Size(), strings.TrimSpace(string(b))
+		}
+	}
+
+	d, err := a.client.OpenFile(ctx, id, offset, etag)
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == 416 {
+		// 本地部分已经不小于服务器上的文件，重新下载
+		offset = 0
+		d, err = a.client.OpenFile(ctx, id, 0, "")
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	defer d.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if d.Offset != offset || d.Offset == 0 {
+		flags |= os.O_TRUNC
+		offset = 0
+	}
+	part, err := os.OpenFile(partPath, flags, 0600)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.WriteFile(etagPath, []byte(d.ETag), 0600); err != nil {
+		part.Close()
+		return "", 0, err
+	}
+
+	name := target
+	if name == "" {
+		name = filepath.Join(dir, localName(d.Filename, id))
+	}
+	p := newProgress(filepath.Base(name), d.Size, offset)
+	_, err = io.Copy(io.MultiWriter(part, p), d.Body)
+	p.finish()
+	if cerr := part.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("%w (run the same command again to resume)", err)
+	}
+
+	fi, err := os.Stat(partPath)
+	if err != nil {
+		return "", 0, err
+	}
+	if d.Size >= 0 && fi.Size() != d.Size {
+		return "", 0, fmt.Errorf("size mismatch: got %d of %d bytes (run again to resume)", fi.Size(), d.Size)
+	}
+	if !force {
+		if _, err := os.Stat(name); err == nil {
+			return "", 0, fmt.Errorf("%s already exists (use -f to overwrite; the download is kept in %s)", name, partPath)
+		}
+	}
+	if err := os.Rename(partPath, name); err != nil {
+		return "", 0, err
+	}
+	_ = os.Remove(etagPath)
+	return name, fi.Size(), nil
+}
+
+// localName 只取服务器给出的文件名的最后一段，防止写到目标目录之外
+func localName(name string, id uint) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" || name == "" {
+		return fmt.Sprintf("file-%d", id)
+	}
+	return name
+}
+
+func parseIDs(args []string) ([]uint, error) {
+	ids := make([]uint, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid file id %q", arg)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
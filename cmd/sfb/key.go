@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Kaikai20040827/graduation/internal/keytool"
+)
+
+const keyUsage = "key init|passwd|split [flags]"
+
+// key 子命令在服务器所在的机器上操作主密钥文件，读取当前目录的 config.yaml，不需要登录；
+// 与 sfbctl key 相同
+var keyCommands = map[string]command{
+	"init":   cmdKeyInit,
+	"passwd": cmdKeyPasswd,
+	"split":  cmdKeySplit,
+}
+
+func cmdKey(a *app, args []string) error {
+	if len(args) == 0 {
+		return errUsage(keyUsage)
+	}
+	cmd, ok := keyCommands[args[0]]
+	if !ok {
+		return errUsage(keyUsage)
+	}
+	return cmd(a, args[1:])
+}
+
+func cmdKeyInit(a *app, args []string) error {
+	fset := a.flags("key init")
+	out := fset.String("out", "", "file to write the sealed master key to (required)")
+	generate := fset.Bool("generate", false, "seal a new random master key instead of file_crypto.key (new deployments only)")
+	passFile := fset.String("passphrase-file", "", "read the passphrase from this file instead of the terminal")
+	_ = fset.Parse(args)
+	if *out == "" || fset.NArg() != 0 {
+		return errUsage("key init -out FILE [-generate] [-passphrase-file F]")
+	}
+	res, err := keytool.Init(*out, *generate, *passFile)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.encode(res)
+	}
+	keytool.PrintInit(a.out, res)
+	return nil
+}
+
+func cmdKeyPasswd(a *app, args []string) error {
+	fset := a.flags("key passwd")
+	file := fset.String("file", "", "sealed master key file (default: file_crypto.key_file)")
+	passFile := fset.String("passphrase-file", "", "read the current passphrase from this file")
+	newPassFile := fset.String("new-passphrase-file", "", "read the new passphrase from this file")
+	_ = fset.Parse(args)
+	if fset.NArg() != 0 {
+		return errUsage("key passwd [-file F] [-passphrase-file F] [-new-passphrase-file F]")
+	}
+	res, err := keytool.Passwd(*file, *passFile, *newPassFile)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.encode(res)
+	}
+	fmt.Fprintf(a.out, "passphrase of %s changed\n", res.KeyFile)
+	return nil
+}
+
+func cmdKeySplit(a *app, args []string) error {
+	fset := a.flags("key split")
+	out := fset.String("out", "", "file to write the split master key to (required)")
+	n := fset.Int("shares", 5, "number of key shares")
+	k := fset.Int("threshold", 3, "number of key shares needed to unseal")
+	shareDir := fset.String("share-dir", "", "write each key share to DIR/share-N.txt instead of printing them")
+	_ = fset.Parse(args)
+	if *out == "" || fset.NArg() != 0 {
+		return errUsage("key split -out FILE [-shares N] [-threshold K] [-share-dir DIR]")
+	}
+	res, err := keytool.Split(*out, *n, *k, *shareDir)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.encode(res)
+	}
+	keytool.PrintSplit(a.out, res)
+	return nil
+}
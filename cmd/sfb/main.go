@@ -0,0 +1,317 @@
+// sfb 是面向用户的命令行客户端，通过 REST API 访问服务器：
+//
+//	sfb login [-server URL] [-email E] [-password-stdin]
+//	sfb logout
+//	sfb ls [-page N] [-size N]
+//	sfb put [-r] [-d description] [-public] [-skip-existing] <file|dir|glob>...
+//	sfb get [-o path] [-f] <id>...
+//	sfb rm <id>...
+//	sfb share [-ttl 24h] <id>
+//	sfb vault init|passwd|ls|put|get|rm [-passphrase-file F] ...
+//	sfb seal-status [-server URL]
+//	sfb unseal [-server URL] [-share-file F] [-reset]
+//	sfb seal
+//	sfb key init|passwd|split ...
+//
+// 登录后 token 保存在用户配置目录下的 sfb/credentials.json，过期前自动刷新。
+// vault 子命令在本地加密和解密，服务器只保存密文（见 client.Vault）。
+// key 子命令不经过服务器，在服务器所在的机器上密封、拆分主密钥文件或更换它的口令（同 sfbctl key）。
+// 下载中断后再次执行同一条 get 命令会从断点继续；服务器不支持续传上传，上传失败需要重新执行。
+// 退出码：0 成功，1 出错，2 用法错误。
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/client"
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"golang.org/x/term"
+)
+
+const defaultServer = "http://127.0.0.1:8080"
+
+type command func(a *app, args []string) error
+
+var commands = map[string]command{
+	"login":  cmdLogin,
+	"logout": cmdLogout,
+	"ls":     cmdList,
+	"put":    cmdPut,
+	"get":    cmdGet,
+	"rm":     cmdRemove,
+	"share":  cmdShare,
+	"vault":  cmdVault,
+
+	"seal-status": cmdSealStatus,
+	"unseal":      cmdUnseal,
+	"seal":        cmdSeal,
+	"key":         cmdKey,
+}
+
+// usageError 表示参数不对，退出码为 2
+type usageError string
+
+func (e usageError) Error() string { return "usage: sfb " + string(e) }
+
+func errUsage(s string) error { return usageError(s) }
+
+type app struct {
+	out    io.Writer
+	json   bool
+	creds  *credentials
+	client *client.Client
+}
+
+func main() {
+	a := &app{out: os.Stdout}
+	// key 子命令会加载 config.yaml，进度打印到 stderr，stdout 只留给命令结果
+	config.Progress = os.Stderr
+	global := flag.NewFlagSet("sfb", flag.ExitOnError)
+	global.BoolVar(&a.json, "json", false, "print results as JSON")
+	global.Usage = usage
+	_ = global.Parse(os.Args[1:])
+	args := global.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd(a, args[1:])
+	if err == nil {
+		return
+	}
+	var uerr usageError
+	if errors.As(err, &uerr) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if errors.Is(err, client.ErrUnauthorized) || errors.Is(err, client.ErrTokenExpired) {
+		err = fmt.Errorf("%w; run `sfb login` again", err)
+	}
+	if errors.Is(err, client.ErrSealed) {
+		err = fmt.Errorf("%w; key holders must run `sfb unseal`", err)
+	}
+	if a.json {
+		_ = a.encode(map[string]string{"error": err.Error()})
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sfb [-json] <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands: login, logout, ls, put, get, rm, share, vault, seal-status, unseal, seal, key")
+	fmt.Fprintln(os.Stderr, "run `sfb <command> -h` for the flags of a command")
+}
+
+// flags 为子命令创建 FlagSet，-json 也可以写在子命令之后
+func (a *app) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("sfb "+name, flag.ExitOnError)
+	fs.BoolVar(&a.json, "json", a.json, "print results as JSON")
+	return fs
+}
+
+// connect 用保存的服务器地址和 token 创建客户端；server 非空时覆盖保存的地址
+func (a *app) connect(server string) error {
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+	if server == "" {
+		server = creds.Server
+	}
+	if server == "" {
+		server = defaultServer
+	}
+	opts := []client.Option{client.WithTokenCallback(func(token string, expiresAt time.Time) {
+		creds.Token, creds.ExpiresAt = token, expiresAt
+		if err := creds.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: cannot save credentials: %v\n", err)
+		}
+	})}
+	if creds.Token != "" && server == creds.Server {
+		opts = append(opts, client.WithToken(creds.Token, creds.ExpiresAt))
+	}
+	c, err := client.New(server, opts...)
+	if err != nil {
+		return err
+	}
+	creds.Server = server
+	a.creds, a.client = creds, c
+	return nil
+}
+
+// login 要求已经登录；token 已过期时直接提示重新登录，不再发请求
+func (a *app) login() error {
+	if err := a.connect(""); err != nil {
+		return err
+	}
+	token, expiresAt := a.client.Token()
+	if token == "" {
+		return errors.New("not logged in; run `sfb login` first")
+	}
+	if !expiresAt.IsZero() && time.Now().After(expiresAt) {
+		return client.ErrTokenExpired
+	}
+	return nil
+}
+
+func (a *app) encode(v any) error {
+	enc := json.NewEncoder(a.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func cmdLogin(a *app, args []string) error {
+	fset := a.flags("login")
+	server := fset.String("server", "", "server base URL (default: the last one used, or "+defaultServer+")")
+	email := fset.String("email", "", "account email (prompted when empty)")
+	passwordStdin := fset.Bool("password-stdin", false, "read the password from stdin")
+	_ = fset.Parse(args)
+	if err := a.connect(*server); err != nil {
+		return err
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	if *email == "" {
+		if *passwordStdin {
+			return errUsage("login -email E -password-stdin")
+		}
+		fmt.Fprint(os.Stderr, "Email: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		*email = strings.TrimSpace(line)
+	}
+	var password string
+	if !*passwordStdin && term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		password = string(b)
+	} else {
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	res, err := a.client.Login(context.Background(), *email, password)
+	if err != nil {
+		return err
+	}
+	// token 已经由回调保存，这里补上账号信息
+	a.creds.Email, a.creds.UserID = res.User.Email, res.User.ID
+	if err := a.creds.save(); err != nil {
+		return err
+	}
+	if a.json {
+		return a.encode(map[string]any{"server": a.creds.Server, "email": res.User.Email, "user_id": res.User.ID})
+	}
+	fmt.Fprintf(a.out, "logged in to %s as %s\n", a.creds.Server, res.User.Email)
+	if res.User.MustResetPassword {
+		fmt.Fprintln(os.Stderr, "note: an administrator reset your password; change it in the web UI before using other commands")
+	}
+	return nil
+}
+
+func cmdLogout(a *app, args []string) error {
+	_ = a.flags("logout").Parse(args)
+	return removeCredentials()
+}
+
+func cmdList(a *app, args []string) error {
+	fset := a.flags("ls")
+	page := fset.Int("page", 1, "page number")
+	size := fset.Int("size", 20, "page size (max 100)")
+	_ = fset.Parse(args)
+	if err := a.login(); err != nil {
+		return err
+	}
+	list, err := a.client.ListFiles(context.Background(), *page, *size)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.encode(list)
+	}
+	tw := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSIZE\tCREATED\tNAME")
+	for _, f := range list.Items {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", f.ID, humanBytes(f.Size), f.CreatedAt.Local().Format("2006-01-02 15:04"), f.Filename)
+	}
+	tw.Flush()
+	fmt.Fprintf(a.out, "total: %d\n", list.Total)
+	return nil
+}
+
+func cmdRemove(a *app, args []string) error {
+	fset := a.flags("rm")
+	_ = fset.Parse(args)
+	ids, err := parseIDs(fset.Args())
+	if err != nil || len(ids) == 0 {
+		return errUsage("rm <id>...")
+	}
+	if err := a.login(); err != nil {
+		return err
+	}
+	failed := 0
+	for _, id := range ids {
+		if err := a.client.DeleteFile(context.Background(), id); err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "Error: %d: %v\n", id, err)
+			continue
+		}
+		if !a.json {
+			fmt.Fprintf(a.out, "removed %d\n", id)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deletions failed", failed, len(ids))
+	}
+	return nil
+}
+
+func cmdShare(a *app, args []string) error {
+	fset := a.flags("share")
+	ttl := fset.Duration("ttl", 24*time.Hour, "link lifetime (max 720h)")
+	_ = fset.Parse(args)
+	ids, err := parseIDs(fset.Args())
+	if err != nil || len(ids) != 1 {
+		return errUsage("share [-ttl 24h] <id>")
+	}
+	if err := a.login(); err != nil {
+		return err
+	}
+	link, err := a.client.ShareFile(context.Background(), ids[0], *ttl)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.encode(map[string]any{"url": link.URL, "expires_at": link.ExpiresAt})
+	}
+	fmt.Fprintln(a.out, link.URL)
+	fmt.Fprintf(os.Stderr, "expires %s\n", link.ExpiresAt.Local().Format(time.RFC1123))
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/client"
+	"github.com/Kaikai20040827/graduation/internal/testserver"
+)
+
+// run 像 main 一样执行一条命令，返回写到 stdout 的内容；stdin 非空时作为标准输入
+func run(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	if stdin != "" {
+		f, err := os.CreateTemp(t.TempDir(), "stdin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(stdin); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		oldStdin := os.Stdin
+		os.Stdin = f
+		defer func() { os.Stdin = oldStdin; f.Close() }()
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		t.Fatalf("unknown command %q", args[0])
+	}
+	var out bytes.Buffer
+	err := cmd(&app{out: &out}, args[1:])
+	return out.String(), err
+}
+
+// newTestCLI 启动测试服务器，创建 alice 并让凭据保存在临时目录
+func newTestCLI(t *testing.T) *testserver.Server {
+	t.Helper()
+	srv := testserver.New(t, testserver.Options{})
+	srv.CreateUser(t, "alice", "alice@example.com", "Passw0rd!alice")
+	srv.CreateUser(t, "bob", "bob@example.com", "Passw0rd!bob")
+	t.Setenv("SFB_CONFIG_DIR", t.TempDir())
+	return srv
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func listFiles(t *testing.T) client.FileList {
+	t.Helper()
+	out, err := run(t, "", "ls", "-json")
+	if err != nil {
+		t.Fatalf("ls: %v", err)
+	}
+	var list client.FileList
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		t.Fatalf("ls -json: %v\n%s", err, out)
+	}
+	return list
+}
+
+func TestSfbLogin(t *testing.T) {
+	srv := newTestCLI(t)
+	if _, err := run(t, "", "ls"); err == nil || !strings.Contains(err.Error(), "not logged in") {
+		t.Fatalf("ls before login = %v", err)
+	}
+	if _, err := run(t, "wrong-password\n", "login", "-server", srv.URL, "-email", "alice@example.com", "-password-stdin"); !errors.Is(err, client.ErrUnauthorized) {
+		t.Fatalf("login with a wrong password = %v", err)
+	}
+	out, err := run(t, "Passw0rd!alice\n", "login", "-server", srv.URL, "-email", "alice@example.com", "-password-stdin")
+	if err != nil || !strings.Contains(out, "logged in to "+srv.URL+" as alice@example.com") {
+		t.Fatalf("login = %v, %s", err, out)
+	}
+	creds, err := loadCredentials()
+	if err != nil || creds.Token == "" || creds.Server != srv.URL || creds.Email != "alice@example.com" {
+		t.Fatalf("saved credentials = %+v, %v", creds, err)
+	}
+	path, _ := credentialsPath()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("credentials file: %v", err)
+	}
+	if list := listFiles(t); list.Total != 0 {
+		t.Fatalf("ls = %+v", list)
+	}
+
+	if _, err := run(t, "", "logout"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(t, "", "ls"); err == nil {
+		t.Fatal("ls after logout succeeded")
+	}
+}
+
+func TestSfbPutGetRemove(t *testing.T) {
+	srv := newTestCLI(t)
+	if _, err := run(t, "Passw0rd!alice\n", "login", "-server", srv.URL, "-email", "alice@example.com", "-password-stdin"); err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	files := map[string]string{
+		"a.txt":       "alpha",
+		"b.log":       strings.Repeat("bravo\n", 50000),
+		"sub/c.txt":   "charlie",
+		"sub/d/e.txt": "",
+	}
+	writeFiles(t, src, files)
+
+	if _, err := run(t, "", "put", src); err == nil {
+		t.Fatal("put of a directory without -r succeeded")
+	}
+	out, err := run(t, "", "put", "-json", "-r", src)
+	var uploaded []struct {
+		Path string `json:"path"`
+		ID   uint   `json:"id"`
+	}
+	if err != nil || json.Unmarshal([]byte(out), &uploaded) != nil || len(uploaded) != len(files) {
+		t.Fatalf("put -r = %v, %s", err, out)
+	}
+	// 再传一次带 -skip-existing 的通配符：同名同大小的文件都跳过
+	if out, err := run(t, "", "put", "-json", "-skip-existing", filepath.Join(src, "*.txt")); err != nil || strings.TrimSpace(out) != "[]" {
+		t.Fatalf("put -skip-existing = %v, %s", err, out)
+	}
+
+	list := listFiles(t)
+	var names []string
+	ids := map[string]uint{}
+	for _, f := range list.Items {
+		names = append(names, f.Filename)
+		ids[f.Filename] = f.ID
+	}
+	sort.Strings(names)
+	if list.Total != 4 || strings.Join(names, ",") != "a.txt,b.log,c.txt,e.txt" {
+		t.Fatalf("ls = %d %v", list.Total, names)
+	}
+
+	dst := t.TempDir()
+	out, err = run(t, "", "get", "-o", dst, itoa(ids["a.txt"]), itoa(ids["b.log"]), itoa(ids["e.txt"]))
+	if err != nil {
+		t.Fatalf("get = %v, %s", err, out)
+	}
+	for name, want := range map[string]string{"a.txt": files["a.txt"], "b.log": files["b.log"], "e.txt": ""} {
+		if got, err := os.ReadFile(filepath.Join(dst, name)); err != nil || string(got) != want {
+			t.Fatalf("%s: %d bytes, %v", name, len(got), err)
+		}
+	}
+	// 已存在的文件不覆盖，-f 时覆盖
+	single := filepath.Join(dst, "renamed.txt")
+	if _, err := run(t, "", "get", "-o", single, itoa(ids["c.txt"])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(t, "", "get", "-o", single, itoa(ids["c.txt"])); err == nil {
+		t.Fatal("get over an existing file succeeded")
+	}
+	if _, err := run(t, "", "get", "-f", "-o", single, itoa(ids["c.txt"])); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(single); string(got) != "charlie" {
+		t.Fatalf("renamed.txt = %q", got)
+	}
+
+	if out, err := run(t, "", "rm", itoa(ids["a.txt"]), "999999"); err == nil || !strings.Contains(out, "removed "+itoa(ids["a.txt"])) {
+		t.Fatalf("rm with one unknown id = %v, %s", err, out)
+	}
+	if list := listFiles(t); list.Total != 3 {
+		t.Fatalf("ls after rm = %+v", list)
+	}
+
+	// bob 看不到也删不掉 alice 的文件
+	if _, err := run(t, "Passw0rd!bob\n", "login", "-email", "bob@example.com", "-password-stdin"); err != nil {
+		t.Fatal(err)
+	}
+	if list := listFiles(t); list.Total != 0 {
+		t.Fatalf("bob's ls = %+v", list)
+	}
+	if _, err := run(t, "", "get", "-o", t.TempDir(), itoa(ids["b.log"])); err == nil {
+		t.Fatal("bob downloaded alice's file")
+	}
+	if _, err := run(t, "", "rm", itoa(ids["b.log"])); err == nil {
+		t.Fatal("bob removed alice's file")
+	}
+}
+
+func TestSfbUsage(t *testing.T) {
+	newTestCLI(t)
+	var uerr usageError
+	for _, args := range [][]string{{"get"}, {"rm"}, {"share"}, {"put"}, {"key"}, {"key", "nope"}, {"login", "-password-stdin"}} {
+		if _, err := run(t, "", args...); !errors.As(err, &uerr) {
+			t.Errorf("%v = %v, want a usage error", args, err)
+		}
+	}
+}
+
+func itoa(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// progress 在 stderr 上画一行进度条；stderr 不是终端时不输出
+type progress struct {
+	out     io.Writer
+	name    string
+	total   int64 // 未知时为 -1
+	done    int64
+	resumed int64 // 续传时已有的字节，不计入速度
+	start   time.Time
+	last    time.Time
+}
+
+func newProgress(name string, total, done int64) *progress {
+	p := &progress{name: name, total: total, done: done, resumed: done, start: time.Now()}
+	if isTerminal(os.Stderr) {
+		p.out = os.Stderr
+	}
+	return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if now := time.Now(); now.Sub(p.last) >= 200*time.Millisecond {
+		p.last = now
+		p.draw()
+	}
+	return len(b), nil
+}
+
+// finish 画出最终状态并换行
+func (p *progress) finish() {
+	p.draw()
+	if p.out != nil {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func (p *progress) draw() {
+	if p.out == nil {
+		return
+	}
+	name := p.name
+	if len(name) > 28 {
+		name = "…" + name[len(name)-27:]
+	}
+	rate := ""
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		rate = humanBytes(int64(float64(p.done-p.resumed)/elapsed)) + "/s"
+	}
+	if p.total <= 0 {
+		fmt.Fprintf(p.out, "\r%-28s %10s %12s", name, humanBytes(p.done), rate)
+		return
+	}
+	const width = 30
+	frac := min(float64(p.done)/float64(p.total), 1)
+	filled := int(frac * width)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	fmt.Fprintf(p.out, "\r%-28s [%s] %3.0f%% %10s / %-10s %12s",
+		name, bar, frac*100, humanBytes(p.done), humanBytes(p.total), rate)
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Kaikai20040827/graduation/client"
+)
+
+type uploadTask struct {
+	path string // 本地路径
+	name string // 显示用的相对路径
+	size int64
+}
+
+func cmdPut(a *app, args []string) error {
+	fset := a.flags("put")
+	recursive := fset.Bool("r", false, "upload directories recursively")
+	desc := fset.String("d", "", "description for every uploaded file")
+	public := fset.Bool("public", false, "upload anonymously through /files/public/upload")
+	skipExisting := fset.Bool("skip-existing", false, "skip files you already uploaded with the same name and size")
+	_ = fset.Parse(args)
+	if fset.NArg() == 0 {
+		return errUsage("put [-r] [-d description] [-public] [-skip-existing] <file|dir|glob>...")
+	}
+
+	tasks, err := collectUploads(fset.Args(), *recursive)
+	if err != nil {
+		return err
+	}
+	if !*public {
+		if err := a.login(); err != nil {
+			return err
+		}
+	}
+	ctx := context.Background()
+
+	var existing map[string]bool
+	if *skipExisting && !*public {
+		if existing, err = a.ownFiles(ctx); err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	results := []map[string]any{}
+	for _, t := range tasks {
+		base := filepath.Base(t.path)
+		if existing[fileKey(base, t.size)] {
+			if !a.json {
+				fmt.Fprintf(os.Stderr, "skip %s (already uploaded)\n", t.name)
+			}
+			continue
+		}
+		res, err := a.upload(ctx, t, *desc, *public)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", t.name, err)
+			results = append(results, map[string]any{"path": t.name, "error": err.Error()})
+			continue
+		}
+		results = append(results, map[string]any{"path": t.name, "id": res.FileID, "size": res.Size})
+		if !a.json {
+			fmt.Fprintf(a.out, "%d\t%s\n", res.FileID, t.name)
+		}
+	}
+	if a.json {
+		if err := a.encode(results); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uploads failed", failed, len(tasks))
+	}
+	return nil
+}
+
+func (a *app) upload(ctx context.Context, t uploadTask, desc string, public bool) (*client.UploadResult, error) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p := newProgress(t.name, t.size, 0)
+	defer p.finish()
+	r := io.TeeReader(f, p)
+	if public {
+		return a.client.UploadPublic(ctx, filepath.Base(t.path), r, desc)
+	}
+	return a.client.UploadFile(ctx, filepath.Base(t.path), r, desc)
+}
+
+// collectUploads 展开通配符（Windows 的 shell 不会替我们展开）并遍历目录。
+// 服务器没有目录的概念，上传后只保留文件名。
+func collectUploads(args []string, recursive bool) ([]uploadTask, error) {
+	var tasks []uploadTask
+	for _, arg := range args {
+		paths := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("%s: no matches", arg)
+			}
+			paths = matches
+		}
+		for _, path := range paths {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if !fi.IsDir() {
+				tasks = append(tasks, uploadTask{path: path, name: path, size: fi.Size()})
+				continue
+			}
+			if !recursive {
+				return nil, fmt.Errorf("%s is a directory (use -r)", path)
+			}
+			err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					if p != path && strings.HasPrefix(d.Name(), ".") {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+					return nil
+				}
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				tasks = append(tasks, uploadTask{path: p, name: p, size: info.Size()})
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(tasks) == 0 {
+		return nil, errors.New("nothing to upload")
+	}
+	return tasks, nil
+}
+
+// ownFiles 返回自己已上传文件的 文件名+大小 集合，用于 -skip-existing
+func (a *app) ownFiles(ctx context.Context) (map[string]bool, error) {
+	seen := map[string]bool{}
+	uploader := fmt.Sprint(a.creds.UserID)
+	for page := 1; ; page++ {
+		list, err := a.client.ListFiles(ctx, page, 100)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range list.Items {
+			if f.UploaderID == uploader {
+				seen[fileKey(f.Filename, f.Size)] = true
+			}
+		}
+		if len(list.Items) == 0 || int64(page*100) >= list.Total {
+			return seen, nil
+		}
+	}
+}
+
+func fileKey(name string, size int64) string {
+	return fmt.Sprintf("%s\x00%d", name, size)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Kaikai20040827/graduation/client"
+	"golang.org/x/term"
+)
+
+func cmdSealStatus(a *app, args []string) error {
+	fset := a.flags("seal-status")
+	server := fset.String("server", "", "server base URL (default: the last one used)")
+	_ = fset.Parse(args)
+	if err := a.connect(*server); err != nil {
+		return err
+	}
+	st, err := a.client.SealStatus(context.Background())
+	if err != nil {
+		return err
+	}
+	return a.printSealStatus(st)
+}
+
+// cmdUnseal 提交一份主密钥份额，不需要登录。份额在终端上输入时不回显，
+// 也可以用 -share-file 从文件读取，或者从标准输入读取一行
+func cmdUnseal(a *app, args []string) error {
+	fset := a.flags("unseal")
+	server := fset.String("server", "", "server base URL (default: the last one used)")
+	shareFile := fset.String("share-file", "", "read the key share from this file instead of the terminal")
+	reset := fset.Bool("reset", false, "discard the key shares submitted so far and start again with this share")
+	_ = fset.Parse(args)
+	if fset.NArg() != 0 {
+		// 份额不能写在命令行上，会留在 shell 历史和进程列表里
+		return errUsage("unseal [-server URL] [-share-file F] [-reset]")
+	}
+	if err := a.connect(*server); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	st, err := a.client.SealStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if !st.Sealed {
+		return a.printSealStatus(st)
+	}
+	prompt := fmt.Sprintf("Key share (%d/%d submitted): ", st.Progress, st.Threshold)
+	if *reset {
+		prompt = fmt.Sprintf("Key share (discards the %d submitted): ", st.Progress)
+	}
+	share, err := readShare(*shareFile, prompt)
+	if err != nil {
+		return err
+	}
+	submit := a.client.Unseal
+	if *reset {
+		submit = a.client.ResetUnseal
+	}
+	if st, err = submit(ctx, share); err != nil {
+		return err
+	}
+	return a.printSealStatus(st)
+}
+
+func cmdSeal(a *app, args []string) error {
+	fset := a.flags("seal")
+	_ = fset.Parse(args)
+	if err := a.login(); err != nil {
+		return err
+	}
+	st, err := a.client.Seal(context.Background())
+	if err != nil {
+		if errors.Is(err, client.ErrConflict) {
+			return fmt.Errorf("%w; the master key is not split into key shares", err)
+		}
+		return err
+	}
+	return a.printSealStatus(st)
+}
+
+func (a *app) printSealStatus(st *client.SealStatus) error {
+	if a.json {
+		return a.encode(st)
+	}
+	switch {
+	case !st.Sealed:
+		fmt.Fprintln(a.out, "unsealed")
+	case st.Threshold > 0:
+		fmt.Fprintf(a.out, "sealed: %d of %d key shares submitted (%d shares in total)\n", st.Progress, st.Threshold, st.Shares)
+	default:
+		fmt.Fprintln(a.out, "sealed")
+	}
+	return nil
+}
+
+func readShare(file, prompt string) (string, error) {
+	var line string
+	switch fd := int(os.Stdin.Fd()); {
+	case file != "":
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		line, _, _ = strings.Cut(string(b), "\n")
+	case term.IsTerminal(fd):
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		line = string(b)
+	default:
+		l, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && l == "" {
+			return "", err
+		}
+		line = l
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", errors.New("empty key share")
+	}
+	return line, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Kaikai20040827/graduation/client"
+	"golang.org/x/term"
+)
+
+const vaultUsage = "vault init|passwd|ls|put|get|rm [flags]"
+
+var vaultCommands = map[string]command{
+	"init":   cmdVaultInit,
+	"passwd": cmdVaultPasswd,
+	"ls":     cmdVaultList,
+	"put":    cmdVaultPut,
+	"get":    cmdVaultGet,
+	"rm":     cmdVaultRemove,
+}
+
+// cmdVault 处理保险库子命令。文件在本地用口令派生的密钥加密后再上传，服务器无法解密；
+// 口令从终端读取，或用 -passphrase-file 从文件的第一行读取
+func cmdVault(a *app, args []string) error {
+	if len(args) == 0 {
+		return errUsage(vaultUsage)
+	}
+	cmd, ok := vaultCommands[args[0]]
+	if !ok {
+		return errUsage(vaultUsage)
+	}
+	return cmd(a, args[1:])
+}
+
+func cmdVaultInit(a *app, args []string) error {
+	fset := a.flags("vault init")
+	ppFile := fset.String("passphrase-file", "", "read the passphrase from this file instead of the terminal")
+	_ = fset.Parse(args)
+	if err := a.login(); err != nil {
+		return err
+	}
+	passphrase, err := readPassphrase(*ppFile, "Vault passphrase: ", true)
+	if err != nil {
+		return err
+	}
+	if _, err := a.client.InitVault(context.Background(), passphrase); err != nil {
+		if errors.Is(err, client.ErrConflict) {
+			return errors.New("vault already exists; use `sfb vault passwd` to change its passphrase")
+		}
+		return err
+	}
+	if a.json {
+		return a.encode(map[string]any{"initialized": true})
+	}
+	fmt.Fprintln(a.out, "vault created; a forgotten passphrase cannot be recovered")
+	return nil
+}
+
+func cmdVaultPasswd(a *app, args []string) error {
+	fset := a.flags("vault passwd")
+	oldFile := fset.String("passphrase-file", "", "read the current passphrase from this file")
+	newFile := fset.String("new-passphrase-file", "", "read the new passphrase from this file")
+	_ = fset.Parse(args)
+	if err := a.login(); err != nil {
+		return err
+	}
+	oldPP, err := readPassphrase(*oldFile, "Current vault passphrase: ", false)
+	if err != nil {
+		return err
+	}
+	newPP, err := readPassphrase(*newFile, "New vault passphrase: ", true)
+	if err != nil {
+		return err
+	}
+	if err := a.client.ChangeVaultPassphrase(context.Background(), oldPP, newPP); err != nil {
+		return err
+	}
+	if !a.json {
+		fmt.Fprintln(a.out, "vault passphrase changed")
+	}
+	return nil
+}
+
+func cmdVaultList(a *app, args []string) error {
+	fset := a.flags("vault ls")
+	ppFile := fset.String("passphrase-file", "", "read the passphrase from this file instead of the terminal")
+	_ = fset.Parse(args)
+	v, err := a.unlockVault(*ppFile)
+	if err != nil {
+		return err
+	}
+	files, err := a.client.ListVaultFiles(context.Background())
+	if err != nil {
+		return err
+	}
+	type entry struct {
+		client.VaultFile
+		Name string `json:"name"`
+	}
+	entries := make([]entry, 0, len(files))
+	for i := range files {
+		name, err := v.Name(&files[i])
+		if err != nil {
+			name = "<undecryptable: " + err.Error() + ">"
+		}
+		entries = append(entries, entry{VaultFile: files[i], Name: name})
+	}
+	if a.json {
+		return a.encode(entries)
+	}
+	tw := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSIZE\tSTATUS\tCREATED\tNAME")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", e.ID, humanBytes(e.Size), e.Status, e.CreatedAt.Local().Format("2006-01-02 15:04"), e.Name)
+	}
+	return tw.Flush()
+}
+
+func cmdVaultPut(a *app, args []string) error {
+	fset := a.flags("vault put")
+	ppFile := fset.String("passphrase-file", "", "read the passphrase from this file instead of the terminal")
+	_ = fset.Parse(args)
+	if fset.NArg() == 0 {
+		return errUsage("vault put [-passphrase-file F] <file>...")
+	}
+	v, err := a.unlockVault(*ppFile)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	failed := 0
+	results := []map[string]any{}
+	for _, path := range fset.Args() {
+		f, err := a.vaultPut(ctx, v, path)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", path, err)
+			results = append(results, map[string]any{"path": path, "error": err.Error()})
+			continue
+		}
+		results = append(results, map[string]any{"path": path, "id": f.ID, "size": f.Size})
+		if !a.json {
+			fmt.Fprintf(a.out, "%d\t%s\n", f.ID, path)
+		}
+	}
+	if a.json {
+		if err := a.encode(results); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uploads failed", failed, fset.NArg())
+	}
+	return nil
+}
+
+func (a *app) vaultPut(ctx context.Context, v *client.Vault, path string) (*client.VaultFile, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("not a regular file")
+	}
+	p := newProgress(filepath.Base(path), fi.Size(), 0)
+	f, err := v.Upload(ctx, filepath.Base(path), io.TeeReader(in, p))
+	p.finish()
+	return f, err
+}
+
+func cmdVaultGet(a *app, args []string) error {
+	fset := a.flags("vault get")
+	ppFile := fset.String("passphrase-file", "", "read the passphrase from this file instead of the terminal")
+	out := fset.String("o", "", "output file, or directory when downloading several ids (default: current directory)")
+	force := fset.Bool("f", false, "overwrite existing files")
+	_ = fset.Parse(args)
+	ids, err := parseIDs(fset.Args())
+	if err != nil || len(ids) == 0 {
+		return errUsage("vault get [-passphrase-file F] [-o path] [-f] <id>...")
+	}
+	dir, target := ".", ""
+	if *out != "" {
+		if fi, err := os.Stat(*out); err == nil && fi.IsDir() {
+			dir = *out
+		} else if len(ids) > 1 {
+			return fmt.Errorf("%s is not a directory", *out)
+		} else {
+			dir, target = filepath.Dir(*out), *out
+		}
+	}
+	v, err := a.unlockVault(*ppFile)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	failed := 0
+	results := []map[string]any{}
+	for _, id := range ids {
+		path, size, err := a.vaultGet(ctx, v, id, dir, target, *force)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "Error: %d: %v\n", id, err)
+			results = append(results, map[string]any{"id": id, "error": err.Error()})
+			continue
+		}
+		results = append(results, map[string]any{"id": id, "path": path, "size": size})
+		if !a.json {
+			fmt.Fprintf(a.out, "%d\t%s\n", id, path)
+		}
+	}
+	if a.json {
+		if err := a.encode(results); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d downloads failed", failed, len(ids))
+	}
+	return nil
+}
+
+// vaultGet 解密到 dir 下的临时文件，全部块通过认证后才改名，失败时删除临时文件
+func (a *app) vaultGet(ctx context.Context, v *client.Vault, id uint, dir, target string, force bool) (string, int64, error) {
+	f, err := a.client.GetVaultFile(ctx, id)
+	if err != nil {
+		return "", 0, err
+	}
+	name := target
+	if name == "" {
+		plainName, err := v.Name(f)
+		if err != nil {
+			return "", 0, err
+		}
+		name = filepath.Join(dir, localName(plainName, id))
+	}
+	if !force {
+		if _, err := os.Stat(name); err == nil {
+			return "", 0, fmt.Errorf("%s already exists (use -f to overwrite)", name)
+		}
+	}
+	part, err := os.CreateTemp(dir, fmt.Sprintf(".sfb-vault-%d-*.part", id))
+	if err != nil {
+		return "", 0, err
+	}
+	p := newProgress(filepath.Base(name), -1, 0)
+	n, err := v.Download(ctx, f, io.MultiWriter(part, p))
+	p.finish()
+	if cerr := part.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(part.Name(), name)
+	}
+	if err != nil {
+		_ = os.Remove(part.Name())
+		return "", 0, err
+	}
+	return name, n, nil
+}
+
+func cmdVaultRemove(a *app, args []string) error {
+	fset := a.flags("vault rm")
+	_ = fset.Parse(args)
+	ids, err := parseIDs(fset.Args())
+	if err != nil || len(ids) == 0 {
+		return errUsage("vault rm <id>...")
+	}
+	if err := a.login(); err != nil {
+		return err
+	}
+	failed := 0
+	for _, id := range ids {
+		if err := a.client.DeleteVaultFile(context.Background(), id); err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "Error: %d: %v\n", id, err)
+			continue
+		}
+		if !a.json {
+			fmt.Fprintf(a.out, "removed %d\n", id)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deletions failed", failed, len(ids))
+	}
+	return nil
+}
+
+func (a *app) unlockVault(ppFile string) (*client.Vault, error) {
+	if err := a.login(); err != nil {
+		return nil, err
+	}
+	passphrase, err := readPassphrase(ppFile, "Vault passphrase: ", false)
+	if err != nil {
+		return nil, err
+	}
+	v, err := a.client.UnlockVault(context.Background(), passphrase)
+	if errors.Is(err, client.ErrNotFound) {
+		return nil, errors.New("no vault yet; run `sfb vault init` first")
+	}
+	return v, err
+}
+
+// readPassphrase 从文件的第一行读取口令，file 为空时在终端提示输入；confirm 要求输入两次
+func readPassphrase(file string, prompt string, confirm bool) ([]byte, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		line, _, _ := strings.Cut(string(b), "\n")
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			return nil, fmt.Errorf("%s: empty passphrase", file)
+		}
+		return []byte(line), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("no terminal to read the vault passphrase; use -passphrase-file")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	pp, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(pp) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(pp, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return pp, nil
+}
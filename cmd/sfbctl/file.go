@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+func fileList(a *app, args []string) error {
+	fs := a.flags("file list")
+	user := fs.Uint("user", 0, "only files uploaded by this user id")
+	page := fs.Int("page", 1, "page number")
+	size := fs.Int("size", 100, "page size")
+	_ = fs.Parse(args)
+	if *page < 1 || *size < 1 {
+		return errors.New("-page and -size must be positive")
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	var (
+		total int64
+		files []model.File
+		err   error
+	)
+	if *user != 0 {
+		files, err = a.fileSrv.ListFilesByOwner(*user)
+		total = int64(len(files))
+	} else {
+		total, files, err = a.fileSrv.ListFiles(*page, *size)
+	}
+	if err != nil {
+		return err
+	}
+	return a.emit(map[string]any{"total": total, "files": files}, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSIZE\tUPLOADER\tSCAN\tCREATED\tFILENAME")
+		for _, f := range files {
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%s\n", f.ID, f.Size, f.UploaderID, f.ScanStatus,
+				f.CreatedAt.Format("2006-01-02 15:04:05"), f.Filename)
+		}
+		tw.Flush()
+		fmt.Fprintf(w, "total: %d\n", total)
+	})
+}
+
+type verifyResult struct {
+	ID     uint   `json:"id"`
+	OK     bool   `json:"ok"`
+	Locked bool   `json:"locked,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func fileVerify(a *app, args []string) error {
+	fs := a.flags("file verify")
+	id := fs.Uint("id", 0, "verify a single file id (default: all files)")
+	_ = fs.Parse(args)
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	results := []verifyResult{}
+	failed, locked := 0, 0
+	record := func(fileID uint, err error) {
+		r := verifyResult{ID: fileID, OK: err == nil}
+		// 用用户密钥或客户密钥加密的文件离线时读不了，单独统计，不算失败
+		if service.KeyUnavailable(err) {
+			r.Locked, err = true, nil
+			locked++
+		} else if err != nil {
+			r.Error = err.Error()
+			failed++
+		}
+		results = append(results, r)
+		if !a.json {
+			switch {
+			case err != nil:
+				fmt.Fprintf(a.out, "%d\tFAIL\t%v\n", fileID, err)
+			case r.Locked:
+				fmt.Fprintf(a.out, "%d\tlocked\n", fileID)
+			default:
+				fmt.Fprintf(a.out, "%d\tok\n", fileID)
+			}
+		}
+	}
+	if *id != 0 {
+		record(*id, a.fileSrv.VerifyFile(*id))
+	} else if err := a.fileSrv.VerifyAll(record); err != nil {
+		return err
+	}
+
+	if a.json {
+		if err := a.encode(map[string]any{"checked": len(results), "failed": failed, "locked": locked, "results": results}); err != nil {
+			return err
+		}
+	} else if locked > 0 {
+		fmt.Fprintf(a.out, "checked %d, failed %d, locked %d (key not available offline)\n", len(results), failed, locked)
+	} else {
+		fmt.Fprintf(a.out, "checked %d, failed %d\n", len(results), failed)
+	}
+	if failed > 0 {
+		return errIssuesFound
+	}
+	return nil
+}
+
+func fileDecrypt(a *app, args []string) error {
+	fs := a.flags("file decrypt")
+	id := fs.Uint("id", 0, "file id (required)")
+	out := fs.String("o", "", "output path (required); - writes to stdout")
+	force := fs.Bool("force", false, "allow downloading files flagged as infected")
+	keyFile := fs.String("customer-key-file", "", "file holding the base64 customer-provided key of the file")
+	_ = fs.Parse(args)
+	if *id == 0 || *out == "" {
+		return errors.New("-id and -o are required")
+	}
+	var ck *service.CustomerKey
+	if *keyFile != "" {
+		b, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		if ck, err = service.ParseCustomerKey(string(b)); err != nil {
+			return err
+		}
+	}
+	if *out == "-" && a.json {
+		return errors.New("-o - cannot be combined with -json")
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	file, err := a.fileSrv.GetFileByID(*id)
+	if err != nil {
+		return err
+	}
+	err = a.fileSrv.EnsureDownloadableWithKey(file, ck)
+	switch {
+	case errors.Is(err, service.ErrUserKeyLocked):
+		return errors.New("file is encrypted with its owner's user key, which is only available to the server while the owner is logged in")
+	case errors.Is(err, service.ErrCustomerKeyRequired):
+		return errors.New("file is encrypted with a customer-provided key; pass it with -customer-key-file")
+	case errors.Is(err, service.ErrCustomerKeyMismatch), errors.Is(err, service.ErrCustomerKeyNotUsed):
+		return err
+	case err != nil && !*force:
+		return fmt.Errorf("%w (use -force to override)", err)
+	}
+
+	if *out == "-" {
+		return a.fileSrv.DecryptFileWithKey(a.out, file, ck)
+	}
+	// 不覆盖已有文件；失败时删除写了一半的明文
+	dst, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = a.fileSrv.DecryptFileWithKey(dst, file, ck)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(*out)
+		return err
+	}
+	return a.emit(map[string]any{"id": file.ID, "filename": file.Filename, "size": file.Size, "path": *out}, func(w io.Writer) {
+		fmt.Fprintf(w, "decrypted file %d (%s, %d bytes) to %s\n", file.ID, file.Filename, file.Size, *out)
+	})
+}
+
+// fileExportMeta 以 JSON lines 输出加密列，配合 sfbdecrypt -meta 使用；输出不含明文
+func fileExportMeta(a *app, args []string) error {
+	fs := a.flags("file export-meta")
+	id := fs.Uint("id", 0, "export a single file id (default: all rows)")
+	_ = fs.Parse(args)
+	if err := a.open(); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(a.out)
+	return a.fileSrv.ExportMetadataRows(*id, func(row sfbcrypt.MetadataRow) error {
+		return enc.Encode(row)
+	})
+}
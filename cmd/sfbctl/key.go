@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Kaikai20040827/graduation/internal/keytool"
+)
+
+// keyInit 把主密钥密封到 -out（不覆盖已有文件）：默认使用 config.yaml 中的明文 file_crypto.key，
+// -generate 时生成新的主密钥（只用于新部署，已有数据会无法解密）
+func keyInit(a *app, args []string) error {
+	fs := a.flags("key init")
+	out := fs.String("out", "", "file to write the sealed master key to (required)")
+	generate := fs.Bool("generate", false, "seal a new random master key instead of file_crypto.key (new deployments only)")
+	passFile := fs.String("passphrase-file", "", "read the passphrase from this file instead of prompting")
+	_ = fs.Parse(args)
+	res, err := keytool.Init(*out, *generate, *passFile)
+	if err != nil {
+		return err
+	}
+	return a.emit(res, func(w io.Writer) { keytool.PrintInit(w, res) })
+}
+
+// keyPasswd 用新口令重新包装密钥文件；主密钥不变，已有数据不需要重新加密
+func keyPasswd(a *app, args []string) error {
+	fs := a.flags("key passwd")
+	file := fs.String("file", "", "sealed master key file (default: file_crypto.key_file)")
+	passFile := fs.String("passphrase-file", "", "read the current passphrase from this file")
+	newPassFile := fs.String("new-passphrase-file", "", "read the new passphrase from this file")
+	_ = fs.Parse(args)
+	res, err := keytool.Passwd(*file, *passFile, *newPassFile)
+	if err != nil {
+		return err
+	}
+	return a.emit(res, func(w io.Writer) {
+		fmt.Fprintf(w, "passphrase of %s changed\n", res.KeyFile)
+	})
+}
+
+// keySplit 把主密钥拆成 -shares 份，任意 -threshold 份可以还原，写出新的密钥文件（不覆盖已有文件）。
+// 份额默认打印出来，-share-dir 时每份写一个文件，分别交给不同的保管人
+func keySplit(a *app, args []string) error {
+	fs := a.flags("key split")
+	out := fs.String("out", "", "file to write the split master key to (required)")
+	n := fs.Int("shares", 5, "number of key shares")
+	k := fs.Int("threshold", 3, "number of key shares needed to unseal")
+	shareDir := fs.String("share-dir", "", "write each key share to DIR/share-N.txt instead of printing them")
+	_ = fs.Parse(args)
+	res, err := keytool.Split(*out, *n, *k, *shareDir)
+	if err != nil {
+		return err
+	}
+	return a.emit(res, func(w io.Writer) { keytool.PrintSplit(w, res) })
+}
@@ -0,0 +1,203 @@
+// sfbctl 是离线维护工具，直接使用配置文件里的数据库和密钥：
+//
+//	sfbctl [-json] user create|disable|enable|reset-password ...
+//	sfbctl [-json] file list|verify|decrypt|export-meta ...
+//	sfbctl [-json] storage gc|shard ...
+//	sfbctl [-json] config check
+//	sfbctl [-json] audit verify
+//	sfbctl [-json] scan rescan ...
+//	sfbctl [-json] migrate status|up|down ...
+//	sfbctl [-json] recovery keygen -out FILE
+//	sfbctl [-json] key init|passwd|split ...
+//
+// 与 server 不同，sfbctl 从不生成密钥或写回 config.yaml。
+// 退出码：0 成功，1 出错，2 检查发现问题（校验失败、感染文件等）。
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/migrate"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"gorm.io/gorm"
+)
+
+type command func(a *app, args []string) error
+
+var commands = map[string]command{
+	"user create":         userCreate,
+	"user disable":        userDisable,
+	"user enable":         userEnable,
+	"user reset-password": userResetPassword,
+	"file list":           fileList,
+	"file verify":         fileVerify,
+	"file decrypt":        fileDecrypt,
+	"file export-meta":    fileExportMeta,
+	"storage gc":          storageGC,
+	"storage shard":       storageShard,
+	"config check":        configCheck,
+	"audit verify":        auditVerify,
+	"scan rescan":         scanRescan,
+	"migrate status":      migrateStatus,
+	"migrate up":          migrateUp,
+	"migrate down":        migrateDown,
+	"recovery keygen":     recoveryKeygen,
+	"key init":            keyInit,
+	"key passwd":          keyPasswd,
+	"key split":           keySplit,
+}
+
+// errIssuesFound 表示命令本身执行成功，但检查结果不通过
+var errIssuesFound = fmt.Errorf("issues found")
+
+type app struct {
+	out      io.Writer
+	json     bool
+	cfg      *config.Config
+	db       *gorm.DB
+	userSrv  *service.UserService
+	fileSrv  *service.FileService
+	auditSrv *service.AuditService
+	migrator *migrate.Migrator
+}
+
+func main() {
+	a := &app{out: os.Stdout}
+	// 加载配置和各个构造函数的进度打印到 stderr，stdout 只留给命令结果
+	config.Progress = os.Stderr
+
+	global := flag.NewFlagSet("sfbctl", flag.ExitOnError)
+	global.BoolVar(&a.json, "json", false, "print results as JSON")
+	global.Usage = usage
+	_ = global.Parse(os.Args[1:])
+	args := global.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	cmd, ok := commands[args[0]+" "+args[1]]
+	if !ok {
+		usage()
+		os.Exit(1)
+	}
+
+	err := cmd(a, args[2:])
+	switch {
+	case err == nil:
+	case err == errIssuesFound:
+		os.Exit(2)
+	default:
+		if a.json {
+			_ = a.encode(map[string]string{"error": err.Error()})
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "usage: sfbctl [-json] <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  "+name)
+	}
+}
+
+// flags 为子命令创建 FlagSet，-json 也可以写在子命令之后
+func (a *app) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("sfbctl "+name, flag.ExitOnError)
+	fs.BoolVar(&a.json, "json", a.json, "print results as JSON")
+	return fs
+}
+
+// open 按需加载配置和连接数据库，并要求数据库结构是最新版本；config check 不需要数据库也能运行
+func (a *app) open() error {
+	if a.db != nil {
+		return nil
+	}
+	if err := a.openDB(); err != nil {
+		return err
+	}
+	return a.migrator.Startup(false)
+}
+
+// openDB 只连接数据库，不检查结构版本，供 migrate 子命令使用
+func (a *app) openDB() error {
+	if a.migrator != nil {
+		return nil
+	}
+	cfg, err := config.LoadConfigReadOnly()
+	if err != nil {
+		return err
+	}
+	if err := config.UnlockMasterKey(cfg, -1); err != nil {
+		return err
+	}
+	db, err := pkg.NewDatabase(&cfg.Database)
+	if err != nil {
+		return err
+	}
+	a.cfg, a.migrator = cfg, migrate.New(db, cfg.FileCrypto.Key)
+	a.db = db
+	a.userSrv = service.NewUserService(db)
+	a.fileSrv = service.NewFileService(db, storageDir, cfg.FileCrypto.Key)
+	a.fileSrv.SetGCGrace(cfg.Storage.GCGrace)
+	// 命令行里没有人登录，密钥环只用于创建用户时生成用户密钥；用户密钥加密的文件在这里无法解密
+	keys, err := service.NewUserKeyRing(db, cfg.FileCrypto.UserKeys, cfg.FileCrypto.RecoveryPublicKey, cfg.JWT.TTL)
+	if err != nil {
+		return err
+	}
+	a.userSrv.SetUserKeys(keys)
+	a.fileSrv.SetUserKeys(keys)
+	a.auditSrv = service.NewAuditService(db, cfg.FileCrypto.Key)
+	return nil
+}
+
+// storageDir 与 server 相同，是项目根目录下的 storage；测试中换成临时目录
+var storageDir = defaultStorageDir()
+
+func defaultStorageDir() string {
+	_, currentFile, _, _ := runtime.Caller(0)
+	projectRoot := filepath.Dir(filepath.Dir(filepath.Dir(currentFile)))
+	return filepath.Join(projectRoot, "storage")
+}
+
+// emit 在 -json 时输出 v，否则调用 text 输出人类可读的格式
+func (a *app) emit(v any, text func(w io.Writer)) error {
+	if a.json {
+		return a.encode(v)
+	}
+	text(a.out)
+	return nil
+}
+
+func (a *app) encode(v any) error {
+	enc := json.NewEncoder(a.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func readSecretLine(r io.Reader) (string, error) {
+	b, err := io.ReadAll(io.LimitReader(r, 4096))
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(string(b), "\n")
+	return strings.TrimRight(line, "\r"), nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+)
+
+const testConfig = `server:
+  env: development
+jwt:
+  secret: sfbctl-test-secret-0123456789abcdefghij
+file_crypto:
+  key: AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA
+database:
+  driver: sqlite
+  name: sfbctl_test
+`
+
+// setupCLI 在临时目录里写好 config.yaml（SQLite 数据库也在那里），并把存储目录和进度输出换掉
+func setupCLI(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	oldStorage, oldProgress := storageDir, config.Progress
+	storageDir = filepath.Join(dir, "storage")
+	if err := os.Mkdir(storageDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	progress := new(bytes.Buffer)
+	config.Progress = progress
+	t.Cleanup(func() { storageDir, config.Progress = oldStorage, oldProgress })
+	return progress
+}
+
+// run 像 main 一样执行一条子命令，返回写到 stdout 的内容
+func run(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	if stdin != "" {
+		f, err := os.CreateTemp(t.TempDir(), "stdin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(stdin); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		oldStdin := os.Stdin
+		os.Stdin = f
+		defer func() { os.Stdin = oldStdin; f.Close() }()
+	}
+	cmd, ok := commands[args[0]+" "+args[1]]
+	if !ok {
+		t.Fatalf("unknown command %q", args[:2])
+	}
+	var out bytes.Buffer
+	a := &app{out: &out}
+	err := cmd(a, args[2:])
+	if a.db != nil {
+		if sqlDB, derr := a.db.DB(); derr == nil {
+			sqlDB.Close()
+		}
+	}
+	return out.String(), err
+}
+
+func decode(t *testing.T, out string, v any) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(out), v); err != nil {
+		t.Fatalf("stdout is not JSON: %v\n%s", err, out)
+	}
+}
+
+func TestSfbctlUsers(t *testing.T) {
+	progress := setupCLI(t)
+
+	if _, err := run(t, "", "migrate", "status"); err != errIssuesFound {
+		t.Fatalf("migrate status on an empty database = %v, want errIssuesFound", err)
+	}
+	if _, err := run(t, "", "user", "create", "-email", "a@example.com", "-username", "a"); err == nil || !strings.Contains(err.Error(), "migrate up") {
+		t.Fatalf("user create before migrate up = %v", err)
+	}
+	out, err := run(t, "", "migrate", "up", "-json")
+	var ran []migrationResult
+	decode(t, out, &ran)
+	if err != nil || len(ran) == 0 {
+		t.Fatalf("migrate up = %v, %s", err, out)
+	}
+
+	out, err = run(t, "", "config", "check", "-json")
+	var check struct {
+		OK     bool        `json:"ok"`
+		Checks []checkItem `json:"checks"`
+	}
+	decode(t, out, &check)
+	if err != nil || !check.OK {
+		t.Fatalf("config check = %v, %+v", err, check)
+	}
+	// 进度只写到 config.Progress，stdout 只有命令结果
+	if !strings.Contains(progress.String(), "✓ Unmarshalling config file done") || strings.Contains(out, "✓") {
+		t.Fatalf("progress %q, stdout %q", progress.String(), out)
+	}
+
+	out, err = run(t, "Passw0rd!alice\n", "user", "create", "-json", "-email", "alice@example.com", "-username", "alice", "-password-stdin")
+	var alice userResult
+	decode(t, out, &alice)
+	if err != nil || alice.User == nil || alice.Role != "user" || alice.TempPassword != "" || alice.MustResetPassword {
+		t.Fatalf("user create = %v, %s", err, out)
+	}
+	if _, err := run(t, "Passw0rd!alice\n", "user", "create", "-email", "ALICE@example.com", "-username", "alice2", "-password-stdin"); err == nil {
+		t.Fatal("user create with an existing email succeeded")
+	}
+	if _, err := run(t, "short\n", "user", "create", "-email", "bob@example.com", "-username", "bob", "-password-stdin"); err == nil {
+		t.Fatal("user create with a short password succeeded")
+	}
+
+	out, err = run(t, "", "user", "create", "-json", "-admin", "-email", "root@example.com", "-username", "root")
+	var root userResult
+	decode(t, out, &root)
+	if err != nil || root.User == nil || root.Role != "admin" || root.TempPassword == "" || !root.MustResetPassword {
+		t.Fatalf("user create -admin = %v, %s", err, out)
+	}
+
+	out, err = run(t, "", "user", "disable", "-email", "alice@example.com")
+	if err != nil || !strings.Contains(out, "disabled=true") {
+		t.Fatalf("user disable = %v, %s", err, out)
+	}
+	if _, err := run(t, "", "user", "enable", "-email", "nobody@example.com"); err == nil {
+		t.Fatal("user enable of an unknown email succeeded")
+	}
+
+	out, err = run(t, "", "file", "list", "-json")
+	var files struct {
+		Total int64 `json:"total"`
+	}
+	decode(t, out, &files)
+	if err != nil || files.Total != 0 {
+		t.Fatalf("file list = %v, %s", err, out)
+	}
+	if out, err := run(t, "", "audit", "verify"); err != nil || !strings.Contains(out, "audit chain ok") {
+		t.Fatalf("audit verify = %v, %s", err, out)
+	}
+}
+
+func TestSfbctlRecoveryKeygen(t *testing.T) {
+	setupCLI(t)
+	out := filepath.Join(t.TempDir(), "recovery.key")
+	stdout, err := run(t, "", "recovery", "keygen", "-json", "-out", out)
+	var res map[string]any
+	decode(t, stdout, &res)
+	if err != nil || len(res) == 0 {
+		t.Fatalf("recovery keygen = %v, %s", err, stdout)
+	}
+	if fi, err := os.Stat(out); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("private key file: %v", err)
+	}
+	if _, err := run(t, "", "recovery", "keygen", "-out", out); err == nil {
+		t.Fatal("recovery keygen overwrote an existing key file")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/migrate"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+func storageGC(a *app, args []string) error {
+	fs := a.flags("storage gc")
+	del := fs.Bool("delete", false, "actually quarantine and remove orphaned blobs (default is a dry run)")
+	minAge := fs.Duration("min-age", time.Hour, "ignore blobs newer than this (uploads in progress)")
+	grace := fs.Duration("grace", -1, "keep quarantined blobs this long before removing them (default storage.gc_grace)")
+	_ = fs.Parse(args)
+	if err := a.open(); err != nil {
+		return err
+	}
+	if *grace >= 0 {
+		a.fileSrv.SetGCGrace(*grace)
+	}
+	report, err := a.fileSrv.CollectGarbage(*minAge, !*del)
+	if report == nil {
+		return err
+	}
+	if eerr := a.emit(report, func(w io.Writer) {
+		for _, c := range report.Orphans {
+			fmt.Fprintf(w, "orphan\t%s\t%d\t%s\n", c.Path, c.Size, c.ModTime.Format(time.RFC3339))
+		}
+		for _, c := range report.Expired {
+			fmt.Fprintf(w, "expired\t%s\t%d\t%s\n", c.Path, c.Size, c.ModTime.Format(time.RFC3339))
+		}
+		for _, p := range report.Restored {
+			fmt.Fprintf(w, "restore\t%s\n", p)
+		}
+		for _, d := range report.Dangling {
+			fmt.Fprintf(w, "dangling\t%s %d\t%s\n", d.Kind, d.ID, d.Path)
+		}
+		quarantine, remove, restore := "would quarantine", "would remove", "would restore"
+		if !report.DryRun {
+			quarantine, remove, restore = "quarantined", "removed", "restored"
+		}
+		if report.Grace <= 0 {
+			quarantine = remove
+		}
+		fmt.Fprintf(w, "scanned %d blobs, %d referenced, %s %d orphans (%d bytes), %s %d expired, %s %d, %d dangling records\n",
+			report.Scanned, report.Referenced, quarantine, len(report.Orphans), report.Bytes,
+			remove, len(report.Expired), restore, len(report.Restored), len(report.Dangling))
+	}); eerr != nil {
+		return eerr
+	}
+	if err == nil && len(report.Dangling) > 0 {
+		return errIssuesFound
+	}
+	return err
+}
+
+// storageShard 把旧版本平铺在 storage 根目录下的密文移到分级目录；可以重复运行
+func storageShard(a *app, args []string) error {
+	fs := a.flags("storage shard")
+	dryRun := fs.Bool("dry-run", false, "only report what would be moved")
+	_ = fs.Parse(args)
+	if err := a.open(); err != nil {
+		return err
+	}
+	report, err := a.fileSrv.ShardStorage(*dryRun)
+	if eerr := a.emit(report, func(w io.Writer) {
+		for _, d := range report.Missing {
+			fmt.Fprintf(w, "missing\t%s %d\t%s\n", d.Kind, d.ID, d.Path)
+		}
+		action := "moved"
+		if report.DryRun {
+			action = "would move"
+		}
+		fmt.Fprintf(w, "%s %d files and %d avatars, %d skipped, %d missing\n",
+			action, report.Files, report.Avatars, report.Skipped, len(report.Missing))
+	}); eerr != nil {
+		return eerr
+	}
+	if err == nil && len(report.Missing) > 0 {
+		return errIssuesFound
+	}
+	return err
+}
+
+type checkItem struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// configCheck 只读地检查配置、数据库、存储目录和 clamd，不会修改 config.yaml
+func configCheck(a *app, args []string) error {
+	fs := a.flags("config check")
+	_ = fs.Parse(args)
+
+	var items []checkItem
+	add := func(name string, err error, detail string) {
+		item := checkItem{Name: name, OK: err == nil, Detail: detail}
+		if err != nil {
+			item.Detail = err.Error()
+		}
+		items = append(items, item)
+	}
+
+	cfg, err := config.LoadConfigReadOnly()
+	add("config", err, "")
+	if cfg != nil {
+		add("server.env", nil, cfg.Server.Env)
+		shared, serr := config.ReadSharedKeyFile(cfg)
+		_, haveShares := os.LookupEnv(config.KeySharesEnv)
+		switch {
+		case serr != nil:
+			add("master key", serr, cfg.FileCrypto.KeyFile)
+		case shared != nil && !haveShares:
+			// 没有提供份额时只检查密钥文件本身，下面的元数据解密检查跳过
+			sharing, _ := sfbcrypt.MasterKeySharing(shared)
+			add("master key", nil, fmt.Sprintf("split into %d shares (threshold %d) in %s; set %s to check it",
+				sharing.Shares, sharing.Threshold, cfg.FileCrypto.KeyFile, config.KeySharesEnv))
+		case shared != nil:
+			add("master key", config.UnlockMasterKey(cfg, -1), "unlocked with key shares from "+cfg.FileCrypto.KeyFile)
+		case cfg.FileCrypto.KeyFile != "":
+			add("master key", config.UnlockMasterKey(cfg, -1), "sealed in "+cfg.FileCrypto.KeyFile)
+		default:
+			var perr error
+			if cfg.Production() {
+				perr = fmt.Errorf("file_crypto.key is stored in plaintext; server.env %q requires file_crypto.key_file", cfg.Server.Env)
+			}
+			add("master key", perr, "plaintext file_crypto.key")
+		}
+		db, err := pkg.NewDatabase(&cfg.Database)
+		dbDetail := fmt.Sprintf("%s %s:%d/%s", cfg.Database.Driver, cfg.Database.Host, cfg.Database.Port, cfg.Database.Name)
+		if cfg.Database.Driver == "sqlite" {
+			dbDetail = "sqlite " + cfg.Database.Path
+		}
+		add("database", err, dbDetail)
+		add("storage", checkWritable(storageDir), storageDir)
+		if db != nil {
+			migrator := migrate.New(db, cfg.FileCrypto.Key)
+			add("schema", migrator.Check(), fmt.Sprintf("version %d", migrator.Latest()))
+			// 试着解密最新一行的元数据，确认 file_crypto.key 与数据库匹配
+			var newest model.File
+			var kerr error
+			detail := "no files yet"
+			if cfg.FileCrypto.Key == "" {
+				detail = "master key not unlocked"
+			} else if db.Order("id desc").Limit(1).Find(&newest); newest.ID != 0 {
+				fileSrv := service.NewFileService(db, storageDir, cfg.FileCrypto.Key)
+				if _, kerr = fileSrv.GetFileByID(newest.ID); kerr != nil {
+					kerr = fmt.Errorf("cannot decrypt metadata of file %d: %v", newest.ID, kerr)
+				}
+				detail = fmt.Sprintf("decrypted metadata of file %d", newest.ID)
+			}
+			add("file_crypto.key", kerr, detail)
+		}
+		if cfg.Scanner.Enabled {
+			scanner, err := pkg.NewClamdClient(cfg.Scanner.Address, cfg.Scanner.Timeout)
+			if err == nil {
+				err = scanner.Ping()
+			}
+			add("scanner", err, cfg.Scanner.Address)
+		}
+	}
+
+	failed := 0
+	for _, item := range items {
+		if !item.OK {
+			failed++
+		}
+	}
+	if eerr := a.emit(map[string]any{"ok": failed == 0, "checks": items}, func(w io.Writer) {
+		for _, item := range items {
+			status := "ok"
+			if !item.OK {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "%-16s %-4s %s\n", item.Name, status, item.Detail)
+		}
+	}); eerr != nil {
+		return eerr
+	}
+	if failed > 0 {
+		return errIssuesFound
+	}
+	return nil
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".sfbctl-check-")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(filepath.Clean(name))
+}
+
+// auditVerify 重新计算审计日志的哈希链，链被破坏时以 2 退出
+func auditVerify(a *app, args []string) error {
+	fs := a.flags("audit verify")
+	_ = fs.Parse(args)
+	if err := a.open(); err != nil {
+		return err
+	}
+	result, err := a.auditSrv.Verify()
+	if err != nil {
+		return err
+	}
+	if eerr := a.emit(result, func(w io.Writer) {
+		if result.OK {
+			fmt.Fprintf(w, "audit chain ok: %d records, head seq %d\n", result.Checked, result.HeadSeq)
+		} else {
+			fmt.Fprintf(w, "audit chain BROKEN at seq %d: %s\n", result.BadSeq, result.Reason)
+		}
+	}); eerr != nil {
+		return eerr
+	}
+	if !result.OK {
+		return errIssuesFound
+	}
+	return nil
+}
+
+type rescanResult struct {
+	ID        uint   `json:"id"`
+	Status    string `json:"status"`
+	Signature string `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// scanRescan 用当前配置的 clamd 重新扫描已经存储的文件，发现感染文件时以 2 退出
+func scanRescan(a *app, args []string) error {
+	fs := a.flags("scan rescan")
+	id := fs.Uint("id", 0, "rescan a single file id")
+	onlyUnscanned := fs.Bool("only-unscanned", false, "skip files that already have a clean or infected verdict")
+	_ = fs.Parse(args)
+	if err := a.open(); err != nil {
+		return err
+	}
+	scanner, err := pkg.NewClamdClient(a.cfg.Scanner.Address, a.cfg.Scanner.Timeout)
+	if err != nil {
+		return err
+	}
+	if err := scanner.Ping(); err != nil {
+		return fmt.Errorf("clamd not reachable: %w", err)
+	}
+	a.fileSrv.SetScanner(scanner, a.cfg.Scanner.Action, a.cfg.Scanner.FailOpen)
+
+	results := []rescanResult{}
+	infected := 0
+	report := func(fileID uint, file *model.File, err error) {
+		r := rescanResult{ID: fileID}
+		switch {
+		case err != nil:
+			r.Status, r.Error = model.ScanError, err.Error()
+		default:
+			r.Status, r.Signature = file.ScanStatus, file.ScanSignature
+			if file.ScanStatus == model.ScanInfected {
+				infected++
+			}
+		}
+		results = append(results, r)
+		if !a.json {
+			fmt.Fprintf(a.out, "%d\t%s\t%s%s\n", r.ID, r.Status, r.Signature, r.Error)
+		}
+	}
+	if *id != 0 {
+		file, err := a.fileSrv.RescanFile(*id)
+		report(*id, file, err)
+	} else if err := a.fileSrv.RescanAll(*onlyUnscanned, report); err != nil {
+		return err
+	}
+	if a.json {
+		if err := a.encode(map[string]any{"scanned": len(results), "infected": infected, "results": results}); err != nil {
+			return err
+		}
+	}
+	if infected > 0 {
+		return errIssuesFound
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/migrate"
+)
+
+type migrationResult struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+}
+
+func migrationResults(ran []migrate.Migration) []migrationResult {
+	out := make([]migrationResult, 0, len(ran))
+	for _, m := range ran {
+		out = append(out, migrationResult{Version: m.Version, Name: m.Name})
+	}
+	return out
+}
+
+// migrateStatus 列出每个迁移是否已执行；数据库版本与本程序不一致时以 2 退出
+func migrateStatus(a *app, args []string) error {
+	fs := a.flags("migrate status")
+	_ = fs.Parse(args)
+	if err := a.openDB(); err != nil {
+		return err
+	}
+	status, err := a.migrator.Status()
+	if err != nil {
+		return err
+	}
+	checkErr := a.migrator.Check()
+	if eerr := a.emit(status, func(w io.Writer) {
+		for _, st := range status {
+			applied := "pending"
+			if st.AppliedAt != nil {
+				applied = st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%4d  %-32s  %s\n", st.Version, st.Name, applied)
+		}
+		if checkErr != nil {
+			fmt.Fprintln(w, checkErr)
+		} else {
+			fmt.Fprintf(w, "schema is up to date (version %d)\n", a.migrator.Latest())
+		}
+	}); eerr != nil {
+		return eerr
+	}
+	if checkErr != nil {
+		return errIssuesFound
+	}
+	return nil
+}
+
+func migrateUp(a *app, args []string) error {
+	fs := a.flags("migrate up")
+	to := fs.Int("to", 0, "stop after this version (default: latest)")
+	_ = fs.Parse(args)
+	if err := a.openDB(); err != nil {
+		return err
+	}
+	ran, err := a.migrator.Up(*to)
+	if eerr := a.emitMigrations("applied", ran); eerr != nil {
+		return eerr
+	}
+	return err
+}
+
+func migrateDown(a *app, args []string) error {
+	fs := a.flags("migrate down")
+	steps := fs.Int("steps", 1, "number of migrations to revert")
+	_ = fs.Parse(args)
+	if *steps < 1 {
+		return fmt.Errorf("-steps must be at least 1")
+	}
+	if err := a.openDB(); err != nil {
+		return err
+	}
+	ran, err := a.migrator.Down(*steps)
+	if eerr := a.emitMigrations("reverted", ran); eerr != nil {
+		return eerr
+	}
+	return err
+}
+
+func (a *app) emitMigrations(action string, ran []migrate.Migration) error {
+	results := migrationResults(ran)
+	return a.emit(results, func(w io.Writer) {
+		for _, m := range results {
+			fmt.Fprintf(w, "%s %d %s\n", action, m.Version, m.Name)
+		}
+		if len(results) == 0 {
+			fmt.Fprintf(w, "nothing %s\n", action)
+		}
+	})
+}
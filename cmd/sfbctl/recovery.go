@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+type recoveryKeyResult struct {
+	PublicKey      string `json:"public_key"`
+	PrivateKeyFile string `json:"private_key_file"`
+}
+
+// recoveryKeygen 生成管理员恢复密钥对：私钥写入 -out（不覆盖已有文件），公钥填到
+// file_crypto.recovery_public_key。私钥应离线保存，服务器上不需要它
+func recoveryKeygen(a *app, args []string) error {
+	fs := a.flags("recovery keygen")
+	out := fs.String("out", "", "file to write the private key to (required)")
+	_ = fs.Parse(args)
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+	pub, priv, err := sfbcrypt.NewRecoveryKey()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, priv)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(*out)
+		return err
+	}
+	return a.emit(recoveryKeyResult{PublicKey: pub, PrivateKeyFile: *out}, func(w io.Writer) {
+		fmt.Fprintf(w, "private key written to %s; keep it offline\n", *out)
+		fmt.Fprintf(w, "add to config.yaml:\n\nfile_crypto:\n    recovery_public_key: %s\n", pub)
+	})
+}
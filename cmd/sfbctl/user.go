@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/service"
+)
+
+type userResult struct {
+	*model.User
+	TempPassword string `json:"temp_password,omitempty"`
+}
+
+func userCreate(a *app, args []string) error {
+	fs := a.flags("user create")
+	email := fs.String("email", "", "email (required)")
+	username := fs.String("username", "", "username (required)")
+	admin := fs.Bool("admin", false, "create the user as an admin")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin; otherwise a temporary password is generated")
+	_ = fs.Parse(args)
+	if *email == "" || *username == "" {
+		return errors.New("-email and -username are required")
+	}
+
+	var password string
+	if *passwordStdin {
+		var err error
+		if password, err = readSecretLine(os.Stdin); err != nil {
+			return err
+		}
+		if len(password) < 6 {
+			return errors.New("password must be at least 6 characters")
+		}
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	generated := password == ""
+	if generated {
+		// 先用一个随机值建号，下面再换成需要首次登录修改的临时密码
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		password = base64.RawURLEncoding.EncodeToString(b)
+	}
+	if _, err := a.userSrv.GetByEmail(*email); err == nil {
+		return errors.New("email already exists")
+	}
+
+	var (
+		user *model.User
+		err  error
+	)
+	if *admin {
+		user, err = a.userSrv.EnsureAdmin(*email, *username, password)
+	} else {
+		user, err = a.userSrv.CreateUser(*username, *email, password)
+	}
+	if err != nil {
+		return err
+	}
+
+	res := userResult{User: user}
+	if generated {
+		// 随机密码包装的用户密钥没有人能解开，丢弃它，首次登录时再创建
+		if res.TempPassword, err = a.userSrv.ResetPassword(user.ID, true); err != nil {
+			return err
+		}
+		res.MustResetPassword = true
+	}
+	return a.emit(res, func(w io.Writer) {
+		fmt.Fprintf(w, "created user %d <%s> role=%s\n", user.ID, user.Email, user.Role)
+		if res.TempPassword != "" {
+			fmt.Fprintf(w, "temporary password: %s (must be changed at first login)\n", res.TempPassword)
+		}
+	})
+}
+
+func userDisable(a *app, args []string) error {
+	return userSetDisabled(a, "user disable", args, true)
+}
+
+func userEnable(a *app, args []string) error {
+	return userSetDisabled(a, "user enable", args, false)
+}
+
+func userSetDisabled(a *app, name string, args []string, disabled bool) error {
+	fs := a.flags(name)
+	id := fs.Uint("id", 0, "user id")
+	email := fs.String("email", "", "user email")
+	_ = fs.Parse(args)
+	if err := a.open(); err != nil {
+		return err
+	}
+	uid, err := a.resolveUser(*id, *email)
+	if err != nil {
+		return err
+	}
+	// actorID 为 0：命令行不是任何一个用户，不受“不能禁用自己”的限制
+	user, err := a.userSrv.SetDisabled(0, uid, disabled)
+	if err != nil {
+		return err
+	}
+	return a.emit(user, func(w io.Writer) {
+		fmt.Fprintf(w, "user %d <%s> disabled=%t\n", user.ID, user.Email, user.Disabled)
+	})
+}
+
+// userResetPassword 生成临时密码。用户有用户密钥时需要 -recovery-key（用托管副本保留密钥）
+// 或 -discard-key（丢弃密钥，用它加密的文件再也无法读取）
+func userResetPassword(a *app, args []string) error {
+	fs := a.flags("user reset-password")
+	id := fs.Uint("id", 0, "user id")
+	email := fs.String("email", "", "user email")
+	recoveryKey := fs.String("recovery-key", "", "file with the recovery private key from `sfbctl recovery keygen`; keeps the user key")
+	discardKey := fs.Bool("discard-key", false, "discard the user key; files encrypted with it become unreadable")
+	_ = fs.Parse(args)
+	if *recoveryKey != "" && *discardKey {
+		return errors.New("use either -recovery-key or -discard-key")
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	uid, err := a.resolveUser(*id, *email)
+	if err != nil {
+		return err
+	}
+	var temp string
+	if *recoveryKey != "" {
+		priv, rerr := os.ReadFile(*recoveryKey)
+		if rerr != nil {
+			return rerr
+		}
+		temp, err = a.userSrv.RecoverPassword(uid, string(priv))
+	} else {
+		temp, err = a.userSrv.ResetPassword(uid, *discardKey)
+	}
+	if errors.Is(err, service.ErrUserKeyReset) {
+		return fmt.Errorf("%w; pass -recovery-key or -discard-key", err)
+	}
+	if err != nil {
+		return err
+	}
+	user, err := a.userSrv.GetByID(uid)
+	if err != nil {
+		return err
+	}
+	res := userResult{User: user, TempPassword: temp}
+	return a.emit(res, func(w io.Writer) {
+		fmt.Fprintf(w, "temporary password for user %d <%s>: %s\n", user.ID, user.Email, temp)
+	})
+}
+
+func (a *app) resolveUser(id uint, email string) (uint, error) {
+	switch {
+	case id != 0 && email != "":
+		return 0, errors.New("use either -id or -email")
+	case id != 0:
+		return id, nil
+	case email != "":
+		user, err := a.userSrv.GetByEmail(email)
+		if err != nil {
+			return 0, fmt.Errorf("user %s: %w", email, err)
+		}
+		return user.ID, nil
+	}
+	return 0, errors.New("-id or -email is required")
+}
@@ -0,0 +1,262 @@
+// sfbdecrypt 在没有服务器和数据库的情况下解密 storage/*.bin。
+// 只依赖 sfbcrypt 和标准库，可以单独编译后与备份放在一起：
+//
+//	sfbdecrypt -key-file key.txt -in storage/abc.bin -out report.pdf
+//	sfbdecrypt -key-file key.txt -in storage/abc.bin -meta rows.jsonl -out restored/
+//	sfbdecrypt -key-file key.txt -in storage/abc.bin -verify-only
+//
+// 主密钥即 config.yaml 中的 file_crypto.key，从 -key-file 或 SFB_FILE_CRYPTO_KEY 读取；
+// -key-file 也可以是 sfbctl key init 生成的密封文件，口令从 SFB_KEY_PASSPHRASE 读取；
+// 或者是 sfbctl key split 生成的密钥文件，份额从 SFB_KEY_SHARES 读取（以空白分隔）。
+// -meta 是 sfbctl file export-meta 导出的行（一行或多行 JSON），会按存储文件名自动匹配。
+// 结果报告以 JSON 写到 stderr。退出码：0 成功，1 用法或 I/O 错误，2 完整性校验失败。
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+type report struct {
+	Input    string                 `json:"input"`
+	Output   string                 `json:"output,omitempty"`
+	OK       bool                   `json:"ok"`
+	Blob     *sfbcrypt.BlobInfo     `json:"blob,omitempty"`
+	Metadata *sfbcrypt.FileMetadata `json:"metadata,omitempty"`
+	RowID    uint                   `json:"row_id,omitempty"`
+	Error    *reportError           `json:"error,omitempty"`
+}
+
+type reportError struct {
+	Message string `json:"message"`
+	Chunk   *int64 `json:"chunk,omitempty"`
+	Offset  *int64 `json:"offset,omitempty"`
+	Column  string `json:"column,omitempty"`
+}
+
+func main() {
+	keyFile := flag.String("key-file", "", "file containing file_crypto.key (default: $SFB_FILE_CRYPTO_KEY)")
+	in := flag.String("in", "", "encrypted blob (required)")
+	out := flag.String("out", "", "output file, directory (name taken from -meta) or - for stdout")
+	metaFile := flag.String("meta", "", "exported metadata rows (JSON / JSON lines)")
+	verifyOnly := flag.Bool("verify-only", false, "check integrity without writing plaintext")
+	keepPartial := flag.Bool("keep-partial", false, "on failure keep the plaintext of the chunks that verified")
+	flag.Parse()
+
+	rep := &report{Input: *in}
+	code := run(rep, *keyFile, *in, *out, *metaFile, *verifyOnly, *keepPartial)
+	enc := json.NewEncoder(os.Stderr)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(rep)
+	os.Exit(code)
+}
+
+func run(rep *report, keyFile, in, out, metaFile string, verifyOnly, keepPartial bool) int {
+	fail := func(code int, err error) int {
+		rep.Error = describe(err)
+		return code
+	}
+	if in == "" || (out == "" && !verifyOnly) {
+		return fail(1, errors.New("-in and either -out or -verify-only are required"))
+	}
+
+	keys, err := loadKeys(keyFile)
+	if err != nil {
+		return fail(1, err)
+	}
+	blobs, err := sfbcrypt.NewBlobCipher(keys.File)
+	if err != nil {
+		return fail(1, err)
+	}
+
+	if metaFile != "" {
+		metaCipher, err := sfbcrypt.NewMetaCipher(keys.Metadata)
+		if err != nil {
+			return fail(1, err)
+		}
+		row, meta, err := findRow(metaCipher, metaFile, filepath.Base(in))
+		if err != nil {
+			return fail(2, err)
+		}
+		rep.RowID, rep.Metadata = row, meta
+	}
+
+	src, err := os.Open(in)
+	if err != nil {
+		return fail(1, err)
+	}
+	defer src.Close()
+
+	var dst io.Writer = io.Discard
+	var tmp *os.File
+	if !verifyOnly {
+		if out, err = outputPath(out, rep.Metadata); err != nil {
+			return fail(1, err)
+		}
+		rep.Output = out
+		if out == "-" {
+			dst = os.Stdout
+		} else {
+			// 先写到 .partial，校验全部通过后再改名，避免把半截文件当成完整文件
+			if tmp, err = os.OpenFile(out+".partial", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
+				return fail(1, err)
+			}
+			dst = tmp
+		}
+	}
+
+	rep.Blob, err = blobs.Decrypt(dst, src)
+	if err == nil && rep.Metadata != nil && rep.Blob.PlainBytes != rep.Metadata.Size {
+		// SFB2 没有结束标记，整块丢失只能靠元数据里的大小发现
+		err = fmt.Errorf("%w: decrypted %d bytes but metadata says %d", sfbcrypt.ErrTruncated, rep.Blob.PlainBytes, rep.Metadata.Size)
+	}
+	if tmp != nil {
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		switch {
+		case err == nil:
+			err = os.Rename(tmp.Name(), out)
+		case keepPartial:
+			rep.Output = tmp.Name()
+		default:
+			_ = os.Remove(tmp.Name())
+			rep.Output = ""
+		}
+	}
+	if err != nil {
+		var ce *sfbcrypt.ChunkError
+		if errors.As(err, &ce) || errors.Is(err, sfbcrypt.ErrTruncated) ||
+			errors.Is(err, sfbcrypt.ErrBadMagic) || errors.Is(err, sfbcrypt.ErrHeaderMissing) {
+			return fail(2, err)
+		}
+		return fail(1, err)
+	}
+	rep.OK = true
+	return 0
+}
+
+func loadKeys(keyFile string) (*sfbcrypt.Keys, error) {
+	key := os.Getenv("SFB_FILE_CRYPTO_KEY")
+	if keyFile != "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = string(b)
+	}
+	if strings.TrimSpace(key) == "" {
+		return nil, errors.New("master key required: use -key-file or SFB_FILE_CRYPTO_KEY")
+	}
+	if strings.HasPrefix(strings.TrimSpace(key), "{") {
+		master, err := openKeyFile([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		key = base64.RawURLEncoding.EncodeToString(master)
+	}
+	return sfbcrypt.NewKeys(key)
+}
+
+func openKeyFile(data []byte) ([]byte, error) {
+	sharing, err := sfbcrypt.MasterKeySharing(data)
+	if err != nil {
+		return nil, err
+	}
+	if sharing == nil {
+		passphrase := os.Getenv("SFB_KEY_PASSPHRASE")
+		if passphrase == "" {
+			return nil, errors.New("sealed master key file: set SFB_KEY_PASSPHRASE")
+		}
+		return sfbcrypt.OpenMasterKey([]byte(passphrase), data)
+	}
+	var shares []*sfbcrypt.KeyShare
+	for _, t := range strings.Fields(os.Getenv("SFB_KEY_SHARES")) {
+		share, err := sfbcrypt.ParseKeyShare(t)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	if len(shares) < sharing.Threshold {
+		return nil, fmt.Errorf("master key file is split into key shares: set SFB_KEY_SHARES to %d of them", sharing.Threshold)
+	}
+	return sfbcrypt.OpenMasterKeyShares(data, shares)
+}
+
+// findRow 在导出的行中找到 storage_path 文件名与 blob 相同的一行
+func findRow(m *sfbcrypt.MetaCipher, path string, blobName string) (uint, *sfbcrypt.FileMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	var firstErr error
+	for {
+		var row sfbcrypt.MetadataRow
+		if err := dec.Decode(&row); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		meta, err := m.DecryptRow(row)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("row %d: %w", row.ID, err)
+			}
+			continue
+		}
+		if filepath.Base(meta.StoragePath) == blobName {
+			return row.ID, meta, nil
+		}
+	}
+	if firstErr != nil {
+		return 0, nil, fmt.Errorf("no row matches %s; %w", blobName, firstErr)
+	}
+	return 0, nil, fmt.Errorf("no row matches %s", blobName)
+}
+
+// outputPath 在 out 是目录时使用元数据中的原始文件名
+func outputPath(out string, meta *sfbcrypt.FileMetadata) (string, error) {
+	if out == "-" {
+		return out, nil
+	}
+	info, err := os.Stat(out)
+	if err != nil || !info.IsDir() {
+		return out, nil
+	}
+	if meta == nil {
+		return "", errors.New("-out is a directory; -meta is needed for the file name")
+	}
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(meta.Filename)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" {
+		return "", errors.New("metadata has no usable file name")
+	}
+	return filepath.Join(out, name), nil
+}
+
+func describe(err error) *reportError {
+	re := &reportError{Message: err.Error()}
+	var ce *sfbcrypt.ChunkError
+	if errors.As(err, &ce) {
+		chunk, offset := int64(ce.Chunk), ce.Offset
+		re.Chunk, re.Offset = &chunk, &offset
+	}
+	var fe *sfbcrypt.FieldError
+	if errors.As(err, &fe) {
+		re.Column = fe.Column
+	}
+	return re
+}
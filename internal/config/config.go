@@ -4,13 +4,21 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
 	"github.com/spf13/viper"
 )
 
+// Progress 接收加载配置和各个构造函数打印的进度（"✓ ... done"），默认是标准输出；
+// sfbctl、sfb 的标准输出只留给命令结果，它们把 Progress 换成标准错误
+var Progress io.Writer = os.Stdout
+
 type FuncCounters struct {
 	ConfigLoadingFuncCounter int
 	LoggerFuncCounter        int
@@ -26,8 +34,13 @@ type ServerConfig struct {
 	Host     string `mapstructure:"host"`
 	Port     int    `mapstructure:"port"`
 	TimeZone string `mapstructure:"time_zone"`
+	// TrustedProxies 是反向代理的 IP 或 CIDR；只有来自它们的 X-Forwarded-For 和 X-Forwarded-Proto 才被采信
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
 }
 
+// DatabaseConfig 的 Driver 可选 mysql、postgres、sqlite。
+// sqlite 只使用 Path（为空时为 Name + ".db"，":memory:" 表示内存数据库），
+// Host/Port/User/Password/SSLMode 只对 mysql 和 postgres 生效；Port 为 0 时使用驱动的默认端口。
 type DatabaseConfig struct {
 	Driver        string `mapstructure:"driver"`
 	Host          string `mapstructure:"host"`
@@ -37,6 +50,9 @@ type DatabaseConfig struct {
 	User          string `mapstructure:"user"`
 	Password      string `mapstructure:"password"`
 	Name          string `mapstructure:"name"`
+	Path          string `mapstructure:"path"`
+	SSLMode       string `mapstructure:"sslmode"`
+	AutoMigrate   bool   `mapstructure:"auto_migrate"` // 启动时执行未执行的迁移，否则只检查版本
 	Debug         bool   `mapstructure:"debug"`
 }
 
@@ -44,11 +60,103 @@ type JWTConfig struct {
 	Secret   string `mapstructure:"secret"` //签名密钥
 	Issuer   string `mapstructure:"issuer"` // 签发者
 	Audience string `mapstructure:"audience"`
+	// TTL 为 token 有效期，0 表示永不过期（旧行为）；过期前可以用 /auth/refresh 换新
+	TTL time.Duration `mapstructure:"ttl"`
 }
 
 type FileCryptoConfig struct {
 	// Base64 URL-safe (no padding) 32 bytes key for AES-256
 	Key string `mapstructure:"key"`
+	// KeyFile 为口令密封的主密钥文件（sfbctl key init 生成），与 Key 二选一；
+	// 相对路径相对于 config.yaml 所在目录。启动时由 UnlockMasterKey 解开并填入 Key
+	KeyFile string `mapstructure:"key_file"`
+	// UserKeys 为 true 时，用户在用密码登录时得到一个随机的用户密钥，之后上传的内容用它加密，
+	// 只有主密钥无法解密；用户的所有会话都过期或服务重启后，要重新登录才能读取这些文件
+	UserKeys bool `mapstructure:"user_keys"`
+	// RecoveryPublicKey 为管理员恢复公钥（sfbctl recovery keygen 生成），非空时每个用户密钥
+	// 都会额外用它加密保存一份，忘记密码后可以用离线保存的私钥恢复；默认不托管
+	RecoveryPublicKey string `mapstructure:"recovery_public_key"`
+}
+
+// AdminConfig 用于引导第一个管理员账号；email 为空时不做任何事。
+// 邮箱已存在时只会把该用户提升为管理员，不会修改其密码。
+type AdminConfig struct {
+	Email    string `mapstructure:"email"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// WebhookConfig 控制后台投递：失败后按 InitialBackoff * 2^n 退避，
+// 超过 MaxAttempts 次进入死信列表
+type WebhookConfig struct {
+	MaxAttempts          int           `mapstructure:"max_attempts"`
+	InitialBackoff       time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff           time.Duration `mapstructure:"max_backoff"`
+	Timeout              time.Duration `mapstructure:"timeout"`
+	PollInterval         time.Duration `mapstructure:"poll_interval"`
+	AllowPrivateNetworks bool          `mapstructure:"allow_private_networks"`
+	// Retention 之后删除投递成功的记录，0 表示保留
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+// ScannerConfig 配置 clamd 病毒扫描。Action 为 "reject" 时拒绝感染文件，
+// 为 "quarantine" 时保存到隔离目录并禁止下载；FailOpen 决定 clamd 不可用时是否放行。
+type ScannerConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Address  string        `mapstructure:"address"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	Action   string        `mapstructure:"action"`
+	FailOpen bool          `mapstructure:"fail_open"`
+}
+
+// StorageConfig 中 UserQuota 为每个用户可保存的明文总字节数，0 表示不限制；
+// ScrubRate 为巡检每秒最多读取的密文字节数，0 表示不限速；
+// GCGrace 为孤儿密文移入 .gc 后保留多久才删除，0 表示直接删除；
+// Dedup 为去重范围：off、user（同一用户内）或 tenant（整个实例）
+type StorageConfig struct {
+	UserQuota int64         `mapstructure:"user_quota"`
+	ScrubRate int64         `mapstructure:"scrub_rate"`
+	GCGrace   time.Duration `mapstructure:"gc_grace"`
+	Dedup     string        `mapstructure:"dedup"`
+}
+
+// MetricsConfig 控制 /metrics（Prometheus 文本格式）；Token 不为空时要求 Authorization: Bearer <token>
+type MetricsConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Token   string `mapstructure:"token"`
+}
+
+// SFTPConfig 配置内置的 SFTP 服务。HostKey 为 OpenSSH 格式的私钥文件，
+// 为空时使用项目根目录下的 sftp_host_ed25519_key，不存在时自动生成。
+type SFTPConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Host    string `mapstructure:"host"`
+	Port    int    `mapstructure:"port"`
+	HostKey string `mapstructure:"host_key"`
+}
+
+// S3Config 配置兼容 S3 的 API（路径风格，如 http://host:9000/bucket/key）。
+// Region 只用于 GetBucketLocation 的返回值，签名中的区域不做限制。
+type S3Config struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Host    string `mapstructure:"host"`
+	Port    int    `mapstructure:"port"`
+	Region  string `mapstructure:"region"`
+}
+
+// JobsConfig 控制后台任务：Workers 个 worker 并发执行，运行中的任务每隔 Lease/3 续约，
+// 失败后按 InitialBackoff * 2^n 退避，超过 MaxAttempts 次标记为失败。
+// Schedules 为任务类型到 cron 表达式的映射（支持 @hourly、@every 10m 等），空字符串表示停用；
+// 已结束的任务保留 Retention 后删除，0 表示永久保留。
+type JobsConfig struct {
+	Workers        int               `mapstructure:"workers"`
+	PollInterval   time.Duration     `mapstructure:"poll_interval"`
+	Lease          time.Duration     `mapstructure:"lease"`
+	MaxAttempts    int               `mapstructure:"max_attempts"`
+	InitialBackoff time.Duration     `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration     `mapstructure:"max_backoff"`
+	Retention      time.Duration     `mapstructure:"retention"`
+	Schedules      map[string]string `mapstructure:"schedules"`
 }
 
 type Config struct {
@@ -56,50 +164,84 @@ type Config struct {
 	Database   DatabaseConfig   `mapstructure:"database"`
 	JWT        JWTConfig        `mapstructure:"jwt"`
 	FileCrypto FileCryptoConfig `mapstructure:"file_crypto"`
+	Admin      AdminConfig      `mapstructure:"admin"`
+	Webhook    WebhookConfig    `mapstructure:"webhook"`
+	Scanner    ScannerConfig    `mapstructure:"scanner"`
+	Storage    StorageConfig    `mapstructure:"storage"`
+	SFTP       SFTPConfig       `mapstructure:"sftp"`
+	S3         S3Config         `mapstructure:"s3"`
+	Jobs       JobsConfig       `mapstructure:"jobs"`
+	Metrics    MetricsConfig    `mapstructure:"metrics"`
+}
+
+// 默认配置中的占位密钥，LoadConfig 会把它替换成随机值
+const placeholderSecret = "PLEASE_CHANGE_ME_32_CHARS_MINIMUM"
+
+// EnvProduction 是生产环境的 server.env；生产环境不会生成明文主密钥，服务器也拒绝使用明文主密钥
+const EnvProduction = "production"
+
+// Production 报告是否运行在生产环境
+func (c *Config) Production() bool {
+	return strings.EqualFold(c.Server.Env, EnvProduction)
 }
 
 func LoadConfig() (*Config, error) {
+	return loadConfig(true)
+}
+
+// LoadConfigReadOnly 与 LoadConfig 相同，但不会生成密钥并写回 config.yaml；
+// 密钥缺失或仍是占位值时直接报错。供 sfbctl 等离线工具使用。
+func LoadConfigReadOnly() (*Config, error) {
+	return loadConfig(false)
+}
+
+func loadConfig(ensureSecrets bool) (*Config, error) {
 	v := viper.New()
 	// 配置文件名
 	v.SetConfigName("config")
 	v.SetConfigType("yaml")
 	addConfigPaths(v)
-	fmt.Println("✓ Loading config file done")
+	fmt.Fprintln(Progress, "✓ Loading config file done")
 
 	// 支持环境变量覆盖，例如：SERVER_APP_NAME
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	v.AutomaticEnv()
 
 	setDefaults(v)
-	fmt.Println("✓ Setting default configuration done")
+	fmt.Fprintln(Progress, "✓ Setting default configuration done")
 
 	// 读取 YAML
 	if err := v.ReadInConfig(); err != nil {
-		fmt.Println("Error: ⚠ config.yaml not found, using default values and environment variables")
+		fmt.Fprintln(Progress, "Error: ⚠ config.yaml not found, using default values and environment variables")
 	} else {
-		fmt.Printf("✓ Using config file: %s, not using default configuration\n", v.ConfigFileUsed())
+		fmt.Fprintf(Progress, "✓ Using config file: %s, not using default configuration\n", v.ConfigFileUsed())
 	}
 
-	// 确保 jwt.secret 存在且强度足够，否则生成并写入配置文件
-	if err := EnsureJWTSecret(v); err != nil {
-		return nil, fmt.Errorf("Error: can't generate and write in jwt.secret: %w", err)
-	}
-	// 确保 file_crypto.key 存在且强度足够，否则生成并写入配置文件
-	if err := EnsureFileCryptoKey(v); err != nil {
-		return nil, fmt.Errorf("Error: can't generate and write in file_crypto.key: %w", err)
+	if ensureSecrets {
+		// 确保 jwt.secret 存在且强度足够，否则生成并写入配置文件
+		if err := EnsureJWTSecret(v); err != nil {
+			return nil, fmt.Errorf("Error: can't generate and write in jwt.secret: %w", err)
+		}
+		// 确保 file_crypto.key 存在且强度足够，否则生成并写入配置文件
+		if err := EnsureFileCryptoKey(v); err != nil {
+			return nil, fmt.Errorf("Error: can't generate and write in file_crypto.key: %w", err)
+		}
 	}
 
 	var cfg Config
 	if err := v.Unmarshal(&cfg); err != nil {
 		return nil, fmt.Errorf("Error: parsing config failed: %w", err)
 	}
-	fmt.Println("✓ Unmarshalling config file done")
+	fmt.Fprintln(Progress, "✓ Unmarshalling config file done")
+	if kf := cfg.FileCrypto.KeyFile; kf != "" && !filepath.IsAbs(kf) && v.ConfigFileUsed() != "" {
+		cfg.FileCrypto.KeyFile = filepath.Join(filepath.Dir(v.ConfigFileUsed()), kf)
+	}
 
 	// 校验
 	if err := validateConfig(&cfg); err != nil {
 		return nil, err
 	}
-	fmt.Println("✓ Validating config file done")
+	fmt.Fprintln(Progress, "✓ Validating config file done")
 
 	return &cfg, nil
 }
@@ -124,36 +266,172 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("server.host", "127.0.0.1")
 	v.SetDefault("server.port", 8080)
 	v.SetDefault("server.time_zone", "Asia/Shanghai")
+	v.SetDefault("server.trusted_proxies", []string{})
 
 	v.SetDefault("database.driver", "mysql")
 	v.SetDefault("database.host", "localhost")
-	v.SetDefault("database.port", 3306)
+	v.SetDefault("database.port", 0) // 0: mysql 3306, postgres 5432
 	v.SetDefault("database.user", "root")
 	v.SetDefault("database.password", "0827")        // you own password, change it
 	v.SetDefault("database.name", "secure_file_box") //create database with name "secure_file_box"
+	v.SetDefault("database.path", "")
+	v.SetDefault("database.sslmode", "disable")
+	v.SetDefault("database.auto_migrate", false)
 	v.SetDefault("database.debug", false)
 
-	v.SetDefault("jwt.secret", "PLEASE_CHANGE_ME_32_CHARS_MINIMUM")
+	v.SetDefault("jwt.secret", placeholderSecret)
 	v.SetDefault("jwt.issuer", "secure_file_box")
 	v.SetDefault("jwt.audience", "secure_users")
-
-	v.SetDefault("file_crypto.key", "PLEASE_CHANGE_ME_32_CHARS_MINIMUM")
+	v.SetDefault("jwt.ttl", "24h")
+
+	v.SetDefault("file_crypto.key", placeholderSecret)
+	v.SetDefault("file_crypto.key_file", "")
+	v.SetDefault("file_crypto.user_keys", false)
+	v.SetDefault("file_crypto.recovery_public_key", "")
+
+	v.SetDefault("admin.email", "")
+	v.SetDefault("admin.username", "admin")
+	v.SetDefault("admin.password", "")
+
+	v.SetDefault("webhook.max_attempts", 8)
+	v.SetDefault("webhook.initial_backoff", "10s")
+	v.SetDefault("webhook.max_backoff", "1h")
+	v.SetDefault("webhook.timeout", "10s")
+	v.SetDefault("webhook.poll_interval", "2s")
+	v.SetDefault("webhook.allow_private_networks", false)
+	v.SetDefault("webhook.retention", "168h")
+
+	v.SetDefault("scanner.enabled", false)
+	v.SetDefault("scanner.address", "tcp://127.0.0.1:3310")
+	v.SetDefault("scanner.timeout", "60s")
+	v.SetDefault("scanner.action", "reject")
+	v.SetDefault("scanner.fail_open", false)
+
+	v.SetDefault("storage.user_quota", 0)
+	v.SetDefault("storage.scrub_rate", 32<<20)
+	v.SetDefault("storage.gc_grace", "168h")
+	v.SetDefault("storage.dedup", "off")
+
+	v.SetDefault("sftp.enabled", false)
+	v.SetDefault("sftp.host", "127.0.0.1")
+	v.SetDefault("sftp.port", 2022)
+	v.SetDefault("sftp.host_key", "")
+
+	v.SetDefault("s3.enabled", false)
+	v.SetDefault("s3.host", "127.0.0.1")
+	v.SetDefault("s3.port", 9000)
+	v.SetDefault("s3.region", "us-east-1")
+
+	v.SetDefault("jobs.workers", 2)
+	v.SetDefault("jobs.poll_interval", "2s")
+	v.SetDefault("jobs.lease", "5m")
+	v.SetDefault("jobs.max_attempts", 5)
+	v.SetDefault("jobs.initial_backoff", "30s")
+	v.SetDefault("jobs.max_backoff", "1h")
+	v.SetDefault("jobs.retention", "720h")
+	v.SetDefault("jobs.schedules", map[string]string{
+		"s3.expire_uploads":    "@hourly",
+		"vault.expire_uploads": "@hourly",
+		"audit.verify":         "@daily",
+		"storage.scrub":        "@weekly",
+		"webhook.prune":        "@hourly",
+	})
+
+	v.SetDefault("metrics.enabled", false)
+	v.SetDefault("metrics.token", "")
 }
 
 func validateConfig(cfg *Config) error {
+	if cfg.JWT.Secret == placeholderSecret {
+		return fmt.Errorf("Error: jwt.secret is not set")
+	}
 	if len(cfg.JWT.Secret) < 32 {
 		return fmt.Errorf("Error: jwt.secret must be greater than 32 fugures")
 	}
-	if len(cfg.FileCrypto.Key) < 32 {
-		return fmt.Errorf("Error: file_crypto.key must be greater than 32 fugures")
+	if err := validateFileCryptoKey(&cfg.FileCrypto); err != nil {
+		return err
 	}
-	rawKey, err := base64.RawURLEncoding.DecodeString(cfg.FileCrypto.Key)
-	if err != nil || len(rawKey) < 32 {
-		return fmt.Errorf("Error: file_crypto.key must be a valid base64 string of at least 32 bytes")
+	if cfg.FileCrypto.RecoveryPublicKey != "" {
+		if _, err := sfbcrypt.ParseRecoveryPublicKey(cfg.FileCrypto.RecoveryPublicKey); err != nil {
+			return fmt.Errorf("Error: file_crypto.recovery_public_key must be an X25519 public key from sfbctl recovery keygen")
+		}
 	}
 	if cfg.Database.Name == "" {
 		return fmt.Errorf("Error: database.name can't be empty")
 	}
+	cfg.Database.Driver = strings.ToLower(cfg.Database.Driver)
+	switch cfg.Database.Driver {
+	case "mysql":
+		if cfg.Database.Port == 0 {
+			cfg.Database.Port = 3306
+		}
+	case "postgres":
+		if cfg.Database.Port == 0 {
+			cfg.Database.Port = 5432
+		}
+	case "sqlite":
+		if cfg.Database.Path == "" {
+			cfg.Database.Path = cfg.Database.Name + ".db"
+		}
+	default:
+		return fmt.Errorf("Error: database.driver must be mysql, postgres or sqlite")
+	}
+	if cfg.Database.Port < 0 || cfg.Database.Port > 65535 {
+		return fmt.Errorf("Error: database.port must be between 1 and 65535")
+	}
+	if cfg.Scanner.Action != "reject" && cfg.Scanner.Action != "quarantine" {
+		return fmt.Errorf("Error: scanner.action must be reject or quarantine")
+	}
+	if cfg.Storage.UserQuota < 0 {
+		return fmt.Errorf("Error: storage.user_quota can't be negative")
+	}
+	if cfg.Storage.ScrubRate < 0 {
+		return fmt.Errorf("Error: storage.scrub_rate can't be negative")
+	}
+	if cfg.Storage.GCGrace < 0 {
+		return fmt.Errorf("Error: storage.gc_grace can't be negative")
+	}
+	cfg.Storage.Dedup = strings.ToLower(cfg.Storage.Dedup)
+	if cfg.Storage.Dedup != "off" && cfg.Storage.Dedup != "user" && cfg.Storage.Dedup != "tenant" {
+		return fmt.Errorf("Error: storage.dedup must be off, user or tenant")
+	}
+	if cfg.SFTP.Enabled && (cfg.SFTP.Port <= 0 || cfg.SFTP.Port > 65535) {
+		return fmt.Errorf("Error: sftp.port must be between 1 and 65535")
+	}
+	if cfg.S3.Enabled && (cfg.S3.Port <= 0 || cfg.S3.Port > 65535) {
+		return fmt.Errorf("Error: s3.port must be between 1 and 65535")
+	}
+	if cfg.Jobs.Workers < 1 {
+		return fmt.Errorf("Error: jobs.workers must be at least 1")
+	}
+	if cfg.Jobs.PollInterval <= 0 || cfg.Jobs.Lease <= 0 {
+		return fmt.Errorf("Error: jobs.poll_interval and jobs.lease must be positive")
+	}
+	if cfg.Jobs.MaxAttempts < 1 {
+		return fmt.Errorf("Error: jobs.max_attempts must be at least 1")
+	}
+	return nil
+}
+
+// validateFileCryptoKey 检查明文的 file_crypto.key；使用密钥文件时 Key 要留空，由 UnlockMasterKey 填入
+func validateFileCryptoKey(fc *FileCryptoConfig) error {
+	if fc.KeyFile != "" {
+		if fc.Key != "" && fc.Key != placeholderSecret {
+			return fmt.Errorf("Error: set either file_crypto.key or file_crypto.key_file, not both")
+		}
+		fc.Key = ""
+		return nil
+	}
+	if fc.Key == placeholderSecret {
+		return fmt.Errorf("Error: file_crypto.key is not set")
+	}
+	if len(fc.Key) < 32 {
+		return fmt.Errorf("Error: file_crypto.key must be greater than 32 fugures")
+	}
+	rawKey, err := base64.RawURLEncoding.DecodeString(fc.Key)
+	if err != nil || len(rawKey) < 32 {
+		return fmt.Errorf("Error: file_crypto.key must be a valid base64 string of at least 32 bytes")
+	}
 	return nil
 }
 
@@ -175,7 +453,7 @@ func GenerateJWTSecret(nBytes int) (string, error) {
 // EnsureJWTSecret 检查 viper 中的 jwt.secret，若缺失或强度不足则生成并写回配置文件。
 func EnsureJWTSecret(v *viper.Viper) error {
 	cur := v.GetString("jwt.secret")
-	if len(cur) >= 32 && cur != "PLEASE_CHANGE_ME_32_CHARS_MINIMUM" {
+	if len(cur) >= 32 && cur != placeholderSecret {
 		return nil
 	}
 
@@ -194,9 +472,14 @@ func EnsureJWTSecret(v *viper.Viper) error {
 }
 
 // EnsureFileCryptoKey 检查 viper 中的 file_crypto.key，若缺失或强度不足则生成并写回配置文件。
+// 配置了 file_crypto.key_file 或者在生产环境时不生成：前者由 UnlockMasterKey 解开密钥文件，
+// 后者不允许把主密钥以明文写进 config.yaml
 func EnsureFileCryptoKey(v *viper.Viper) error {
+	if v.GetString("file_crypto.key_file") != "" || strings.EqualFold(v.GetString("server.env"), EnvProduction) {
+		return nil
+	}
 	cur := v.GetString("file_crypto.key")
-	if len(cur) >= 32 && cur != "PLEASE_CHANGE_ME_32_CHARS_MINIMUM" {
+	if len(cur) >= 32 && cur != placeholderSecret {
 		return nil
 	}
 
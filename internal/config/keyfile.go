@@ -0,0 +1,188 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+	"golang.org/x/term"
+)
+
+// KeyPassphraseEnv 是主密钥文件口令的环境变量，读取后立即从进程环境中删除
+const KeyPassphraseEnv = "SFB_KEY_PASSPHRASE"
+
+// maxPassphrase 限制从文件描述符读取的长度
+const maxPassphrase = 4096
+
+// KeySharesEnv 是离线工具使用的主密钥份额，以空白分隔，读取后同样立即删除
+const KeySharesEnv = "SFB_KEY_SHARES"
+
+var (
+	ErrNoKeyPassphrase = errors.New("master key file is locked: set " + KeyPassphraseEnv + ", pass the passphrase on a file descriptor, or run on a terminal")
+	ErrNoKeyShares     = errors.New("master key is split into key shares: set " + KeySharesEnv + " or run on a terminal")
+)
+
+// UnlockMasterKey 在配置了 file_crypto.key_file 时解开主密钥，填入 cfg.FileCrypto.Key，
+// 之后各个服务照常使用 cfg.FileCrypto.Key；主密钥只在内存中。没有配置密钥文件时什么都不做。
+// 口令依次取自文件描述符 passphraseFD（小于 0 表示不用）、环境变量 SFB_KEY_PASSPHRASE 和终端提示；
+// 按份额拆分的密钥文件（sfbctl key split）改为读取 SFB_KEY_SHARES 或在终端上逐份输入
+func UnlockMasterKey(cfg *Config, passphraseFD int) error {
+	if cfg.FileCrypto.KeyFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.FileCrypto.KeyFile)
+	if err != nil {
+		return fmt.Errorf("reading file_crypto.key_file: %w", err)
+	}
+	sharing, err := sfbcrypt.MasterKeySharing(data)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", cfg.FileCrypto.KeyFile, err)
+	}
+	var master []byte
+	if sharing != nil {
+		shares, err := readKeyShares(sharing.Threshold)
+		if err != nil {
+			return err
+		}
+		master, err = sfbcrypt.OpenMasterKeyShares(data, shares)
+		for _, s := range shares {
+			s.Wipe()
+		}
+		if err != nil {
+			return fmt.Errorf("unlocking %s: %w", cfg.FileCrypto.KeyFile, err)
+		}
+	} else {
+		passphrase, err := ReadKeyPassphrase(passphraseFD, "Master key passphrase: ", false)
+		if err != nil {
+			return err
+		}
+		master, err = sfbcrypt.OpenMasterKey(passphrase, data)
+		if err != nil {
+			return fmt.Errorf("unlocking %s: %w", cfg.FileCrypto.KeyFile, err)
+		}
+	}
+	cfg.FileCrypto.Key = base64.RawURLEncoding.EncodeToString(master)
+	clear(master)
+	fmt.Fprintln(Progress, "✓ Unlocking master key done")
+	return nil
+}
+
+// ReadSharedKeyFile 在 file_crypto.key_file 是按份额拆分的密钥文件时返回文件内容，否则返回 nil。
+// 服务器用它决定以封存状态启动，而不是在启动时解开主密钥
+func ReadSharedKeyFile(cfg *Config) ([]byte, error) {
+	if cfg.FileCrypto.KeyFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.FileCrypto.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading file_crypto.key_file: %w", err)
+	}
+	sharing, err := sfbcrypt.MasterKeySharing(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", cfg.FileCrypto.KeyFile, err)
+	}
+	if sharing == nil {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// readKeyShares 取 threshold 份份额：先看 SFB_KEY_SHARES，再在终端上逐份输入，不回显
+func readKeyShares(threshold int) ([]*sfbcrypt.KeyShare, error) {
+	var texts []string
+	if v, ok := os.LookupEnv(KeySharesEnv); ok {
+		_ = os.Unsetenv(KeySharesEnv)
+		texts = strings.Fields(v)
+	} else {
+		fd := int(os.Stdin.Fd())
+		if !term.IsTerminal(fd) {
+			return nil, ErrNoKeyShares
+		}
+		for i := 1; i <= threshold; i++ {
+			fmt.Fprintf(os.Stderr, "Key share %d/%d: ", i, threshold)
+			b, err := term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return nil, err
+			}
+			texts = append(texts, string(b))
+		}
+	}
+	if len(texts) < threshold {
+		return nil, fmt.Errorf("need %d key shares, got %d", threshold, len(texts))
+	}
+	shares := make([]*sfbcrypt.KeyShare, 0, len(texts))
+	for i, t := range texts {
+		share, err := sfbcrypt.ParseKeyShare(t)
+		if err != nil {
+			return nil, fmt.Errorf("key share %d: %w", i+1, err)
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// ReadKeyPassphrase 按 UnlockMasterKey 的顺序读取口令；confirm 只对终端提示生效，要求输入两次
+func ReadKeyPassphrase(fd int, prompt string, confirm bool) ([]byte, error) {
+	if fd >= 0 {
+		f := os.NewFile(uintptr(fd), "passphrase")
+		if f == nil {
+			return nil, fmt.Errorf("invalid passphrase file descriptor %d", fd)
+		}
+		defer f.Close()
+		b, err := io.ReadAll(io.LimitReader(f, maxPassphrase))
+		if err != nil {
+			return nil, err
+		}
+		return firstLine(b)
+	}
+	if p, ok := os.LookupEnv(KeyPassphraseEnv); ok {
+		// 读取后删除，子进程不会继承
+		_ = os.Unsetenv(KeyPassphraseEnv)
+		return firstLine([]byte(p))
+	}
+	return PromptPassphrase(prompt, confirm)
+}
+
+// PromptPassphrase 在终端上读取口令，不回显；标准输入不是终端时返回 ErrNoKeyPassphrase
+func PromptPassphrase(prompt string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, ErrNoKeyPassphrase
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(p, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return p, nil
+}
+
+func firstLine(b []byte) ([]byte, error) {
+	line, _, _ := bytes.Cut(b, []byte("\n"))
+	line = bytes.TrimRight(line, "\r")
+	if len(line) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return line, nil
+}
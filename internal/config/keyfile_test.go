@@ -0,0 +1,47 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+func TestUnlockMasterKey(t *testing.T) {
+	master := make([]byte, 32)
+	master[0] = 1
+	data, err := sfbcrypt.SealMasterKey([]byte("correct horse battery"), master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	if err := os.WriteFile(keyFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{FileCrypto: FileCryptoConfig{KeyFile: keyFile}}
+	t.Setenv(KeyPassphraseEnv, "correct horse battery")
+	if err := UnlockMasterKey(cfg, -1); err != nil {
+		t.Fatalf("UnlockMasterKey: %v", err)
+	}
+	if got, err := sfbcrypt.ParseMasterKey(cfg.FileCrypto.Key); err != nil || got[0] != 1 {
+		t.Fatalf("file_crypto.key = %q, %v", cfg.FileCrypto.Key, err)
+	}
+	if _, ok := os.LookupEnv(KeyPassphraseEnv); ok {
+		t.Fatalf("%s is still set after unlocking", KeyPassphraseEnv)
+	}
+
+	// 命令在输出时自己加 "Error: "，返回的错误不能再带这个前缀
+	t.Setenv(KeyPassphraseEnv, "wrong passphrase")
+	err = UnlockMasterKey(&Config{FileCrypto: FileCryptoConfig{KeyFile: keyFile}}, -1)
+	if err == nil || strings.HasPrefix(err.Error(), "Error") || !strings.Contains(err.Error(), keyFile) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	err = UnlockMasterKey(&Config{FileCrypto: FileCryptoConfig{KeyFile: keyFile + ".missing"}}, -1)
+	if !errors.Is(err, os.ErrNotExist) || strings.HasPrefix(err.Error(), "Error") {
+		t.Fatalf("missing key file: %v", err)
+	}
+}
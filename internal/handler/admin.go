@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type AdminHandler struct {
+	userSrv    *service.UserService
+	fileSrv    *service.FileService
+	auditSrv   *service.AuditService
+	webhookSrv *service.WebhookService
+}
+
+func NewAdminHandler(us *service.UserService, fs *service.FileService, as *service.AuditService, ws *service.WebhookService) *AdminHandler {
+	fmt.Fprintln(config.Progress, "✓ Creating a new admin handler done")
+	return &AdminHandler{
+		userSrv:    us,
+		fileSrv:    fs,
+		auditSrv:   as,
+		webhookSrv: ws,
+	}
+}
+
+// ListUsers 分页列出用户，支持 ?q= 按邮箱/用户名搜索
+func (ah *AdminHandler) ListUsers(c *gin.Context) {
+	page, size := pkg.GetPageParams(c)
+	total, users, err := ah.userSrv.ListUsers(page, size, c.Query("q"))
+	if err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(c, gin.H{"total": total, "items": users})
+}
+
+func (ah *AdminHandler) GetUser(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	u, err := ah.userSrv.GetByID(id)
+	if err != nil {
+		pkg.JSONError(c, 404, "cannot find user")
+		return
+	}
+	pkg.JSONOK(c, u)
+}
+
+func (ah *AdminHandler) DisableUser(c *gin.Context) {
+	ah.setDisabled(c, true)
+}
+
+func (ah *AdminHandler) EnableUser(c *gin.Context) {
+	ah.setDisabled(c, false)
+}
+
+func (ah *AdminHandler) setDisabled(c *gin.Context, disabled bool) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	u, err := ah.userSrv.SetDisabled(currentUserID(c), id, disabled)
+	recordAudit(ah.auditSrv, c, currentUserID(c), model.AuditAdminUser, "user", id, err)
+	if err != nil {
+		adminUserError(c, err)
+		return
+	}
+	if disabled {
+		ah.webhookSrv.EmitUser(model.EventUserDisabled, id)
+	} else {
+		ah.webhookSrv.EmitUser(model.EventUserEnabled, id)
+	}
+	pkg.JSONOK(c, u)
+}
+
+type SetRoleReq struct {
+	Role string `json:"role" binding:"required"`
+}
+
+func (ah *AdminHandler) SetRole(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	var req SetRoleReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		pkg.JSONError(c, 40001, "invalid params")
+		return
+	}
+	u, err := ah.userSrv.SetRole(currentUserID(c), id, req.Role)
+	recordAudit(ah.auditSrv, c, currentUserID(c), model.AuditAdminUser, "user", id, err)
+	if err != nil {
+		adminUserError(c, err)
+		return
+	}
+	ah.webhookSrv.EmitUser(model.EventUserRoleChanged, id)
+	pkg.JSONOK(c, u)
+}
+
+// ResetPassword 生成临时密码，用户用它登录后必须先修改密码。
+// 用户有用户密钥时返回 409，除非带 ?discard_key=true 明确丢弃它（用它加密的文件随之无法读取）
+func (ah *AdminHandler) ResetPassword(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	tempPassword, err := ah.userSrv.ResetPassword(id, c.Query("discard_key") == "true")
+	recordAudit(ah.auditSrv, c, currentUserID(c), model.AuditAdminReset, "user", id, err)
+	if err != nil {
+		adminUserError(c, err)
+		return
+	}
+	ah.webhookSrv.EmitUser(model.EventUserPasswordReset, id)
+	c.Header("Cache-Control", "no-store")
+	pkg.JSONOK(c, gin.H{
+		"user_id":            id,
+		"temporary_password": tempPassword,
+	})
+}
+
+// DeleteUser 删除用户；文件、头像和密钥由后台任务清理
+func (ah *AdminHandler) DeleteUser(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	err := ah.userSrv.DeleteUserByID(currentUserID(c), id)
+	recordAudit(ah.auditSrv, c, currentUserID(c), model.AuditAdminDelete, "user", id, err)
+	if err != nil {
+		adminUserError(c, err)
+		return
+	}
+	pkg.JSONOK(c, gin.H{"id": id})
+}
+
+func (ah *AdminHandler) GetUserStorage(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	if _, err := ah.userSrv.GetByID(id); err != nil {
+		pkg.JSONError(c, 404, "cannot find user")
+		return
+	}
+	count, bytes, err := ah.fileSrv.UserStorageUsage(id)
+	if err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(c, gin.H{
+		"user_id":    id,
+		"file_count": count,
+		"bytes":      bytes,
+		"quota":      ah.fileSrv.UserQuota(),
+	})
+}
+
+// StorageHealth 返回最近一次巡检的统计和有问题的密文，?status= 和 ?kind= 可以改变过滤条件
+func (ah *AdminHandler) StorageHealth(c *gin.Context) {
+	summary, err := ah.fileSrv.ScrubSummary()
+	if err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	page, size := pkg.GetPageParams(c)
+	total, items, err := ah.fileSrv.ListScrubResults(c.Query("status"), c.Query("kind"), page, size)
+	if err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(c, gin.H{"summary": summary, "total": total, "items": items})
+}
+
+func userIDParam(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		pkg.JSONError(c, 40001, "invalid user id")
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func currentUserID(c *gin.Context) uint {
+	uidv, _ := c.Get("user_id")
+	uid, _ := uidv.(uint)
+	return uid
+}
+
+func adminUserError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		pkg.JSONError(c, 404, "cannot find user")
+	case errors.Is(err, service.ErrInvalidRole), errors.Is(err, service.ErrAdminSelfLock):
+		pkg.JSONError(c, 40001, err.Error())
+	case errors.Is(err, service.ErrUserKeyReset):
+		pkg.JSONError(c, 409, err.Error())
+	default:
+		pkg.JSONError(c, 50001, err.Error())
+	}
+}
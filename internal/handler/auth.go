@@ -1,25 +1,32 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/Kaikai20040827/graduation/internal/config"
 	"github.com/Kaikai20040827/graduation/internal/middleware"
+	"github.com/Kaikai20040827/graduation/internal/model"
 	"github.com/Kaikai20040827/graduation/internal/pkg"
 	"github.com/Kaikai20040827/graduation/internal/service"
 	"github.com/gin-gonic/gin"
 )
 
 type AuthHandler struct {
-	userSrv *service.UserService
-	jwtCfg  *config.JWTConfig
+	userSrv    *service.UserService
+	auditSrv   *service.AuditService
+	webhookSrv *service.WebhookService
+	jwtCfg     *config.JWTConfig
 }
 
-func NewAuthHandler(usersrv *service.UserService, jwtcfg *config.JWTConfig) *AuthHandler {
-	fmt.Println("✓ Creating a new authorization handler done")
+func NewAuthHandler(usersrv *service.UserService, auditsrv *service.AuditService, webhooksrv *service.WebhookService, jwtcfg *config.JWTConfig) *AuthHandler {
+	fmt.Fprintln(config.Progress, "✓ Creating a new authorization handler done")
 	return &AuthHandler{
-		userSrv: usersrv,
-		jwtCfg:  jwtcfg,
+		userSrv:    usersrv,
+		auditSrv:   auditsrv,
+		webhookSrv: webhooksrv,
+		jwtCfg:     jwtcfg,
 	}
 }
 
@@ -38,10 +45,13 @@ func (h *AuthHandler) Register(context *gin.Context) {
 	}
 	user, err := h.userSrv.CreateUser(req.Username, req.Email, req.Password)
 	if err != nil {
+		recordAudit(h.auditSrv, context, 0, model.AuditAuthRegister, "user", 0, err)
 		pkg.JSONError(context, 40002, "failed to create user")
 		context.Abort()
 		return
 	}
+	recordAudit(h.auditSrv, context, user.ID, model.AuditAuthRegister, "user", user.ID, nil)
+	h.webhookSrv.EmitUser(model.EventUserRegistered, user.ID)
 	pkg.JSONOK(context, user)
 }
 
@@ -57,12 +67,19 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 	u, err := h.userSrv.Authenticate(req.Email, req.Password)
+	if errors.Is(err, service.ErrUserDisabled) {
+		recordAudit(h.auditSrv, c, 0, model.AuditAuthLogin, "user", 0, err)
+		pkg.JSONError(c, 403, "user is disabled")
+		return
+	}
 	if err != nil {
+		recordAudit(h.auditSrv, c, 0, model.AuditAuthLogin, "user", 0, errors.New("invalid credentials"))
 		pkg.JSONError(c, 401, "invalid credentials")
 		return
 	}
+	recordAudit(h.auditSrv, c, u.ID, model.AuditAuthLogin, "user", u.ID, nil)
 	user_id := u.ID
-	token, err := middleware.GenerateToken(h.jwtCfg, uint(user_id))
+	token, expiresAt, err := middleware.GenerateToken(h.jwtCfg, uint(user_id))
 	if err != nil {
 		pkg.JSONError(c, 500, "token gen failed")
 		return
@@ -70,6 +87,37 @@ func (h *AuthHandler) Login(c *gin.Context) {
 
 	pkg.JSONOK(c, gin.H{
 		"token":   token,
-		"expires": 0,
+		"expires": expiresUnix(expiresAt),
 		"user":    u})
 }
+
+// Refresh 用尚未过期的 token 换一个新的；中间件已经确认用户仍然有效。
+// 内存中的用户密钥随之延长到新 token 的有效期
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	uid := currentUserID(c)
+	if uid == 0 {
+		pkg.JSONError(c, 401, "unauthorized")
+		return
+	}
+	if err := h.userSrv.ExtendUserKey(uid); err != nil {
+		pkg.JSONError(c, 401, err.Error())
+		return
+	}
+	token, expiresAt, err := middleware.GenerateToken(h.jwtCfg, uid)
+	if err != nil {
+		pkg.JSONError(c, 500, "token gen failed")
+		return
+	}
+	pkg.JSONOK(c, gin.H{
+		"token":   token,
+		"expires": expiresUnix(expiresAt),
+	})
+}
+
+// expiresUnix 返回过期时间的 Unix 秒；永不过期时为 0
+func expiresUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
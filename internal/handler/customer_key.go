@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"github.com/Kaikai20040827/graduation/internal/middleware"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+// CustomerKeyHeader 携带客户提供的密钥：标准 base64 编码的 32 字节
+const CustomerKeyHeader = "X-SFB-Customer-Key"
+
+// customerKey 读取请求中的客户密钥，没有时返回 nil。密钥只能经 HTTPS 传输：直接的 TLS 连接，
+// 或者 server.trusted_proxies 中的反向代理设置了 X-Forwarded-Proto: https。读取后立即从请求中删除，
+// gin 的 panic 恢复等打印请求头的地方就不会把它写进日志。出错时已经写好错误响应，返回 false
+func customerKey(c *gin.Context) (*service.CustomerKey, bool) {
+	value := c.GetHeader(CustomerKeyHeader)
+	if value == "" {
+		return nil, true
+	}
+	c.Request.Header.Del(CustomerKeyHeader)
+	if !middleware.IsHTTPS(c) {
+		pkg.JSONError(c, 40001, "customer-provided keys are only accepted over HTTPS")
+		return nil, false
+	}
+	ck, err := service.ParseCustomerKey(value)
+	if err != nil {
+		pkg.JSONError(c, 40001, err.Error())
+		return nil, false
+	}
+	return ck, true
+}
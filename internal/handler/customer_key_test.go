@@ -0,0 +1,56 @@
+package handler_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/handler"
+	"github.com/Kaikai20040827/graduation/internal/testserver"
+)
+
+// 客户密钥只接受 HTTPS；X-Forwarded-Proto 只在直接对端是 server.trusted_proxies 中的代理时才被采信
+func TestCustomerKeyRequiresHTTPS(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	upload := func(srv *testserver.Server, token string, forwardedProto string) int {
+		body, ct := multipartFile(t, "ck.txt", "customer keyed")
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/files/upload", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", ct)
+		req.Header.Set(handler.CustomerKeyHeader, key)
+		if forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", forwardedProto)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	srv := testserver.New(t, testserver.Options{})
+	srv.CreateUser(t, "alice", "alice@example.com", "Passw0rd!alice")
+	token := login(t, srv, "alice@example.com", "Passw0rd!alice")
+	if got := upload(srv, token, ""); got != http.StatusBadRequest {
+		t.Fatalf("plain HTTP: status %d, want 400", got)
+	}
+	// 没有配置受信任的代理时，任何客户端都不能靠这个请求头冒充 HTTPS
+	if got := upload(srv, token, "https"); got != http.StatusBadRequest {
+		t.Fatalf("X-Forwarded-Proto from an untrusted peer: status %d, want 400", got)
+	}
+
+	proxied := testserver.New(t, testserver.Options{TrustedProxies: []string{"127.0.0.0/8"}})
+	proxied.CreateUser(t, "alice", "alice@example.com", "Passw0rd!alice")
+	token = login(t, proxied, "alice@example.com", "Passw0rd!alice")
+	if got := upload(proxied, token, "http"); got != http.StatusBadRequest {
+		t.Fatalf("trusted proxy forwarding plain HTTP: status %d, want 400", got)
+	}
+	if got := upload(proxied, token, "https"); got != http.StatusOK {
+		t.Fatalf("trusted proxy forwarding HTTPS: status %d, want 200", got)
+	}
+}
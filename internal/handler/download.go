@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+// serveFile 输出解密后的文件。支持单段 Range 和 If-Range，客户端可以据此断点续传；
+// 多段 Range 或无法解析的 Range 按规范忽略，返回完整内容。
+// ck 为客户密钥加密的文件的密钥，调用方已经用 EnsureDownloadableWithKey 核对过。
+// 出错时已经写好错误响应，返回的 error 只用于审计。
+func (h *FileHandler) serveFile(c *gin.Context, f *model.File, ck *service.CustomerKey) error {
+	err := h.writeFile(c, f, ck)
+	if err == nil {
+		return nil
+	}
+	if c.Writer.Written() {
+		// 已经开始输出，只能中断；Content-Length 不符会让客户端发现截断
+		_ = c.Error(err)
+		return err
+	}
+	for _, k := range []string{"Content-Length", "Content-Range", "Content-Disposition", "ETag", "Accept-Ranges"} {
+		c.Writer.Header().Del(k)
+	}
+	pkg.JSONError(c, 50002, err.Error())
+	return err
+}
+
+func (h *FileHandler) writeFile(c *gin.Context, f *model.File, ck *service.CustomerKey) error {
+	etag := service.FileETag(f)
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("ETag", etag)
+	c.Header("Content-Disposition", "attachment; filename=\""+f.Filename+"\"")
+
+	start, length, partial, ok := parseRange(c.GetHeader("Range"), f.Size)
+	if ifRange := c.GetHeader("If-Range"); partial && ifRange != "" && ifRange != etag {
+		// 文件在两次请求之间被替换过，从头返回
+		start, length, partial, ok = 0, f.Size, false, true
+	}
+	if !ok {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", f.Size))
+		pkg.JSONError(c, http.StatusRequestedRangeNotSatisfiable, "range not satisfiable")
+		return nil
+	}
+
+	c.Header("Content-Length", strconv.FormatInt(length, 10))
+	if !partial {
+		c.Status(http.StatusOK)
+		return h.fileSrv.DecryptFileWithKey(c.Writer, f, ck)
+	}
+	c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, f.Size))
+	c.Status(http.StatusPartialContent)
+	return h.fileSrv.DecryptFileRangeWithKey(c.Writer, f, ck, start, length)
+}
+
+// parseRange 解析 "bytes=a-b"、"bytes=a-" 和 "bytes=-n"。
+// partial 为 false 表示返回完整内容；ok 为 false 表示范围无法满足（416）。
+func parseRange(header string, size int64) (start, length int64, partial, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, size, false, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, size, false, true
+	}
+	if first == "" {
+		// 最后 n 个字节
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, size, false, true
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, false
+		}
+		n = min(n, size)
+		return size - n, n, true, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, false, true
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, size, false, true
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, false
+	}
+	return start, end - start + 1, true, true
+}
@@ -8,18 +8,58 @@ import (
 	"path/filepath"
 	"strconv"
 
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
 	"github.com/Kaikai20040827/graduation/internal/pkg"
 	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type FileHandler struct {
-	fileSrv *service.FileService
+	fileSrv    *service.FileService
+	auditSrv   *service.AuditService
+	webhookSrv *service.WebhookService
 }
 
-func NewFileHandler(fs *service.FileService) *FileHandler {
-	fmt.Println("✓ Creating a new file handler done")
-	return &FileHandler{fileSrv: fs}
+func NewFileHandler(fs *service.FileService, as *service.AuditService, ws *service.WebhookService) *FileHandler {
+	fmt.Fprintln(config.Progress, "✓ Creating a new file handler done")
+	return &FileHandler{fileSrv: fs, auditSrv: as, webhookSrv: ws}
+}
+
+// emitFileEvent 把文件事件投递给文件所属用户和全局 webhook
+func (h *FileHandler) emitFileEvent(event string, f *model.File) {
+	if h.webhookSrv == nil {
+		return
+	}
+	ownerID, _ := strconv.ParseUint(f.UploaderID, 10, 64)
+	h.webhookSrv.EmitFile(event, uint(ownerID), service.FileEvent{
+		FileID:     f.ID,
+		Filename:   f.Filename,
+		Size:       f.Size,
+		UploaderID: f.UploaderID,
+	})
+}
+
+// recordFileEvent 供 WebDAV 和 SFTP 使用：记录审计，成功时投递对应的 webhook
+func (h *FileHandler) recordFileEvent(ip string, actorID uint, action string, f *model.File, err error) {
+	var id uint
+	if f != nil {
+		id = f.ID
+	}
+	recordAuditIP(h.auditSrv, ip, actorID, action, "file", id, err)
+	if err != nil || f == nil {
+		return
+	}
+	switch action {
+	case model.AuditFileUpload:
+		h.emitFileEvent(model.EventFileUploaded, f)
+	case model.AuditFileUpdate:
+		h.emitFileEvent(model.EventFileUpdated, f)
+	case model.AuditFileDelete:
+		h.emitFileEvent(model.EventFileDeleted, f)
+	}
 }
 
 // 以下代码可能存在漏洞，需要检查
@@ -36,6 +76,10 @@ func (h *FileHandler) UploadFile(c *gin.Context) {
 		return
 	}
 
+	ck, ok := customerKey(c)
+	if !ok {
+		return
+	}
 	fileHeader, err := c.FormFile("file")
 	if err != nil {
 		pkg.JSONError(c, 40001, "file required")
@@ -50,11 +94,19 @@ func (h *FileHandler) UploadFile(c *gin.Context) {
 
 	desc := c.PostForm("description")
 	// save
-	out, err := h.fileSrv.UploadFile(f, filepath.Base(fileHeader.Filename), uid, desc)
+	out, err := h.fileSrv.UploadFileWithKey(f, filepath.Base(fileHeader.Filename), uid, desc, ck)
 	if err != nil {
-		pkg.JSONError(c, 50002, err.Error())
+		recordAudit(h.auditSrv, c, uid, model.AuditFileUpload, "file", 0, err)
+		uploadError(c, err)
+		return
+	}
+	if out.ScanStatus == model.ScanInfected {
+		recordAudit(h.auditSrv, c, uid, model.AuditFileUpload, "file", out.ID, service.ErrFileQuarantined)
+		pkg.JSONError(c, 40003, "file quarantined: malware detected")
 		return
 	}
+	recordAudit(h.auditSrv, c, uid, model.AuditFileUpload, "file", out.ID, nil)
+	h.emitFileEvent(model.EventFileUploaded, out)
 
 	pkg.JSONOK(c, gin.H{
 		"file_id":  out.ID,
@@ -66,6 +118,13 @@ func (h *FileHandler) UploadFile(c *gin.Context) {
 
 // UploadFilePublic allows anonymous/public uploads (no JWT required).
 func (h *FileHandler) UploadFilePublic(c *gin.Context) {
+	// 匿名上传的文件所有登录用户都能读取（CanRead），是公开的内容；用客户密钥加密后
+	// 只有拿到密钥的人能读，与公开矛盾，而且没有上传者可以在之后替换或删除它，所以不接受
+	if c.GetHeader(CustomerKeyHeader) != "" {
+		c.Request.Header.Del(CustomerKeyHeader)
+		pkg.JSONError(c, 40001, "customer-provided keys require a logged-in upload")
+		return
+	}
 	fileHeader, err := c.FormFile("file")
 	if err != nil {
 		pkg.JSONError(c, 40001, "file required")
@@ -82,9 +141,17 @@ func (h *FileHandler) UploadFilePublic(c *gin.Context) {
 	// use uploader id 0 for public uploads
 	out, err := h.fileSrv.UploadFile(f, filepath.Base(fileHeader.Filename), 0, desc)
 	if err != nil {
-		pkg.JSONError(c, 50002, err.Error())
+		recordAudit(h.auditSrv, c, 0, model.AuditFileUpload, "file", 0, err)
+		uploadError(c, err)
 		return
 	}
+	if out.ScanStatus == model.ScanInfected {
+		recordAudit(h.auditSrv, c, 0, model.AuditFileUpload, "file", out.ID, service.ErrFileQuarantined)
+		pkg.JSONError(c, 40003, "file quarantined: malware detected")
+		return
+	}
+	recordAudit(h.auditSrv, c, 0, model.AuditFileUpload, "file", out.ID, nil)
+	h.emitFileEvent(model.EventFileUploaded, out)
 	pkg.JSONOK(c, gin.H{
 		"file_id":  out.ID,
 		"filename": out.Filename,
@@ -101,6 +168,23 @@ func (h *FileHandler) UpdateFile(c *gin.Context) {
 		pkg.JSONError(c, 40001, "invalid file id")
 		return
 	}
+	ck, ok := customerKey(c)
+	if !ok {
+		return
+	}
+	uid := currentUserID(c)
+	existing, err := h.fileSrv.GetFileByID(uint(id))
+	if err != nil {
+		recordAudit(h.auditSrv, c, uid, model.AuditFileUpdate, "file", uint(id), err)
+		pkg.JSONError(c, 404, "file not found")
+		return
+	}
+	// 用户密钥按上传者解密，必须在进入服务之前确认调用者有权修改
+	if !h.fileSrv.CanModify(existing, uid, isAdmin(c)) {
+		recordAudit(h.auditSrv, c, uid, model.AuditFileUpdate, "file", existing.ID, service.ErrFileForbidden)
+		pkg.JSONError(c, 403, service.ErrFileForbidden.Error())
+		return
+	}
 
 	var fileReader io.Reader
 	var fileCloser io.Closer
@@ -136,11 +220,13 @@ func (h *FileHandler) UpdateFile(c *gin.Context) {
 		return
 	}
 
-	out, err := h.fileSrv.UpdateFile(uint(id), fileReader, filenamePtr, descPtr)
+	out, err := h.fileSrv.UpdateFileWithKey(uint(id), fileReader, filenamePtr, descPtr, ck)
+	recordAudit(h.auditSrv, c, uid, model.AuditFileUpdate, "file", uint(id), err)
 	if err != nil {
-		pkg.JSONError(c, 50002, err.Error())
+		uploadError(c, err)
 		return
 	}
+	h.emitFileEvent(model.EventFileUpdated, out)
 
 	pkg.JSONOK(c, gin.H{
 		"file_id":  out.ID,
@@ -153,7 +239,15 @@ func (h *FileHandler) UpdateFile(c *gin.Context) {
 // List
 func (h *FileHandler) ListFiles(c *gin.Context) {
 	page, size := pkg.GetPageParams(c)
-	total, files, err := h.fileSrv.ListFiles(page, size)
+	var total int64
+	var files []model.File
+	var err error
+	if isAdmin(c) {
+		total, files, err = h.fileSrv.ListFiles(page, size)
+	} else {
+		// 普通用户只看到自己能读取的文件：自己上传的和匿名公共上传的
+		total, files, err = h.fileSrv.ListReadableFiles(page, size, currentUserID(c))
+	}
 	if err != nil {
 		pkg.JSONError(c, 50001, err.Error())
 		return
@@ -165,25 +259,112 @@ func (h *FileHandler) ListFiles(c *gin.Context) {
 func (h *FileHandler) DownloadFile(c *gin.Context) {
 	idStr := c.Param("id")
 	id, _ := strconv.Atoi(idStr)
+	ck, ok := customerKey(c)
+	if !ok {
+		return
+	}
+	uid := currentUserID(c)
 	f, err := h.fileSrv.GetFileByID(uint(id))
 	if err != nil {
+		recordAudit(h.auditSrv, c, uid, model.AuditFileDownload, "file", uint(id), err)
 		pkg.JSONError(c, 404, "file not found")
 		return
 	}
-	c.Header("Content-Disposition", "attachment; filename=\""+f.Filename+"\"")
-	if err := h.fileSrv.DecryptToWriter(c.Writer, f.StoragePath); err != nil {
-		pkg.JSONError(c, 50002, err.Error())
+	if !h.fileSrv.CanRead(f, uid, isAdmin(c)) {
+		recordAudit(h.auditSrv, c, uid, model.AuditFileDownload, "file", f.ID, service.ErrFileForbidden)
+		pkg.JSONError(c, 403, service.ErrFileForbidden.Error())
+		return
+	}
+	// 客户密钥缺失或不对时在这里就被拒绝，不会解密出任何明文
+	if err := h.fileSrv.EnsureDownloadableWithKey(f, ck); err != nil {
+		recordAudit(h.auditSrv, c, uid, model.AuditFileDownload, "file", f.ID, err)
+		pkg.JSONError(c, 403, err.Error())
+		return
+	}
+	err = h.serveFile(c, f, ck)
+	recordAudit(h.auditSrv, c, uid, model.AuditFileDownload, "file", f.ID, err)
+}
+
+type ArchiveReq struct {
+	FileIDs []uint `json:"file_ids" binding:"required"`
+	// Password 非空时生成 WinZip AES-256 加密的 zip
+	Password string `json:"password"`
+}
+
+// DownloadArchive 把多个文件即时打包成 zip 流式返回
+func (h *FileHandler) DownloadArchive(c *gin.Context) {
+	var req ArchiveReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		pkg.JSONError(c, 40001, "invalid params")
+		return
+	}
+	uid := currentUserID(c)
+	entries, err := h.fileSrv.PrepareArchive(req.FileIDs, uid, isAdmin(c))
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrFileForbidden), errors.Is(err, service.ErrFileQuarantined),
+			errors.Is(err, service.ErrUserKeyLocked), errors.Is(err, service.ErrCustomerKeyRequired):
+			pkg.JSONError(c, 403, err.Error())
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			pkg.JSONError(c, 404, err.Error())
+		default:
+			pkg.JSONError(c, 40001, err.Error())
+		}
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", "attachment; filename=\"files.zip\"")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	if err := h.fileSrv.WriteArchive(c.Writer, entries, req.Password); err != nil {
+		// 响应头已经发出，只能中断输出；缺少中央目录的 zip 无法被打开
+		_ = c.Error(err)
 		return
 	}
+	for _, entry := range entries {
+		recordAudit(h.auditSrv, c, uid, model.AuditFileDownload, "file", entry.File.ID, nil)
+	}
 }
 
 // Delete
 func (h *FileHandler) DeleteFile(c *gin.Context) {
 	idStr := c.Param("id")
 	id, _ := strconv.Atoi(idStr)
-	if err := h.fileSrv.DeleteFile(uint(id)); err != nil {
+	uid := currentUserID(c)
+	f, err := h.fileSrv.GetFileByID(uint(id))
+	if err == nil && !h.fileSrv.CanModify(f, uid, isAdmin(c)) {
+		err = service.ErrFileForbidden
+	}
+	if err == nil {
+		err = h.fileSrv.DeleteFile(uint(id))
+	}
+	recordAudit(h.auditSrv, c, uid, model.AuditFileDelete, "file", uint(id), err)
+	if errors.Is(err, service.ErrFileForbidden) {
+		pkg.JSONError(c, 403, err.Error())
+		return
+	}
+	if err != nil {
 		pkg.JSONError(c, 50001, err.Error())
 		return
 	}
+	h.emitFileEvent(model.EventFileDeleted, f)
 	c.Status(http.StatusNoContent)
 }
+
+func uploadError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrFileInfected):
+		pkg.JSONError(c, 40003, err.Error())
+	case errors.Is(err, service.ErrScanFailed):
+		pkg.JSONError(c, 50003, service.ErrScanFailed.Error())
+	case errors.Is(err, service.ErrQuotaExceeded):
+		pkg.JSONError(c, 413, err.Error())
+	case errors.Is(err, service.ErrUserKeyLocked):
+		pkg.JSONError(c, 403, err.Error())
+	case errors.Is(err, sfbcrypt.ErrCustomerKey):
+		pkg.JSONError(c, 40001, err.Error())
+	default:
+		pkg.JSONError(c, 50002, err.Error())
+	}
+}
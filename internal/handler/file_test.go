@@ -0,0 +1,198 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/testserver"
+)
+
+func login(t *testing.T, srv *testserver.Server, email, password string) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	resp, err := http.Post(srv.URL+"/api/v1/auth/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || out.Data.Token == "" {
+		t.Fatalf("login %s: status %d, %v", email, resp.StatusCode, err)
+	}
+	return out.Data.Token
+}
+
+func do(t *testing.T, method, url, token string, body io.Reader, contentType string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func multipartFile(t *testing.T, name, content string) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	part, err := w.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(part, content)
+	w.Close()
+	return &buf, w.FormDataContentType()
+}
+
+// 上传者登录后其用户密钥在内存中，其他用户仍不能通过文件 ID 下载、修改或删除它的文件
+func TestFileCrossUserAccessRefused(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{UserKeys: true})
+	srv.CreateUser(t, "alice", "alice@example.com", "Passw0rd!alice")
+	srv.CreateUser(t, "bob", "bob@example.com", "Passw0rd!bob")
+	alice := login(t, srv, "alice@example.com", "Passw0rd!alice")
+	bob := login(t, srv, "bob@example.com", "Passw0rd!bob")
+
+	body, ct := multipartFile(t, "secret.txt", "alice's secret")
+	resp := do(t, http.MethodPost, srv.URL+"/api/v1/files/upload", alice, body, ct)
+	var up struct {
+		Data struct {
+			FileID uint `json:"file_id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&up); err != nil || up.Data.FileID == 0 {
+		t.Fatalf("upload: status %d, %v", resp.StatusCode, err)
+	}
+	fileURL := fmt.Sprintf("%s/api/v1/files/%d", srv.URL, up.Data.FileID)
+	downloadURL := fmt.Sprintf("%s/api/v1/files/download/%d", srv.URL, up.Data.FileID)
+
+	resp = do(t, http.MethodGet, downloadURL, bob, nil, "")
+	if got, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusForbidden || bytes.Contains(got, []byte("secret")) {
+		t.Fatalf("bob download: status %d, body %q", resp.StatusCode, got)
+	}
+	body, ct = multipartFile(t, "secret.txt", "overwritten by bob")
+	if resp := do(t, http.MethodPut, fileURL, bob, body, ct); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bob update: status %d, want 403", resp.StatusCode)
+	}
+	if resp := do(t, http.MethodDelete, fileURL, bob, nil, ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bob delete: status %d, want 403", resp.StatusCode)
+	}
+	// WebDAV 的根目录只列出自己的文件
+	if resp := do(t, http.MethodGet, srv.URL+"/dav/secret.txt", bob, nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("bob webdav get: status %d, want 404", resp.StatusCode)
+	}
+
+	resp = do(t, http.MethodGet, downloadURL, alice, nil, "")
+	if got, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(got) != "alice's secret" {
+		t.Fatalf("alice download: status %d, body %q", resp.StatusCode, got)
+	}
+}
+
+func uploadFile(t *testing.T, url, token, name, content string) uint {
+	t.Helper()
+	body, ct := multipartFile(t, name, content)
+	resp := do(t, http.MethodPost, url, token, body, ct)
+	var up struct {
+		Data struct {
+			FileID uint `json:"file_id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&up); err != nil || up.Data.FileID == 0 {
+		t.Fatalf("upload %s: status %d, %v", name, resp.StatusCode, err)
+	}
+	return up.Data.FileID
+}
+
+func listFilenames(t *testing.T, srv *testserver.Server, token string) map[string]bool {
+	t.Helper()
+	resp := do(t, http.MethodGet, srv.URL+"/api/v1/files?page=1&size=50", token, nil, "")
+	var out struct {
+		Data struct {
+			Total int64 `json:"total"`
+			Items []struct {
+				Filename string `json:"filename"`
+			} `json:"items"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("list: status %d, %v", resp.StatusCode, err)
+	}
+	names := make(map[string]bool)
+	for _, it := range out.Data.Items {
+		names[it.Filename] = true
+	}
+	if int(out.Data.Total) != len(names) {
+		t.Fatalf("list: total %d, %d items", out.Data.Total, len(names))
+	}
+	return names
+}
+
+// 普通用户的文件列表只有自己上传的和匿名公共上传的文件，管理员看到全部
+func TestListFilesOnlyReadable(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{})
+	srv.CreateUser(t, "alice", "alice@example.com", "Passw0rd!alice")
+	srv.CreateUser(t, "bob", "bob@example.com", "Passw0rd!bob")
+	srv.CreateAdmin(t, "admin@example.com", "Passw0rd!admin")
+	alice := login(t, srv, "alice@example.com", "Passw0rd!alice")
+	bob := login(t, srv, "bob@example.com", "Passw0rd!bob")
+	admin := login(t, srv, "admin@example.com", "Passw0rd!admin")
+
+	uploadFile(t, srv.URL+"/api/v1/files/upload", alice, "alice.txt", "alice's")
+	uploadFile(t, srv.URL+"/api/v1/files/upload", bob, "bob.txt", "bob's")
+	uploadFile(t, srv.URL+"/api/v1/files/public/upload", "", "public.txt", "anyone's")
+
+	if got := listFilenames(t, srv, bob); len(got) != 2 || !got["bob.txt"] || !got["public.txt"] {
+		t.Fatalf("bob lists %v, want bob.txt and public.txt", got)
+	}
+	if got := listFilenames(t, srv, alice); len(got) != 2 || !got["alice.txt"] || !got["public.txt"] {
+		t.Fatalf("alice lists %v, want alice.txt and public.txt", got)
+	}
+	if got := listFilenames(t, srv, admin); len(got) != 3 {
+		t.Fatalf("admin lists %v, want all three files", got)
+	}
+}
+
+// 匿名公共上传的文件人人可读，但只有管理员能修改或删除
+func TestPublicUploadReadOnlyForUsers(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{})
+	srv.CreateUser(t, "bob", "bob@example.com", "Passw0rd!bob")
+	srv.CreateAdmin(t, "admin@example.com", "Passw0rd!admin")
+	bob := login(t, srv, "bob@example.com", "Passw0rd!bob")
+	admin := login(t, srv, "admin@example.com", "Passw0rd!admin")
+
+	id := uploadFile(t, srv.URL+"/api/v1/files/public/upload", "", "public.txt", "anyone's")
+	fileURL := fmt.Sprintf("%s/api/v1/files/%d", srv.URL, id)
+	downloadURL := fmt.Sprintf("%s/api/v1/files/download/%d", srv.URL, id)
+
+	resp := do(t, http.MethodGet, downloadURL, bob, nil, "")
+	if got, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(got) != "anyone's" {
+		t.Fatalf("bob download: status %d, body %q", resp.StatusCode, got)
+	}
+	body, ct := multipartFile(t, "public.txt", "overwritten by bob")
+	if resp := do(t, http.MethodPut, fileURL, bob, body, ct); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bob update: status %d, want 403", resp.StatusCode)
+	}
+	if resp := do(t, http.MethodDelete, fileURL, bob, nil, ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bob delete: status %d, want 403", resp.StatusCode)
+	}
+	if resp := do(t, http.MethodDelete, fileURL, admin, nil, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("admin delete: status %d, want 204", resp.StatusCode)
+	}
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JobHandler struct {
+	jobSrv   *service.JobService
+	auditSrv *service.AuditService
+}
+
+func NewJobHandler(js *service.JobService, as *service.AuditService) *JobHandler {
+	fmt.Fprintln(config.Progress, "✓ Creating a new job handler done")
+	return &JobHandler{jobSrv: js, auditSrv: as}
+}
+
+// ListJobs 分页列出后台任务，支持 ?status= 和 ?type= 过滤
+func (jh *JobHandler) ListJobs(c *gin.Context) {
+	page, size := pkg.GetPageParams(c)
+	total, items, err := jh.jobSrv.List(c.Query("status"), c.Query("type"), page, size)
+	if err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(c, gin.H{"total": total, "items": items})
+}
+
+func (jh *JobHandler) GetJob(c *gin.Context) {
+	id, ok := idParam(c, "invalid job id")
+	if !ok {
+		return
+	}
+	job, err := jh.jobSrv.Get(id)
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	pkg.JSONOK(c, job)
+}
+
+// ListJobTypes 列出可以创建的任务类型和定时任务
+func (jh *JobHandler) ListJobTypes(c *gin.Context) {
+	schedules, err := jh.jobSrv.Schedules()
+	if err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(c, gin.H{"types": jh.jobSrv.Types(), "schedules": schedules})
+}
+
+type EnqueueJobReq struct {
+	Type    string          `json:"type" binding:"required"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// EnqueueJob 手动创建一个任务，例如 {"type":"storage.gc","payload":{"min_age":"24h"}}
+func (jh *JobHandler) EnqueueJob(c *gin.Context) {
+	var req EnqueueJobReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		pkg.JSONError(c, 40001, "invalid params")
+		return
+	}
+	var payload any
+	if len(req.Payload) > 0 {
+		payload = req.Payload
+	}
+	job, err := jh.jobSrv.Enqueue(req.Type, payload)
+	var id uint
+	if job != nil {
+		id = job.ID
+	}
+	recordAudit(jh.auditSrv, c, currentUserID(c), model.AuditAdminJob, "job", id, err)
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	pkg.JSONOK(c, job)
+}
+
+func (jh *JobHandler) CancelJob(c *gin.Context) {
+	id, ok := idParam(c, "invalid job id")
+	if !ok {
+		return
+	}
+	job, err := jh.jobSrv.Cancel(id)
+	recordAudit(jh.auditSrv, c, currentUserID(c), model.AuditAdminJob, "job", id, err)
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	pkg.JSONOK(c, job)
+}
+
+// RerunJob 以相同参数创建新任务，返回新任务
+func (jh *JobHandler) RerunJob(c *gin.Context) {
+	id, ok := idParam(c, "invalid job id")
+	if !ok {
+		return
+	}
+	job, err := jh.jobSrv.Rerun(id)
+	recordAudit(jh.auditSrv, c, currentUserID(c), model.AuditAdminJob, "job", id, err)
+	if err != nil {
+		jobError(c, err)
+		return
+	}
+	pkg.JSONOK(c, job)
+}
+
+func jobError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrJobNotFound):
+		pkg.JSONError(c, 404, err.Error())
+	case errors.Is(err, service.ErrJobFinished), errors.Is(err, service.ErrJobActive):
+		pkg.JSONError(c, 409, err.Error())
+	case errors.Is(err, service.ErrUnknownJobType), errors.Is(err, service.ErrInvalidJob):
+		pkg.JSONError(c, 40001, err.Error())
+	default:
+		pkg.JSONError(c, 50001, err.Error())
+	}
+}
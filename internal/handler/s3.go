@@ -0,0 +1,698 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	s3TimeFormat     = "2006-01-02T15:04:05.000Z"
+	s3MaxListKeys    = 1000
+	s3MaxRequestBody = 1 << 20
+)
+
+// S3Handler 实现兼容 S3 的 API（路径风格），桶属于签名所用访问密钥的所有者。
+// 支持 ListBuckets、ListObjects(V2)、PutObject、GetObject（Range）、HeadObject、
+// DeleteObject 和分段上传；其余操作返回 NotImplemented。
+type S3Handler struct {
+	s3Srv  *service.S3Service
+	fileH  *FileHandler
+	region string
+}
+
+func NewS3Handler(s3Srv *service.S3Service, fileH *FileHandler, region string) *S3Handler {
+	fmt.Fprintln(config.Progress, "✓ Creating a new S3 handler done")
+	return &S3Handler{s3Srv: s3Srv, fileH: fileH, region: region}
+}
+
+// s3Error 是 S3 的 XML 错误响应
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string { return e.Code + ": " + e.Message }
+
+var (
+	s3ErrAccessDenied          = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	s3ErrSignatureVersion      = &s3Error{http.StatusBadRequest, "InvalidRequest", "only AWS Signature Version 4 is supported"}
+	s3ErrAuthHeaderMalformed   = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "the authorization header is malformed"}
+	s3ErrAuthQueryMalformed    = &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "the presigned url is malformed"}
+	s3ErrInvalidQueryEscape    = &s3Error{http.StatusBadRequest, "InvalidArgument", "the query string contains an invalid percent-encoding"}
+	s3ErrRequestTimeTooSkewed  = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "the difference between the request time and the server's time is too large"}
+	s3ErrExpiredPresign        = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	s3ErrInvalidAccessKeyID    = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "the access key id does not exist"}
+	s3ErrSignatureMismatch     = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "the request signature does not match"}
+	s3ErrMissingContentSHA256  = &s3Error{http.StatusBadRequest, "InvalidRequest", "missing required header x-amz-content-sha256"}
+	s3ErrInvalidContentSHA256  = &s3Error{http.StatusBadRequest, "InvalidArgument", "x-amz-content-sha256 must be a hex sha256, UNSIGNED-PAYLOAD or a supported streaming mode"}
+	s3ErrContentSHA256Mismatch = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "the provided x-amz-content-sha256 does not match the body"}
+	s3ErrInvalidDigest         = &s3Error{http.StatusBadRequest, "InvalidDigest", "the Content-MD5 is not valid"}
+	s3ErrBadDigest             = &s3Error{http.StatusBadRequest, "BadDigest", "the Content-MD5 does not match the body"}
+	s3ErrIncompleteBody        = &s3Error{http.StatusBadRequest, "IncompleteBody", "the request body is incomplete or malformed"}
+	s3ErrMalformedXML          = &s3Error{http.StatusBadRequest, "MalformedXML", "the XML is not well-formed"}
+	s3ErrInvalidRange          = &s3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "the requested range is not satisfiable"}
+	s3ErrInvalidPartNumber     = &s3Error{http.StatusBadRequest, "InvalidArgument", "partNumber must be an integer between 1 and 10000"}
+	s3ErrQuotaExceeded         = &s3Error{http.StatusForbidden, "QuotaExceeded", service.ErrQuotaExceeded.Error()}
+	s3ErrNotImplemented        = &s3Error{http.StatusNotImplemented, "NotImplemented", "this operation is not supported"}
+	s3ErrMethodNotAllowed      = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "the method is not allowed against this resource"}
+)
+
+func s3InternalError(err error) *s3Error {
+	return &s3Error{http.StatusInternalServerError, "InternalError", err.Error()}
+}
+
+// toS3Error 把服务层错误转换为 S3 错误码
+func toS3Error(err error) *s3Error {
+	var se *s3Error
+	switch {
+	case errors.As(err, &se):
+		return se
+	case errors.Is(err, service.ErrNoSuchBucket):
+		return &s3Error{http.StatusNotFound, "NoSuchBucket", err.Error()}
+	case errors.Is(err, service.ErrNoSuchKey):
+		return &s3Error{http.StatusNotFound, "NoSuchKey", err.Error()}
+	case errors.Is(err, service.ErrNoSuchUpload):
+		return &s3Error{http.StatusNotFound, "NoSuchUpload", err.Error()}
+	case errors.Is(err, service.ErrBucketExists):
+		return &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", err.Error()}
+	case errors.Is(err, service.ErrBucketNotEmpty):
+		return &s3Error{http.StatusConflict, "BucketNotEmpty", err.Error()}
+	case errors.Is(err, service.ErrInvalidBucketName):
+		return &s3Error{http.StatusBadRequest, "InvalidBucketName", err.Error()}
+	case errors.Is(err, service.ErrInvalidObjectKey):
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", err.Error()}
+	case errors.Is(err, service.ErrInvalidPart):
+		return &s3Error{http.StatusBadRequest, "InvalidPart", err.Error()}
+	case errors.Is(err, service.ErrInvalidPartOrder):
+		return &s3Error{http.StatusBadRequest, "InvalidPartOrder", err.Error()}
+	case errors.Is(err, service.ErrEntityTooSmall):
+		return &s3Error{http.StatusBadRequest, "EntityTooSmall", err.Error()}
+	case errors.Is(err, service.ErrQuotaExceeded):
+		return s3ErrQuotaExceeded
+	case errors.Is(err, service.ErrFileInfected), errors.Is(err, service.ErrFileQuarantined),
+		errors.Is(err, service.ErrUserKeyLocked), errors.Is(err, service.ErrFileForbidden):
+		return &s3Error{http.StatusForbidden, "AccessDenied", err.Error()}
+	case errors.Is(err, service.ErrCustomerKeyRequired):
+		return &s3Error{http.StatusBadRequest, "InvalidRequest", err.Error()}
+	case errors.Is(err, service.ErrScanFailed), errors.Is(err, service.ErrSealed):
+		return &s3Error{http.StatusServiceUnavailable, "ServiceUnavailable", err.Error()}
+	default:
+		return s3InternalError(err)
+	}
+}
+
+// 不支持的子资源，例如 ?acl、?tagging；带这些参数的请求返回 NotImplemented
+var s3UnsupportedSubresources = []string{
+	"acl", "analytics", "cors", "delete", "encryption", "inventory", "legal-hold", "lifecycle",
+	"logging", "metrics", "notification", "object-lock", "ownershipControls", "policy",
+	"publicAccessBlock", "replication", "requestPayment", "restore", "retention", "select",
+	"tagging", "torrent", "versioning", "versions", "website",
+}
+
+func (h *S3Handler) Serve(c *gin.Context) {
+	idBytes := make([]byte, 8)
+	_, _ = rand.Read(idBytes)
+	c.Header("x-amz-request-id", strings.ToUpper(hex.EncodeToString(idBytes)))
+
+	// 封存期间访问密钥也无法解密，直接拒绝
+	if h.fileH.fileSrv.Sealed() {
+		h.writeError(c, toS3Error(service.ErrSealed))
+		return
+	}
+
+	auth, serr := h.authenticateS3(c.Request)
+	if serr != nil {
+		h.writeError(c, serr)
+		return
+	}
+	q := c.Request.URL.Query()
+	for _, sub := range s3UnsupportedSubresources {
+		if q.Has(sub) {
+			h.writeError(c, s3ErrNotImplemented)
+			return
+		}
+	}
+	if c.Request.Method == http.MethodPut && c.GetHeader("X-Amz-Copy-Source") != "" {
+		h.writeError(c, s3ErrNotImplemented)
+		return
+	}
+	// 客户提供的密钥只在 REST 接口上支持；忽略 SSE-C 请求头会让客户端误以为对象用自己的密钥加密了
+	if c.GetHeader("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" ||
+		c.GetHeader("X-Amz-Server-Side-Encryption-Customer-Key") != "" {
+		c.Request.Header.Del("X-Amz-Server-Side-Encryption-Customer-Key")
+		h.writeError(c, s3ErrNotImplemented)
+		return
+	}
+
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(c.Request.URL.Path, "/"), "/")
+	uid := auth.user.ID
+	method := c.Request.Method
+	switch {
+	case bucketName == "" && method == http.MethodGet:
+		h.listBuckets(c, auth.user)
+	case bucketName == "":
+		h.writeError(c, s3ErrMethodNotAllowed)
+	case key == "" && method == http.MethodPut:
+		_, err := h.s3Srv.CreateBucket(uid, bucketName)
+		if err != nil {
+			h.writeError(c, toS3Error(err))
+			return
+		}
+		c.Header("Location", "/"+bucketName)
+		c.Status(http.StatusOK)
+	case key == "" && method == http.MethodDelete:
+		if err := h.s3Srv.DeleteBucket(uid, bucketName); err != nil {
+			h.writeError(c, toS3Error(err))
+			return
+		}
+		c.Status(http.StatusNoContent)
+	default:
+		bucket, err := h.s3Srv.GetBucket(uid, bucketName)
+		if err != nil {
+			h.writeError(c, toS3Error(err))
+			return
+		}
+		if key == "" {
+			h.serveBucket(c, bucket)
+		} else {
+			h.serveObject(c, auth, bucket, key)
+		}
+	}
+}
+
+func (h *S3Handler) serveBucket(c *gin.Context, bucket *model.S3Bucket) {
+	q := c.Request.URL.Query()
+	switch c.Request.Method {
+	case http.MethodHead:
+		c.Status(http.StatusOK)
+	case http.MethodGet:
+		switch {
+		case q.Has("location"):
+			h.writeXML(c, http.StatusOK, locationConstraint{Region: h.locationRegion()})
+		case q.Has("uploads"):
+			h.writeError(c, s3ErrNotImplemented)
+		default:
+			h.listObjects(c, bucket)
+		}
+	default:
+		h.writeError(c, s3ErrMethodNotAllowed)
+	}
+}
+
+func (h *S3Handler) serveObject(c *gin.Context, auth *s3Auth, bucket *model.S3Bucket, key string) {
+	q := c.Request.URL.Query()
+	switch c.Request.Method {
+	case http.MethodGet:
+		if q.Has("uploadId") {
+			h.listParts(c, bucket, key)
+			return
+		}
+		h.getObject(c, auth, bucket, key, true)
+	case http.MethodHead:
+		h.getObject(c, auth, bucket, key, false)
+	case http.MethodPut:
+		if q.Has("uploadId") || q.Has("partNumber") {
+			h.uploadPart(c, auth, bucket, key)
+			return
+		}
+		h.putObject(c, auth, bucket, key)
+	case http.MethodDelete:
+		if q.Has("uploadId") {
+			up, err := h.s3Srv.GetUpload(bucket, key, q.Get("uploadId"))
+			if err == nil {
+				err = h.s3Srv.AbortMultipartUpload(up)
+			}
+			if err != nil {
+				h.writeError(c, toS3Error(err))
+				return
+			}
+			c.Status(http.StatusNoContent)
+			return
+		}
+		h.deleteObject(c, auth, bucket, key)
+	case http.MethodPost:
+		switch {
+		case q.Has("uploads"):
+			h.createMultipartUpload(c, bucket, key)
+		case q.Has("uploadId"):
+			h.completeMultipartUpload(c, auth, bucket, key)
+		default:
+			h.writeError(c, s3ErrNotImplemented)
+		}
+	default:
+		h.writeError(c, s3ErrMethodNotAllowed)
+	}
+}
+
+// locationRegion 按 S3 的约定，us-east-1 的 LocationConstraint 为空
+func (h *S3Handler) locationRegion() string {
+	if h.region == "us-east-1" {
+		return ""
+	}
+	return h.region
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type locationConstraint struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Region  string   `xml:",chardata"`
+}
+
+type s3BucketXML struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   s3Owner       `xml:"Owner"`
+	Buckets []s3BucketXML `xml:"Buckets>Bucket"`
+}
+
+func (h *S3Handler) listBuckets(c *gin.Context, user *model.User) {
+	buckets, err := h.s3Srv.ListBuckets(user.ID)
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	res := listAllMyBucketsResult{Owner: s3Owner{ID: strconv.FormatUint(uint64(user.ID), 10), DisplayName: user.Username}}
+	res.Buckets = make([]s3BucketXML, 0, len(buckets))
+	for _, b := range buckets {
+		res.Buckets = append(res.Buckets, s3BucketXML{Name: b.Name, CreationDate: b.CreatedAt.UTC().Format(s3TimeFormat)})
+	}
+	h.writeXML(c, http.StatusOK, res)
+}
+
+type s3ObjectXML struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3PrefixXML struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listBucketResult 同时用于 ListObjects 和 ListObjectsV2，不适用的字段为空时省略
+type listBucketResult struct {
+	XMLName               xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string        `xml:"Name"`
+	Prefix                string        `xml:"Prefix"`
+	Delimiter             string        `xml:"Delimiter,omitempty"`
+	Marker                *string       `xml:"Marker"`
+	NextMarker            string        `xml:"NextMarker,omitempty"`
+	StartAfter            string        `xml:"StartAfter,omitempty"`
+	ContinuationToken     string        `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string        `xml:"NextContinuationToken,omitempty"`
+	KeyCount              *int          `xml:"KeyCount"`
+	MaxKeys               int           `xml:"MaxKeys"`
+	EncodingType          string        `xml:"EncodingType,omitempty"`
+	IsTruncated           bool          `xml:"IsTruncated"`
+	Contents              []s3ObjectXML `xml:"Contents"`
+	CommonPrefixes        []s3PrefixXML `xml:"CommonPrefixes"`
+}
+
+func (h *S3Handler) listObjects(c *gin.Context, bucket *model.S3Bucket) {
+	q := c.Request.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := s3MaxListKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			h.writeError(c, &s3Error{http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer"})
+			return
+		}
+		maxKeys = min(n, s3MaxListKeys)
+	}
+	encode := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" {
+		encode = func(s string) string { return awsURIEncode(s, false) }
+	}
+
+	// 从 marker（V1）或 start-after / continuation-token（V2）之后开始
+	var after string
+	res := listBucketResult{Name: bucket.Name, Prefix: encode(prefix), Delimiter: encode(delimiter), MaxKeys: maxKeys, EncodingType: q.Get("encoding-type")}
+	if v2 {
+		after = q.Get("start-after")
+		res.StartAfter = encode(after)
+		if token := q.Get("continuation-token"); token != "" {
+			raw, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				h.writeError(c, &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid continuation token"})
+				return
+			}
+			after = max(after, string(raw))
+			res.ContinuationToken = token
+		}
+	} else {
+		after = q.Get("marker")
+		marker := encode(after)
+		res.Marker = &marker
+	}
+
+	objects, err := h.s3Srv.ListObjects(bucket)
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	var last string
+	count := 0
+	for _, obj := range objects {
+		if obj.Key <= after || !strings.HasPrefix(obj.Key, prefix) {
+			continue
+		}
+		var commonPrefix string
+		if delimiter != "" {
+			if i := strings.Index(obj.Key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix = obj.Key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		// 上一页以这个公共前缀结束，或它已经在本页中
+		if commonPrefix != "" && (commonPrefix == last || commonPrefix == after) {
+			continue
+		}
+		if count == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+		count++
+		if commonPrefix != "" {
+			last = commonPrefix
+			res.CommonPrefixes = append(res.CommonPrefixes, s3PrefixXML{Prefix: encode(commonPrefix)})
+			continue
+		}
+		last = obj.Key
+		res.Contents = append(res.Contents, s3ObjectXML{
+			Key:          encode(obj.Key),
+			LastModified: obj.File.UpdatedAt.UTC().Format(s3TimeFormat),
+			ETag:         `"` + obj.ETag + `"`,
+			Size:         obj.File.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	if res.IsTruncated {
+		if v2 {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		} else {
+			res.NextMarker = encode(last)
+		}
+	}
+	if v2 {
+		res.KeyCount = &count
+	}
+	h.writeXML(c, http.StatusOK, res)
+}
+
+// getObject 输出对象内容或（HEAD）只输出头部；支持单段 Range
+func (h *S3Handler) getObject(c *gin.Context, auth *s3Auth, bucket *model.S3Bucket, key string, withBody bool) {
+	obj, err := h.s3Srv.HeadObject(bucket, key)
+	if err == nil && !h.fileH.fileSrv.CanRead(obj.File, auth.user.ID, false) {
+		err = service.ErrFileForbidden
+	}
+	if err == nil {
+		err = h.fileH.fileSrv.EnsureDownloadable(obj.File)
+	}
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	size := obj.File.Size
+	start, length, partial, ok := parseRange(c.GetHeader("Range"), size)
+	if !ok {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", size))
+		h.writeError(c, s3ErrInvalidRange)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	q := c.Request.URL.Query()
+	if v := q.Get("response-content-type"); v != "" {
+		contentType = v
+	}
+	if v := q.Get("response-content-disposition"); v != "" {
+		c.Header("Content-Disposition", v)
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("ETag", `"`+obj.ETag+`"`)
+	c.Header("Last-Modified", obj.File.UpdatedAt.UTC().Format(http.TimeFormat))
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("Content-Length", strconv.FormatInt(length, 10))
+	status := http.StatusOK
+	if partial {
+		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		status = http.StatusPartialContent
+	}
+	c.Status(status)
+	if !withBody {
+		return
+	}
+
+	c.Writer.WriteHeaderNow()
+	if partial {
+		err = h.fileH.fileSrv.DecryptFileRange(c.Writer, obj.File, start, length)
+	} else {
+		err = h.fileH.fileSrv.DecryptFile(c.Writer, obj.File)
+	}
+	if err != nil {
+		// 已经开始输出，只能中断；Content-Length 不符会让客户端发现截断
+		_ = c.Error(err)
+	}
+	h.fileH.recordFileEvent(c.ClientIP(), auth.user.ID, model.AuditFileDownload, obj.File, err)
+}
+
+func (h *S3Handler) putObject(c *gin.Context, auth *s3Auth, bucket *model.S3Bucket, key string) {
+	body, serr := auth.payloadReader(c.Request)
+	if serr != nil {
+		h.writeError(c, serr)
+		return
+	}
+	obj, replaced, err := h.s3Srv.PutObject(bucket, key, body)
+	h.recordPut(c, auth, obj, replaced, err)
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	c.Header("ETag", `"`+obj.ETag+`"`)
+	c.Status(http.StatusOK)
+}
+
+// recordPut 记录上传；覆盖已有对象时记为 file.update，与 WebDAV 和 SFTP 一致
+func (h *S3Handler) recordPut(c *gin.Context, auth *s3Auth, obj *service.S3Object, replaced bool, err error) {
+	action := model.AuditFileUpload
+	if replaced {
+		action = model.AuditFileUpdate
+	}
+	var file *model.File
+	if obj != nil {
+		file = obj.File
+	}
+	h.fileH.recordFileEvent(c.ClientIP(), auth.user.ID, action, file, err)
+}
+
+func (h *S3Handler) deleteObject(c *gin.Context, auth *s3Auth, bucket *model.S3Bucket, key string) {
+	file, err := h.s3Srv.DeleteObject(bucket, key)
+	if file != nil || err != nil {
+		h.fileH.recordFileEvent(c.ClientIP(), auth.user.ID, model.AuditFileDelete, file, err)
+	}
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func (h *S3Handler) createMultipartUpload(c *gin.Context, bucket *model.S3Bucket, key string) {
+	up, err := h.s3Srv.CreateMultipartUpload(bucket, key)
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	h.writeXML(c, http.StatusOK, initiateMultipartUploadResult{Bucket: bucket.Name, Key: key, UploadID: up.UploadID})
+}
+
+func (h *S3Handler) uploadPart(c *gin.Context, auth *s3Auth, bucket *model.S3Bucket, key string) {
+	q := c.Request.URL.Query()
+	partNumber, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		h.writeError(c, s3ErrInvalidPartNumber)
+		return
+	}
+	up, err := h.s3Srv.GetUpload(bucket, key, q.Get("uploadId"))
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	body, serr := auth.payloadReader(c.Request)
+	if serr != nil {
+		h.writeError(c, serr)
+		return
+	}
+	part, err := h.s3Srv.UploadPart(up, partNumber, body)
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	c.Header("ETag", `"`+part.ETag+`"`)
+	c.Status(http.StatusOK)
+}
+
+type s3PartXML struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type listPartsResult struct {
+	XMLName     xml.Name    `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket      string      `xml:"Bucket"`
+	Key         string      `xml:"Key"`
+	UploadID    string      `xml:"UploadId"`
+	MaxParts    int         `xml:"MaxParts"`
+	IsTruncated bool        `xml:"IsTruncated"`
+	Parts       []s3PartXML `xml:"Part"`
+}
+
+// listParts 一次返回全部分段（最多 10000 个），不分页
+func (h *S3Handler) listParts(c *gin.Context, bucket *model.S3Bucket, key string) {
+	up, err := h.s3Srv.GetUpload(bucket, key, c.Query("uploadId"))
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	parts, err := h.s3Srv.ListParts(up)
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	res := listPartsResult{Bucket: bucket.Name, Key: key, UploadID: up.UploadID, MaxParts: 10000}
+	res.Parts = make([]s3PartXML, 0, len(parts))
+	for _, p := range parts {
+		res.Parts = append(res.Parts, s3PartXML{
+			PartNumber:   p.PartNumber,
+			LastModified: p.CreatedAt.UTC().Format(s3TimeFormat),
+			ETag:         `"` + p.ETag + `"`,
+			Size:         p.Size,
+		})
+	}
+	h.writeXML(c, http.StatusOK, res)
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func (h *S3Handler) completeMultipartUpload(c *gin.Context, auth *s3Auth, bucket *model.S3Bucket, key string) {
+	up, err := h.s3Srv.GetUpload(bucket, key, c.Query("uploadId"))
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	body, serr := auth.payloadReader(c.Request)
+	if serr != nil {
+		h.writeError(c, serr)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(body, s3MaxRequestBody))
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	var req completeMultipartUpload
+	if err := xml.Unmarshal(data, &req); err != nil {
+		h.writeError(c, s3ErrMalformedXML)
+		return
+	}
+	parts := make([]service.CompletedPart, len(req.Parts))
+	for i, p := range req.Parts {
+		parts[i] = service.CompletedPart{PartNumber: p.PartNumber, ETag: p.ETag}
+	}
+
+	obj, replaced, err := h.s3Srv.CompleteMultipartUpload(bucket, up, parts)
+	h.recordPut(c, auth, obj, replaced, err)
+	if err != nil {
+		h.writeError(c, toS3Error(err))
+		return
+	}
+	h.writeXML(c, http.StatusOK, completeMultipartUploadResult{
+		Location: "/" + bucket.Name + "/" + key,
+		Bucket:   bucket.Name,
+		Key:      key,
+		ETag:     `"` + obj.ETag + `"`,
+	})
+}
+
+func (h *S3Handler) writeXML(c *gin.Context, status int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		h.writeError(c, s3InternalError(err))
+		return
+	}
+	c.Data(status, "application/xml", append([]byte(xml.Header), data...))
+}
+
+type s3ErrorXML struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+func (h *S3Handler) writeError(c *gin.Context, e *s3Error) {
+	if c.Request.Method == http.MethodHead {
+		c.Status(e.Status)
+		return
+	}
+	data, _ := xml.Marshal(s3ErrorXML{
+		Code:      e.Code,
+		Message:   e.Message,
+		Resource:  c.Request.URL.Path,
+		RequestID: c.Writer.Header().Get("x-amz-request-id"),
+	})
+	c.Data(e.Status, "application/xml", append([]byte(xml.Header), data...))
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type CreateS3KeyReq struct {
+	Name string `json:"name"`
+}
+
+// ListS3Keys 列出自己的 S3 访问密钥（不含 secret）
+func (h *S3Handler) ListS3Keys(c *gin.Context) {
+	keys, err := h.s3Srv.ListS3Keys(currentUserID(c))
+	if err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(c, gin.H{"items": keys})
+}
+
+// CreateS3Key 签发一对访问密钥；secret 只在这次响应中返回
+func (h *S3Handler) CreateS3Key(c *gin.Context) {
+	var req CreateS3KeyReq
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			pkg.JSONError(c, 40001, "invalid params")
+			return
+		}
+	}
+	uid := currentUserID(c)
+	key, secret, err := h.s3Srv.CreateS3Key(uid, req.Name)
+	if err != nil {
+		recordAudit(h.fileH.auditSrv, c, uid, model.AuditS3KeyAdd, "s3_key", 0, err)
+		if errors.Is(err, service.ErrS3KeyLimit) {
+			pkg.JSONError(c, 40001, err.Error())
+			return
+		}
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	recordAudit(h.fileH.auditSrv, c, uid, model.AuditS3KeyAdd, "s3_key", key.ID, nil)
+	c.Header("Cache-Control", "no-store")
+	pkg.JSONOK(c, gin.H{
+		"key":               key,
+		"access_key_id":     key.AccessKeyID,
+		"secret_access_key": secret,
+	})
+}
+
+func (h *S3Handler) DeleteS3Key(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		pkg.JSONError(c, 40001, "invalid key id")
+		return
+	}
+	uid := currentUserID(c)
+	err = h.s3Srv.DeleteS3Key(uid, uint(id))
+	recordAudit(h.fileH.auditSrv, c, uid, model.AuditS3KeyDelete, "s3_key", uint(id), err)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		pkg.JSONError(c, 404, "s3 key not found")
+		return
+	}
+	if err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 每个 IP 每分钟最多提交 unsealLimit 次份额，成功和失败的都算
+const (
+	unsealLimit  = 10
+	unsealWindow = time.Minute
+)
+
+type SealHandler struct {
+	sealSrv  *service.SealService
+	auditSrv *service.AuditService
+	limiter  *attemptLimiter
+}
+
+func NewSealHandler(ss *service.SealService, as *service.AuditService) *SealHandler {
+	fmt.Fprintln(config.Progress, "✓ Creating a new seal handler done")
+	return &SealHandler{sealSrv: ss, auditSrv: as, limiter: newAttemptLimiter(unsealLimit, unsealWindow)}
+}
+
+// SealStatus 不需要认证，封存期间也可以访问
+func (sh *SealHandler) SealStatus(c *gin.Context) {
+	pkg.JSONOK(c, sh.sealSrv.Status())
+}
+
+type UnsealReq struct {
+	Share string `json:"share"`
+	// Reset 为 true 时丢弃本轮已提交的份额，以 Share 开始新的一轮；Share 同样必须有效
+	Reset bool `json:"reset"`
+}
+
+// Unseal 不需要认证：份额本身就是凭证，而封存期间也没有人能登录。
+// 封存期间审计密钥不可用，失败的提交只写入日志；解封成功后补记一条审计记录
+func (sh *SealHandler) Unseal(c *gin.Context) {
+	if !sh.limiter.allow(c.ClientIP()) {
+		pkg.JSONError(c, 429, "too many unseal attempts; try again later")
+		return
+	}
+	var req UnsealReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		pkg.JSONError(c, 40001, "invalid params")
+		return
+	}
+	if req.Share == "" {
+		pkg.JSONError(c, 40001, "share is required")
+		return
+	}
+	submit := sh.sealSrv.Unseal
+	if req.Reset {
+		submit = sh.sealSrv.Reset
+	}
+	status, unsealed, err := submit(req.Share)
+	if err != nil {
+		if pkg.Logger != nil {
+			pkg.Logger.Warn("unseal share rejected", zap.String("ip", c.ClientIP()), zap.Bool("reset", req.Reset), zap.Error(err))
+		}
+		switch {
+		case errors.Is(err, sfbcrypt.ErrKeyShareDup):
+			pkg.JSONError(c, 409, err.Error())
+		case errors.Is(err, sfbcrypt.ErrKeyShares):
+			pkg.JSONError(c, 400, err.Error()+"; all shares must be submitted again")
+		default:
+			pkg.JSONError(c, 40001, err.Error())
+		}
+		return
+	}
+	if unsealed {
+		recordAudit(sh.auditSrv, c, 0, model.AuditSystemUnseal, "system", 0, nil)
+	}
+	pkg.JSONOK(c, status)
+}
+
+// Seal 只有管理员可以调用；封存之后审计密钥也被清除，所以先记录再封存
+func (sh *SealHandler) Seal(c *gin.Context) {
+	if !sh.sealSrv.CanSeal() {
+		recordAudit(sh.auditSrv, c, currentUserID(c), model.AuditSystemSeal, "system", 0, service.ErrSealNotSupported)
+		pkg.JSONError(c, 409, service.ErrSealNotSupported.Error())
+		return
+	}
+	if sh.sealSrv.Sealed() {
+		pkg.JSONOK(c, sh.sealSrv.Status())
+		return
+	}
+	recordAudit(sh.auditSrv, c, currentUserID(c), model.AuditSystemSeal, "system", 0, nil)
+	if err := sh.sealSrv.Seal(); err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(c, sh.sealSrv.Status())
+}
+
+// attemptLimiter 按 key 计数，每个固定窗口内最多允许 limit 次；只保存在内存中
+type attemptLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*attemptWindow
+}
+
+type attemptWindow struct {
+	start time.Time
+	n     int
+}
+
+func newAttemptLimiter(limit int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{limit: limit, window: window, entries: make(map[string]*attemptWindow)}
+}
+
+func (l *attemptLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	w := l.entries[key]
+	if w == nil || now.Sub(w.start) >= l.window {
+		// 顺便清掉过期的窗口，map 不会随来访的 IP 无限增长
+		for k, old := range l.entries {
+			if now.Sub(old.start) >= l.window {
+				delete(l.entries, k)
+			}
+		}
+		w = &attemptWindow{start: now}
+		l.entries[key] = w
+	}
+	w.n++
+	return w.n <= l.limit
+}
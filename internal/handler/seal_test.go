@@ -0,0 +1,116 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/testserver"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+// newSealedServer 用 testserver.Key 拆成 n 份、门限 k 的密钥文件启动一个封存的服务器
+func newSealedServer(t *testing.T, n, k int) (*testserver.Server, []string) {
+	t.Helper()
+	master, err := base64.RawURLEncoding.DecodeString(testserver.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, shares, err := sfbcrypt.SplitMasterKey(master, n, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testserver.New(t, testserver.Options{KeyFile: keyFile}), shares
+}
+
+type unsealResult struct {
+	status   int
+	sealed   bool
+	progress int
+}
+
+func unseal(t *testing.T, srv *testserver.Server, req map[string]any) unsealResult {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	resp, err := http.Post(srv.URL+"/api/v1/sys/unseal", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Data struct {
+			Sealed   bool `json:"sealed"`
+			Progress int  `json:"progress"`
+		} `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	return unsealResult{resp.StatusCode, out.Data.Sealed, out.Data.Progress}
+}
+
+func sealProgress(t *testing.T, srv *testserver.Server) int {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/api/v1/sys/seal-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Data struct {
+			Progress int `json:"progress"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Data.Progress
+}
+
+// 不持有份额的人不能清空保管人已经提交的份额
+func TestUnsealResetRequiresShare(t *testing.T) {
+	srv, shares := newSealedServer(t, 3, 3)
+	_, otherShares, err := sfbcrypt.SplitMasterKey(make([]byte, 32), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := unseal(t, srv, map[string]any{"share": shares[0]}); got.status != http.StatusOK || got.progress != 1 {
+		t.Fatalf("first share: %+v", got)
+	}
+	if got := unseal(t, srv, map[string]any{"reset": true}); got.status != http.StatusBadRequest {
+		t.Fatalf("reset without a share: status %d, want 400", got.status)
+	}
+	if got := unseal(t, srv, map[string]any{"reset": true, "share": "sfbs1:junk"}); got.status != http.StatusBadRequest {
+		t.Fatalf("reset with a malformed share: status %d, want 400", got.status)
+	}
+	if got := unseal(t, srv, map[string]any{"reset": true, "share": otherShares[0]}); got.status != http.StatusBadRequest {
+		t.Fatalf("reset with another key file's share: status %d, want 400", got.status)
+	}
+	if got := sealProgress(t, srv); got != 1 {
+		t.Fatalf("progress after refused resets = %d, want 1", got)
+	}
+
+	// 带有效份额的 reset 丢弃旧的一轮，这一份算作新一轮的第一份
+	if got := unseal(t, srv, map[string]any{"reset": true, "share": shares[1]}); got.status != http.StatusOK || got.progress != 1 {
+		t.Fatalf("reset with a valid share: %+v", got)
+	}
+	if got := unseal(t, srv, map[string]any{"share": shares[0]}); got.status != http.StatusOK || got.progress != 2 {
+		t.Fatalf("share after reset: %+v", got)
+	}
+	if got := unseal(t, srv, map[string]any{"share": shares[2]}); got.status != http.StatusOK || got.sealed {
+		t.Fatalf("last share: %+v", got)
+	}
+}
+
+func TestUnsealRateLimited(t *testing.T) {
+	srv, _ := newSealedServer(t, 3, 2)
+	for i := 0; i < 10; i++ {
+		if got := unseal(t, srv, map[string]any{"share": "sfbs1:junk"}); got.status != http.StatusBadRequest {
+			t.Fatalf("attempt %d: status %d, want 400", i+1, got.status)
+		}
+	}
+	if got := unseal(t, srv, map[string]any{"share": "sfbs1:junk"}); got.status != http.StatusTooManyRequests {
+		t.Fatalf("attempt 11: status %d, want 429", got.status)
+	}
+}
@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH 握手（含认证）必须在这段时间内完成
+const sftpHandshakeTimeout = 30 * time.Second
+
+// SFTPServer 是内置的 SFTP 服务。用户名为邮箱，使用账号密码或登记过的 SSH 公钥登录；
+// 每个用户只能看到自己上传的文件，读写都经过 FileService 加解密。
+type SFTPServer struct {
+	addr    string
+	userSrv *service.UserService
+	fileH   *FileHandler
+	sshCfg  *ssh.ServerConfig
+}
+
+// NewSFTPServer 加载主机私钥；hostKeyPath 不存在时生成一把 ed25519 私钥并保存
+func NewSFTPServer(cfg *config.SFTPConfig, hostKeyPath string, userSrv *service.UserService, fileH *FileHandler) (*SFTPServer, error) {
+	hostKey, err := loadHostKey(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	s := &SFTPServer{
+		addr:    net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		userSrv: userSrv,
+		fileH:   fileH,
+	}
+	s.sshCfg = &ssh.ServerConfig{
+		PasswordCallback:  s.checkPassword,
+		PublicKeyCallback: s.checkPublicKey,
+		AuthLogCallback:   s.logAuth,
+		ServerVersion:     "SSH-2.0-SecureFileBox",
+	}
+	s.sshCfg.AddHostKey(hostKey)
+	fmt.Fprintln(config.Progress, "✓ Creating a new SFTP server done")
+	fmt.Fprintf(config.Progress, "✓ SFTP host key fingerprint: %s\n", ssh.FingerprintSHA256(hostKey.PublicKey()))
+	return s, nil
+}
+
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "secure-file-box sftp host key")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("write sftp host key: %w", err)
+		}
+		fmt.Fprintf(config.Progress, "✓ Generated SFTP host key %s\n", path)
+	} else if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse sftp host key %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+func sftpPermissions(u *model.User) (*ssh.Permissions, error) {
+	// 与 REST 接口一致：管理员重置过的密码必须先在网页或 API 中修改
+	if u.MustResetPassword {
+		return nil, errors.New("password reset required")
+	}
+	return &ssh.Permissions{Extensions: map[string]string{"user_id": strconv.FormatUint(uint64(u.ID), 10)}}, nil
+}
+
+func (s *SFTPServer) checkPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if s.fileH.fileSrv.Sealed() {
+		return nil, service.ErrSealed
+	}
+	u, err := s.userSrv.Authenticate(conn.User(), string(password))
+	if err != nil {
+		return nil, err
+	}
+	return sftpPermissions(u)
+}
+
+// checkPublicKey 要求用户名与公钥所有者的邮箱一致
+func (s *SFTPServer) checkPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if s.fileH.fileSrv.Sealed() {
+		return nil, service.ErrSealed
+	}
+	u, err := s.userSrv.AuthenticateSSHKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(u.Email, conn.User()) {
+		return nil, errors.New("public key does not belong to this user")
+	}
+	return sftpPermissions(u)
+}
+
+// logAuth 只记录失败的密码登录；客户端会先逐个试探公钥，这些失败不是攻击
+func (s *SFTPServer) logAuth(conn ssh.ConnMetadata, method string, err error) {
+	if err == nil || method != "password" {
+		return
+	}
+	var actorID uint
+	if u, uerr := s.userSrv.GetByEmail(conn.User()); uerr == nil {
+		actorID = u.ID
+	}
+	recordAuditIP(s.fileH.auditSrv, remoteIP(conn.RemoteAddr()), actorID, model.AuditAuthLogin, "user", actorID, err)
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// ListenAndServe 在 ctx 结束前一直接受连接
+func (s *SFTPServer) ListenAndServe(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	log.Println("sftp server running at", s.addr)
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *SFTPServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(sftpHandshakeTimeout))
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.sshCfg)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	_ = conn.SetDeadline(time.Time{})
+	go ssh.DiscardRequests(reqs)
+
+	ip := remoteIP(conn.RemoteAddr())
+	id, _ := strconv.ParseUint(sconn.Permissions.Extensions["user_id"], 10, 64)
+	uid := uint(id)
+	recordAuditIP(s.fileH.auditSrv, ip, uid, model.AuditAuthLogin, "user", uid, nil)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveSession(channel, requests, uid, ip)
+	}
+}
+
+// serveSession 只接受 sftp 子系统，拒绝 shell、exec 和端口转发
+func (s *SFTPServer) serveSession(channel ssh.Channel, requests <-chan *ssh.Request, uid uint, ip string) {
+	defer channel.Close()
+	started := false
+	for req := range requests {
+		ok := !started && req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		_ = req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		started = true
+		go func() {
+			defer channel.Close()
+			// 连接期间用户被禁用或删除后，新会话不再可用
+			if _, err := s.userSrv.CheckActive(uid); err != nil {
+				return
+			}
+			fs := service.NewSFTPFS(s.fileH.fileSrv, uid)
+			fs.OnEvent = func(action string, f *model.File, err error) {
+				s.fileH.recordFileEvent(ip, uid, action, f, err)
+			}
+			server := sftp.NewRequestServer(channel, fs.Handlers())
+			if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+				log.Printf("sftp session for user %d ended: %v", uid, err)
+			}
+			_ = server.Close()
+		}()
+	}
+}
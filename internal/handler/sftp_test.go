@@ -0,0 +1,219 @@
+package handler_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/handler"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/Kaikai20040827/graduation/internal/testserver"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSFTP 在一个空闲端口上启动 SFTP 服务，与 srv 共用数据库和存储
+func startSFTP(t *testing.T, srv *testserver.Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	webhooks := service.NewWebhookService(srv.DB, config.WebhookConfig{MaxAttempts: 1}, srv.Files)
+	fileH := handler.NewFileHandler(srv.Files, srv.Audit, webhooks)
+	cfg := &config.SFTPConfig{Enabled: true, Host: "127.0.0.1", Port: port}
+	s, err := handler.NewSFTPServer(cfg, filepath.Join(t.TempDir(), "host_key"), srv.Users, fileH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sftp server not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func dialSFTP(addr, user string, auth ssh.AuthMethod) (*sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func sftpNames(t *testing.T, client *sftp.Client) string {
+	t.Helper()
+	entries, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name()+":"+strconv.FormatInt(e.Size(), 10))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestSFTPAuth(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{})
+	srv.CreateUser(t, "alice", "alice@example.com", "Passw0rd!alice")
+	bobID := srv.CreateUser(t, "bob", "bob@example.com", "Passw0rd!bob")
+	addr := startSFTP(t, srv)
+
+	if _, err := dialSFTP(addr, "alice@example.com", ssh.Password("wrong")); err == nil {
+		t.Fatal("login with a wrong password succeeded")
+	}
+	client, err := dialSFTP(addr, "alice@example.com", ssh.Password("Passw0rd!alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialSFTP(addr, "bob@example.com", ssh.PublicKeys(signer)); err == nil {
+		t.Fatal("login with an unregistered key succeeded")
+	}
+	if _, err := srv.Users.AddSSHKey(bobID, "laptop", string(ssh.MarshalAuthorizedKey(sshPub))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialSFTP(addr, "alice@example.com", ssh.PublicKeys(signer)); err == nil {
+		t.Fatal("bob's key accepted for alice")
+	}
+	client, err = dialSFTP(addr, "bob@example.com", ssh.PublicKeys(signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	if _, err := srv.Users.SetDisabled(0, bobID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialSFTP(addr, "bob@example.com", ssh.PublicKeys(signer)); err == nil {
+		t.Fatal("disabled user logged in with a key")
+	}
+}
+
+func TestSFTPFiles(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{})
+	srv.CreateUser(t, "alice", "alice@example.com", "Passw0rd!alice")
+	srv.CreateUser(t, "bob", "bob@example.com", "Passw0rd!bob")
+	alice := login(t, srv, "alice@example.com", "Passw0rd!alice")
+	uploadFile(t, srv.URL+"/api/v1/files/upload", alice, "report.txt", "alice's report")
+	addr := startSFTP(t, srv)
+
+	ac, err := dialSFTP(addr, "alice@example.com", ssh.Password("Passw0rd!alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	bc, err := dialSFTP(addr, "bob@example.com", ssh.Password("Passw0rd!bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	// 大于一个 SFTP 数据包，客户端会并发地乱序写入
+	content := strings.Repeat("0123456789abcdef", 20000)
+	w, err := ac.Create("/upload.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ReadFrom(strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sftpNames(t, ac); got != "report.txt:14,upload.bin:"+strconv.Itoa(len(content)) {
+		t.Fatalf("alice's listing: %s", got)
+	}
+	if names := listFilenames(t, srv, alice); !names["upload.bin"] {
+		t.Fatalf("REST listing: %v", names)
+	}
+	r, err := ac.Open("/upload.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(got) != content {
+		t.Fatalf("read back %d bytes, %v", len(got), err)
+	}
+
+	// bob 看不到、读不到、改不了 alice 的文件
+	if got := sftpNames(t, bc); got != "" {
+		t.Fatalf("bob's listing: %s", got)
+	}
+	if _, err := bc.Open("/report.txt"); !os.IsNotExist(err) {
+		t.Fatalf("bob open = %v", err)
+	}
+	if err := bc.Remove("/report.txt"); !os.IsNotExist(err) {
+		t.Fatalf("bob remove = %v", err)
+	}
+	if err := bc.Rename("/report.txt", "/mine.txt"); !os.IsNotExist(err) {
+		t.Fatalf("bob rename = %v", err)
+	}
+
+	if err := ac.Mkdir("/dir"); err == nil {
+		t.Fatal("mkdir succeeded")
+	}
+	if err := ac.Rename("/upload.bin", "/final.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.Remove("/report.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := sftpNames(t, ac); got != "final.bin:"+strconv.Itoa(len(content)) {
+		t.Fatalf("alice's listing after rename and remove: %s", got)
+	}
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+type ShareReq struct {
+	// ExpiresIn 为 Go duration 字符串，例如 "1h"、"72h"；为空时 24 小时
+	ExpiresIn string `json:"expires_in"`
+}
+
+// ShareFile 为自己的文件（管理员可以为任意文件）生成限时下载链接
+func (h *FileHandler) ShareFile(c *gin.Context) {
+	var req ShareReq
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			pkg.JSONError(c, 40001, "invalid params")
+			return
+		}
+	}
+	ttl := service.DefaultShareTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			pkg.JSONError(c, 40001, "invalid expires_in")
+			return
+		}
+		ttl = d
+	}
+
+	uid := currentUserID(c)
+	id, _ := strconv.Atoi(c.Param("id"))
+	f, err := h.fileSrv.GetFileByID(uint(id))
+	if err != nil {
+		recordAudit(h.auditSrv, c, uid, model.AuditFileShare, "file", uint(id), err)
+		pkg.JSONError(c, 404, "file not found")
+		return
+	}
+	if !h.fileSrv.CanRead(f, uid, isAdmin(c)) {
+		recordAudit(h.auditSrv, c, uid, model.AuditFileShare, "file", f.ID, service.ErrFileForbidden)
+		pkg.JSONError(c, 403, service.ErrFileForbidden.Error())
+		return
+	}
+	if err := h.fileSrv.EnsureDownloadable(f); err != nil {
+		recordAudit(h.auditSrv, c, uid, model.AuditFileShare, "file", f.ID, err)
+		pkg.JSONError(c, 403, err.Error())
+		return
+	}
+	token, expiresAt, err := h.fileSrv.ShareToken(f, ttl)
+	recordAudit(h.auditSrv, c, uid, model.AuditFileShare, "file", f.ID, err)
+	if err != nil {
+		if errors.Is(err, service.ErrShareTTL) {
+			pkg.JSONError(c, 40001, err.Error())
+			return
+		}
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(c, gin.H{
+		"url":     "/api/v1/share/" + token,
+		"expires": expiresAt.Unix(),
+	})
+}
+
+// DownloadShared 通过分享链接匿名下载，同样支持 Range
+func (h *FileHandler) DownloadShared(c *gin.Context) {
+	f, err := h.fileSrv.ResolveShareToken(c.Param("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrShareExpired):
+			pkg.JSONError(c, 403, err.Error())
+		case errors.Is(err, service.ErrShareInvalid):
+			pkg.JSONError(c, 404, err.Error())
+		default:
+			// 文件已被删除
+			pkg.JSONError(c, 404, "file not found")
+		}
+		return
+	}
+	if err := h.fileSrv.EnsureDownloadable(f); err != nil {
+		recordAudit(h.auditSrv, c, 0, model.AuditFileDownload, "file", f.ID, err)
+		pkg.JSONError(c, 403, err.Error())
+		return
+	}
+	err = h.serveFile(c, f, nil)
+	recordAudit(h.auditSrv, c, 0, model.AuditFileDownload, "file", f.ID, err)
+}
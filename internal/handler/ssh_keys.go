@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type AddSSHKeyReq struct {
+	Name string `json:"name"`
+	// PublicKey 为 authorized_keys 格式，例如 id_ed25519.pub 的内容
+	PublicKey string `json:"public_key" binding:"required"`
+}
+
+// ListSSHKeys 列出自己用于 SFTP 登录的公钥
+func (uh *UserHandler) ListSSHKeys(context *gin.Context) {
+	keys, err := uh.userSrv.ListSSHKeys(currentUserID(context))
+	if err != nil {
+		pkg.JSONError(context, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(context, gin.H{"items": keys})
+}
+
+func (uh *UserHandler) AddSSHKey(context *gin.Context) {
+	var req AddSSHKeyReq
+	if err := context.ShouldBindJSON(&req); err != nil {
+		pkg.JSONError(context, 40001, "invalid params")
+		return
+	}
+	uid := currentUserID(context)
+	key, err := uh.userSrv.AddSSHKey(uid, req.Name, req.PublicKey)
+	if err != nil {
+		recordAudit(uh.auditSrv, context, uid, model.AuditSSHKeyAdd, "ssh_key", 0, err)
+		switch {
+		case errors.Is(err, service.ErrSSHKeyInvalid), errors.Is(err, service.ErrSSHKeyLimit):
+			pkg.JSONError(context, 40001, err.Error())
+		case errors.Is(err, service.ErrSSHKeyExists):
+			pkg.JSONError(context, 409, err.Error())
+		default:
+			pkg.JSONError(context, 50001, err.Error())
+		}
+		return
+	}
+	recordAudit(uh.auditSrv, context, uid, model.AuditSSHKeyAdd, "ssh_key", key.ID, nil)
+	pkg.JSONOK(context, key)
+}
+
+func (uh *UserHandler) DeleteSSHKey(context *gin.Context) {
+	id, err := strconv.ParseUint(context.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		pkg.JSONError(context, 40001, "invalid key id")
+		return
+	}
+	uid := currentUserID(context)
+	err = uh.userSrv.DeleteSSHKey(uid, uint(id))
+	recordAudit(uh.auditSrv, context, uid, model.AuditSSHKeyDelete, "ssh_key", uint(id), err)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		pkg.JSONError(context, 404, "ssh key not found")
+		return
+	}
+	if err != nil {
+		pkg.JSONError(context, 50001, err.Error())
+		return
+	}
+	context.Status(http.StatusNoContent)
+}
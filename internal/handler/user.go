@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Kaikai20040827/graduation/internal/config"
 	"github.com/Kaikai20040827/graduation/internal/model"
 	"github.com/Kaikai20040827/graduation/internal/pkg"
 	"github.com/Kaikai20040827/graduation/internal/service"
@@ -17,15 +18,19 @@ import (
 )
 
 type UserHandler struct {
-	userSrv *service.UserService
-	fileSrv *service.FileService
+	userSrv    *service.UserService
+	fileSrv    *service.FileService
+	auditSrv   *service.AuditService
+	webhookSrv *service.WebhookService
 }
 
-func NewUserHandler(us *service.UserService, fs *service.FileService) *UserHandler {
-	fmt.Println("✓ Creating a new user handler done")
+func NewUserHandler(us *service.UserService, fs *service.FileService, as *service.AuditService, ws *service.WebhookService) *UserHandler {
+	fmt.Fprintln(config.Progress, "✓ Creating a new user handler done")
 	return &UserHandler{
-		userSrv: us,
-		fileSrv: fs,
+		userSrv:    us,
+		fileSrv:    fs,
+		auditSrv:   as,
+		webhookSrv: ws,
 	}
 }
 
@@ -89,27 +94,34 @@ func (uh *UserHandler) ChangePassword(context *gin.Context) {
 	uid := uidv.(uint)
 
 	if err := uh.userSrv.ChangePassword(uid, req.OldPassword, req.NewPassword); err != nil {
+		recordAudit(uh.auditSrv, context, uid, model.AuditPasswordChange, "user", uid, err)
 		pkg.JSONError(context, 40002, err.Error())
 		return
 	}
+	recordAudit(uh.auditSrv, context, uid, model.AuditPasswordChange, "user", uid, nil)
+	uh.webhookSrv.EmitUser(model.EventUserPasswordChanged, uid)
 	context.Status(http.StatusNoContent)
 }
 
 const maxAvatarSize = 5 * 1024 * 1024
 
 type ProfileResp struct {
-	ID              uint       `json:"id"`
-	Email           string     `json:"email"`
-	Username        string     `json:"username"`
-	AvatarURL       string     `json:"avatar_url,omitempty"`
-	AvatarUpdatedAt *time.Time `json:"avatar_updated_at,omitempty"`
+	ID                uint       `json:"id"`
+	Email             string     `json:"email"`
+	Username          string     `json:"username"`
+	Role              string     `json:"role"`
+	MustResetPassword bool       `json:"must_reset_password,omitempty"`
+	AvatarURL         string     `json:"avatar_url,omitempty"`
+	AvatarUpdatedAt   *time.Time `json:"avatar_updated_at,omitempty"`
 }
 
 func (uh *UserHandler) profileResponse(u *model.User) ProfileResp {
 	resp := ProfileResp{
-		ID:       u.ID,
-		Email:    u.Email,
-		Username: u.Username,
+		ID:                u.ID,
+		Email:             u.Email,
+		Username:          u.Username,
+		Role:              u.Role,
+		MustResetPassword: u.MustResetPassword,
 	}
 	if u.AvatarPath != "" {
 		resp.AvatarURL = "/api/v1/user/avatar"
@@ -170,13 +182,7 @@ func (uh *UserHandler) UpdateAvatar(context *gin.Context) {
 
 	storedPath, _, err := uh.fileSrv.SaveUserAvatar(src, filepath.Base(fileHeader.Filename), uid)
 	if err != nil {
-		pkg.JSONError(context, 50002, err.Error())
-		return
-	}
-
-	if err := uh.fileSrv.RemoveStoredFile(user.AvatarPath); err != nil {
-		_ = uh.fileSrv.RemoveStoredFile(storedPath)
-		pkg.JSONError(context, 50002, err.Error())
+		uploadError(context, err)
 		return
 	}
 
@@ -186,6 +192,8 @@ func (uh *UserHandler) UpdateAvatar(context *gin.Context) {
 		pkg.JSONError(context, 50002, err.Error())
 		return
 	}
+	// 新头像已保存后再删除旧的；删除失败时留给 storage gc
+	_ = uh.fileSrv.RemoveStoredFile(user.AvatarPath)
 	pkg.JSONOK(context, uh.profileResponse(u))
 }
 
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VaultHandler 提供客户端加密的保险库接口；服务器只保存密文和包装后的密钥，无法解密
+type VaultHandler struct {
+	fileSrv  *service.FileService
+	auditSrv *service.AuditService
+}
+
+func NewVaultHandler(fs *service.FileService, as *service.AuditService) *VaultHandler {
+	fmt.Fprintln(config.Progress, "✓ Creating a new vault handler done")
+	return &VaultHandler{fileSrv: fs, auditSrv: as}
+}
+
+// GetVault 返回 KDF 参数和包装后的保险库密钥，还没有创建时返回 404
+func (vh *VaultHandler) GetVault(c *gin.Context) {
+	m, err := vh.fileSrv.GetVaultKey(currentUserID(c))
+	if err != nil {
+		vaultError(c, err)
+		return
+	}
+	pkg.JSONOK(c, m)
+}
+
+// PutVault 创建（version 为 0）或替换密钥材料；version 必须等于当前版本
+func (vh *VaultHandler) PutVault(c *gin.Context) {
+	var req service.VaultKeyMaterial
+	if err := c.ShouldBindJSON(&req); err != nil {
+		pkg.JSONError(c, 40001, "invalid params")
+		return
+	}
+	uid := currentUserID(c)
+	m, err := vh.fileSrv.PutVaultKey(uid, &req)
+	recordAudit(vh.auditSrv, c, uid, model.AuditVaultKey, "user", uid, err)
+	if err != nil {
+		vaultError(c, err)
+		return
+	}
+	pkg.JSONOK(c, m)
+}
+
+func (vh *VaultHandler) ListFiles(c *gin.Context) {
+	files, err := vh.fileSrv.ListVaultFiles(currentUserID(c))
+	if err != nil {
+		vaultError(c, err)
+		return
+	}
+	pkg.JSONOK(c, files)
+}
+
+type CreateVaultFileReq struct {
+	EncName string `json:"enc_name" binding:"required"`
+	EncKey  string `json:"enc_key" binding:"required"`
+}
+
+// CreateFile 登记一个新文件，之后按顺序 PUT 各块
+func (vh *VaultHandler) CreateFile(c *gin.Context) {
+	var req CreateVaultFileReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		pkg.JSONError(c, 40001, "invalid params")
+		return
+	}
+	file, err := vh.fileSrv.CreateVaultFile(currentUserID(c), req.EncName, req.EncKey)
+	if err != nil {
+		vaultError(c, err)
+		return
+	}
+	pkg.JSONOK(c, file)
+}
+
+func (vh *VaultHandler) GetFile(c *gin.Context) {
+	id, ok := idParam(c, "invalid file id")
+	if !ok {
+		return
+	}
+	file, err := vh.fileSrv.GetVaultFile(currentUserID(c), id)
+	if err != nil {
+		vaultError(c, err)
+		return
+	}
+	pkg.JSONOK(c, file)
+}
+
+// PutChunk 上传第 n 块，请求体为 sfbcrypt 的块格式。n 必须等于已上传的块数，
+// 否则返回 409；最后一块上传后文件变为 complete
+func (vh *VaultHandler) PutChunk(c *gin.Context) {
+	id, ok := idParam(c, "invalid file id")
+	if !ok {
+		return
+	}
+	n, err := strconv.ParseUint(c.Param("n"), 10, 32)
+	if err != nil {
+		pkg.JSONError(c, 40001, "invalid chunk index")
+		return
+	}
+	chunk, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, sfbcrypt.VaultMaxChunk))
+	if err != nil {
+		pkg.JSONError(c, 413, "chunk too large")
+		return
+	}
+	uid := currentUserID(c)
+	file, err := vh.fileSrv.AppendVaultChunk(uid, id, uint32(n), chunk)
+	if err != nil {
+		vaultError(c, err)
+		return
+	}
+	if file.Status == model.VaultComplete {
+		recordAudit(vh.auditSrv, c, uid, model.AuditVaultUpload, "vault_file", file.ID, nil)
+	}
+	pkg.JSONOK(c, file)
+}
+
+// DownloadContent 原样返回服务器保存的 SFV1 文件，由客户端解密
+func (vh *VaultHandler) DownloadContent(c *gin.Context) {
+	id, ok := idParam(c, "invalid file id")
+	if !ok {
+		return
+	}
+	file, content, err := vh.fileSrv.OpenVaultContent(currentUserID(c), id)
+	if err != nil {
+		vaultError(c, err)
+		return
+	}
+	defer content.Close()
+	c.DataFromReader(http.StatusOK, file.Size, "application/octet-stream", content, nil)
+}
+
+func (vh *VaultHandler) DeleteFile(c *gin.Context) {
+	id, ok := idParam(c, "invalid file id")
+	if !ok {
+		return
+	}
+	uid := currentUserID(c)
+	err := vh.fileSrv.DeleteVaultFile(uid, id)
+	recordAudit(vh.auditSrv, c, uid, model.AuditVaultDelete, "vault_file", id, err)
+	if err != nil {
+		vaultError(c, err)
+		return
+	}
+	pkg.JSONOK(c, nil)
+}
+
+func vaultError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrVaultNotFound), errors.Is(err, service.ErrVaultFileNotFound):
+		pkg.JSONError(c, 404, err.Error())
+	case errors.Is(err, service.ErrVaultExists), errors.Is(err, service.ErrVaultVersion),
+		errors.Is(err, service.ErrVaultChunkOrder), errors.Is(err, service.ErrVaultComplete),
+		errors.Is(err, service.ErrVaultIncomplete):
+		pkg.JSONError(c, 409, err.Error())
+	case errors.Is(err, service.ErrQuotaExceeded):
+		pkg.JSONError(c, 413, err.Error())
+	case errors.Is(err, service.ErrVaultKeyMaterial), errors.Is(err, service.ErrVaultFileMeta),
+		errors.Is(err, sfbcrypt.ErrVaultChunk):
+		pkg.JSONError(c, 40001, err.Error())
+	default:
+		pkg.JSONError(c, 50001, err.Error())
+	}
+}
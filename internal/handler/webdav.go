@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAVHandler 在 /dav/ 下提供 WebDAV 访问，只能看到自己上传的文件
+type WebDAVHandler struct {
+	fileH *FileHandler
+	dav   *webdav.Handler
+}
+
+type ginContextKey struct{}
+
+func NewWebDAVHandler(fileH *FileHandler) *WebDAVHandler {
+	fmt.Fprintln(config.Progress, "✓ Creating a new WebDAV handler done")
+	h := &WebDAVHandler{fileH: fileH}
+	davFS := service.NewDavFS(fileH.fileSrv)
+	davFS.OnEvent = h.onEvent
+	h.dav = &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: davFS,
+		LockSystem: webdav.NewMemLS(),
+	}
+	return h
+}
+
+func (h *WebDAVHandler) Serve(c *gin.Context) {
+	body := &trackedBody{ReadCloser: c.Request.Body}
+	c.Request.Body = body
+	ctx := service.WithDavRequest(c.Request.Context(), &service.DavRequest{
+		UserID:  currentUserID(c),
+		BodyErr: body.error,
+	})
+	ctx = context.WithValue(ctx, ginContextKey{}, c)
+	h.dav.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+}
+
+// onEvent 记录审计并投递 webhook，与 REST 接口的行为一致
+func (h *WebDAVHandler) onEvent(ctx context.Context, action string, f *model.File, err error) {
+	c, ok := ctx.Value(ginContextKey{}).(*gin.Context)
+	if !ok {
+		return
+	}
+	h.fileH.recordFileEvent(c.ClientIP(), currentUserID(c), action, f, err)
+}
+
+// trackedBody 记住读取请求体时的错误（客户端中途断开），用于放弃不完整的上传
+type trackedBody struct {
+	io.ReadCloser
+	mu  sync.Mutex
+	err error
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		b.mu.Lock()
+		b.err = err
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+func (b *trackedBody) error() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
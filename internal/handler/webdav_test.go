@@ -0,0 +1,159 @@
+package handler_test
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/testserver"
+)
+
+// davRequest 发出一个 WebDAV 请求；password 为空时 auth 作为 Bearer token 使用
+func davRequest(t *testing.T, method, url, auth, password string, body io.Reader, headers map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case password != "":
+		req.SetBasicAuth(auth, password)
+	case auth != "":
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// davList 用 PROPFIND（Depth: 1）列出根目录，返回文件名到大小的映射
+func davList(t *testing.T, srv *testserver.Server, auth, password string) map[string]string {
+	t.Helper()
+	resp := davRequest(t, "PROPFIND", srv.URL+"/dav/", auth, password, nil, map[string]string{"Depth": "1"})
+	var ms struct {
+		Responses []struct {
+			Href   string `xml:"href"`
+			Name   string `xml:"propstat>prop>displayname"`
+			Length string `xml:"propstat>prop>getcontentlength"`
+		} `xml:"response"`
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND: status %d", resp.StatusCode)
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, r := range ms.Responses {
+		if r.Href != "/dav/" {
+			files[r.Name] = r.Length
+		}
+	}
+	return files
+}
+
+func TestWebDAVAuth(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{})
+	aliceID := srv.CreateUser(t, "alice", "alice@example.com", "Passw0rd!alice")
+
+	resp := davRequest(t, "PROPFIND", srv.URL+"/dav/", "", "", nil, map[string]string{"Depth": "1"})
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic ") {
+		t.Fatalf("no credentials: status %d, WWW-Authenticate %q", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+	if resp := davRequest(t, "PROPFIND", srv.URL+"/dav/", "alice@example.com", "wrong", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d", resp.StatusCode)
+	}
+	if resp := davRequest(t, "PROPFIND", srv.URL+"/dav/", "not-a-token", "", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bad token: status %d", resp.StatusCode)
+	}
+	davList(t, srv, "alice@example.com", "Passw0rd!alice")
+	davList(t, srv, login(t, srv, "alice@example.com", "Passw0rd!alice"), "")
+
+	// 验证结果有缓存，但禁用后立即失效
+	if _, err := srv.Users.SetDisabled(0, aliceID, true); err != nil {
+		t.Fatal(err)
+	}
+	if resp := davRequest(t, "PROPFIND", srv.URL+"/dav/", "alice@example.com", "Passw0rd!alice", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("disabled user: status %d", resp.StatusCode)
+	}
+}
+
+func TestWebDAVFiles(t *testing.T) {
+	srv := testserver.New(t, testserver.Options{})
+	srv.CreateUser(t, "alice", "alice@example.com", "Passw0rd!alice")
+	srv.CreateUser(t, "bob", "bob@example.com", "Passw0rd!bob")
+	alice := login(t, srv, "alice@example.com", "Passw0rd!alice")
+	bob := login(t, srv, "bob@example.com", "Passw0rd!bob")
+	uploadFile(t, srv.URL+"/api/v1/files/upload", alice, "report.txt", "alice's report")
+	uploadFile(t, srv.URL+"/api/v1/files/upload", bob, "bob.txt", "bob's file")
+	notes := srv.URL + "/dav/notes.txt"
+
+	if resp := davRequest(t, http.MethodPut, notes, alice, "", strings.NewReader("first draft"), nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT new file: status %d", resp.StatusCode)
+	}
+	// x/net/webdav 替换已有文件时也返回 201，下面的列表确认没有多出一个文件
+	if resp := davRequest(t, http.MethodPut, notes, alice, "", strings.NewReader("second draft"), nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT over an existing file: status %d", resp.StatusCode)
+	}
+	// 不能建目录，也不保存客户端生成的隐藏文件（x/net/webdav 把 OpenFile 的错误都报告为 404）
+	if resp := davRequest(t, "MKCOL", srv.URL+"/dav/folder", alice, "", nil, nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("MKCOL: status %d", resp.StatusCode)
+	}
+	if resp := davRequest(t, http.MethodPut, srv.URL+"/dav/.DS_Store", alice, "", strings.NewReader("x"), nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("PUT .DS_Store: status %d", resp.StatusCode)
+	}
+
+	if got := davList(t, srv, "alice@example.com", "Passw0rd!alice"); len(got) != 2 || got["report.txt"] != "14" || got["notes.txt"] != "12" {
+		t.Fatalf("alice's listing: %v", got)
+	}
+	resp := davRequest(t, http.MethodGet, notes, alice, "", nil, nil)
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "second draft" {
+		t.Fatalf("GET: status %d, %q", resp.StatusCode, body)
+	}
+	resp = davRequest(t, http.MethodGet, notes, alice, "", nil, map[string]string{"Range": "bytes=7-11"})
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusPartialContent || string(body) != "draft" {
+		t.Fatalf("GET range: status %d, %q", resp.StatusCode, body)
+	}
+
+	// bob 只看得到自己的文件；同名 PUT 创建的是 bob 自己的文件
+	if got := davList(t, srv, bob, ""); len(got) != 1 || got["bob.txt"] == "" {
+		t.Fatalf("bob's listing: %v", got)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if resp := davRequest(t, method, notes, bob, "", nil, nil); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("bob %s alice's file: status %d", method, resp.StatusCode)
+		}
+	}
+	if resp := davRequest(t, "MOVE", notes, bob, "", nil, map[string]string{"Destination": srv.URL + "/dav/stolen.txt"}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bob MOVE alice's file: status %d", resp.StatusCode)
+	}
+	if resp := davRequest(t, http.MethodPut, notes, bob, "", strings.NewReader("bob's notes"), nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("bob PUT: status %d", resp.StatusCode)
+	}
+	resp = davRequest(t, http.MethodGet, notes, alice, "", nil, nil)
+	if body, _ := io.ReadAll(resp.Body); string(body) != "second draft" {
+		t.Fatalf("alice's notes after bob's PUT: %q", body)
+	}
+
+	resp = davRequest(t, "MOVE", notes, alice, "", nil, map[string]string{"Destination": srv.URL + "/dav/final.txt"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MOVE: status %d", resp.StatusCode)
+	}
+	if names := listFilenames(t, srv, alice); !names["final.txt"] || names["notes.txt"] {
+		t.Fatalf("REST listing after MOVE: %v", names)
+	}
+	if resp := davRequest(t, http.MethodDelete, srv.URL+"/dav/final.txt", alice, "", nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d", resp.StatusCode)
+	}
+	if names := listFilenames(t, srv, alice); len(names) != 1 || !names["report.txt"] {
+		t.Fatalf("REST listing after DELETE: %v", names)
+	}
+}
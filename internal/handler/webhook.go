@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebhookHandler struct {
+	webhookSrv *service.WebhookService
+}
+
+func NewWebhookHandler(ws *service.WebhookService) *WebhookHandler {
+	fmt.Fprintln(config.Progress, "✓ Creating a new webhook handler done")
+	return &WebhookHandler{webhookSrv: ws}
+}
+
+type CreateWebhookReq struct {
+	URL              string   `json:"url" binding:"required"`
+	Secret           string   `json:"secret"`
+	Events           []string `json:"events" binding:"required"`
+	IncludeFilenames bool     `json:"include_filenames"`
+	Global           bool     `json:"global"`
+}
+
+func (wh *WebhookHandler) CreateWebhook(c *gin.Context) {
+	var req CreateWebhookReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		pkg.JSONError(c, 40001, "invalid params")
+		return
+	}
+	hook, secret, err := wh.webhookSrv.Create(currentUserID(c), isAdmin(c), service.WebhookInput{
+		URL:              req.URL,
+		Secret:           req.Secret,
+		Events:           req.Events,
+		IncludeFilenames: req.IncludeFilenames,
+		Global:           req.Global,
+	})
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	pkg.JSONOK(c, gin.H{
+		"webhook": hook,
+		"secret":  secret,
+	})
+}
+
+func (wh *WebhookHandler) ListWebhooks(c *gin.Context) {
+	hooks, err := wh.webhookSrv.List(currentUserID(c), isAdmin(c))
+	if err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(c, gin.H{"items": hooks})
+}
+
+func (wh *WebhookHandler) DeleteWebhook(c *gin.Context) {
+	id, ok := idParam(c, "invalid webhook id")
+	if !ok {
+		return
+	}
+	if err := wh.webhookSrv.Delete(id, currentUserID(c), isAdmin(c)); err != nil {
+		webhookError(c, err)
+		return
+	}
+	pkg.JSONOK(c, gin.H{"id": id})
+}
+
+// ListDeliveries 列出某个 webhook 的投递记录，?status=dead 即死信列表
+func (wh *WebhookHandler) ListDeliveries(c *gin.Context) {
+	id, ok := idParam(c, "invalid webhook id")
+	if !ok {
+		return
+	}
+	if _, err := wh.webhookSrv.Get(id, currentUserID(c), isAdmin(c)); err != nil {
+		webhookError(c, err)
+		return
+	}
+	page, size := pkg.GetPageParams(c)
+	total, items, err := wh.webhookSrv.ListDeliveries(id, c.Query("status"), page, size)
+	if err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(c, gin.H{"total": total, "items": items})
+}
+
+func (wh *WebhookHandler) Redeliver(c *gin.Context) {
+	id, ok := idParam(c, "invalid delivery id")
+	if !ok {
+		return
+	}
+	delivery, err := wh.webhookSrv.Redeliver(id, currentUserID(c), isAdmin(c))
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+	pkg.JSONOK(c, delivery)
+}
+
+// ListDeadLetters 管理员查看所有 webhook 的死信
+func (wh *WebhookHandler) ListDeadLetters(c *gin.Context) {
+	page, size := pkg.GetPageParams(c)
+	total, items, err := wh.webhookSrv.ListDeliveries(0, model.DeliveryDead, page, size)
+	if err != nil {
+		pkg.JSONError(c, 50001, err.Error())
+		return
+	}
+	pkg.JSONOK(c, gin.H{"total": total, "items": items})
+}
+
+func idParam(c *gin.Context, message string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		pkg.JSONError(c, 40001, message)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func isAdmin(c *gin.Context) bool {
+	role, _ := c.Get("role")
+	return role == model.RoleAdmin
+}
+
+func webhookError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrWebhookNotFound):
+		pkg.JSONError(c, 404, err.Error())
+	case errors.Is(err, service.ErrInvalidWebhook):
+		pkg.JSONError(c, 40001, err.Error())
+	default:
+		pkg.JSONError(c, 50001, err.Error())
+	}
+}
@@ -0,0 +1,285 @@
+// Package keytool 实现 sfbctl key 和 sfb key 共用的主密钥文件操作：密封（Init）、
+// 更换口令（Passwd）和按份额拆分（Split）。都在本机读取 config.yaml，不经过服务器；
+// 两个命令只负责解析参数和输出结果
+package keytool
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+// MinPassphrase 是新口令的最短长度；口令只经过一次 Argon2id，不能太短
+const MinPassphrase = 12
+
+type FileResult struct {
+	KeyFile   string `json:"key_file"`
+	Generated bool   `json:"generated,omitempty"`
+}
+
+type SplitResult struct {
+	KeyFile   string   `json:"key_file"`
+	Shares    int      `json:"shares"`
+	Threshold int      `json:"threshold"`
+	KeyShares []string `json:"key_shares,omitempty"`
+	ShareDir  string   `json:"share_dir,omitempty"`
+}
+
+// Init 把主密钥密封到 out（不覆盖已有文件）：默认使用 config.yaml 中的明文 file_crypto.key，
+// generate 时生成新的主密钥（只用于新部署，已有数据会无法解密）。passFile 为空时在终端上输入两次口令
+func Init(out string, generate bool, passFile string) (*FileResult, error) {
+	if out == "" {
+		return nil, errors.New("-out is required")
+	}
+	var master []byte
+	if generate {
+		secret, err := config.GenerateJWTSecret(32)
+		if err != nil {
+			return nil, err
+		}
+		if master, err = sfbcrypt.ParseMasterKey(secret); err != nil {
+			return nil, err
+		}
+	} else {
+		cfg, err := config.LoadConfigReadOnly()
+		if err != nil {
+			return nil, err
+		}
+		if cfg.FileCrypto.KeyFile != "" {
+			return nil, fmt.Errorf("master key is already sealed in %s; use key passwd to change its passphrase", cfg.FileCrypto.KeyFile)
+		}
+		if master, err = sfbcrypt.ParseMasterKey(cfg.FileCrypto.Key); err != nil {
+			return nil, fmt.Errorf("file_crypto.key: %w (use -generate for a new deployment)", err)
+		}
+	}
+	defer clear(master)
+
+	passphrase, err := newPassphrase(passFile, "New master key passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	data, err := sfbcrypt.SealMasterKey(passphrase, master)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeNewFile(out, data); err != nil {
+		return nil, err
+	}
+	return &FileResult{KeyFile: absPath(out), Generated: generate}, nil
+}
+
+// PrintInit 输出 Init 之后要做的配置修改
+func PrintInit(w io.Writer, res *FileResult) {
+	fmt.Fprintf(w, "master key sealed in %s\n", res.KeyFile)
+	fmt.Fprintf(w, "update config.yaml and remove file_crypto.key:\n\nfile_crypto:\n    key_file: %s\n", res.KeyFile)
+	fmt.Fprintf(w, "\nthen start the server with %s set, -key-passphrase-fd, or on a terminal\n", config.KeyPassphraseEnv)
+}
+
+// Passwd 用新口令重新包装密钥文件 file（为空时为 file_crypto.key_file）；主密钥不变，已有数据不需要重新加密
+func Passwd(file, passFile, newPassFile string) (*FileResult, error) {
+	if file == "" {
+		cfg, err := config.LoadConfigReadOnly()
+		if err != nil {
+			return nil, err
+		}
+		if cfg.FileCrypto.KeyFile == "" {
+			return nil, errors.New("file_crypto.key_file is not set; use -file or key init")
+		}
+		file = cfg.FileCrypto.KeyFile
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if sharing, err := sfbcrypt.MasterKeySharing(data); err != nil {
+		return nil, err
+	} else if sharing != nil {
+		return nil, fmt.Errorf("%s is split into key shares and has no passphrase; use key split to split it again", file)
+	}
+	var old []byte
+	if passFile != "" {
+		old, err = readPassphraseFile(passFile)
+	} else {
+		old, err = config.ReadKeyPassphrase(-1, "Current passphrase: ", false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	master, err := sfbcrypt.OpenMasterKey(old, data)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(master)
+	passphrase, err := newPassphrase(newPassFile, "New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sfbcrypt.SealMasterKey(passphrase, master)
+	if err != nil {
+		return nil, err
+	}
+	if err := replaceFile(file, sealed); err != nil {
+		return nil, err
+	}
+	return &FileResult{KeyFile: file}, nil
+}
+
+// Split 把主密钥拆成 n 份，任意 k 份可以还原，写出新的密钥文件 out（不覆盖已有文件）。
+// 主密钥取自当前配置：明文 file_crypto.key，或者用口令、份额解开 file_crypto.key_file。
+// shareDir 为空时份额放在结果中返回，否则每份写一个文件 shareDir/share-N.txt
+func Split(out string, n, k int, shareDir string) (*SplitResult, error) {
+	if out == "" {
+		return nil, errors.New("-out is required")
+	}
+	if k < 2 || k > n || n > sfbcrypt.MaxKeyShares {
+		return nil, sfbcrypt.ErrKeySharing
+	}
+	if _, err := os.Stat(out); err == nil {
+		return nil, fmt.Errorf("%s already exists", out)
+	}
+
+	cfg, err := config.LoadConfigReadOnly()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.UnlockMasterKey(cfg, -1); err != nil {
+		return nil, err
+	}
+	master, err := sfbcrypt.ParseMasterKey(cfg.FileCrypto.Key)
+	if err != nil {
+		return nil, fmt.Errorf("file_crypto.key: %w", err)
+	}
+	data, shares, err := sfbcrypt.SplitMasterKey(master, n, k)
+	clear(master)
+	if err != nil {
+		return nil, err
+	}
+	if shareDir != "" {
+		if err := os.MkdirAll(shareDir, 0700); err != nil {
+			return nil, err
+		}
+		for i, share := range shares {
+			if err := writeNewFile(filepath.Join(shareDir, fmt.Sprintf("share-%d.txt", i+1)), []byte(share+"\n")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// 份额写齐之后再写密钥文件，免得留下一个没有份额的密钥文件
+	if err := writeNewFile(out, data); err != nil {
+		return nil, err
+	}
+	res := &SplitResult{KeyFile: absPath(out), Shares: n, Threshold: k, ShareDir: shareDir}
+	if shareDir == "" {
+		res.KeyShares = shares
+	}
+	return res, nil
+}
+
+// PrintSplit 输出份额（没有写入文件时）和之后要做的配置修改
+func PrintSplit(w io.Writer, res *SplitResult) {
+	fmt.Fprintf(w, "master key split into %d shares in %s, %d needed to unseal\n", res.Shares, res.KeyFile, res.Threshold)
+	if res.ShareDir != "" {
+		fmt.Fprintf(w, "key shares written to %s/share-1.txt ... share-%d.txt\n", res.ShareDir, res.Shares)
+	} else {
+		fmt.Fprintln(w, "\nhand each key share to a different key holder; they are not stored anywhere else:")
+		for i, share := range res.KeyShares {
+			fmt.Fprintf(w, "  share %d: %s\n", i+1, share)
+		}
+	}
+	fmt.Fprintf(w, "\nupdate config.yaml and remove file_crypto.key:\n\nfile_crypto:\n    key_file: %s\n", res.KeyFile)
+	fmt.Fprintln(w, "\nthe server then starts sealed; submit shares with `sfb unseal` or POST /api/v1/sys/unseal")
+}
+
+// absPath 给出绝对路径：相对路径在配置里按 config.yaml 所在目录解析，容易弄错
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// newPassphrase 从 file 读取新口令，没有指定时在终端上输入两次
+func newPassphrase(file, prompt string) ([]byte, error) {
+	var p []byte
+	var err error
+	if file != "" {
+		p, err = readPassphraseFile(file)
+	} else {
+		p, err = config.PromptPassphrase(prompt, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(p) < MinPassphrase {
+		return nil, fmt.Errorf("passphrase must be at least %d characters", MinPassphrase)
+	}
+	return p, nil
+}
+
+// readPassphraseFile 读取 path 的第一行
+func readPassphraseFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, 4096))
+	if err != nil {
+		return nil, err
+	}
+	line, _, _ := bytes.Cut(b, []byte("\n"))
+	line = bytes.TrimRight(line, "\r")
+	if len(line) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return line, nil
+}
+
+// writeNewFile 以 0600 创建 path 并写入 data，path 已存在时失败
+func writeNewFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+// replaceFile 先写临时文件再改名，中途失败时原来的密钥文件保持不变
+func replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sfb-key-")
+	if err != nil {
+		return err
+	}
+	name := tmp.Name()
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(name, path)
+	}
+	if err != nil {
+		_ = os.Remove(name)
+	}
+	return err
+}
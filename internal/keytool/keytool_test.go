@@ -0,0 +1,72 @@
+package keytool
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+func writePassphrase(t *testing.T, dir, name, passphrase string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(passphrase+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func openKeyFile(t *testing.T, path, passphrase string) ([]byte, error) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sfbcrypt.OpenMasterKey([]byte(passphrase), data)
+}
+
+func TestInitAndPasswd(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "master.key")
+	oldPass := writePassphrase(t, dir, "old", "correct horse battery")
+	newPass := writePassphrase(t, dir, "new", "staple and more words")
+	short := writePassphrase(t, dir, "short", "too short")
+
+	if _, err := Init(keyFile, true, short); err == nil {
+		t.Fatal("Init with a short passphrase succeeded")
+	}
+	res, err := Init(keyFile, true, oldPass)
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if !filepath.IsAbs(res.KeyFile) || !res.Generated {
+		t.Fatalf("Init = %+v", res)
+	}
+	if fi, err := os.Stat(keyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode: %v, %v", fi.Mode(), err)
+	}
+	master, err := openKeyFile(t, keyFile, "correct horse battery")
+	if err != nil {
+		t.Fatalf("open sealed key: %v", err)
+	}
+	// 不覆盖已有的密钥文件
+	if _, err := Init(keyFile, true, oldPass); err == nil {
+		t.Fatal("Init over an existing key file succeeded")
+	}
+
+	if _, err := Passwd(keyFile, newPass, newPass); err == nil {
+		t.Fatal("Passwd with a wrong current passphrase succeeded")
+	}
+	if _, err := Passwd(keyFile, oldPass, newPass); err != nil {
+		t.Fatalf("Passwd: %v", err)
+	}
+	if _, err := openKeyFile(t, keyFile, "correct horse battery"); err == nil {
+		t.Fatal("old passphrase still opens the key file")
+	}
+	again, err := openKeyFile(t, keyFile, "staple and more words")
+	if err != nil || !bytes.Equal(again, master) {
+		t.Fatalf("new passphrase: master key changed or not readable: %v", err)
+	}
+}
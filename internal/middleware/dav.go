@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	davRealm        = `Basic realm="Secure File Box", charset="UTF-8"`
+	davCacheTTL     = time.Minute
+	davCacheEntries = 1024
+)
+
+// DAVAuthMiddleware 供 /dav/ 使用：接受 Basic（邮箱 + 密码）或 Bearer token。
+// WebDAV 客户端每个请求都带 Basic 凭据，验证成功后缓存一分钟，避免每次都做 bcrypt；
+// 命中缓存时仍然回查用户状态，密码被修改或用户被禁用后立即失效。
+func DAVAuthMiddleware(cfg *config.JWTConfig, userSrv *service.UserService) gin.HandlerFunc {
+	cache := &davAuthCache{entries: map[[32]byte]davAuthEntry{}}
+	return func(context *gin.Context) {
+		user, err := davAuthenticate(context, cfg, userSrv, cache)
+		switch {
+		case errors.Is(err, service.ErrUserDisabled):
+			pkg.JSONError(context, 403, "user is disabled")
+			context.Abort()
+			return
+		case err != nil:
+			context.Header("WWW-Authenticate", davRealm)
+			pkg.JSONError(context, 401, err.Error())
+			context.Abort()
+			return
+		}
+		// WebDAV 里没有修改密码的入口，必须先在网页或 API 中修改
+		if user.MustResetPassword {
+			pkg.JSONError(context, 403, "password reset required")
+			context.Abort()
+			return
+		}
+		context.Set("user_id", user.ID)
+		context.Set("role", user.Role)
+		context.Next()
+	}
+}
+
+func davAuthenticate(context *gin.Context, cfg *config.JWTConfig, userSrv *service.UserService, cache *davAuthCache) (*model.User, error) {
+	if auth := context.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		claims, err := parseToken(cfg, strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			return nil, err
+		}
+		user, err := userSrv.CheckActive(claims.UserID)
+		if err == nil && !userSrv.UserKeyUnlocked(user) {
+			return nil, service.ErrUserKeyLocked
+		}
+		return user, err
+	}
+
+	email, password, ok := context.Request.BasicAuth()
+	if !ok {
+		return nil, errors.New("authentication required")
+	}
+	key := sha256.Sum256([]byte(email + "\x00" + password))
+	if entry, ok := cache.get(key); ok {
+		user, err := userSrv.CheckActive(entry.userID)
+		if err != nil {
+			cache.remove(key)
+			return nil, err
+		}
+		// 用户密钥过期后重新验证密码，顺便再次解开
+		if user.UpdatedAt.Equal(entry.updatedAt) && userSrv.UserKeyUnlocked(user) {
+			return user, nil
+		}
+		cache.remove(key)
+	}
+
+	u, err := userSrv.Authenticate(email, password)
+	if errors.Is(err, service.ErrUserDisabled) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.New("invalid credentials")
+	}
+	user, err := userSrv.CheckActive(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	cache.put(key, davAuthEntry{userID: user.ID, updatedAt: user.UpdatedAt, expires: time.Now().Add(davCacheTTL)})
+	return user, nil
+}
+
+type davAuthEntry struct {
+	userID uint
+	// updatedAt 为验证时用户的 updated_at；修改或重置密码都会改变它
+	updatedAt time.Time
+	expires   time.Time
+}
+
+type davAuthCache struct {
+	mu      sync.Mutex
+	entries map[[32]byte]davAuthEntry
+}
+
+func (c *davAuthCache) get(key [32]byte) (davAuthEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return davAuthEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *davAuthCache) put(key [32]byte, entry davAuthEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= davCacheEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= davCacheEntries {
+			c.entries = map[[32]byte]davAuthEntry{}
+		}
+	}
+	c.entries[key] = entry
+}
+
+func (c *davAuthCache) remove(key [32]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
@@ -1,10 +1,14 @@
 package middleware
 
 import (
+	"errors"
 	"strings"
+	"time"
 
 	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
 	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
@@ -15,20 +19,31 @@ type JWTClaims struct {
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(cfg *config.JWTConfig, user_id uint) (string, error) {
+// GenerateToken 签发 token；cfg.TTL 为 0 时不设置过期时间，返回的 expiresAt 为零值
+func GenerateToken(cfg *config.JWTConfig, user_id uint) (string, time.Time, error) {
+	now := time.Now()
 	claims := JWTClaims{
 		UserID: user_id,
 		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer: cfg.Issuer,
+			Issuer:   cfg.Issuer,
+			IssuedAt: jwt.NewNumericDate(now),
 		},
 	}
+	var expiresAt time.Time
+	if cfg.TTL > 0 {
+		expiresAt = now.Add(cfg.TTL).Truncate(time.Second)
+		claims.ExpiresAt = jwt.NewNumericDate(expiresAt)
+	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	return token.SignedString([]byte(cfg.Secret))
+	signed, err := token.SignedString([]byte(cfg.Secret))
+	return signed, expiresAt, err
 }
 
-func JWTAuthMiddleware(cfg *config.JWTConfig) gin.HandlerFunc {
+// JWTAuthMiddleware 校验 token，并且每次请求都回查用户状态，
+// 这样被禁用的用户会立即被拒绝，而不是等到 token 过期。
+func JWTAuthMiddleware(cfg *config.JWTConfig, userSrv *service.UserService) gin.HandlerFunc {
 	return func(context *gin.Context) {
 		auth := context.GetHeader("authorization")
 		if auth == "" {
@@ -41,32 +56,85 @@ func JWTAuthMiddleware(cfg *config.JWTConfig) gin.HandlerFunc {
 			return
 		}
 
-		//去掉前缀 "Bearer " 
-		auth = strings.TrimPrefix(auth, "Bearer ")
-		
-		token, err := jwt.ParseWithClaims(
-			auth, 
-			&JWTClaims{},
-			func(t *jwt.Token) (interface{}, error) {
-			return []byte(cfg.Secret), nil
-		})
-
-		if err != nil || !token.Valid {
-			pkg.JSONError(context, 401, "invalid token")
+		//去掉前缀 "Bearer "
+		claims, err := parseToken(cfg, strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			pkg.JSONError(context, 401, err.Error())
 			context.Abort()
 			return
 		}
 
-		claims, ok := token.Claims.(*JWTClaims)
-
-		if !ok {
-			pkg.JSONError(context, 401, "invalid token claim")
+		user, err := userSrv.CheckActive(claims.UserID)
+		if errors.Is(err, service.ErrUserDisabled) {
+			pkg.JSONError(context, 403, "user is disabled")
+			context.Abort()
+			return
+		}
+		if err != nil {
+			pkg.JSONError(context, 401, "user not found")
+			context.Abort()
+			return
+		}
+		// 用户密钥只在密码登录时解开；会话过期或服务重启后它已经不在内存中，要求重新登录
+		if !userSrv.UserKeyUnlocked(user) {
+			pkg.JSONError(context, 401, service.ErrUserKeyLocked.Error())
+			context.Abort()
+			return
+		}
+		// 管理员重置密码后，除了查看资料和修改密码，其余接口一律拒绝
+		if user.MustResetPassword && !passwordResetAllowed(context) {
+			pkg.JSONError(context, 403, "password reset required")
 			context.Abort()
 			return
 		}
+
 		context.Set("user_id", claims.UserID)
+		context.Set("role", user.Role)
+		context.Next()
+	}
+}
+
+// parseToken 校验签名和有效期；错误信息可以直接返回给客户端
+func parseToken(cfg *config.JWTConfig, raw string) (*JWTClaims, error) {
+	token, err := jwt.ParseWithClaims(raw, &JWTClaims{}, func(t *jwt.Token) (interface{}, error) {
+		return []byte(cfg.Secret), nil
+	})
+	var verr *jwt.ValidationError
+	if errors.As(err, &verr) && verr.Errors&jwt.ValidationErrorExpired != 0 {
+		return nil, errors.New("token expired")
+	}
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	claims, ok := token.Claims.(*JWTClaims)
+	if !ok {
+		return nil, errors.New("invalid token claim")
+	}
+	return claims, nil
+}
+
+// RequireAdmin 必须挂在 JWTAuthMiddleware 之后
+func RequireAdmin() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		role, _ := context.Get("role")
+		if role != model.RoleAdmin {
+			pkg.JSONError(context, 403, "admin only")
+			context.Abort()
+			return
+		}
 		context.Next()
 	}
 }
 
+func passwordResetAllowed(context *gin.Context) bool {
+	path := context.FullPath()
+	switch {
+	case strings.HasSuffix(path, "/user/password"), strings.HasSuffix(path, "/auth/refresh"):
+		return true
+	case strings.HasSuffix(path, "/user/profile") && context.Request.Method == "GET":
+		return true
+	}
+	return false
+}
+
 
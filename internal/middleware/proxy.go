@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const forwardedHTTPSKey = "forwarded_https"
+
+// TrustProxies 只信任来自 proxies（IP 或 CIDR）的转发请求头：gin 的 ClientIP 只在直接对端是
+// 受信任的代理时才读 X-Forwarded-For，X-Forwarded-Proto 也一样，由 IsHTTPS 判断。
+// proxies 为空时不信任任何代理。要在注册路由之前调用
+func TrustProxies(r *gin.Engine, proxies []string) error {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, p := range proxies {
+		prefix, err := parseProxy(p)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		return err
+	}
+	r.Use(func(context *gin.Context) {
+		if context.GetHeader("X-Forwarded-Proto") == "https" && trustedPeer(prefixes, context.RemoteIP()) {
+			context.Set(forwardedHTTPSKey, true)
+		}
+		context.Next()
+	})
+	return nil
+}
+
+// IsHTTPS 报告请求是否经 HTTPS 到达：直接的 TLS 连接，或者受信任的代理设置了 X-Forwarded-Proto: https
+func IsHTTPS(context *gin.Context) bool {
+	return context.Request.TLS != nil || context.GetBool(forwardedHTTPSKey)
+}
+
+func parseProxy(p string) (netip.Prefix, error) {
+	if strings.Contains(p, "/") {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(p)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func trustedPeer(prefixes []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
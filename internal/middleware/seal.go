@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+// SealGate 在服务器封存期间对 API、旧的 /files 路由和 WebDAV 返回 503，
+// 只有 /api/v1/sys/ 下的封存接口和 ping 可以访问；页面和静态文件不受影响。
+// 要放在 engine 上，并在注册这些路由之前调用 Use
+func SealGate(sealSrv *service.SealService) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if sealSrv.Sealed() && sealBlocked(context.Request.URL.Path) {
+			pkg.JSONError(context, 503, service.ErrSealed.Error())
+			context.Abort()
+			return
+		}
+		context.Next()
+	}
+}
+
+func sealBlocked(path string) bool {
+	switch {
+	case strings.HasPrefix(path, "/api/v1/sys/"), path == "/api/v1/ping":
+		return false
+	case strings.HasPrefix(path, "/api/"), strings.HasPrefix(path, "/files"), strings.HasPrefix(path, "/dav"):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+// Package migrate 管理数据库结构的版本。每个迁移有递增的版本号和 up/down 两个方向，
+// 已执行的版本记录在 schema_migrations 表中。服务启动时只做检查，不会悄悄改表；
+// 升级数据库结构使用 sfbctl migrate up。
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSchemaBehind = errors.New("database schema is older than this build")
+	ErrSchemaAhead  = errors.New("database schema is newer than this build")
+	ErrIrreversible = errors.New("migration cannot be reverted")
+)
+
+// Migration 是一个版本的结构变更。Up/Down 在同一个事务中执行并写入版本记录；
+// MySQL 的 DDL 会隐式提交，所以迁移本身要能安全地重复执行。Down 为 nil 表示不可回滚。
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB, env *Env) error
+	Down    func(tx *gorm.DB, env *Env) error
+}
+
+// Env 是迁移可以使用的外部资源；密钥无效时 Keys 为 nil，需要密钥的迁移应当报错
+type Env struct {
+	Keys *sfbcrypt.Keys
+}
+
+// schemaMigration 是 schema_migrations 表中的一行
+type schemaMigration struct {
+	Version   int    `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"size:100"`
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string { return "schema_migrations" }
+
+// Status 是 sfbctl migrate status 的一行；AppliedAt 为 nil 表示尚未执行
+type Status struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+type Migrator struct {
+	db         *gorm.DB
+	env        *Env
+	migrations []Migration
+}
+
+func New(db *gorm.DB, base64Key string) *Migrator {
+	env := &Env{}
+	if keys, err := sfbcrypt.NewKeys(base64Key); err == nil {
+		env.Keys = keys
+	}
+	return &Migrator{db: db, env: env, migrations: all}
+}
+
+// Latest 是本程序认识的最新版本
+func (m *Migrator) Latest() int {
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) applied() (map[int]schemaMigration, error) {
+	if err := m.db.AutoMigrate(&schemaMigration{}); err != nil {
+		return nil, err
+	}
+	var rows []schemaMigration
+	if err := m.db.Order("version asc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	done := make(map[int]schemaMigration, len(rows))
+	for _, row := range rows {
+		done[row.Version] = row
+	}
+	return done, nil
+}
+
+// Current 返回已执行的最大版本，0 表示一个迁移都没有执行过
+func (m *Migrator) Current() (int, error) {
+	done, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for v := range done {
+		current = max(current, v)
+	}
+	return current, nil
+}
+
+// Status 列出所有已知迁移和数据库中出现的未知版本
+func (m *Migrator) Status() ([]Status, error) {
+	done, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var out []Status
+	for _, mig := range m.migrations {
+		st := Status{Version: mig.Version, Name: mig.Name}
+		if row, ok := done[mig.Version]; ok {
+			st.AppliedAt = &row.AppliedAt
+			delete(done, mig.Version)
+		}
+		out = append(out, st)
+	}
+	for _, row := range done {
+		out = append(out, Status{Version: row.Version, Name: row.Name + " (unknown to this build)", AppliedAt: &row.AppliedAt})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Up 依次执行版本不超过 target 的未执行迁移；target 为 0 表示最新版本
+func (m *Migrator) Up(target int) ([]Migration, error) {
+	if target == 0 {
+		target = m.Latest()
+	}
+	done, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var ran []Migration
+	for _, mig := range m.migrations {
+		if mig.Version > target {
+			break
+		}
+		if _, ok := done[mig.Version]; ok {
+			continue
+		}
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := mig.Up(tx, m.env); err != nil {
+				return err
+			}
+			return tx.Create(&schemaMigration{Version: mig.Version, Name: mig.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return ran, fmt.Errorf("migration %d (%s): %w", mig.Version, mig.Name, err)
+		}
+		ran = append(ran, mig)
+	}
+	return ran, nil
+}
+
+// Down 从最新的已执行版本开始回滚 steps 个迁移
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	done, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var ran []Migration
+	for i := len(m.migrations) - 1; i >= 0 && len(ran) < steps; i-- {
+		mig := m.migrations[i]
+		if _, ok := done[mig.Version]; !ok {
+			continue
+		}
+		if mig.Down == nil {
+			return ran, fmt.Errorf("migration %d (%s): %w", mig.Version, mig.Name, ErrIrreversible)
+		}
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := mig.Down(tx, m.env); err != nil {
+				return err
+			}
+			return tx.Delete(&schemaMigration{}, mig.Version).Error
+		})
+		if err != nil {
+			return ran, fmt.Errorf("revert migration %d (%s): %w", mig.Version, mig.Name, err)
+		}
+		ran = append(ran, mig)
+	}
+	return ran, nil
+}
+
+// Check 要求数据库恰好处于本程序的最新版本：有未执行的迁移或出现未知版本都返回错误
+func (m *Migrator) Check() error {
+	done, err := m.applied()
+	if err != nil {
+		return err
+	}
+	for v := range done {
+		if v > m.Latest() {
+			return fmt.Errorf("%w: database is at version %d, this build knows up to %d", ErrSchemaAhead, v, m.Latest())
+		}
+	}
+	pending := 0
+	for _, mig := range m.migrations {
+		if _, ok := done[mig.Version]; !ok {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%w: %d migration(s) pending, run `sfbctl migrate up`", ErrSchemaBehind, pending)
+	}
+	return nil
+}
+
+// Startup 供 server 等程序启动时调用：全新的空数据库直接建到最新版本，
+// autoMigrate 为 true 时执行所有未执行的迁移，最后用 Check 确认版本
+func (m *Migrator) Startup(autoMigrate bool) error {
+	fresh := !m.db.Migrator().HasTable(&schemaMigration{}) && !m.db.Migrator().HasTable("users")
+	if fresh || autoMigrate {
+		if _, err := m.Up(0); err != nil {
+			return err
+		}
+	}
+	return m.Check()
+}
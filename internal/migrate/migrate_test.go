@@ -0,0 +1,276 @@
+package migrate
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+	"gorm.io/gorm"
+)
+
+// testKey 是测试用的主密钥（32 个零字节）
+const testKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+// newTestDB 返回临时目录中一个空的 SQLite 数据库
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := pkg.NewDatabase(&config.DatabaseConfig{Driver: "sqlite", Path: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+func mustUp(t *testing.T, m *Migrator, target int) {
+	t.Helper()
+	if _, err := m.Up(target); err != nil {
+		t.Fatalf("Up(%d): %v", target, err)
+	}
+}
+
+func current(t *testing.T, m *Migrator) int {
+	t.Helper()
+	v, err := m.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func metaCipher(t *testing.T) *sfbcrypt.MetaCipher {
+	t.Helper()
+	keys, err := sfbcrypt.NewKeys(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := sfbcrypt.NewMetaCipher(keys.Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+// schemaAt 描述每个版本之后应当存在（true）或不存在（false）的表和列
+var schemaAt = []struct {
+	version int
+	tables  map[string]bool
+	columns map[string]map[string]bool
+}{
+	{1, map[string]bool{"users": true, "files": true, "jobs": false},
+		map[string]map[string]bool{"files": {"filename": true}}},
+	{2, nil, map[string]map[string]bool{"files": {"filename": false, "enc_filename": true}}},
+	{3, map[string]bool{"jobs": true, "job_schedules": true, "scrub_results": false}, nil},
+	{4, map[string]bool{"scrub_results": true, "blobs": false}, nil},
+	{5, map[string]bool{"blobs": true, "vault_keys": false}, nil},
+	{6, map[string]bool{"vault_keys": true, "vault_files": true}, map[string]map[string]bool{"users": {"user_key": false}}},
+	{7, nil, map[string]map[string]bool{"users": {"user_key": true, "user_key_escrow": true}, "files": {"user_keyed": true, "customer_key_tag": false}}},
+	{8, nil, map[string]map[string]bool{"files": {"customer_key_tag": true}, "webhooks": {"secret": true, "enc_secret": false}}},
+	{9, nil, map[string]map[string]bool{"webhooks": {"secret": false, "enc_secret": true}, "webhook_deliveries": {"payload": false, "enc_payload": true}}},
+}
+
+func checkSchema(t *testing.T, db *gorm.DB, version int) {
+	t.Helper()
+	for _, s := range schemaAt {
+		if s.version != version {
+			continue
+		}
+		for table, want := range s.tables {
+			if got := db.Migrator().HasTable(table); got != want {
+				t.Errorf("version %d: HasTable(%s) = %v, want %v", version, table, got, want)
+			}
+		}
+		for table, cols := range s.columns {
+			for col, want := range cols {
+				if got := db.Migrator().HasColumn(table, col); got != want {
+					t.Errorf("version %d: HasColumn(%s.%s) = %v, want %v", version, table, col, got, want)
+				}
+			}
+		}
+	}
+}
+
+// 逐个版本升级到最新，再逐个回滚到 1，每一步检查表结构，最后再升回最新
+func TestUpDownEachVersion(t *testing.T) {
+	db := newTestDB(t)
+	m := New(db, testKey)
+	for v := 1; v <= m.Latest(); v++ {
+		mustUp(t, m, v)
+		if got := current(t, m); got != v {
+			t.Fatalf("after Up(%d): Current = %d", v, got)
+		}
+		checkSchema(t, db, v)
+	}
+	if err := m.Check(); err != nil {
+		t.Fatalf("Check at latest: %v", err)
+	}
+
+	for v := m.Latest(); v > 1; v-- {
+		ran, err := m.Down(1)
+		if err != nil || len(ran) != 1 || ran[0].Version != v {
+			t.Fatalf("Down(1) from %d = %v, %v", v, ran, err)
+		}
+		checkSchema(t, db, v-1)
+	}
+	// 基线不能回滚
+	if _, err := m.Down(1); !errors.Is(err, ErrIrreversible) {
+		t.Fatalf("Down past the baseline = %v, want ErrIrreversible", err)
+	}
+
+	mustUp(t, m, 0)
+	if got := current(t, m); got != m.Latest() {
+		t.Fatalf("after Up(0): Current = %d, want %d", got, m.Latest())
+	}
+	checkSchema(t, db, m.Latest())
+}
+
+func TestStartupAndCheck(t *testing.T) {
+	db := newTestDB(t)
+	m := New(db, testKey)
+	// 空数据库直接建到最新版本
+	if err := m.Startup(false); err != nil {
+		t.Fatalf("Startup on an empty database: %v", err)
+	}
+	if got := current(t, m); got != m.Latest() {
+		t.Fatalf("Current = %d, want %d", got, m.Latest())
+	}
+
+	if _, err := m.Down(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check(); !errors.Is(err, ErrSchemaBehind) {
+		t.Fatalf("Check with pending migrations = %v, want ErrSchemaBehind", err)
+	}
+	// 已有数据库不会在启动时悄悄升级
+	if err := m.Startup(false); !errors.Is(err, ErrSchemaBehind) {
+		t.Fatalf("Startup(false) with pending migrations = %v, want ErrSchemaBehind", err)
+	}
+	if err := m.Startup(true); err != nil {
+		t.Fatalf("Startup(true): %v", err)
+	}
+
+	if err := db.Create(&schemaMigration{Version: m.Latest() + 1, Name: "future"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check(); !errors.Is(err, ErrSchemaAhead) {
+		t.Fatalf("Check with an unknown version = %v, want ErrSchemaAhead", err)
+	}
+}
+
+// 有文件用用户密钥加密时，v7 不能回滚：删掉 users.user_key 后这些文件再也无法解密
+func TestUserKeysDownRefused(t *testing.T) {
+	db := newTestDB(t)
+	m := New(db, testKey)
+	mustUp(t, m, 0)
+	if err := db.Exec("INSERT INTO files (enc_filename, user_keyed, customer_key_tag) VALUES ('x', ?, '')", true).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ran, err := m.Down(m.Latest() - 6)
+	if !errors.Is(err, ErrIrreversible) {
+		t.Fatalf("Down through v7 = %v, want ErrIrreversible", err)
+	}
+	if len(ran) != m.Latest()-7 {
+		t.Fatalf("reverted %d migrations before refusing, want %d", len(ran), m.Latest()-7)
+	}
+	if got := current(t, m); got != 7 {
+		t.Fatalf("Current = %d, want 7", got)
+	}
+	// 拒绝时事务回滚，列仍在
+	checkSchema(t, db, 7)
+}
+
+func TestCustomerKeysDownRefused(t *testing.T) {
+	db := newTestDB(t)
+	m := New(db, testKey)
+	mustUp(t, m, 8)
+	if err := db.Exec("INSERT INTO files (enc_filename, customer_key_tag) VALUES ('x', 'ck1:abc')").Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Down(1); !errors.Is(err, ErrIrreversible) {
+		t.Fatalf("Down from v8 = %v, want ErrIrreversible", err)
+	}
+	if got := current(t, m); got != 8 {
+		t.Fatalf("Current = %d, want 8", got)
+	}
+}
+
+// v2 把只有明文列的旧记录加密，owner_tag 与 FileService 的计算方式一致
+func TestLegacyFilesEncrypted(t *testing.T) {
+	db := newTestDB(t)
+	m := New(db, testKey)
+	mustUp(t, m, 1)
+	if err := db.Exec("INSERT INTO files (filename, storage_path, size, description, uploader_id) VALUES ('a.txt', '/s/a.bin', 3, 'd', '7')").Error; err != nil {
+		t.Fatal(err)
+	}
+	mustUp(t, m, 2)
+
+	var row sfbcrypt.MetadataRow
+	if err := db.Table("files").Select("id, enc_filename, enc_storage_path, enc_size, enc_description, enc_uploader_id").Take(&row).Error; err != nil {
+		t.Fatal(err)
+	}
+	meta, err := metaCipher(t).DecryptRow(row)
+	if err != nil {
+		t.Fatalf("DecryptRow: %v", err)
+	}
+	if meta.Filename != "a.txt" || meta.StoragePath != "/s/a.bin" || meta.Size != 3 || meta.UploaderID != "7" {
+		t.Fatalf("decrypted metadata = %+v", meta)
+	}
+
+	// 需要加密旧记录但没有密钥时失败，不会丢掉明文
+	db2 := newTestDB(t)
+	m2 := New(db2, "")
+	mustUp(t, m2, 1)
+	if err := db2.Exec("INSERT INTO files (filename, uploader_id) VALUES ('b.txt', '1')").Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m2.Up(2); err == nil {
+		t.Fatal("Up(2) without a key succeeded")
+	}
+	if !db2.Migrator().HasColumn("files", "filename") {
+		t.Fatal("plaintext column dropped although encryption failed")
+	}
+}
+
+// v9 加密 webhook 的签名密钥，回滚时解密写回
+func TestWebhookEncryptionRoundTrip(t *testing.T) {
+	db := newTestDB(t)
+	m := New(db, testKey)
+	mustUp(t, m, 8)
+	if err := db.Exec("INSERT INTO webhooks (owner_id, url, secret, events) VALUES (1, 'https://example.com', 's3cret', '*')").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("INSERT INTO webhook_deliveries (webhook_id, event, payload, status) VALUES (1, 'file.uploaded', '{\"filename\":\"a.txt\"}', 'pending')").Error; err != nil {
+		t.Fatal(err)
+	}
+	mustUp(t, m, 9)
+
+	var enc string
+	if err := db.Table("webhooks").Select("enc_secret").Take(&enc).Error; err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := metaCipher(t).DecryptString(enc); err != nil || plain != "s3cret" {
+		t.Fatalf("enc_secret decrypts to %q, %v", plain, err)
+	}
+
+	if _, err := m.Down(1); err != nil {
+		t.Fatalf("Down from v9: %v", err)
+	}
+	var secret, payload string
+	if err := db.Table("webhooks").Select("secret").Take(&secret).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Table("webhook_deliveries").Select("payload").Take(&payload).Error; err != nil {
+		t.Fatal(err)
+	}
+	if secret != "s3cret" || payload != `{"filename":"a.txt"}` {
+		t.Fatalf("after Down: secret %q, payload %q", secret, payload)
+	}
+}
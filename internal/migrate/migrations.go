@@ -0,0 +1,14 @@
+package migrate
+
+// all 按版本号升序排列。已发布的迁移不要再修改，结构变化一律追加新版本。
+var all = []Migration{
+	{Version: 1, Name: "baseline", Up: baselineUp},
+	{Version: 2, Name: "drop_legacy_file_columns", Up: dropLegacyFileColumnsUp, Down: dropLegacyFileColumnsDown},
+	{Version: 3, Name: "jobs", Up: jobsUp, Down: jobsDown},
+	{Version: 4, Name: "scrub_results", Up: scrubResultsUp, Down: scrubResultsDown},
+	{Version: 5, Name: "blobs", Up: blobsUp, Down: blobsDown},
+	{Version: 6, Name: "vault", Up: vaultUp, Down: vaultDown},
+	{Version: 7, Name: "user_keys", Up: userKeysUp, Down: userKeysDown},
+	{Version: 8, Name: "customer_keys", Up: customerKeysUp, Down: customerKeysDown},
+	{Version: 9, Name: "webhook_encryption", Up: webhookEncryptionUp, Down: webhookEncryptionDown},
+}
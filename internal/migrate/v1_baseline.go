@@ -0,0 +1,185 @@
+package migrate
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 版本 1 是引入迁移之前 AutoMigrate 建出的结构。这里保留当时模型的副本而不是引用
+// internal/model，之后修改模型不会改变这个迁移的结果。对已经由 AutoMigrate 建好的
+// 数据库执行时不会有任何变化，只是补上版本记录。
+
+type v1User struct {
+	ID                uint   `gorm:"primarykey"`
+	Email             string `gorm:"uniqueIndex;size:255"`
+	Username          string `gorm:"size:100"`
+	Password          string `gorm:"size:255"`
+	Role              string `gorm:"size:32;default:user;index"`
+	Disabled          bool   `gorm:"default:false"`
+	MustResetPassword bool   `gorm:"default:false"`
+	AvatarPath        string `gorm:"size:1024"`
+	AvatarMime        string `gorm:"size:128"`
+	AvatarUpdatedAt   *time.Time
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	DeletedAt         gorm.DeletedAt `gorm:"index"`
+}
+
+func (v1User) TableName() string { return "users" }
+
+type v1File struct {
+	ID             uint   `gorm:"primarykey"`
+	EncFilename    string `gorm:"column:enc_filename;type:text"`
+	EncStoragePath string `gorm:"column:enc_storage_path;type:text"`
+	EncSize        string `gorm:"column:enc_size;type:text"`
+	EncDescription string `gorm:"column:enc_description;type:text"`
+	EncUploaderID  string `gorm:"column:enc_uploader_id;type:text"`
+	OwnerTag       string `gorm:"column:owner_tag;size:64;index"`
+	ScanStatus     string `gorm:"size:16;index"`
+	ScanSignature  string `gorm:"size:255"`
+	ScannedAt      *time.Time
+	LegacyFilename string `gorm:"column:filename"`
+	LegacyPath     string `gorm:"column:storage_path"`
+	LegacySize     int64  `gorm:"column:size"`
+	LegacyDesc     string `gorm:"column:description"`
+	LegacyUploader string `gorm:"column:uploader_id"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	DeletedAt      gorm.DeletedAt `gorm:"index"`
+}
+
+func (v1File) TableName() string { return "files" }
+
+type v1AuditLog struct {
+	ID         uint      `gorm:"primarykey"`
+	Seq        uint64    `gorm:"uniqueIndex"`
+	ActorID    uint      `gorm:"index"`
+	Action     string    `gorm:"size:64;index"`
+	TargetType string    `gorm:"size:32"`
+	TargetID   uint      `gorm:"index"`
+	IP         string    `gorm:"size:64"`
+	Outcome    string    `gorm:"size:16;index"`
+	Detail     string    `gorm:"size:255"`
+	PrevHash   string    `gorm:"size:64"`
+	Hash       string    `gorm:"size:64"`
+	CreatedAt  time.Time `gorm:"index"`
+}
+
+func (v1AuditLog) TableName() string { return "audit_logs" }
+
+type v1Webhook struct {
+	ID               uint   `gorm:"primarykey"`
+	OwnerID          uint   `gorm:"index"`
+	Global           bool   `gorm:"default:false"`
+	URL              string `gorm:"size:1024"`
+	Secret           string `gorm:"size:128"`
+	Events           string `gorm:"size:512"`
+	IncludeFilenames bool   `gorm:"default:false"`
+	Active           bool   `gorm:"default:true"`
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+func (v1Webhook) TableName() string { return "webhooks" }
+
+type v1WebhookDelivery struct {
+	ID             uint   `gorm:"primarykey"`
+	WebhookID      uint   `gorm:"index"`
+	Event          string `gorm:"size:64"`
+	Payload        string `gorm:"type:text"`
+	Status         string `gorm:"size:16;index"`
+	Attempts       int
+	NextAttemptAt  time.Time `gorm:"index"`
+	LastStatusCode int
+	LastError      string `gorm:"size:512"`
+	DeliveredAt    *time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (v1WebhookDelivery) TableName() string { return "webhook_deliveries" }
+
+type v1SSHKey struct {
+	ID          uint   `gorm:"primarykey"`
+	UserID      uint   `gorm:"index"`
+	Name        string `gorm:"size:100"`
+	Fingerprint string `gorm:"uniqueIndex;size:64"`
+	PublicKey   string `gorm:"type:text"`
+	LastUsedAt  *time.Time
+	CreatedAt   time.Time
+}
+
+func (v1SSHKey) TableName() string { return "ssh_keys" }
+
+type v1S3Credential struct {
+	ID          uint   `gorm:"primarykey"`
+	UserID      uint   `gorm:"index"`
+	Name        string `gorm:"size:100"`
+	AccessKeyID string `gorm:"uniqueIndex;size:32"`
+	EncSecret   string `gorm:"type:text"`
+	LastUsedAt  *time.Time
+	CreatedAt   time.Time
+}
+
+func (v1S3Credential) TableName() string { return "s3_credentials" }
+
+type v1S3Bucket struct {
+	ID        uint   `gorm:"primarykey"`
+	UserID    uint   `gorm:"uniqueIndex:idx_s3_bucket_user_name"`
+	Name      string `gorm:"uniqueIndex:idx_s3_bucket_user_name;size:63"`
+	CreatedAt time.Time
+}
+
+func (v1S3Bucket) TableName() string { return "s3_buckets" }
+
+type v1S3Object struct {
+	ID          uint   `gorm:"primarykey"`
+	BucketID    uint   `gorm:"index"`
+	FileID      uint   `gorm:"uniqueIndex"`
+	KeyTag      string `gorm:"uniqueIndex;size:64"`
+	EncETag     string `gorm:"column:enc_etag;type:text"`
+	FileVersion int64
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (v1S3Object) TableName() string { return "s3_objects" }
+
+type v1S3Upload struct {
+	ID        uint      `gorm:"primarykey"`
+	UploadID  string    `gorm:"uniqueIndex;size:64"`
+	BucketID  uint      `gorm:"index"`
+	UserID    uint      `gorm:"index"`
+	EncKey    string    `gorm:"type:text"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
+func (v1S3Upload) TableName() string { return "s3_uploads" }
+
+type v1S3Part struct {
+	ID         uint `gorm:"primarykey"`
+	UploadID   uint `gorm:"uniqueIndex:idx_s3_part_upload_number"`
+	PartNumber int  `gorm:"uniqueIndex:idx_s3_part_upload_number"`
+	Size       int64
+	ETag       string `gorm:"size:64"`
+	CreatedAt  time.Time
+}
+
+func (v1S3Part) TableName() string { return "s3_parts" }
+
+func baselineUp(tx *gorm.DB, _ *Env) error {
+	return tx.AutoMigrate(
+		&v1User{},
+		&v1File{},
+		&v1AuditLog{},
+		&v1Webhook{},
+		&v1WebhookDelivery{},
+		&v1SSHKey{},
+		&v1S3Credential{},
+		&v1S3Bucket{},
+		&v1S3Object{},
+		&v1S3Upload{},
+		&v1S3Part{},
+	)
+}
@@ -0,0 +1,121 @@
+package migrate
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+	"gorm.io/gorm"
+)
+
+// 版本 2 把仍然只有明文列的旧记录加密到 enc_* 列，然后删除明文列。
+// 回滚只会加回空的明文列，加密后的数据不会再写回明文。
+
+var legacyFileColumns = []string{"filename", "storage_path", "size", "description", "uploader_id"}
+
+// v2LegacyFile 只映射这个迁移需要读写的列；没有 DeletedAt，因此软删除的行也会被处理
+type v2LegacyFile struct {
+	ID             uint
+	EncFilename    string `gorm:"column:enc_filename"`
+	EncStoragePath string `gorm:"column:enc_storage_path"`
+	EncSize        string `gorm:"column:enc_size"`
+	EncDescription string `gorm:"column:enc_description"`
+	EncUploaderID  string `gorm:"column:enc_uploader_id"`
+	Filename       string `gorm:"column:filename"`
+	StoragePath    string `gorm:"column:storage_path"`
+	Size           int64  `gorm:"column:size"`
+	Description    string `gorm:"column:description"`
+	UploaderID     string `gorm:"column:uploader_id"`
+}
+
+func (v2LegacyFile) TableName() string { return "files" }
+
+func (f *v2LegacyFile) encrypted() bool {
+	return f.EncFilename != "" || f.EncStoragePath != "" || f.EncSize != "" || f.EncDescription != "" || f.EncUploaderID != ""
+}
+
+func dropLegacyFileColumnsUp(tx *gorm.DB, env *Env) error {
+	if !tx.Migrator().HasColumn(&v1File{}, "filename") {
+		return nil
+	}
+	var meta *sfbcrypt.MetaCipher
+	var lastID uint
+	for {
+		var batch []v2LegacyFile
+		if err := tx.Where("id > ?", lastID).Order("id asc").Limit(500).Find(&batch).Error; err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for i := range batch {
+			file := &batch[i]
+			lastID = file.ID
+			if file.encrypted() {
+				continue
+			}
+			if meta == nil {
+				if env.Keys == nil {
+					return errors.New("file_crypto.key is required to encrypt legacy file rows")
+				}
+				var err error
+				if meta, err = sfbcrypt.NewMetaCipher(env.Keys.Metadata); err != nil {
+					return err
+				}
+			}
+			row, err := meta.EncryptRow(file.ID, &sfbcrypt.FileMetadata{
+				Filename:    file.Filename,
+				StoragePath: file.StoragePath,
+				Size:        file.Size,
+				Description: file.Description,
+				UploaderID:  file.UploaderID,
+			})
+			if err != nil {
+				return err
+			}
+			// owner_tag 与 FileService.ownerTag 的计算方式相同
+			mac := hmac.New(sha256.New, env.Keys.OwnerIndex)
+			mac.Write([]byte(file.UploaderID))
+			err = tx.Model(&v2LegacyFile{}).Where("id = ?", file.ID).Updates(map[string]any{
+				"enc_filename":     row.EncFilename,
+				"enc_storage_path": row.EncStoragePath,
+				"enc_size":         row.EncSize,
+				"enc_description":  row.EncDescription,
+				"enc_uploader_id":  row.EncUploaderID,
+				"owner_tag":        hex.EncodeToString(mac.Sum(nil)),
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, column := range legacyFileColumns {
+		if tx.Migrator().HasColumn(&v1File{}, column) {
+			if err := tx.Migrator().DropColumn(&v1File{}, column); err != nil {
+				return err
+			}
+		}
+	}
+	// SQLite 删除列时会重建整张表，原有索引随之丢失
+	for _, field := range []string{"OwnerTag", "ScanStatus", "DeletedAt"} {
+		if !tx.Migrator().HasIndex(&v1File{}, field) {
+			if err := tx.Migrator().CreateIndex(&v1File{}, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dropLegacyFileColumnsDown(tx *gorm.DB, _ *Env) error {
+	for _, column := range legacyFileColumns {
+		if !tx.Migrator().HasColumn(&v1File{}, column) {
+			if err := tx.Migrator().AddColumn(&v1File{}, column); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
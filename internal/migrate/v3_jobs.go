@@ -0,0 +1,49 @@
+package migrate
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 版本 3 增加后台任务队列和定时任务表
+
+type v3Job struct {
+	ID          uint      `gorm:"primarykey"`
+	Type        string    `gorm:"size:64;index"`
+	Payload     string    `gorm:"type:text"`
+	Status      string    `gorm:"size:16;index:idx_jobs_status_run_at"`
+	RunAt       time.Time `gorm:"index:idx_jobs_status_run_at"`
+	Attempts    int
+	MaxAttempts int
+	LockedBy    string `gorm:"size:64"`
+	LeaseUntil  *time.Time
+	Schedule    string `gorm:"size:128"`
+	LastError   string `gorm:"size:512"`
+	StartedAt   *time.Time
+	FinishedAt  *time.Time `gorm:"index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (v3Job) TableName() string { return "jobs" }
+
+type v3JobSchedule struct {
+	ID        uint   `gorm:"primarykey"`
+	Type      string `gorm:"uniqueIndex;size:64"`
+	Spec      string `gorm:"size:128"`
+	NextRunAt time.Time
+	LastRunAt *time.Time
+	Runs      int64
+	UpdatedAt time.Time
+}
+
+func (v3JobSchedule) TableName() string { return "job_schedules" }
+
+func jobsUp(tx *gorm.DB, _ *Env) error {
+	return tx.AutoMigrate(&v3Job{}, &v3JobSchedule{})
+}
+
+func jobsDown(tx *gorm.DB, _ *Env) error {
+	return tx.Migrator().DropTable(&v3JobSchedule{}, &v3Job{})
+}
@@ -0,0 +1,29 @@
+package migrate
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 版本 4 增加存储巡检结果表
+
+type v4ScrubResult struct {
+	ID         uint   `gorm:"primarykey"`
+	Kind       string `gorm:"size:16;uniqueIndex:idx_scrub_kind_ref"`
+	RefID      uint   `gorm:"uniqueIndex:idx_scrub_kind_ref"`
+	Status     string `gorm:"size:16;index"`
+	Error      string `gorm:"size:512"`
+	CheckedAt  time.Time
+	VerifiedAt *time.Time
+}
+
+func (v4ScrubResult) TableName() string { return "scrub_results" }
+
+func scrubResultsUp(tx *gorm.DB, _ *Env) error {
+	return tx.AutoMigrate(&v4ScrubResult{})
+}
+
+func scrubResultsDown(tx *gorm.DB, _ *Env) error {
+	return tx.Migrator().DropTable(&v4ScrubResult{})
+}
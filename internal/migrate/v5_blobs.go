@@ -0,0 +1,37 @@
+package migrate
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 版本 5 增加去重密文的引用计数表
+
+type v5Blob struct {
+	ID         uint   `gorm:"primarykey"`
+	ContentTag string `gorm:"size:64;uniqueIndex"`
+	Name       string `gorm:"size:64;uniqueIndex"`
+	RefCount   int64
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (v5Blob) TableName() string { return "blobs" }
+
+func blobsUp(tx *gorm.DB, _ *Env) error {
+	return tx.AutoMigrate(&v5Blob{})
+}
+
+func blobsDown(tx *gorm.DB, _ *Env) error {
+	var shared int64
+	if err := tx.Model(&v5Blob{}).Count(&shared).Error; err != nil {
+		return err
+	}
+	if shared > 0 {
+		// 没有这张表就无法知道哪些文件共享密文，删除其中一个会让其余的失去内容
+		return fmt.Errorf("%d deduplicated blobs exist: %w", shared, ErrIrreversible)
+	}
+	return tx.Migrator().DropTable(&v5Blob{})
+}
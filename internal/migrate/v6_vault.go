@@ -0,0 +1,57 @@
+package migrate
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 版本 6 增加客户端加密的保险库
+
+type v6VaultKey struct {
+	ID         uint   `gorm:"primarykey"`
+	UserID     uint   `gorm:"uniqueIndex"`
+	KDF        string `gorm:"size:16"`
+	KDFTime    uint32
+	KDFMemory  uint32
+	KDFThreads uint8
+	Salt       []byte `gorm:"size:64"`
+	WrappedKey string `gorm:"size:256"`
+	Version    uint
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (v6VaultKey) TableName() string { return "vault_keys" }
+
+type v6VaultFile struct {
+	ID        uint   `gorm:"primarykey"`
+	UserID    uint   `gorm:"index"`
+	EncName   string `gorm:"size:2048"`
+	EncKey    string `gorm:"size:256"`
+	Name      string `gorm:"size:64;uniqueIndex"`
+	Size      int64
+	Chunks    uint32
+	Status    string `gorm:"size:16;index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (v6VaultFile) TableName() string { return "vault_files" }
+
+func vaultUp(tx *gorm.DB, _ *Env) error {
+	return tx.AutoMigrate(&v6VaultKey{}, &v6VaultFile{})
+}
+
+func vaultDown(tx *gorm.DB, _ *Env) error {
+	var keys int64
+	if err := tx.Model(&v6VaultKey{}).Count(&keys).Error; err != nil {
+		return err
+	}
+	if keys > 0 {
+		// 包装后的密钥只在这里，删除后保险库文件再也无法解密
+		return fmt.Errorf("%d users have a vault: %w", keys, ErrIrreversible)
+	}
+	return tx.Migrator().DropTable(&v6VaultFile{}, &v6VaultKey{})
+}
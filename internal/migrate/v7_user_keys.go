@@ -0,0 +1,58 @@
+package migrate
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// 版本 7 增加每用户密钥：users 上包装后的用户密钥和托管副本，files 上标记内容用哪种密钥加密
+
+type v7User struct {
+	ID            uint   `gorm:"primarykey"`
+	UserKey       string `gorm:"type:text"`
+	UserKeyEscrow string `gorm:"size:255"`
+}
+
+func (v7User) TableName() string { return "users" }
+
+type v7File struct {
+	ID        uint `gorm:"primarykey"`
+	UserKeyed bool `gorm:"not null;default:false"`
+}
+
+func (v7File) TableName() string { return "files" }
+
+func userKeysUp(tx *gorm.DB, _ *Env) error {
+	m := tx.Migrator()
+	for _, col := range []string{"UserKey", "UserKeyEscrow"} {
+		if !m.HasColumn(&v7User{}, col) {
+			if err := m.AddColumn(&v7User{}, col); err != nil {
+				return err
+			}
+		}
+	}
+	if !m.HasColumn(&v7File{}, "UserKeyed") {
+		return m.AddColumn(&v7File{}, "UserKeyed")
+	}
+	return nil
+}
+
+func userKeysDown(tx *gorm.DB, _ *Env) error {
+	var keyed int64
+	if err := tx.Model(&v7File{}).Where("user_keyed = ?", true).Count(&keyed).Error; err != nil {
+		return err
+	}
+	if keyed > 0 {
+		// 用户密钥只在 users.user_key 中，删除这一列后这些文件再也无法解密
+		return fmt.Errorf("%d files are encrypted with user keys: %w", keyed, ErrIrreversible)
+	}
+	m := tx.Migrator()
+	if err := m.DropColumn(&v7File{}, "UserKeyed"); err != nil {
+		return err
+	}
+	if err := m.DropColumn(&v7User{}, "UserKeyEscrow"); err != nil {
+		return err
+	}
+	return m.DropColumn(&v7User{}, "UserKey")
+}
@@ -0,0 +1,36 @@
+package migrate
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// 版本 8 增加客户提供的密钥：files 上保存客户密钥的指纹，非空表示内容用客户密钥加密
+
+type v8File struct {
+	ID             uint   `gorm:"primarykey"`
+	CustomerKeyTag string `gorm:"size:128;not null;default:''"`
+}
+
+func (v8File) TableName() string { return "files" }
+
+func customerKeysUp(tx *gorm.DB, _ *Env) error {
+	m := tx.Migrator()
+	if !m.HasColumn(&v8File{}, "CustomerKeyTag") {
+		return m.AddColumn(&v8File{}, "CustomerKeyTag")
+	}
+	return nil
+}
+
+func customerKeysDown(tx *gorm.DB, _ *Env) error {
+	var keyed int64
+	if err := tx.Model(&v8File{}).Where("customer_key_tag <> ?", "").Count(&keyed).Error; err != nil {
+		return err
+	}
+	if keyed > 0 {
+		// 没有这一列就分不出哪些文件要用客户密钥解密
+		return fmt.Errorf("%d files are encrypted with customer-provided keys: %w", keyed, ErrIrreversible)
+	}
+	return tx.Migrator().DropColumn(&v8File{}, "CustomerKeyTag")
+}
@@ -0,0 +1,131 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+	"gorm.io/gorm"
+)
+
+// 版本 9 用元数据密钥加密 webhook 的签名密钥和投递 payload（payload 可能含有文件名）：
+// 新增 enc_secret / enc_payload，把已有的明文加密进去后删除明文列。
+// 回滚把密文解密写回明文列，已有的记录需要密钥。
+
+type v9Webhook struct {
+	ID        uint
+	Secret    string `gorm:"size:128"`
+	EncSecret string `gorm:"type:text"`
+}
+
+func (v9Webhook) TableName() string { return "webhooks" }
+
+type v9WebhookDelivery struct {
+	ID         uint
+	Payload    string `gorm:"type:text"`
+	EncPayload string `gorm:"type:text"`
+}
+
+func (v9WebhookDelivery) TableName() string { return "webhook_deliveries" }
+
+func webhookEncryptionUp(tx *gorm.DB, env *Env) error {
+	m := tx.Migrator()
+	if !m.HasColumn(&v9Webhook{}, "EncSecret") {
+		if err := m.AddColumn(&v9Webhook{}, "EncSecret"); err != nil {
+			return err
+		}
+	}
+	if !m.HasColumn(&v9WebhookDelivery{}, "EncPayload") {
+		if err := m.AddColumn(&v9WebhookDelivery{}, "EncPayload"); err != nil {
+			return err
+		}
+	}
+	encrypt := func(meta *sfbcrypt.MetaCipher, s string) (string, error) { return meta.EncryptString(s) }
+	if m.HasColumn(&v9Webhook{}, "Secret") {
+		if err := convertColumn(tx, "webhooks", "secret", "enc_secret", env, encrypt); err != nil {
+			return err
+		}
+		if err := m.DropColumn(&v9Webhook{}, "Secret"); err != nil {
+			return err
+		}
+	}
+	if m.HasColumn(&v9WebhookDelivery{}, "Payload") {
+		if err := convertColumn(tx, "webhook_deliveries", "payload", "enc_payload", env, encrypt); err != nil {
+			return err
+		}
+		return m.DropColumn(&v9WebhookDelivery{}, "Payload")
+	}
+	return nil
+}
+
+func webhookEncryptionDown(tx *gorm.DB, env *Env) error {
+	m := tx.Migrator()
+	if !m.HasColumn(&v9Webhook{}, "Secret") {
+		if err := m.AddColumn(&v9Webhook{}, "Secret"); err != nil {
+			return err
+		}
+	}
+	if !m.HasColumn(&v9WebhookDelivery{}, "Payload") {
+		if err := m.AddColumn(&v9WebhookDelivery{}, "Payload"); err != nil {
+			return err
+		}
+	}
+	decrypt := func(meta *sfbcrypt.MetaCipher, s string) (string, error) { return meta.DecryptString(s) }
+	if m.HasColumn(&v9Webhook{}, "EncSecret") {
+		if err := convertColumn(tx, "webhooks", "enc_secret", "secret", env, decrypt); err != nil {
+			return err
+		}
+		if err := m.DropColumn(&v9Webhook{}, "EncSecret"); err != nil {
+			return err
+		}
+	}
+	if m.HasColumn(&v9WebhookDelivery{}, "EncPayload") {
+		if err := convertColumn(tx, "webhook_deliveries", "enc_payload", "payload", env, decrypt); err != nil {
+			return err
+		}
+		return m.DropColumn(&v9WebhookDelivery{}, "EncPayload")
+	}
+	return nil
+}
+
+// convertColumn 把 table 中 from 非空、to 为空的行用 convert 改写到 to 列；
+// 只有确实有行要改写时才需要密钥
+func convertColumn(tx *gorm.DB, table, from, to string, env *Env, convert func(*sfbcrypt.MetaCipher, string) (string, error)) error {
+	type row struct {
+		ID    uint
+		Value string
+	}
+	var meta *sfbcrypt.MetaCipher
+	var lastID uint
+	for {
+		var batch []row
+		err := tx.Table(table).Select("id, "+from+" AS value").
+			Where("id > ? AND "+from+" IS NOT NULL AND "+from+" <> ''", lastID).
+			Where(to + " IS NULL OR " + to + " = ''").
+			Order("id asc").Limit(500).Scan(&batch).Error
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if meta == nil {
+			if env.Keys == nil {
+				return errors.New("file_crypto.key is required to convert webhook secrets and payloads")
+			}
+			if meta, err = sfbcrypt.NewMetaCipher(env.Keys.Metadata); err != nil {
+				return err
+			}
+		}
+		for _, r := range batch {
+			lastID = r.ID
+			v, err := convert(meta, r.Value)
+			if err != nil {
+				return fmt.Errorf("%s %d: %w", table, r.ID, err)
+			}
+			if err := tx.Table(table).Where("id = ?", r.ID).Update(to, v).Error; err != nil {
+				return err
+			}
+		}
+	}
+}
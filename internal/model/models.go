@@ -5,31 +5,127 @@ import (
 	"time"
 )
 
+// 用户角色
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
-	ID              uint           `gorm:"primarykey" json:"id"`
-	Email           string         `gorm:"uniqueIndex;size:255" json:"email"`
-	Username        string         `gorm:"size:100" json:"username"`
-	Password        string         `gorm:"size:255" json:"-"`
-	AvatarPath      string         `gorm:"size:1024" json:"-"`
-	AvatarMime      string         `gorm:"size:128" json:"-"`
-	AvatarUpdatedAt *time.Time     `json:"avatar_updated_at,omitempty"`
-	CreatedAt       time.Time      `json:"created_at"`
-	UpdatedAt       time.Time      `json:"updated_at"`
-	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                uint       `gorm:"primarykey" json:"id"`
+	Email             string     `gorm:"uniqueIndex;size:255" json:"email"`
+	Username          string     `gorm:"size:100" json:"username"`
+	Password          string     `gorm:"size:255" json:"-"`
+	Role              string     `gorm:"size:32;default:user;index" json:"role"`
+	Disabled          bool       `gorm:"default:false" json:"disabled"`
+	MustResetPassword bool       `gorm:"default:false" json:"must_reset_password"`
+	AvatarPath        string     `gorm:"size:1024" json:"-"`
+	AvatarMime        string     `gorm:"size:128" json:"-"`
+	AvatarUpdatedAt   *time.Time `json:"avatar_updated_at,omitempty"`
+	// UserKey 为用登录密码包装的用户密钥（sfbcrypt.UserKeyMaterial 的 JSON），空表示还没有；
+	// UserKeyEscrow 为用管理员恢复公钥加密的同一个密钥，没有配置恢复公钥时为空
+	UserKey       string         `gorm:"type:text" json:"-"`
+	UserKeyEscrow string         `gorm:"size:255" json:"-"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
 }
 
+// SSHKey 是用户登记的 SSH 公钥，用于登录 SFTP。
+// Fingerprint 为 SHA256 指纹（与 ssh-keygen -lf 输出相同），同一把公钥只能属于一个用户。
+type SSHKey struct {
+	ID          uint       `gorm:"primarykey" json:"id"`
+	UserID      uint       `gorm:"index" json:"user_id"`
+	Name        string     `gorm:"size:100" json:"name"`
+	Fingerprint string     `gorm:"uniqueIndex;size:64" json:"fingerprint"`
+	PublicKey   string     `gorm:"type:text" json:"public_key"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// S3Credential 是用户的 S3 访问密钥对。验证 SigV4 签名需要原始 secret，
+// 因此 secret 用元数据密钥加密后保存，只在创建时返回一次。
+type S3Credential struct {
+	ID          uint       `gorm:"primarykey" json:"id"`
+	UserID      uint       `gorm:"index" json:"user_id"`
+	Name        string     `gorm:"size:100" json:"name"`
+	AccessKeyID string     `gorm:"uniqueIndex;size:32" json:"access_key_id"`
+	EncSecret   string     `gorm:"type:text" json:"-"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// S3Bucket 属于一个用户，名字只需在该用户内唯一
+type S3Bucket struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	UserID    uint      `gorm:"uniqueIndex:idx_s3_bucket_user_name" json:"user_id"`
+	Name      string    `gorm:"uniqueIndex:idx_s3_bucket_user_name;size:63" json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// S3Object 把桶中的对象映射到一个 File，对象键就是（加密保存的）文件名。
+// KeyTag 是桶 ID 和对象键的 keyed hash，用于按键查找；EncETag 为加密的 ETag（明文 MD5）。
+// FileVersion 是写入 ETag 时文件 updated_at 的毫秒数，文件在别处被修改后两者不再一致。
+type S3Object struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	BucketID    uint      `gorm:"index" json:"bucket_id"`
+	FileID      uint      `gorm:"uniqueIndex" json:"file_id"`
+	KeyTag      string    `gorm:"uniqueIndex;size:64" json:"-"`
+	EncETag     string    `gorm:"column:enc_etag;type:text" json:"-"`
+	FileVersion int64     `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// S3Upload 是进行中的分段上传，分段密文保存在 storage/.s3-multipart/<UploadID>/ 下
+type S3Upload struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	UploadID  string    `gorm:"uniqueIndex;size:64" json:"upload_id"`
+	BucketID  uint      `gorm:"index" json:"bucket_id"`
+	UserID    uint      `gorm:"index" json:"user_id"`
+	EncKey    string    `gorm:"type:text" json:"-"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// S3Part 是已上传的一个分段；ETag 为分段明文的 MD5，完成上传后随分段一起删除
+type S3Part struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	UploadID   uint      `gorm:"uniqueIndex:idx_s3_part_upload_number" json:"upload_id"`
+	PartNumber int       `gorm:"uniqueIndex:idx_s3_part_upload_number" json:"part_number"`
+	Size       int64     `json:"size"`
+	ETag       string    `gorm:"size:64" json:"etag"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// 病毒扫描状态；空字符串表示未扫描
+const (
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanError    = "error"
+)
+
 type File struct {
-	ID             uint           `gorm:"primarykey" json:"id"`
-	EncFilename    string         `gorm:"column:enc_filename;type:text" json:"-"`
-	EncStoragePath string         `gorm:"column:enc_storage_path;type:text" json:"-"`
-	EncSize        string         `gorm:"column:enc_size;type:text" json:"-"`
-	EncDescription string         `gorm:"column:enc_description;type:text" json:"-"`
-	EncUploaderID  string         `gorm:"column:enc_uploader_id;type:text" json:"-"`
-	LegacyFilename string         `gorm:"column:filename" json:"-"`
-	LegacyPath     string         `gorm:"column:storage_path" json:"-"`
-	LegacySize     int64          `gorm:"column:size" json:"-"`
-	LegacyDesc     string         `gorm:"column:description" json:"-"`
-	LegacyUploader string         `gorm:"column:uploader_id" json:"-"`
+	ID             uint   `gorm:"primarykey" json:"id"`
+	EncFilename    string `gorm:"column:enc_filename;type:text" json:"-"`
+	EncStoragePath string `gorm:"column:enc_storage_path;type:text" json:"-"`
+	EncSize        string `gorm:"column:enc_size;type:text" json:"-"`
+	EncDescription string `gorm:"column:enc_description;type:text" json:"-"`
+	EncUploaderID  string `gorm:"column:enc_uploader_id;type:text" json:"-"`
+	// OwnerTag 是上传者 ID 的 keyed hash（盲索引），用于按用户查询而不暴露明文上传者
+	OwnerTag      string     `gorm:"column:owner_tag;size:64;index" json:"-"`
+	ScanStatus    string     `gorm:"size:16;index" json:"scan_status,omitempty"`
+	ScanSignature string     `gorm:"size:255" json:"scan_signature,omitempty"`
+	ScannedAt     *time.Time `json:"scanned_at,omitempty"`
+	// UserKeyed 表示内容用上传者的用户密钥加密，而不是主密钥派生的文件密钥
+	UserKeyed bool `gorm:"not null;default:false" json:"user_keyed"`
+	// CustomerKeyTag 是客户提供的密钥的指纹（见 sfbcrypt.CustomerKeyFingerprint），非空表示内容用客户密钥加密，
+	// 服务器不保存密钥本身；CustomerKeyed 由它得出，供列表接口标记这些文件
+	CustomerKeyTag string         `gorm:"size:128;not null;default:''" json:"-"`
+	CustomerKeyed  bool           `gorm:"-" json:"customer_keyed"`
 	Filename       string         `gorm:"-" json:"filename"`
 	StoragePath    string         `gorm:"-" json:"-"`
 	Size           int64          `gorm:"-" json:"size"`
@@ -39,3 +135,215 @@ type File struct {
 	UpdatedAt      time.Time      `json:"updated_at"`
 	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
 }
+
+// 审计动作
+const (
+	AuditAuthLogin      = "auth.login"
+	AuditAuthRegister   = "auth.register"
+	AuditPasswordChange = "user.password_change"
+	AuditFileUpload     = "file.upload"
+	AuditFileDownload   = "file.download"
+	AuditFileUpdate     = "file.update"
+	AuditFileDelete     = "file.delete"
+	AuditFileShare      = "file.share"
+	AuditSSHKeyAdd      = "user.ssh_key_add"
+	AuditSSHKeyDelete   = "user.ssh_key_delete"
+	AuditS3KeyAdd       = "user.s3_key_add"
+	AuditS3KeyDelete    = "user.s3_key_delete"
+	AuditAdminUser      = "admin.user_update"
+	AuditAdminReset     = "admin.password_reset"
+	AuditAdminDelete    = "admin.user_delete"
+	AuditAdminJob       = "admin.job"
+	AuditVaultKey       = "vault.key_update"
+	AuditVaultUpload    = "vault.upload"
+	AuditVaultDelete    = "vault.delete"
+	AuditSystemSeal     = "system.seal"
+	AuditSystemUnseal   = "system.unseal"
+
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditLog 是只追加的审计记录。每条记录的 Hash 覆盖自身字段和上一条的 Hash，
+// 因此删除或篡改任意一条都能被 Verify 发现。文件只以 ID 引用，不记录解密后的文件名。
+type AuditLog struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	Seq        uint64    `gorm:"uniqueIndex" json:"seq"`
+	ActorID    uint      `gorm:"index" json:"actor_id"`
+	Action     string    `gorm:"size:64;index" json:"action"`
+	TargetType string    `gorm:"size:32" json:"target_type"`
+	TargetID   uint      `gorm:"index" json:"target_id"`
+	IP         string    `gorm:"size:64" json:"ip"`
+	Outcome    string    `gorm:"size:16;index" json:"outcome"`
+	Detail     string    `gorm:"size:255" json:"detail,omitempty"`
+	PrevHash   string    `gorm:"size:64" json:"prev_hash"`
+	Hash       string    `gorm:"size:64" json:"hash"`
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+}
+
+// Webhook 事件
+const (
+	EventFileUploaded        = "file.uploaded"
+	EventFileUpdated         = "file.updated"
+	EventFileDeleted         = "file.deleted"
+	EventUserRegistered      = "user.registered"
+	EventUserPasswordChanged = "user.password_changed"
+	EventUserPasswordReset   = "user.password_reset"
+	EventUserDisabled        = "user.disabled"
+	EventUserEnabled         = "user.enabled"
+	EventUserRoleChanged     = "user.role_changed"
+
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Webhook 由用户或管理员注册。Global 只有管理员可以设置，接收所有用户的事件；
+// 否则只接收 OwnerID 自己产生的事件。Events 以逗号分隔，支持 "user.*" 和 "*"。
+type Webhook struct {
+	ID               uint      `gorm:"primarykey" json:"id"`
+	OwnerID          uint      `gorm:"index" json:"owner_id"`
+	Global           bool      `gorm:"default:false" json:"global"`
+	URL              string    `gorm:"size:1024" json:"url"`
+	EncSecret        string    `gorm:"type:text" json:"-"` // 签名密钥，用元数据密钥加密
+	Events           string    `gorm:"size:512" json:"events"`
+	IncludeFilenames bool      `gorm:"default:false" json:"include_filenames"`
+	Active           bool      `gorm:"default:true" json:"active"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery 是一次待投递/已投递/死信的事件。EncPayload 是签名时使用的原始 JSON，
+// 可能含有文件名，所以用元数据密钥加密；Payload 只在查询投递记录时解密填入，解不开时 Unreadable 为 true
+type WebhookDelivery struct {
+	ID             uint       `gorm:"primarykey" json:"id"`
+	WebhookID      uint       `gorm:"index" json:"webhook_id"`
+	Event          string     `gorm:"size:64" json:"event"`
+	EncPayload     string     `gorm:"type:text" json:"-"`
+	Payload        string     `gorm:"-" json:"payload,omitempty"`
+	Unreadable     bool       `gorm:"-" json:"payload_unreadable,omitempty"`
+	Status         string     `gorm:"size:16;index" json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `gorm:"index" json:"next_attempt_at"`
+	LastStatusCode int        `json:"last_status_code"`
+	LastError      string     `gorm:"size:512" json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// 后台任务状态
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// Job 是持久化的后台任务。Payload 为任务参数的 JSON；运行中的任务持有租约，
+// 执行它的进程崩溃后租约过期，任务会被其他 worker 重新领取。
+// Schedule 不为空表示由该 cron 表达式定时创建。
+type Job struct {
+	ID          uint       `gorm:"primarykey" json:"id"`
+	Type        string     `gorm:"size:64;index" json:"type"`
+	Payload     string     `gorm:"type:text" json:"payload"`
+	Status      string     `gorm:"size:16;index:idx_jobs_status_run_at" json:"status"`
+	RunAt       time.Time  `gorm:"index:idx_jobs_status_run_at" json:"run_at"`
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"max_attempts"`
+	LockedBy    string     `gorm:"size:64" json:"locked_by,omitempty"`
+	LeaseUntil  *time.Time `json:"lease_until,omitempty"`
+	Schedule    string     `gorm:"size:128" json:"schedule,omitempty"`
+	LastError   string     `gorm:"size:512" json:"last_error,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `gorm:"index" json:"finished_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// JobSchedule 记录每种定时任务下一次的触发时间，由配置中的 jobs.schedules 同步而来。
+// Runs 是已触发的次数，同时用作多实例之间领取触发的乐观锁。
+type JobSchedule struct {
+	ID        uint       `gorm:"primarykey" json:"id"`
+	Type      string     `gorm:"uniqueIndex;size:64" json:"type"`
+	Spec      string     `gorm:"size:128" json:"spec"`
+	NextRunAt time.Time  `json:"next_run_at"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	Runs      int64      `json:"runs"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// 存储巡检结果
+const (
+	ScrubKindFile   = "file"
+	ScrubKindAvatar = "avatar"
+
+	ScrubOK          = "ok"
+	ScrubMissing     = "missing"
+	ScrubCorrupt     = "corrupt"
+	ScrubBadMetadata = "bad_metadata"
+	// ScrubLocked 表示密文存在，但服务器当时没有它的密钥（上传者的用户密钥没有解开，或者是客户密钥），无法校验
+	ScrubLocked = "locked"
+)
+
+// ScrubResult 是一个密文最近一次巡检的结果。Kind 为 file 时 RefID 是文件 ID，
+// 为 avatar 时是用户 ID；VerifiedAt 是最后一次完整校验通过的时间。
+type ScrubResult struct {
+	ID         uint       `gorm:"primarykey" json:"id"`
+	Kind       string     `gorm:"size:16;uniqueIndex:idx_scrub_kind_ref" json:"kind"`
+	RefID      uint       `gorm:"uniqueIndex:idx_scrub_kind_ref" json:"ref_id"`
+	Status     string     `gorm:"size:16;index" json:"status"`
+	Error      string     `gorm:"size:512" json:"error,omitempty"`
+	CheckedAt  time.Time  `json:"checked_at"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+// Blob 是去重后被多个文件共享的密文。ContentTag 是明文的 keyed hash（其中包含去重范围），
+// Name 是存储名，路径按分级目录规则得出；文件行仍只在加密的元数据里保存路径，
+// 所以数据库看不出哪些文件共享同一个 Blob。
+type Blob struct {
+	ID         uint   `gorm:"primarykey"`
+	ContentTag string `gorm:"size:64;uniqueIndex"`
+	Name       string `gorm:"size:64;uniqueIndex"`
+	RefCount   int64
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// VaultKey 是用户保险库的密钥材料：Argon2id 参数和用口令密钥包装后的保险库密钥。
+// 服务器无法解开 WrappedKey；Version 每次修改加一，用于并发修改检测。
+type VaultKey struct {
+	ID         uint      `gorm:"primarykey" json:"-"`
+	UserID     uint      `gorm:"uniqueIndex" json:"-"`
+	KDF        string    `gorm:"size:16" json:"-"`
+	KDFTime    uint32    `json:"-"`
+	KDFMemory  uint32    `json:"-"`
+	KDFThreads uint8     `json:"-"`
+	Salt       []byte    `gorm:"size:64" json:"-"`
+	WrappedKey string    `gorm:"size:256" json:"wrapped_key"`
+	Version    uint      `json:"version"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// 保险库文件状态
+const (
+	VaultUploading = "uploading"
+	VaultComplete  = "complete"
+)
+
+// VaultFile 是客户端加密的文件。EncName 和 EncKey 由客户端加密，服务器只知道密文大小和块数；
+// Name 是存储名，上传中的内容在 storage/.vault-uploads 下，完成后移到分级目录。
+type VaultFile struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	UserID    uint      `gorm:"index" json:"-"`
+	EncName   string    `gorm:"size:2048" json:"enc_name"`
+	EncKey    string    `gorm:"size:256" json:"enc_key"`
+	Name      string    `gorm:"size:64;uniqueIndex" json:"-"`
+	Size      int64     `json:"size"`
+	Chunks    uint32    `json:"chunks"`
+	Status    string    `gorm:"size:16;index" json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
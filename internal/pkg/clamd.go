@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ClamdClient 通过 clamd 的 INSTREAM 协议扫描数据流。
+// Address 形如 "tcp://127.0.0.1:3310" 或 "unix:///var/run/clamav/clamd.ctl"，
+// 任何实现了同样协议的服务（例如测试用的替身）都可以使用。
+type ClamdClient struct {
+	network   string
+	address   string
+	timeout   time.Duration
+	chunkSize int
+}
+
+type ScanResult struct {
+	Infected  bool
+	Signature string
+}
+
+const clamdChunkSize = 64 * 1024
+
+func NewClamdClient(address string, timeout time.Duration) (*ClamdClient, error) {
+	network, addr, ok := strings.Cut(address, "://")
+	if !ok || addr == "" || (network != "tcp" && network != "unix") {
+		return nil, fmt.Errorf("invalid clamd address %q, expected tcp://host:port or unix:///path", address)
+	}
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &ClamdClient{network: network, address: addr, timeout: timeout, chunkSize: clamdChunkSize}, nil
+}
+
+// Ping 检查 clamd 是否可用
+func (c *ClamdClient) Ping() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+	return nil
+}
+
+// Scan 把 r 的全部内容以 INSTREAM 发给 clamd 并解析结果。
+// clamd 在超过 StreamMaxLength 时会提前应答，此时返回错误，调用方需要自行排空 r。
+func (c *ClamdClient) Scan(r io.Reader) (ScanResult, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriterSize(conn, c.chunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return ScanResult{}, err
+	}
+	buf := make([]byte, c.chunkSize)
+	var size [4]byte
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			_ = conn.SetDeadline(time.Now().Add(c.timeout))
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := w.Write(size[:]); err != nil {
+				return ScanResult{}, c.earlyReply(conn, err)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return ScanResult{}, c.earlyReply(conn, err)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return ScanResult{}, rerr
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := w.Write(size[:]); err != nil {
+		return ScanResult{}, c.earlyReply(conn, err)
+	}
+	if err := w.Flush(); err != nil {
+		return ScanResult{}, c.earlyReply(conn, err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(c.timeout))
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	return parseClamdReply(reply)
+}
+
+func (c *ClamdClient) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(c.timeout))
+	return conn, nil
+}
+
+// earlyReply 在写失败时尝试读取 clamd 已经发出的错误说明（例如超过大小限制）
+func (c *ClamdClient) earlyReply(conn net.Conn, writeErr error) error {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if reply, err := readClamdReply(conn); err == nil && reply != "" {
+		return fmt.Errorf("clamd: %s", reply)
+	}
+	return writeErr
+}
+
+func readClamdReply(r io.Reader) (string, error) {
+	reply, err := bufio.NewReader(r).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return "", err
+	}
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+func parseClamdReply(reply string) (ScanResult, error) {
+	// 形如 "stream: OK"、"stream: Eicar-Signature FOUND"、"... ERROR"
+	body := reply
+	if i := strings.Index(reply, ": "); i >= 0 {
+		body = reply[i+2:]
+	}
+	switch {
+	case body == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(body, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(body, " FOUND")}, nil
+	case strings.HasSuffix(body, " ERROR"):
+		return ScanResult{}, fmt.Errorf("clamd: %s", strings.TrimSuffix(body, " ERROR"))
+	}
+	return ScanResult{}, fmt.Errorf("unexpected clamd reply %q", reply)
+}
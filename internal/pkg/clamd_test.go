@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/pkg/clamdtest"
+)
+
+func newFakeClamd(t *testing.T, reply func([]byte) string) *clamdtest.Server {
+	srv := clamdtest.NewServer(reply)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestClamdClient(t *testing.T, address string) *ClamdClient {
+	t.Helper()
+	c, err := NewClamdClient(address, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClamdPing(t *testing.T) {
+	f := newFakeClamd(t, clamdtest.EICAR)
+	if err := newTestClamdClient(t, f.Address()).Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+}
+
+func TestClamdScanFraming(t *testing.T) {
+	f := newFakeClamd(t, clamdtest.EICAR)
+	c := newTestClamdClient(t, f.Address())
+	c.chunkSize = 1000
+
+	data := bytes.Repeat([]byte("0123456789"), 250) // 2500 字节，分成 1000+1000+500
+	res, err := c.Scan(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if res.Infected {
+		t.Fatalf("clean stream reported infected: %+v", res)
+	}
+	if got := f.Data(); !bytes.Equal(got, data) {
+		t.Fatalf("clamd received %d bytes, want the %d bytes sent", len(got), len(data))
+	}
+	if got, want := f.Chunks(), []int{1000, 1000, 500}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("chunks = %v, want %v", got, want)
+	}
+}
+
+func TestClamdScanFound(t *testing.T) {
+	f := newFakeClamd(t, clamdtest.EICAR)
+	res, err := newTestClamdClient(t, f.Address()).Scan(strings.NewReader("X5O!P%@AP EICAR test"))
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if !res.Infected || res.Signature != "Eicar-Test-Signature" {
+		t.Fatalf("result = %+v, want infected with Eicar-Test-Signature", res)
+	}
+}
+
+func TestClamdScanError(t *testing.T) {
+	f := newFakeClamd(t, func([]byte) string { return "Can't allocate memory ERROR" })
+	_, err := newTestClamdClient(t, f.Address()).Scan(strings.NewReader("data"))
+	if err == nil || !strings.Contains(err.Error(), "Can't allocate memory") {
+		t.Fatalf("err = %v, want the clamd error", err)
+	}
+}
+
+func TestClamdScanSizeLimit(t *testing.T) {
+	f := newFakeClamd(t, clamdtest.EICAR)
+	f.MaxLen = 4096
+	c := newTestClamdClient(t, f.Address())
+	c.chunkSize = 1024
+
+	_, err := c.Scan(bytes.NewReader(make([]byte, 1<<20)))
+	if err == nil {
+		t.Fatal("Scan past StreamMaxLength succeeded")
+	}
+}
+
+func TestClamdUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "tcp://" + ln.Addr().String()
+	ln.Close()
+	if _, err := newTestClamdClient(t, addr).Scan(strings.NewReader("data")); err == nil {
+		t.Fatal("Scan against a closed port succeeded")
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply     string
+		infected  bool
+		signature string
+		wantErr   bool
+	}{
+		{"stream: OK", false, "", false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", true, "Win.Test.EICAR_HDB-1", false},
+		{"stream: Some failure ERROR", false, "", true},
+		{"garbage", false, "", true},
+	}
+	for _, tt := range tests {
+		res, err := parseClamdReply(tt.reply)
+		if (err != nil) != tt.wantErr || res.Infected != tt.infected || res.Signature != tt.signature {
+			t.Errorf("parseClamdReply(%q) = %+v, %v", tt.reply, res, err)
+		}
+	}
+}
+
+func TestNewClamdClientAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:3310", "http://x", "tcp://"} {
+		if _, err := NewClamdClient(addr, time.Second); err == nil {
+			t.Errorf("NewClamdClient(%q) accepted an invalid address", addr)
+		}
+	}
+}
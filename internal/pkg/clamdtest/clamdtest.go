@@ -0,0 +1,119 @@
+// Package clamdtest 提供测试用的 clamd 替身，实现 zPING 和 zINSTREAM，
+// 用法与 net/http/httptest 类似：
+//
+//	srv := clamdtest.NewServer(clamdtest.EICAR)
+//	defer srv.Close()
+//	client, _ := pkg.NewClamdClient(srv.Address(), time.Second)
+package clamdtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// Server 记录收到的分块大小和完整内容；应答由 Reply 根据完整内容决定，
+// 形如 "OK"、"Eicar-Signature FOUND" 或 "... ERROR"（不带 "stream: " 前缀）。
+// MaxLen 大于 0 时模拟 StreamMaxLength：超过后提前应答错误并断开
+type Server struct {
+	Reply  func(data []byte) string
+	MaxLen int
+
+	ln     net.Listener
+	mu     sync.Mutex
+	chunks []int
+	data   []byte
+}
+
+// EICAR 把含有 "EICAR" 的内容报告为 Eicar-Test-Signature
+func EICAR(data []byte) string {
+	if bytes.Contains(data, []byte("EICAR")) {
+		return "Eicar-Test-Signature FOUND"
+	}
+	return "OK"
+}
+
+// NewServer 在 127.0.0.1 的随机端口上启动替身
+func NewServer(reply func(data []byte) string) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("clamdtest: " + err.Error())
+	}
+	s := &Server{Reply: reply, ln: ln}
+	go s.serve()
+	return s
+}
+
+// Address 是 pkg.NewClamdClient 使用的地址
+func (s *Server) Address() string { return "tcp://" + s.ln.Addr().String() }
+
+func (s *Server) Close() { s.ln.Close() }
+
+// Chunks 返回最近一次 INSTREAM 的分块大小
+func (s *Server) Chunks() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.chunks...)
+}
+
+// Data 返回最近一次完整收到的内容
+func (s *Server) Data() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.data...)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch cmd {
+	case "zPING\x00":
+		_, _ = conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		var data []byte
+		var chunks []int
+		for {
+			var size [4]byte
+			if _, err := io.ReadFull(r, size[:]); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size[:])
+			if n == 0 {
+				break
+			}
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			chunks = append(chunks, int(n))
+			data = append(data, chunk...)
+			if s.MaxLen > 0 && len(data) > s.MaxLen {
+				_, _ = conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				return
+			}
+		}
+		s.mu.Lock()
+		s.chunks, s.data = chunks, data
+		s.mu.Unlock()
+		_, _ = conn.Write([]byte("stream: " + s.Reply(data) + "\x00"))
+	default:
+		_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
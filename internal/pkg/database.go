@@ -2,81 +2,137 @@ package pkg
 
 import (
 	"fmt"
-	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/Kaikai20040827/graduation/internal/config"
-	"github.com/Kaikai20040827/graduation/internal/model"
 
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
 var DB *gorm.DB
 
+// NewAdminDatabase 用管理员账号连接服务器自带的库（mysql 的 "mysql"、postgres 的 "postgres"）；
+// sqlite 没有服务器和账号，不支持
 func NewAdminDatabase(cfg *config.DatabaseConfig) (*gorm.DB, error) {
-    dsn := fmt.Sprintf(
-        "%s:%s@tcp(%s:%d)/mysql?charset=utf8mb4&parseTime=True&loc=Local",
-        cfg.AdminUser,
-        cfg.AdminPassword,
-        cfg.Host,
-        cfg.Port,
-    )
-
-    return gorm.Open(mysql.Open(dsn), &gorm.Config{
+    var dialector gorm.Dialector
+    switch cfg.Driver {
+    case "", "mysql":
+        dialector = mysql.Open(mysqlDSN(cfg.AdminUser, cfg.AdminPassword, cfg.Host, cfg.Port, "mysql"))
+    case "postgres":
+        dialector = postgres.Open(postgresDSN(cfg.AdminUser, cfg.AdminPassword, cfg.Host, cfg.Port, "postgres", cfg.SSLMode))
+    default:
+        return nil, fmt.Errorf("admin connection is not supported for database driver %q", cfg.Driver)
+    }
+
+    return gorm.Open(dialector, &gorm.Config{
         Logger: logger.Default.LogMode(logger.Silent),
     })
 }
 
 func NewDatabase(cfg *config.DatabaseConfig) (*gorm.DB, error) {
     //数据库登入基本信息
-    dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-		cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Name,
-	)
-    fmt.Println("✓ Database login basic information done")
+    dialector, err := openDialector(cfg)
+    if err != nil {
+        return nil, err
+    }
+    fmt.Fprintf(config.Progress, "✓ Database login basic information done (%s)\n", cfg.Driver)
 
     //配置访问时的日志模式
     gormConfig := &gorm.Config{
         Logger: logger.Default.LogMode(logger.Silent),
     }
-    fmt.Println("✓ Database logger mode configuration done")
+    fmt.Fprintln(config.Progress, "✓ Database logger mode configuration done")
 
     //创建一个数据库访问实例
-    db, err := gorm.Open(mysql.Open(dsn), gormConfig)
+    db, err := gorm.Open(dialector, gormConfig)
     if err != nil {
         return nil, err
     }
-    fmt.Println("✓ Creating a database connection done")
+    fmt.Fprintln(config.Progress, "✓ Creating a database connection done")
 
     //连接数据库
     sqlDB, err := db.DB()
     if err != nil {
         return nil, err
     }
-    fmt.Println("✓ Connecting the database done")
+    fmt.Fprintln(config.Progress, "✓ Connecting the database done")
 
     //配置连接
-    sqlDB.SetConnMaxIdleTime(20 * time.Minute) //最大闲置连接时间
-    sqlDB.SetConnMaxLifetime(time.Hour) //最大连接生命周期: Hour（小时）
-    sqlDB.SetMaxOpenConns(100) //最大打开的连接数量
-    fmt.Println("✓ Setting configuration of the connection done")
+    if cfg.Driver == "sqlite" {
+        // SQLite 同一时刻只允许一个写入者，单连接避免 "database is locked"；
+        // 连接不过期，否则 :memory: 数据库会随连接一起消失
+        sqlDB.SetMaxOpenConns(1)
+        sqlDB.SetMaxIdleConns(1)
+        sqlDB.SetConnMaxLifetime(0)
+        sqlDB.SetConnMaxIdleTime(0)
+    } else {
+        sqlDB.SetConnMaxIdleTime(20 * time.Minute) //最大闲置连接时间
+        sqlDB.SetConnMaxLifetime(time.Hour) //最大连接生命周期: Hour（小时）
+        sqlDB.SetMaxOpenConns(100) //最大打开的连接数量
+    }
+    fmt.Fprintln(config.Progress, "✓ Setting configuration of the connection done")
 
-    //全局保存这个数据库访问
+    //全局保存这个数据库访问；表结构由 internal/migrate 负责
     DB = db
 
-    if err := migrate(db); err != nil {
-		log.Printf("自动迁移失败: %v", err)
-	}
-    fmt.Println("✓ Migrating the database done")
-
     //无异常，则返回数据库
     return db, nil
 }
 
-func migrate(db *gorm.DB) error {
-    return db.AutoMigrate(
-        &model.User{},
-        &model.File{},
-    )
+// openDialector 按 cfg.Driver 构造对应驱动的 DSN
+func openDialector(cfg *config.DatabaseConfig) (gorm.Dialector, error) {
+	switch cfg.Driver {
+	case "", "mysql":
+		return mysql.Open(mysqlDSN(cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Name)), nil
+	case "postgres":
+		return postgres.Open(postgresDSN(cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Name, cfg.SSLMode)), nil
+	case "sqlite":
+		if cfg.Path != ":memory:" {
+			if err := os.MkdirAll(filepath.Dir(cfg.Path), 0700); err != nil {
+				return nil, err
+			}
+		}
+		return sqlite.Open(sqliteDSN(cfg.Path)), nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", cfg.Driver)
+	}
+}
+
+func mysqlDSN(user, password, host string, port int, name string) string {
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+		user, password, host, port, name,
+	)
+}
+
+// postgresDSN 使用 URL 形式，用户名和密码中的特殊字符由 net/url 转义
+func postgresDSN(user, password, host string, port int, name, sslMode string) string {
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(user, password),
+		Host:     net.JoinHostPort(host, strconv.Itoa(port)),
+		Path:     "/" + name,
+		RawQuery: url.Values{"sslmode": {sslMode}}.Encode(),
+	}
+	return u.String()
+}
+
+// sqliteDSN 打开外键约束并设置忙等待；文件数据库使用 WAL 日志
+func sqliteDSN(path string) string {
+	params := "_foreign_keys=on&_busy_timeout=5000"
+	if path == ":memory:" {
+		return "file::memory:?" + params
+	}
+	return "file:" + path + "?" + params + "&_journal_mode=WAL"
 }
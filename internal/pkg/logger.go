@@ -3,6 +3,7 @@ package pkg
 import (
 	"log"
 	"fmt"
+	"github.com/Kaikai20040827/graduation/internal/config"
 	"go.uber.org/zap"
 )
 
@@ -13,10 +14,10 @@ func InitLogger(debug bool) {
 
 	if debug {
 		Logger, err = zap.NewDevelopment()
-		fmt.Println("✓ Setting development logger done")
+		fmt.Fprintln(config.Progress, "✓ Setting development logger done")
 	} else {
 		Logger, err = zap.NewProduction()
-		fmt.Println("✓ Setting production logger done")
+		fmt.Fprintln(config.Progress, "✓ Setting production logger done")
 	}
 	if err != nil {
 		log.Fatalf("init logger error: %v", err)
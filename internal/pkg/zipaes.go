@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"io"
+)
+
+// WinZip AES（AE-2）加密条目，7-Zip、WinZip、macOS Archive Utility 等都能解开。
+// 格式：salt(16) || 密码校验值(2) || AES-256-CTR(小端计数器) 密文 || HMAC-SHA1 前 10 字节。
+const (
+	zipAESMethod     = 99
+	zipAESExtraID    = 0x9901
+	zipAESSaltLen    = 16
+	zipAESKeyLen     = 32
+	zipAESAuthLen    = 10
+	zipAESIterations = 1000
+)
+
+type ZipAESEntry struct {
+	header   *zip.FileHeader
+	raw      io.Writer
+	ctr      *zipAESCTR
+	mac      hash.Hash
+	deflate  *flate.Writer
+	plainN   int64
+	cipherN  int64
+	finished bool
+}
+
+// CreateZipAESEntry 在 zw 中创建一个使用 AES-256 加密、deflate 压缩的条目。
+// 调用方写完内容后必须调用 Close，然后才能创建下一个条目。
+func CreateZipAESEntry(zw *zip.Writer, fh *zip.FileHeader, password string) (*ZipAESEntry, error) {
+	salt := make([]byte, zipAESSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	encKey, authKey, verifier, err := zipAESKeys(password, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], zipAESExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], 2) // AE-2：不写 CRC
+	extra[6], extra[7] = 'A', 'E'
+	extra[8] = 3 // AES-256
+	binary.LittleEndian.PutUint16(extra[9:], zip.Deflate)
+
+	fh.Method = zipAESMethod
+	fh.Extra = append(fh.Extra, extra...)
+	fh.Flags |= 0x1 | 0x8 // 加密 + 数据描述符（大小在写完后才知道）
+	fh.CRC32 = 0
+	raw, err := zw.CreateRaw(fh)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := raw.Write(salt); err != nil {
+		return nil, err
+	}
+	if _, err := raw.Write(verifier); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	e := &ZipAESEntry{
+		header:  fh,
+		raw:     raw,
+		ctr:     &zipAESCTR{block: block},
+		mac:     hmac.New(sha1.New, authKey),
+		cipherN: int64(len(salt) + len(verifier)),
+	}
+	e.deflate, err = flate.NewWriter(zipAESSink{e}, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// zipAESKeys 用 PBKDF2-HMAC-SHA1 从密码派生加密密钥、HMAC 密钥和 2 字节的密码校验值
+func zipAESKeys(password string, salt []byte) (encKey, authKey, verifier []byte, err error) {
+	keys, err := pbkdf2.Key(sha1.New, password, salt, zipAESIterations, 2*zipAESKeyLen+2)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[:zipAESKeyLen], keys[zipAESKeyLen : 2*zipAESKeyLen], keys[2*zipAESKeyLen:], nil
+}
+
+func (e *ZipAESEntry) Write(p []byte) (int, error) {
+	n, err := e.deflate.Write(p)
+	e.plainN += int64(n)
+	return n, err
+}
+
+// Close 写出认证码并回填条目大小，供数据描述符和中央目录使用
+func (e *ZipAESEntry) Close() error {
+	if e.finished {
+		return nil
+	}
+	e.finished = true
+	if err := e.deflate.Close(); err != nil {
+		return err
+	}
+	auth := e.mac.Sum(nil)[:zipAESAuthLen]
+	if _, err := e.raw.Write(auth); err != nil {
+		return err
+	}
+	e.cipherN += zipAESAuthLen
+
+	e.header.CompressedSize64 = uint64(e.cipherN)
+	e.header.UncompressedSize64 = uint64(e.plainN)
+	e.header.CompressedSize = uint32(min(e.header.CompressedSize64, 0xffffffff))
+	e.header.UncompressedSize = uint32(min(e.header.UncompressedSize64, 0xffffffff))
+	return nil
+}
+
+// zipAESSink 接收压缩后的数据，加密并计算 HMAC 后写入 zip
+type zipAESSink struct {
+	e *ZipAESEntry
+}
+
+func (s zipAESSink) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	s.e.ctr.XORKeyStream(buf, p)
+	s.e.mac.Write(buf)
+	n, err := s.e.raw.Write(buf)
+	s.e.cipherN += int64(n)
+	return n, err
+}
+
+// zipAESCTR 是 WinZip 使用的 CTR 变体：计数器从 1 开始、小端递增，
+// 与 crypto/cipher 的大端 CTR 不兼容。
+type zipAESCTR struct {
+	block   cipher.Block
+	counter uint64
+	stream  [aes.BlockSize]byte
+	used    int
+}
+
+func (c *zipAESCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.counter == 0 || c.used == aes.BlockSize {
+			c.counter++
+			var ctr [aes.BlockSize]byte
+			binary.LittleEndian.PutUint64(ctr[:], c.counter)
+			c.block.Encrypt(c.stream[:], ctr[:])
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.stream[c.used]
+		c.used++
+	}
+}
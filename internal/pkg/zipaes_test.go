@@ -0,0 +1,219 @@
+package pkg
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// 期望值由 Python hashlib.pbkdf2_hmac("sha1", b"pass word", bytes(range(16)), 1000, 66) 算出
+func TestZipAESKeysKnownVector(t *testing.T) {
+	salt := make([]byte, zipAESSaltLen)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	encKey, authKey, verifier, err := zipAESKeys("pass word", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustHex(t, "96ee9f13af9a1df9fd3fb006587695ee8de161d507141bcb9219ee20a49fe936"+
+		"0c385b37c511b6db5a033f025ad414e5cc2dda084940ba6e4e5691c2e1d4afc1"+"c6c6")
+	if !bytes.Equal(encKey, want[:32]) || !bytes.Equal(authKey, want[32:64]) || !bytes.Equal(verifier, want[64:]) {
+		t.Fatalf("zipAESKeys = %x %x %x", encKey, authKey, verifier)
+	}
+}
+
+// 全零密钥下前两块密钥流是 AES-256(0, LE(1)) 和 AES-256(0, LE(2))，由 openssl enc -aes-256-ecb 算出
+func TestZipAESCTRKnownVector(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctr := &zipAESCTR{block: block}
+	stream := make([]byte, 32)
+	// 分两次调用，跨过块边界
+	ctr.XORKeyStream(stream[:5], stream[:5])
+	ctr.XORKeyStream(stream[5:], stream[5:])
+	if want := mustHex(t, "5275f3d86b4fb8684593133ebfa53cd3779b38d15bffb63d8d609d551a5cc98e"); !bytes.Equal(stream, want) {
+		t.Fatalf("keystream = %x", stream)
+	}
+}
+
+var (
+	errZipAESVerifier = errors.New("password verifier mismatch")
+	errZipAESAuth     = errors.New("authentication code mismatch")
+)
+
+// openZipAES 按 WinZip AE-2 规范独立解开一个条目：校验密码校验值和 HMAC，再解密、解压
+func openZipAES(t *testing.T, f *zip.File, password string) ([]byte, error) {
+	t.Helper()
+	if f.Method != zipAESMethod || f.Flags&0x1 == 0 {
+		t.Fatalf("%s: method %d flags %#x", f.Name, f.Method, f.Flags)
+	}
+	extra := f.Extra
+	for len(extra) >= 4 && binary.LittleEndian.Uint16(extra) != zipAESExtraID {
+		extra = extra[4+binary.LittleEndian.Uint16(extra[2:]):]
+	}
+	if len(extra) < 11 || binary.LittleEndian.Uint16(extra[4:]) != 2 || string(extra[6:8]) != "AE" ||
+		extra[8] != 3 || binary.LittleEndian.Uint16(extra[9:]) != zip.Deflate {
+		t.Fatalf("%s: AES extra field %x", f.Name, f.Extra)
+	}
+	r, err := f.OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(raw)) != f.CompressedSize64 || len(raw) < 16+2+10 {
+		t.Fatalf("%s: %d raw bytes, compressed size %d", f.Name, len(raw), f.CompressedSize64)
+	}
+	salt, verifier, data, auth := raw[:16], raw[16:18], raw[18:len(raw)-10], raw[len(raw)-10:]
+
+	keys, err := pbkdf2.Key(sha1.New, password, salt, 1000, 66)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys[64:], verifier) {
+		return nil, errZipAESVerifier
+	}
+	mac := hmac.New(sha1.New, keys[32:64])
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil)[:10], auth) {
+		return nil, errZipAESAuth
+	}
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, len(data))
+	var counter, stream [aes.BlockSize]byte
+	for i := 0; i < len(data); i += aes.BlockSize {
+		binary.LittleEndian.PutUint64(counter[:], uint64(i/aes.BlockSize+1))
+		block.Encrypt(stream[:], counter[:])
+		for j := i; j < len(data) && j < i+aes.BlockSize; j++ {
+			plain[j] = data[j] ^ stream[j-i]
+		}
+	}
+	out, err := io.ReadAll(flate.NewReader(bytes.NewReader(plain)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(out)) != f.UncompressedSize64 {
+		t.Fatalf("%s: %d bytes, uncompressed size %d", f.Name, len(out), f.UncompressedSize64)
+	}
+	return out, nil
+}
+
+var zipAESTestEntries = []struct {
+	name    string
+	content []byte
+}{
+	{"empty.txt", nil},
+	{"report.txt", []byte(strings.Repeat("secure file box\n", 10000))},
+	{"dir/random.bin", bytes.Repeat([]byte{0x00, 0xff, 0x13, 0x37, 0x42}, 7001)},
+}
+
+func writeZipAES(t *testing.T, password string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range zipAESTestEntries {
+		w, err := CreateZipAESEntry(zw, &zip.FileHeader{Name: e.name}, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestZipAESRoundTrip(t *testing.T) {
+	data := writeZipAES(t, "pass word")
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(zipAESTestEntries) {
+		t.Fatalf("%d entries", len(zr.File))
+	}
+	for i, f := range zr.File {
+		got, err := openZipAES(t, f, "pass word")
+		if err != nil || f.Name != zipAESTestEntries[i].name || !bytes.Equal(got, zipAESTestEntries[i].content) {
+			t.Fatalf("%s: %d bytes, %v", f.Name, len(got), err)
+		}
+	}
+
+	// 改动密文的任意一个字节，HMAC 都对不上
+	f := zr.File[1]
+	offset, err := f.DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), data...)
+	tampered[offset+100] ^= 1
+	zr, err = zip.NewReader(bytes.NewReader(tampered), int64(len(tampered)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openZipAES(t, zr.File[1], "pass word"); !errors.Is(err, errZipAESAuth) {
+		t.Fatalf("tampered entry: %v", err)
+	}
+}
+
+// 有 bsdtar（libarchive）时再用它解一遍
+func TestZipAESBsdtar(t *testing.T) {
+	bsdtar, err := exec.LookPath("bsdtar")
+	if err != nil {
+		t.Skip("bsdtar not installed")
+	}
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "out.zip")
+	if err := os.WriteFile(archive, writeZipAES(t, "pass word"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "x")
+	if err := os.Mkdir(out, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := exec.Command(bsdtar, "-x", "--passphrase", "pass word", "-C", out, "-f", archive).CombinedOutput(); err != nil {
+		t.Fatalf("bsdtar: %v: %s", err, msg)
+	}
+	for _, e := range zipAESTestEntries {
+		got, err := os.ReadFile(filepath.Join(out, e.name))
+		if err != nil || !bytes.Equal(got, e.content) {
+			t.Fatalf("%s: %d bytes, %v", e.name, len(got), err)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/Kaikai20040827/graduation/internal/config"
 	"github.com/Kaikai20040827/graduation/internal/handler"
 	"github.com/Kaikai20040827/graduation/internal/middleware"
+	"github.com/Kaikai20040827/graduation/internal/service"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -20,16 +21,30 @@ func RegisterAPIRoutes(
 	authH *handler.AuthHandler,
 	userH *handler.UserHandler,
 	fileH *handler.FileHandler,
+	adminH *handler.AdminHandler,
+	auditH *handler.AuditHandler,
+	webhookH *handler.WebhookHandler,
+	jobH *handler.JobHandler,
+	vaultH *handler.VaultHandler,
+	sealH *handler.SealHandler,
+	userSrv *service.UserService,
 	jwtCfg *config.JWTConfig,
 ) {
 	api := r.Group("/api/v1")
+	jwtAuth := middleware.JWTAuthMiddleware(jwtCfg, userSrv)
 
 	// 公共 API
 	{
 		api.GET("/ping", handler.Ping)
 
+		// 封存状态和解封，封存期间只有这些接口可用（见 middleware.SealGate）
+		api.GET("/sys/seal-status", sealH.SealStatus)
+		api.POST("/sys/unseal", sealH.Unseal)
+
 		// 公共文件上传（无需认证，供前端测试或匿名上传使用）
 		api.POST("/files/public/upload", fileH.UploadFilePublic)
+		// 分享链接，令牌本身就是凭证
+		api.GET("/share/:token", fileH.DownloadShared)
 
 		auth := api.Group("/auth")
 		{
@@ -40,21 +55,75 @@ func RegisterAPIRoutes(
 
 	// 需要认证
 	authRequired := api.Group("")
-	authRequired.Use(middleware.JWTAuthMiddleware(jwtCfg))
+	authRequired.Use(jwtAuth)
 	{
+		authRequired.POST("/auth/refresh", authH.Refresh)
+
 		// 用户
 		authRequired.GET("/user/profile", userH.GetProfile)
 		authRequired.PUT("/user/profile", userH.UpdateProfile)
 		authRequired.GET("/user/avatar", userH.GetAvatar)
 		authRequired.PUT("/user/avatar", userH.UpdateAvatar)
 		authRequired.PUT("/user/password", userH.ChangePassword)
+		authRequired.GET("/user/ssh-keys", userH.ListSSHKeys)
+		authRequired.POST("/user/ssh-keys", userH.AddSSHKey)
+		authRequired.DELETE("/user/ssh-keys/:id", userH.DeleteSSHKey)
 
 		// 文件
 		authRequired.POST("/files/upload", fileH.UploadFile)
 		authRequired.GET("/files", fileH.ListFiles)
 		authRequired.GET("/files/download/:id", fileH.DownloadFile)
+		authRequired.POST("/files/archive", fileH.DownloadArchive)
+		authRequired.POST("/files/:id/share", fileH.ShareFile)
 		authRequired.PUT("/files/:id", fileH.UpdateFile)
 		authRequired.DELETE("/files/:id", fileH.DeleteFile)
+
+		// 保险库（客户端加密）
+		authRequired.GET("/vault", vaultH.GetVault)
+		authRequired.PUT("/vault", vaultH.PutVault)
+		authRequired.GET("/vault/files", vaultH.ListFiles)
+		authRequired.POST("/vault/files", vaultH.CreateFile)
+		authRequired.GET("/vault/files/:id", vaultH.GetFile)
+		authRequired.PUT("/vault/files/:id/chunks/:n", vaultH.PutChunk)
+		authRequired.GET("/vault/files/:id/content", vaultH.DownloadContent)
+		authRequired.DELETE("/vault/files/:id", vaultH.DeleteFile)
+
+		// Webhook
+		authRequired.POST("/webhooks", webhookH.CreateWebhook)
+		authRequired.GET("/webhooks", webhookH.ListWebhooks)
+		authRequired.DELETE("/webhooks/:id", webhookH.DeleteWebhook)
+		authRequired.GET("/webhooks/:id/deliveries", webhookH.ListDeliveries)
+		authRequired.POST("/webhooks/deliveries/:id/retry", webhookH.Redeliver)
+	}
+
+	// 管理员
+	authRequired.POST("/sys/seal", middleware.RequireAdmin(), sealH.Seal)
+
+	admin := authRequired.Group("/admin")
+	admin.Use(middleware.RequireAdmin())
+	{
+		admin.GET("/users", adminH.ListUsers)
+		admin.GET("/users/:id", adminH.GetUser)
+		admin.GET("/users/:id/storage", adminH.GetUserStorage)
+		admin.POST("/users/:id/disable", adminH.DisableUser)
+		admin.POST("/users/:id/enable", adminH.EnableUser)
+		admin.POST("/users/:id/reset-password", adminH.ResetPassword)
+		admin.PUT("/users/:id/role", adminH.SetRole)
+		admin.DELETE("/users/:id", adminH.DeleteUser)
+
+		admin.GET("/storage/health", adminH.StorageHealth)
+
+		admin.GET("/audit", auditH.ListAudit)
+		admin.GET("/audit/verify", auditH.VerifyAudit)
+
+		admin.GET("/webhooks/dead-letters", webhookH.ListDeadLetters)
+
+		admin.GET("/jobs", jobH.ListJobs)
+		admin.POST("/jobs", jobH.EnqueueJob)
+		admin.GET("/jobs/types", jobH.ListJobTypes)
+		admin.GET("/jobs/:id", jobH.GetJob)
+		admin.POST("/jobs/:id/cancel", jobH.CancelJob)
+		admin.POST("/jobs/:id/rerun", jobH.RerunJob)
 	}
 
 	// Legacy routes (no /api/v1 prefix) for compatibility with older clients
@@ -62,7 +131,7 @@ func RegisterAPIRoutes(
 		r.POST("/files/public/upload", fileH.UploadFilePublic)
 
 		legacyAuth := r.Group("")
-		legacyAuth.Use(middleware.JWTAuthMiddleware(jwtCfg))
+		legacyAuth.Use(jwtAuth)
 		legacyAuth.POST("/files/upload", fileH.UploadFile)
 		legacyAuth.GET("/files", fileH.ListFiles)
 		legacyAuth.GET("/files/download/:id", fileH.DownloadFile)
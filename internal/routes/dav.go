@@ -0,0 +1,25 @@
+package routes
+
+import (
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/handler"
+	"github.com/Kaikai20040827/graduation/internal/middleware"
+	"github.com/Kaikai20040827/graduation/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// davMethods 是 WebDAV 客户端会用到的全部方法（RFC 4918）
+var davMethods = []string{
+	"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS",
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// RegisterDAVRoutes 在 /dav/ 下挂载 WebDAV，认证方式为 Basic（邮箱 + 密码）或 Bearer token
+func RegisterDAVRoutes(r *gin.Engine, davH *handler.WebDAVHandler, userSrv *service.UserService, jwtCfg *config.JWTConfig) {
+	davAuth := middleware.DAVAuthMiddleware(jwtCfg, userSrv)
+	for _, method := range davMethods {
+		r.Handle(method, "/dav", davAuth, davH.Serve)
+		r.Handle(method, "/dav/*path", davAuth, davH.Serve)
+	}
+}
@@ -0,0 +1,12 @@
+package routes
+
+import (
+	"github.com/Kaikai20040827/graduation/internal/handler"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterMetricsRoutes 挂载 /metrics；认证由 metrics.token 在 handler 中检查
+func RegisterMetricsRoutes(r *gin.Engine, metricsH *handler.MetricsHandler) {
+	r.GET("/metrics", metricsH.Metrics)
+}
@@ -0,0 +1,27 @@
+package routes
+
+import (
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/handler"
+	"github.com/Kaikai20040827/graduation/internal/middleware"
+	"github.com/Kaikai20040827/graduation/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterS3KeyRoutes 注册管理 S3 访问密钥的 API，挂在主服务的 /api/v1/user/s3-keys 下
+func RegisterS3KeyRoutes(r *gin.Engine, s3H *handler.S3Handler, userSrv *service.UserService, jwtCfg *config.JWTConfig) {
+	keys := r.Group("/api/v1/user/s3-keys", middleware.JWTAuthMiddleware(jwtCfg, userSrv))
+	keys.GET("", s3H.ListS3Keys)
+	keys.POST("", s3H.CreateS3Key)
+	keys.DELETE("/:id", s3H.DeleteS3Key)
+}
+
+// SetupS3Router 创建 S3 API 使用的独立路由。S3 客户端以路径风格访问 /bucket/key，
+// 操作由方法和查询参数区分，全部交给 S3Handler 分派；这里不使用 CORS 和网页路由。
+func SetupS3Router(s3H *handler.S3Handler) *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Logger(), gin.Recovery())
+	r.Any("/*path", s3H.Serve)
+	return r
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+)
+
+var (
+	ErrFileForbidden   = errors.New("file access denied")
+	ErrArchiveTooLarge = errors.New("too many files in archive")
+	ErrArchiveEmpty    = errors.New("no files selected")
+)
+
+const MaxArchiveEntries = 1000
+
+// ArchiveEntry 是打包时的一项：Name 为去重后的 zip 条目名
+type ArchiveEntry struct {
+	File *model.File
+	Name string
+}
+
+// publicUploaderID 是匿名公共上传（POST /api/v1/files/public/upload）的 UploaderID
+const publicUploaderID = "0"
+
+// CanRead 判断用户能否读取文件：管理员可以读取全部，普通用户只能读取自己上传的
+// 和匿名公共上传的文件
+func (f *FileService) CanRead(file *model.File, userID uint, isAdmin bool) bool {
+	return f.CanModify(file, userID, isAdmin) || file.UploaderID == publicUploaderID
+}
+
+// CanModify 判断用户能否修改或删除文件：只有上传者和管理员可以；匿名公共上传的文件没有上传者，只有管理员可以
+func (f *FileService) CanModify(file *model.File, userID uint, isAdmin bool) bool {
+	return isAdmin || file.UploaderID == strconv.FormatUint(uint64(userID), 10)
+}
+
+// PrepareArchive 在开始输出任何数据之前逐个检查权限，避免写到一半才失败
+func (f *FileService) PrepareArchive(ids []uint, userID uint, isAdmin bool) ([]ArchiveEntry, error) {
+	if len(ids) == 0 {
+		return nil, ErrArchiveEmpty
+	}
+	if len(ids) > MaxArchiveEntries {
+		return nil, ErrArchiveTooLarge
+	}
+	seen := make(map[uint]bool, len(ids))
+	used := make(map[string]bool, len(ids))
+	entries := make([]ArchiveEntry, 0, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		file, err := f.GetFileByID(id)
+		if err != nil {
+			return nil, fmt.Errorf("file %d: %w", id, err)
+		}
+		if !f.CanRead(file, userID, isAdmin) {
+			return nil, fmt.Errorf("file %d: %w", id, ErrFileForbidden)
+		}
+		if err := f.EnsureDownloadable(file); err != nil {
+			return nil, fmt.Errorf("file %d: %w", id, err)
+		}
+		entries = append(entries, ArchiveEntry{File: file, Name: uniqueEntryName(file, used)})
+	}
+	return entries, nil
+}
+
+// WriteArchive 把解密后的内容直接写入 zip 流，不产生任何临时文件。
+// password 非空时每个条目使用 WinZip AES-256 加密。
+func (f *FileService) WriteArchive(w io.Writer, entries []ArchiveEntry, password string) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		fh := &zip.FileHeader{
+			Name:     entry.Name,
+			Method:   zip.Deflate,
+			Modified: entry.File.UpdatedAt,
+		}
+		if password == "" {
+			fw, err := zw.CreateHeader(fh)
+			if err != nil {
+				return err
+			}
+			if err := f.DecryptFile(fw, entry.File); err != nil {
+				return fmt.Errorf("file %d: %w", entry.File.ID, err)
+			}
+			continue
+		}
+
+		aw, err := pkg.CreateZipAESEntry(zw, fh, password)
+		if err != nil {
+			return err
+		}
+		if err := f.DecryptFile(aw, entry.File); err != nil {
+			return fmt.Errorf("file %d: %w", entry.File.ID, err)
+		}
+		if err := aw.Close(); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// uniqueEntryName 用解密后的文件名作为条目名；重名（不区分大小写）时追加 " (2)"、" (3)"…
+func uniqueEntryName(file *model.File, used map[string]bool) string {
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(file.Filename)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" {
+		name = "file-" + strconv.FormatUint(uint64(file.ID), 10)
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 2; used[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
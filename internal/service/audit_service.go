@@ -0,0 +1,245 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+type AuditService struct {
+	db *gorm.DB
+	// key 由 mutex 保护，封存时清零
+	key   []byte
+	mutex sync.Mutex
+}
+
+// AuditEntry 是调用方需要提供的字段，Seq/PrevHash/Hash/CreatedAt 由服务填写
+type AuditEntry struct {
+	ActorID    uint
+	Action     string
+	TargetType string
+	TargetID   uint
+	IP         string
+	Outcome    string
+	Detail     string
+}
+
+type AuditFilter struct {
+	ActorID    *uint
+	Action     string
+	TargetType string
+	TargetID   *uint
+	Outcome    string
+	Since      *time.Time
+	Until      *time.Time
+}
+
+// AuditVerifyResult 描述哈希链校验结果。删掉链尾的若干条后剩下的链仍然完整，
+// Verify 本身发现不了；只有把 HeadSeq/HeadHash 定期抄录到数据库以外，之后对比才能发现截断。
+type AuditVerifyResult struct {
+	Checked  int64  `json:"checked"`
+	OK       bool   `json:"ok"`
+	BadSeq   uint64 `json:"bad_seq,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	HeadSeq  uint64 `json:"head_seq"`
+	HeadHash string `json:"head_hash"`
+}
+
+const auditVerifyBatch = 500
+
+func NewAuditService(db *gorm.DB, base64Key string) *AuditService {
+	fmt.Fprintln(config.Progress, "✓ Creating a new audit service done")
+	return &AuditService{db: db, key: deriveKey(base64Key, "audit-chain-hmac")}
+}
+
+// Unseal 换上从主密钥派生的审计密钥
+func (s *AuditService) Unseal(keys *sfbcrypt.Keys) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.key = keys.AuditChain
+}
+
+// Seal 清零审计密钥；封存期间 Append 失败，Record 只记日志
+func (s *AuditService) Seal() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	clear(s.key)
+	s.key = nil
+}
+
+// Record 追加一条审计记录。写入失败只记日志，不影响业务请求。
+func (s *AuditService) Record(entry AuditEntry) {
+	if err := s.Append(entry); err != nil && pkg.Logger != nil {
+		pkg.Logger.Error("audit log append failed", zap.String("action", entry.Action), zap.Error(err))
+	}
+}
+
+func (s *AuditService) Append(entry AuditEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.key) == 0 {
+		return errors.New("audit key not configured")
+	}
+
+	// seq 上有唯一索引；其他进程并发写入导致冲突时重试
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var last model.AuditLog
+		prevHash := ""
+		var seq uint64 = 1
+		lerr := s.db.Order("seq desc").Limit(1).Find(&last).Error
+		if lerr != nil {
+			return lerr
+		}
+		if last.Seq > 0 {
+			prevHash = last.Hash
+			seq = last.Seq + 1
+		}
+
+		log := model.AuditLog{
+			Seq:        seq,
+			ActorID:    entry.ActorID,
+			Action:     entry.Action,
+			TargetType: entry.TargetType,
+			TargetID:   entry.TargetID,
+			IP:         entry.IP,
+			Outcome:    entry.Outcome,
+			Detail:     truncate(entry.Detail, 255),
+			PrevHash:   prevHash,
+			CreatedAt:  time.Now().Truncate(time.Second),
+		}
+		log.Hash = chainHash(s.key, &log)
+		if err = s.db.Create(&log).Error; err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *AuditService) List(filter AuditFilter, page, size int) (total int64, logs []model.AuditLog, err error) {
+	tx := s.db.Model(&model.AuditLog{})
+	if filter.ActorID != nil {
+		tx = tx.Where("actor_id = ?", *filter.ActorID)
+	}
+	if filter.Action != "" {
+		tx = tx.Where("action = ?", filter.Action)
+	}
+	if filter.TargetType != "" {
+		tx = tx.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetID != nil {
+		tx = tx.Where("target_id = ?", *filter.TargetID)
+	}
+	if filter.Outcome != "" {
+		tx = tx.Where("outcome = ?", filter.Outcome)
+	}
+	if filter.Since != nil {
+		tx = tx.Where("created_at >= ?", *filter.Since)
+	}
+	if filter.Until != nil {
+		tx = tx.Where("created_at < ?", *filter.Until)
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return
+	}
+	offset := (page - 1) * size
+	err = tx.Order("seq desc").Limit(size).Offset(offset).Find(&logs).Error
+	return
+}
+
+// Verify 从第一条开始重算整条哈希链，遇到第一处断裂即停止。能发现修改和中间的缺失，
+// 发现不了链尾的截断（见 AuditVerifyResult）
+func (s *AuditService) Verify() (*AuditVerifyResult, error) {
+	// 复制一份密钥，校验期间被封存也不影响结果
+	s.mutex.Lock()
+	key := append([]byte(nil), s.key...)
+	s.mutex.Unlock()
+	defer clear(key)
+	if len(key) == 0 {
+		return nil, errors.New("audit key not configured")
+	}
+	result := &AuditVerifyResult{OK: true}
+	var expectSeq uint64 = 1
+	prevHash := ""
+
+	for {
+		var batch []model.AuditLog
+		if err := s.db.Where("seq >= ?", expectSeq).Order("seq asc").Limit(auditVerifyBatch).Find(&batch).Error; err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return result, nil
+		}
+		for i := range batch {
+			entry := &batch[i]
+			result.Checked++
+			switch {
+			case entry.Seq != expectSeq:
+				return result.fail(expectSeq, fmt.Sprintf("missing entry, next present seq is %d", entry.Seq)), nil
+			case entry.PrevHash != prevHash:
+				return result.fail(entry.Seq, "prev_hash does not match previous entry"), nil
+			case !hmac.Equal([]byte(entry.Hash), []byte(chainHash(key, entry))):
+				return result.fail(entry.Seq, "hash mismatch, entry was modified"), nil
+			}
+			prevHash = entry.Hash
+			result.HeadSeq = entry.Seq
+			result.HeadHash = entry.Hash
+			expectSeq++
+		}
+	}
+}
+
+func (r *AuditVerifyResult) fail(seq uint64, reason string) *AuditVerifyResult {
+	r.OK = false
+	r.BadSeq = seq
+	r.Reason = reason
+	return r
+}
+
+func chainHash(key []byte, log *model.AuditLog) string {
+	fields := []string{
+		strconv.FormatUint(log.Seq, 10),
+		strconv.FormatUint(uint64(log.ActorID), 10),
+		log.Action,
+		log.TargetType,
+		strconv.FormatUint(uint64(log.TargetID), 10),
+		log.IP,
+		log.Outcome,
+		log.Detail,
+		strconv.FormatInt(log.CreatedAt.Unix(), 10),
+		log.PrevHash,
+	}
+	mac := hmac.New(sha256.New, key)
+	for _, field := range fields {
+		// 长度前缀避免字段拼接产生歧义
+		mac.Write([]byte(strconv.Itoa(len(field))))
+		mac.Write([]byte{':'})
+		mac.Write([]byte(field))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func truncate(s string, n int) string {
+	s = strings.ToValidUTF8(s, "")
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
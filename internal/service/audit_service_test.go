@@ -0,0 +1,124 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"gorm.io/gorm"
+)
+
+// newTestAuditChain 写入 n 条审计记录
+func newTestAuditChain(t *testing.T, n int) (*AuditService, *gorm.DB) {
+	t.Helper()
+	db := newTestDB(t)
+	audit := NewAuditService(db, testKey)
+	for i := 1; i <= n; i++ {
+		if err := audit.Append(AuditEntry{ActorID: 1, Action: "file.download", TargetType: "file", TargetID: uint(i), Outcome: "success"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return audit, db
+}
+
+func verifyAudit(t *testing.T, audit *AuditService) *AuditVerifyResult {
+	t.Helper()
+	result, err := audit.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestAuditVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(db *gorm.DB) error
+		badSeq uint64
+		reason string
+	}{
+		{"edited detail", func(db *gorm.DB) error {
+			return db.Model(&model.AuditLog{}).Where("seq = ?", 3).Update("detail", "nothing happened").Error
+		}, 3, "modified"},
+		{"edited actor", func(db *gorm.DB) error {
+			return db.Model(&model.AuditLog{}).Where("seq = ?", 1).Update("actor_id", 2).Error
+		}, 1, "modified"},
+		{"edited prev_hash", func(db *gorm.DB) error {
+			return db.Model(&model.AuditLog{}).Where("seq = ?", 4).Update("prev_hash", strings.Repeat("0", 64)).Error
+		}, 4, "prev_hash"},
+		{"deleted middle row", func(db *gorm.DB) error {
+			return db.Where("seq = ?", 3).Delete(&model.AuditLog{}).Error
+		}, 3, "missing entry"},
+		{"deleted first row", func(db *gorm.DB) error {
+			return db.Where("seq = ?", 1).Delete(&model.AuditLog{}).Error
+		}, 1, "missing entry"},
+	}
+	for _, tt := range tests {
+		audit, db := newTestAuditChain(t, 5)
+		if err := tt.tamper(db); err != nil {
+			t.Fatal(err)
+		}
+		result := verifyAudit(t, audit)
+		if result.OK || result.BadSeq != tt.badSeq || !strings.Contains(result.Reason, tt.reason) {
+			t.Errorf("%s: %+v", tt.name, result)
+		}
+	}
+
+	audit, _ := newTestAuditChain(t, auditVerifyBatch+3)
+	if result := verifyAudit(t, audit); !result.OK || result.Checked != auditVerifyBatch+3 || result.HeadSeq != auditVerifyBatch+3 {
+		t.Fatalf("intact chain across batches: %+v", result)
+	}
+}
+
+// 截断链尾后剩下的链仍然完整，只能靠抄录在数据库以外的链头发现
+func TestAuditVerifyTruncatedTail(t *testing.T) {
+	audit, db := newTestAuditChain(t, 5)
+	recorded := verifyAudit(t, audit)
+	if !recorded.OK || recorded.HeadSeq != 5 || recorded.HeadHash == "" {
+		t.Fatalf("intact chain: %+v", recorded)
+	}
+	// headStillPresent 是运维人员拿抄录的链头做的对比
+	headStillPresent := func(result *AuditVerifyResult) bool {
+		var entry model.AuditLog
+		if result.HeadSeq < recorded.HeadSeq || db.Where("seq = ?", recorded.HeadSeq).First(&entry).Error != nil {
+			return false
+		}
+		return entry.Hash == recorded.HeadHash
+	}
+	if !headStillPresent(recorded) {
+		t.Fatal("recorded head not found in the intact chain")
+	}
+
+	if err := db.Where("seq >= ?", 4).Delete(&model.AuditLog{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	result := verifyAudit(t, audit)
+	if !result.OK || result.HeadSeq != 3 {
+		t.Fatalf("truncated chain: %+v", result)
+	}
+	if headStillPresent(result) {
+		t.Fatal("truncation not detected against the recorded head")
+	}
+
+	// 截断后再追加，链头序号追上了，哈希却对不上
+	for i := 0; i < 2; i++ {
+		if err := audit.Append(AuditEntry{ActorID: 1, Action: "user.login", Outcome: "success"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result = verifyAudit(t, audit)
+	if !result.OK || result.HeadSeq != 5 || headStillPresent(result) {
+		t.Fatalf("truncated and refilled chain: %+v", result)
+	}
+}
+
+func TestAuditSealed(t *testing.T) {
+	audit, _ := newTestAuditChain(t, 1)
+	audit.Seal()
+	if err := audit.Append(AuditEntry{Action: "user.login"}); err == nil {
+		t.Fatal("Append while sealed succeeded")
+	}
+	if _, err := audit.Verify(); err == nil {
+		t.Fatal("Verify while sealed succeeded")
+	}
+}
@@ -0,0 +1,778 @@
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 备份内容是一个 tar 流，整体再经 backup_stream 加密：
+//
+//	db/users.gob    users 表的全部列（含软删除的行）
+//	db/files.gob    files 表的全部列，元数据仍是 enc_* 密文
+//	db/blobs.gob    blobs 表（去重密文的引用计数），增量备份中也是完整的
+//	db/vault.gob    vault_keys 和已完成的 vault_files，增量备份中也是完整的
+//	db/<表名>.gob   其余各表（审计日志、SSH/S3 密钥、webhook、任务等），见 backupWholeTables
+//	blobs/<path>    文件密文，路径相对 storage 目录；共享的密文只写一次
+//	avatars/<path>  头像密文
+//	vault/<path>    保险库文件（客户端加密），增量备份中只有新完成的
+//	multipart/<path> 进行中的 S3 分段上传的分段密文
+//	manifest.json   最后一项，记录每一项的大小和 SHA-256
+//
+// 备份里不出现任何明文文件内容或明文元数据，恢复时需要同一个 file_crypto.key。
+const (
+	BackupFull        = "full"
+	BackupIncremental = "incremental"
+
+	backupFormat       = 1
+	backupManifestName = "manifest.json"
+	backupUsersName    = "db/users.gob"
+	backupFilesName    = "db/files.gob"
+	backupBlobsName    = "db/blobs.gob"
+	backupVaultName    = "db/vault.gob"
+	backupBlobDir      = "blobs/"
+	backupAvatarDir    = "avatars/"
+	backupVaultDir     = "vault/"
+	backupMultipartDir = "multipart/"
+)
+
+var (
+	ErrRestoreNotEmpty   = errors.New("restore target is not empty")
+	ErrBackupManifest    = errors.New("backup manifest mismatch")
+	ErrBackupKeyMismatch = errors.New("backup was made with a different file_crypto.key")
+)
+
+type BackupService struct {
+	db      *gorm.DB
+	fileSrv *FileService
+}
+
+func NewBackupService(db *gorm.DB, fileSrv *FileService) *BackupService {
+	return &BackupService{db: db, fileSrv: fileSrv}
+}
+
+type BackupManifest struct {
+	Format   int       `json:"format"`
+	Kind     string    `json:"kind"`
+	Since    time.Time `json:"since,omitzero"`
+	Snapshot time.Time `json:"snapshot"`
+	KeyCheck string    `json:"key_check"`
+	// StorageDir 是备份时的 storage 目录，恢复时据此把行中的绝对路径换算到新目录
+	StorageDir string                `json:"storage_dir,omitempty"`
+	Users      int                   `json:"users"`
+	Files      int                   `json:"files"`
+	Blobs      int                   `json:"blobs,omitempty"`
+	Vault      int                   `json:"vault,omitempty"`
+	Tables     map[string]int        `json:"tables,omitempty"`
+	Missing    []string              `json:"missing,omitempty"`
+	Entries    []BackupManifestEntry `json:"entries"`
+}
+
+// backupVault 是 db/vault.gob 的内容。保险库的行删除时不留痕迹，所以总是完整备份，
+// 恢复时删除备份中没有的行
+type backupVault struct {
+	Keys  []model.VaultKey
+	Files []model.VaultFile
+}
+
+type BackupManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Backup 把数据库行和对应的密文写成一个加密流。
+// since 非零时只包含 UpdatedAt（或软删除时间）晚于 since 的行，以及这些行引用的文件。
+// 下一次增量备份应使用本次 manifest 的 Snapshot 作为 since。
+func (s *BackupService) Backup(w io.Writer, passphrase string, since time.Time) (*BackupManifest, error) {
+	bw, err := newBackupWriter(w, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{
+		Format:     backupFormat,
+		Kind:       BackupFull,
+		Snapshot:   time.Now().UTC().Truncate(time.Second),
+		KeyCheck:   s.keyCheck(),
+		StorageDir: s.fileSrv.dirpath,
+	}
+	if !since.IsZero() {
+		manifest.Kind = BackupIncremental
+		manifest.Since = since.UTC()
+	}
+
+	tw := tar.NewWriter(bw)
+	// 在同一个事务（InnoDB 下为一致性快照）里读取两张表，保证用户和文件行彼此一致
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkBackupCoverage(tx); err != nil {
+			return err
+		}
+		var users []model.User
+		if err := changedSince(tx.Unscoped(), since).Order("id asc").Find(&users).Error; err != nil {
+			return err
+		}
+		var files []model.File
+		if err := changedSince(tx.Unscoped(), since).Order("id asc").Find(&files).Error; err != nil {
+			return err
+		}
+		// blobs 表不大，也没有软删除，总是完整备份，恢复时再按文件行重新计数
+		var blobs []model.Blob
+		if err := tx.Order("id asc").Find(&blobs).Error; err != nil {
+			return err
+		}
+		var vault backupVault
+		if err := tx.Order("id asc").Find(&vault.Keys).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("status = ?", model.VaultComplete).Order("id asc").Find(&vault.Files).Error; err != nil {
+			return err
+		}
+		manifest.Users, manifest.Files, manifest.Blobs = len(users), len(files), len(blobs)
+		manifest.Vault = len(vault.Files)
+
+		if err := writeGobEntry(tw, manifest, backupUsersName, users); err != nil {
+			return err
+		}
+		if err := writeGobEntry(tw, manifest, backupFilesName, files); err != nil {
+			return err
+		}
+		if err := writeGobEntry(tw, manifest, backupBlobsName, blobs); err != nil {
+			return err
+		}
+		if err := writeGobEntry(tw, manifest, backupVaultName, vault); err != nil {
+			return err
+		}
+		manifest.Tables = make(map[string]int, len(backupWholeTables))
+		for _, t := range backupWholeTables {
+			name, err := tableName(tx, t.model)
+			if err != nil {
+				return err
+			}
+			rows, n, err := t.dump(tx)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if err := writeGobEntry(tw, manifest, backupTableEntry(name), rows); err != nil {
+				return err
+			}
+			manifest.Tables[name] = n
+		}
+
+		written := make(map[string]bool)
+		for i := range files {
+			file := &files[i]
+			if file.DeletedAt.Valid {
+				continue
+			}
+			if err := s.fileSrv.decryptFileMetadata(file); err != nil {
+				return fmt.Errorf("file %d: %w", file.ID, err)
+			}
+			if written[file.StoragePath] {
+				continue
+			}
+			written[file.StoragePath] = true
+			if err := s.writeBlob(tw, manifest, backupBlobDir, file.StoragePath); err != nil {
+				return fmt.Errorf("file %d: %w", file.ID, err)
+			}
+		}
+		for _, user := range users {
+			if user.DeletedAt.Valid || user.AvatarPath == "" {
+				continue
+			}
+			if err := s.writeBlob(tw, manifest, backupAvatarDir, user.AvatarPath); err != nil {
+				return fmt.Errorf("user %d avatar: %w", user.ID, err)
+			}
+		}
+		// 完成后的保险库文件不再改变
+		for _, v := range vault.Files {
+			if !since.IsZero() && !v.UpdatedAt.After(since) {
+				continue
+			}
+			if err := s.writeBlob(tw, manifest, backupVaultDir, s.fileSrv.shardedPath(v.Name)); err != nil {
+				return fmt.Errorf("vault file %d: %w", v.ID, err)
+			}
+		}
+		return s.writeMultipartParts(tx, tw, manifest)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.WriteHeader(backupTarHeader(backupManifestName, int64(len(body)))); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := bw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Restore 先把整个备份解到 storage 下的临时目录并逐项核对 manifest，
+// 全部通过后才写数据库和移动密文。全量备份只能恢复到空实例；
+// 增量备份按主键覆盖已有的行。verifyOnly 为 true 时只做校验。
+func (s *BackupService) Restore(r io.Reader, passphrase string, verifyOnly bool) (*BackupManifest, error) {
+	br, err := newBackupReader(r, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	staging, err := os.MkdirTemp(s.fileSrv.dirpath, ".restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, err := s.stage(br, staging)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.KeyCheck != s.keyCheck() {
+		return nil, ErrBackupKeyMismatch
+	}
+	if verifyOnly {
+		return manifest, nil
+	}
+
+	if manifest.Kind == BackupFull {
+		var users, files int64
+		if err := s.db.Unscoped().Model(&model.User{}).Count(&users).Error; err != nil {
+			return nil, err
+		}
+		if err := s.db.Unscoped().Model(&model.File{}).Count(&files).Error; err != nil {
+			return nil, err
+		}
+		if users > 0 || files > 0 {
+			return nil, ErrRestoreNotEmpty
+		}
+	}
+
+	var users []model.User
+	if err := readGobEntry(filepath.Join(staging, backupUsersName), &users); err != nil {
+		return nil, err
+	}
+	var files []model.File
+	if err := readGobEntry(filepath.Join(staging, backupFilesName), &files); err != nil {
+		return nil, err
+	}
+	// 去重之前的备份没有 blobs.gob
+	var blobs []model.Blob
+	if err := readGobEntry(filepath.Join(staging, backupBlobsName), &blobs); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// 保险库之前的备份没有 vault.gob，此时保持现有的保险库不变
+	var vault *backupVault
+	if err := readGobEntry(filepath.Join(staging, backupVaultName), &vault); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	type loadedTable struct {
+		name string
+		rows any
+		n    int
+	}
+	var tables []loadedTable
+	for _, t := range backupWholeTables {
+		name, err := tableName(s.db, t.model)
+		if err != nil {
+			return nil, err
+		}
+		rows, n, err := t.load(filepath.Join(staging, backupTableEntry(name)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		tables = append(tables, loadedTable{name, rows, n})
+	}
+
+	// 存储目录可能和备份时不同，路径按相对位置重写；密文在事务提交前就位，
+	// 失败时最多留下未被引用的密文
+	var stale []string
+	for i := range users {
+		user := &users[i]
+		if user.AvatarPath == "" || user.DeletedAt.Valid {
+			continue
+		}
+		if user.AvatarPath, err = s.placeBlob(staging, backupAvatarDir, s.sourceRel(manifest, user.AvatarPath)); err != nil {
+			return nil, fmt.Errorf("user %d avatar: %w", user.ID, err)
+		}
+	}
+	for i := range files {
+		file := &files[i]
+		if err := s.fileSrv.decryptFileMetadata(file); err != nil {
+			return nil, fmt.Errorf("file %d: %w", file.ID, err)
+		}
+		if file.DeletedAt.Valid {
+			stale = append(stale, s.localPath(s.sourceRel(manifest, file.StoragePath)))
+		} else if file.StoragePath, err = s.placeBlob(staging, backupBlobDir, s.sourceRel(manifest, file.StoragePath)); err != nil {
+			return nil, fmt.Errorf("file %d: %w", file.ID, err)
+		}
+		if err := s.fileSrv.encryptFileMetadata(file); err != nil {
+			return nil, fmt.Errorf("file %d: %w", file.ID, err)
+		}
+	}
+	if vault != nil {
+		for _, v := range vault.Files {
+			if _, err := s.placeBlob(staging, backupVaultDir, s.relPath(s.fileSrv.shardedPath(v.Name))); err != nil {
+				return nil, fmt.Errorf("vault file %d: %w", v.ID, err)
+			}
+		}
+	}
+	if err := s.placeMultipartParts(staging); err != nil {
+		return nil, err
+	}
+
+	var unused []string
+	var staleUploads []string
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// Session 让每次 Create 使用新的 Statement，否则第一次解析出的 User schema 会沿用到 File 上
+		upsert := tx.Unscoped().Clauses(clause.OnConflict{UpdateAll: true}).Session(&gorm.Session{})
+		for i := range users {
+			if err := upsert.Create(&users[i]).Error; err != nil {
+				return fmt.Errorf("user %d: %w", users[i].ID, err)
+			}
+		}
+		for i := range files {
+			if err := upsert.Create(&files[i]).Error; err != nil {
+				return fmt.Errorf("file %d: %w", files[i].ID, err)
+			}
+		}
+		for i := range blobs {
+			if err := upsert.Create(&blobs[i]).Error; err != nil {
+				return fmt.Errorf("blob %d: %w", blobs[i].ID, err)
+			}
+		}
+		if vault != nil {
+			var err error
+			if stale, err = s.restoreVault(tx, upsert, vault, stale); err != nil {
+				return err
+			}
+		}
+		var before []string
+		if err := tx.Model(&model.S3Upload{}).Pluck("upload_id", &before).Error; err != nil {
+			return err
+		}
+		for _, t := range tables {
+			if err := replaceTable(tx, t.name, t.rows, t.n); err != nil {
+				return err
+			}
+		}
+		var after []string
+		if err := tx.Model(&model.S3Upload{}).Pluck("upload_id", &after).Error; err != nil {
+			return err
+		}
+		staleUploads = missingFrom(before, after)
+		// 增量备份看不到已经删除的 blobs 行，按恢复后的文件行重新计数
+		var err error
+		if unused, err = s.fileSrv.recountBlobs(tx); err != nil {
+			return err
+		}
+		models := append([]any{}, backupOtherModels...)
+		for _, t := range backupWholeTables {
+			models = append(models, t.model)
+		}
+		return resetIDSequences(tx, models...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range stale {
+		// 仍被其他文件共享的密文保留
+		if shared, err := s.fileSrv.isSharedBlob(p); err != nil || shared {
+			continue
+		}
+		_ = s.fileSrv.RemoveStoredFile(p)
+	}
+	for _, p := range unused {
+		_ = s.fileSrv.RemoveStoredFile(p)
+	}
+	for _, id := range staleUploads {
+		_ = os.RemoveAll(s3UploadDir(s.fileSrv.dirpath, id))
+	}
+	return manifest, nil
+}
+
+// stage 解出 tar 的每一项并计算哈希，最后与 manifest 逐项比对
+func (s *BackupService) stage(r io.Reader, staging string) (*BackupManifest, error) {
+	tr := tar.NewReader(r)
+	actual := make(map[string]BackupManifestEntry)
+	var manifest *BackupManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil {
+			return nil, fmt.Errorf("%w: entry after manifest", ErrBackupManifest)
+		}
+		if hdr.Name == backupManifestName {
+			manifest = &BackupManifest{}
+			if err := json.NewDecoder(io.LimitReader(tr, 64<<20)).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrBackupManifest, err)
+			}
+			continue
+		}
+		name, ok := cleanBackupName(hdr.Name)
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%w: unexpected entry %q", ErrBackupManifest, hdr.Name)
+		}
+		if _, dup := actual[name]; dup {
+			return nil, fmt.Errorf("%w: duplicate entry %q", ErrBackupManifest, name)
+		}
+		dst := filepath.Join(staging, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return nil, err
+		}
+		out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(out, h), tr)
+		if err == nil {
+			err = out.Sync()
+		}
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		actual[name] = BackupManifestEntry{Path: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("%w: manifest missing", ErrBackupManifest)
+	}
+	if manifest.Format != backupFormat {
+		return nil, fmt.Errorf("unsupported backup format %d", manifest.Format)
+	}
+	if len(manifest.Entries) != len(actual) {
+		return nil, fmt.Errorf("%w: expected %d entries, found %d", ErrBackupManifest, len(manifest.Entries), len(actual))
+	}
+	for _, want := range manifest.Entries {
+		got, ok := actual[want.Path]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s missing", ErrBackupManifest, want.Path)
+		}
+		if got.Size != want.Size || got.SHA256 != want.SHA256 {
+			return nil, fmt.Errorf("%w: %s hash differs", ErrBackupManifest, want.Path)
+		}
+	}
+	if _, ok := actual[backupUsersName]; !ok {
+		return nil, fmt.Errorf("%w: %s missing", ErrBackupManifest, backupUsersName)
+	}
+	if _, ok := actual[backupFilesName]; !ok {
+		return nil, fmt.Errorf("%w: %s missing", ErrBackupManifest, backupFilesName)
+	}
+	return manifest, nil
+}
+
+// writeBlob 原样写入密文；文件已不存在时记录到 manifest.Missing 而不是让整个备份失败
+func (s *BackupService) writeBlob(tw *tar.Writer, manifest *BackupManifest, dir string, storagePath string) error {
+	name := dir + s.relPath(storagePath)
+	src, err := os.Open(storagePath)
+	if os.IsNotExist(err) {
+		manifest.Missing = append(manifest.Missing, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(backupTarHeader(name, info.Size())); err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, h), io.LimitReader(src, info.Size()))
+	if err != nil {
+		return err
+	}
+	if n != info.Size() {
+		return fmt.Errorf("%s changed during backup", name)
+	}
+	manifest.Entries = append(manifest.Entries, BackupManifestEntry{Path: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+	return nil
+}
+
+// writeMultipartParts 写入进行中的分段上传已有的分段密文
+func (s *BackupService) writeMultipartParts(tx *gorm.DB, tw *tar.Writer, manifest *BackupManifest) error {
+	var uploads []model.S3Upload
+	if err := tx.Find(&uploads).Error; err != nil {
+		return err
+	}
+	uploadIDs := make(map[uint]string, len(uploads))
+	for _, up := range uploads {
+		uploadIDs[up.ID] = up.UploadID
+	}
+	var parts []model.S3Part
+	if err := tx.Order("id asc").Find(&parts).Error; err != nil {
+		return err
+	}
+	for _, p := range parts {
+		id, ok := uploadIDs[p.UploadID]
+		if !ok {
+			continue
+		}
+		if err := s.writeBlob(tw, manifest, backupMultipartDir, s3PartPath(s.fileSrv.dirpath, id, p.PartNumber)); err != nil {
+			return fmt.Errorf("s3 part %d: %w", p.ID, err)
+		}
+	}
+	return nil
+}
+
+// placeMultipartParts 把暂存的分段密文移回 storage 下相同的位置
+func (s *BackupService) placeMultipartParts(staging string) error {
+	root := filepath.Join(staging, filepath.FromSlash(backupMultipartDir))
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		_, err = s.placeBlob(staging, backupMultipartDir, filepath.ToSlash(rel))
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// missingFrom 返回在 before 中但不在 after 中的值
+func missingFrom(before, after []string) []string {
+	keep := make(map[string]bool, len(after))
+	for _, v := range after {
+		keep[v] = true
+	}
+	var out []string
+	for _, v := range before {
+		if !keep[v] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// restoreVault 让保险库的两张表与备份一致：写入备份中的行，删除备份中没有的行。
+// 被删除的文件（包括上传中的）的内容路径追加到 stale，提交后删除。
+func (s *BackupService) restoreVault(tx *gorm.DB, upsert *gorm.DB, vault *backupVault, stale []string) ([]string, error) {
+	keyIDs := []uint{0}
+	for i := range vault.Keys {
+		if err := upsert.Create(&vault.Keys[i]).Error; err != nil {
+			return nil, fmt.Errorf("vault key %d: %w", vault.Keys[i].ID, err)
+		}
+		keyIDs = append(keyIDs, vault.Keys[i].ID)
+	}
+	if err := tx.Where("id NOT IN ?", keyIDs).Delete(&model.VaultKey{}).Error; err != nil {
+		return nil, err
+	}
+	fileIDs := []uint{0}
+	for i := range vault.Files {
+		if err := upsert.Create(&vault.Files[i]).Error; err != nil {
+			return nil, fmt.Errorf("vault file %d: %w", vault.Files[i].ID, err)
+		}
+		fileIDs = append(fileIDs, vault.Files[i].ID)
+	}
+	var removed []model.VaultFile
+	if err := tx.Where("id NOT IN ?", fileIDs).Find(&removed).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range removed {
+		if err := tx.Delete(&model.VaultFile{}, v.ID).Error; err != nil {
+			return nil, err
+		}
+		stale = append(stale, s.fileSrv.shardedPath(v.Name), s.fileSrv.vaultUploadPath(v.Name))
+	}
+	return stale, nil
+}
+
+// placeBlob 把暂存的密文移到当前 storage 目录，rel 为相对 storage 目录的路径，返回新的绝对路径
+func (s *BackupService) placeBlob(staging string, dir string, rel string) (string, error) {
+	src := filepath.Join(staging, filepath.FromSlash(dir+rel))
+	dst := filepath.Join(s.fileSrv.dirpath, filepath.FromSlash(rel))
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		// 备份时已经缺失，或增量备份中密文没有变化
+		return dst, nil
+	}
+	if err := renameSynced(src, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// relPath 返回相对当前 storage 目录的路径
+func (s *BackupService) relPath(storagePath string) string {
+	return relPathFrom(s.fileSrv.dirpath, storagePath)
+}
+
+// sourceRel 返回相对备份时 storage 目录的路径；旧的备份没有记录 StorageDir，按当前目录计算
+func (s *BackupService) sourceRel(manifest *BackupManifest, storagePath string) string {
+	if manifest.StorageDir == "" {
+		return s.relPath(storagePath)
+	}
+	return relPathFrom(manifest.StorageDir, storagePath)
+}
+
+func (s *BackupService) localPath(rel string) string {
+	return filepath.Join(s.fileSrv.dirpath, filepath.FromSlash(rel))
+}
+
+// relPathFrom 返回 storagePath 相对 dir 的路径；不在 dir 下的旧数据只保留文件名
+func relPathFrom(dir string, storagePath string) string {
+	rel, err := filepath.Rel(dir, storagePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(storagePath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// keyCheck 让恢复前就能确认备份和当前实例使用同一个主密钥，而不暴露密钥本身
+func (s *BackupService) keyCheck() string {
+	k := s.fileSrv.k()
+	mac := k.mac(&k.metaKey)
+	if mac == nil {
+		return ""
+	}
+	mac.Write([]byte("sfb-backup-key-check"))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// resetIDSequences 恢复时按原 ID 写入，PostgreSQL 的自增序列不会随之前进，
+// 需要手动推到 MAX(id) 之后；MySQL 和 SQLite 会自动调整
+func resetIDSequences(tx *gorm.DB, models ...any) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	for _, m := range models {
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(m); err != nil {
+			return err
+		}
+		table := stmt.Schema.Table
+		sql := fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE((SELECT MAX(id) FROM %s), 0) + 1, false)", table, tx.Statement.Quote(table))
+		if err := tx.Exec(sql).Error; err != nil {
+			return fmt.Errorf("reset %s id sequence: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// changedSince 软删除不会更新 updated_at，所以同时按 deleted_at 判断
+func changedSince(tx *gorm.DB, since time.Time) *gorm.DB {
+	if since.IsZero() {
+		return tx
+	}
+	return tx.Where("updated_at > ? OR deleted_at > ?", since, since)
+}
+
+func writeGobEntry(tw *tar.Writer, manifest *BackupManifest, name string, rows any) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rows); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(backupTarHeader(name, int64(buf.Len()))); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	if _, err := tw.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	manifest.Entries = append(manifest.Entries, BackupManifestEntry{Path: name, Size: int64(buf.Len()), SHA256: hex.EncodeToString(sum[:])})
+	return nil
+}
+
+func readGobEntry(path string, rows any) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewDecoder(f).Decode(rows)
+}
+
+func backupTarHeader(name string, size int64) *tar.Header {
+	return &tar.Header{Name: name, Size: size, Mode: 0600, Typeflag: tar.TypeReg, ModTime: time.Now()}
+}
+
+// cleanBackupName 只接受 db/、blobs/、avatars/、vault/、multipart/ 下不含 ".." 的相对路径
+func cleanBackupName(name string) (string, bool) {
+	clean := path.Clean(name)
+	if clean != name || path.IsAbs(clean) || strings.HasPrefix(clean, "../") || strings.Contains(clean, "/../") {
+		return "", false
+	}
+	switch {
+	case clean == backupUsersName, clean == backupFilesName, clean == backupBlobsName, clean == backupVaultName:
+		return clean, true
+	case strings.HasPrefix(clean, "db/") && strings.HasSuffix(clean, ".gob") && validBackupTable(clean[len("db/"):len(clean)-len(".gob")]):
+		return clean, true
+	case strings.HasPrefix(clean, backupBlobDir) && len(clean) > len(backupBlobDir),
+		strings.HasPrefix(clean, backupAvatarDir) && len(clean) > len(backupAvatarDir),
+		strings.HasPrefix(clean, backupVaultDir) && len(clean) > len(backupVaultDir),
+		strings.HasPrefix(clean, backupMultipartDir) && len(clean) > len(backupMultipartDir):
+		return clean, true
+	}
+	return "", false
+}
+
+func validBackupTable(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseBackupSince 接受 RFC3339 时间或 Unix 秒
+func ParseBackupSince(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since %q: want RFC3339 or unix seconds", v)
+	}
+	return time.Unix(sec, 0), nil
+}
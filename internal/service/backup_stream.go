@@ -0,0 +1,209 @@
+package service
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// 备份流格式：
+//
+//	"SFBK" || version(1) || log2(N)(1) || r(1) || p(1) || salt(16) || nonce prefix(8)
+//	然后是若干 uint32(len) || AES-256-GCM(chunk)
+//
+// 密钥由口令经 scrypt 派生。与 SFB2 不同，每块的 AAD 为 counter(4) || final(1)，
+// 最后一块 final=1，所以截断的备份能被发现。
+const (
+	backupMagic     = "SFBK"
+	backupVersion   = 1
+	backupChunkSize = 64 * 1024
+	backupSaltSize  = 16
+	backupLogN      = 15
+	backupR         = 8
+	backupP         = 1
+)
+
+var (
+	ErrBackupPassphrase = errors.New("backup passphrase incorrect or backup corrupted")
+	ErrBackupTruncated  = errors.New("backup is truncated")
+)
+
+type backupWriter struct {
+	out     *bufio.Writer
+	gcm     cipher.AEAD
+	prefix  []byte
+	buf     []byte
+	counter uint32
+}
+
+func newBackupWriter(w io.Writer, passphrase string) (*backupWriter, error) {
+	if passphrase == "" {
+		return nil, errors.New("backup passphrase required")
+	}
+	salt := make([]byte, backupSaltSize)
+	prefix := make([]byte, sfbcrypt.NoncePrefix)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	gcm, err := backupGCM(passphrase, salt, backupLogN, backupR, backupP)
+	if err != nil {
+		return nil, err
+	}
+
+	out := bufio.NewWriterSize(w, backupChunkSize+64)
+	header := append([]byte(backupMagic), backupVersion, backupLogN, backupR, backupP)
+	header = append(header, salt...)
+	header = append(header, prefix...)
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+	return &backupWriter{out: out, gcm: gcm, prefix: prefix, buf: make([]byte, 0, backupChunkSize)}, nil
+}
+
+func (b *backupWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(b.buf[len(b.buf):cap(b.buf)], p)
+		b.buf = b.buf[:len(b.buf)+n]
+		p = p[n:]
+		written += n
+		if len(b.buf) == cap(b.buf) {
+			if err := b.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close 写出带 final 标记的最后一块
+func (b *backupWriter) Close() error {
+	if err := b.seal(true); err != nil {
+		return err
+	}
+	return b.out.Flush()
+}
+
+func (b *backupWriter) seal(final bool) error {
+	sealed := b.gcm.Seal(nil, sfbcrypt.ChunkNonce(b.prefix, b.counter), b.buf, backupAAD(b.counter, final))
+	if err := binary.Write(b.out, binary.BigEndian, uint32(len(sealed))); err != nil {
+		return err
+	}
+	if _, err := b.out.Write(sealed); err != nil {
+		return err
+	}
+	b.counter++
+	b.buf = b.buf[:0]
+	return nil
+}
+
+type backupReader struct {
+	in      *bufio.Reader
+	gcm     cipher.AEAD
+	prefix  []byte
+	plain   []byte
+	counter uint32
+	final   bool
+}
+
+func newBackupReader(r io.Reader, passphrase string) (*backupReader, error) {
+	in := bufio.NewReaderSize(r, backupChunkSize+64)
+	header := make([]byte, len(backupMagic)+4+backupSaltSize+sfbcrypt.NoncePrefix)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, errors.New("not a backup file")
+	}
+	if string(header[:len(backupMagic)]) != backupMagic {
+		return nil, errors.New("not a backup file")
+	}
+	params := header[len(backupMagic):]
+	if params[0] != backupVersion {
+		return nil, errors.New("unsupported backup version")
+	}
+	logN, r8, p := params[1], params[2], params[3]
+	if logN < 10 || logN > 22 || r8 == 0 || p == 0 {
+		return nil, errors.New("invalid backup kdf parameters")
+	}
+	salt := params[4 : 4+backupSaltSize]
+	prefix := params[4+backupSaltSize:]
+	gcm, err := backupGCM(passphrase, salt, logN, r8, p)
+	if err != nil {
+		return nil, err
+	}
+	return &backupReader{in: in, gcm: gcm, prefix: append([]byte(nil), prefix...)}, nil
+}
+
+func (b *backupReader) Read(p []byte) (int, error) {
+	for len(b.plain) == 0 {
+		if b.final {
+			return 0, io.EOF
+		}
+		if err := b.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.plain)
+	b.plain = b.plain[n:]
+	return n, nil
+}
+
+func (b *backupReader) next() error {
+	var n uint32
+	if err := binary.Read(b.in, binary.BigEndian, &n); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrBackupTruncated
+		}
+		return err
+	}
+	if n < uint32(b.gcm.Overhead()) || n > backupChunkSize+uint32(b.gcm.Overhead()) {
+		return ErrBackupPassphrase
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(b.in, sealed); err != nil {
+		return ErrBackupTruncated
+	}
+	nonce := sfbcrypt.ChunkNonce(b.prefix, b.counter)
+	plain, err := b.gcm.Open(nil, nonce, sealed, backupAAD(b.counter, false))
+	if err != nil {
+		if plain, err = b.gcm.Open(nil, nonce, sealed, backupAAD(b.counter, true)); err != nil {
+			return ErrBackupPassphrase
+		}
+		b.final = true
+		if _, err := b.in.ReadByte(); err != io.EOF {
+			return errors.New("unexpected data after end of backup")
+		}
+	}
+	b.counter++
+	b.plain = plain
+	return nil
+}
+
+func backupGCM(passphrase string, salt []byte, logN, r, p byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<logN, int(r), int(p), 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func backupAAD(counter uint32, final bool) []byte {
+	aad := make([]byte, 5)
+	binary.BigEndian.PutUint32(aad, counter)
+	if final {
+		aad[4] = 1
+	}
+	return aad
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"gorm.io/gorm"
+)
+
+const testPassphrase = "correct horse battery staple"
+
+// TestBackupRestoreAllTables 把一个包含各表数据的实例备份后恢复到新实例，检查每张表和审计链
+func TestBackupRestoreAllTables(t *testing.T) {
+	src := newTestFileService(t)
+	users := NewUserService(src.db)
+	alice := newTestUser(t, users, "alice")
+
+	file, err := src.UploadFile(strings.NewReader("hello backup"), "a.txt", alice.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit := NewAuditService(src.db, testKey)
+	for i := 0; i < 3; i++ {
+		if err := audit.Append(AuditEntry{ActorID: alice.ID, Action: model.AuditFileUpload, TargetType: "file", TargetID: file.ID, Outcome: model.AuditSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s3 := NewS3Service(src.db, src, users)
+	if _, _, err := s3.CreateS3Key(alice.ID, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := s3.CreateBucket(alice.ID, "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s3.PutObject(bucket, "b.txt", strings.NewReader("object")); err != nil {
+		t.Fatal(err)
+	}
+	up, err := s3.CreateMultipartUpload(bucket, "big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3.UploadPart(up, 1, strings.NewReader("part one")); err != nil {
+		t.Fatal(err)
+	}
+	webhooks := NewWebhookService(src.db, config.WebhookConfig{MaxAttempts: 3}, src)
+	if _, _, err := webhooks.Create(alice.ID, false, WebhookInput{URL: "https://example.com/hook", Events: []string{"*"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.db.Create(&model.SSHKey{UserID: alice.ID, Name: "k", Fingerprint: "SHA256:test", PublicKey: "ssh-ed25519 AAAA"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	manifest, err := NewBackupService(src.db, src).Backup(&buf, testPassphrase, time.Time{})
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	for _, table := range []string{"audit_logs", "ssh_keys", "s3_credentials", "s3_buckets", "s3_objects", "s3_uploads", "s3_parts", "webhooks"} {
+		if manifest.Tables[table] == 0 {
+			t.Errorf("manifest.Tables[%q] = 0", table)
+		}
+	}
+
+	dst := newTestFileService(t)
+	if _, err := NewBackupService(dst.db, dst).Restore(&buf, testPassphrase, false); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	for _, m := range []any{&model.User{}, &model.File{}, &model.AuditLog{}, &model.SSHKey{}, &model.S3Credential{},
+		&model.S3Bucket{}, &model.S3Object{}, &model.S3Upload{}, &model.S3Part{}, &model.Webhook{}} {
+		if got, want := rowCount(t, dst.db, m), rowCount(t, src.db, m); got != want {
+			t.Errorf("%T: restored %d rows, want %d", m, got, want)
+		}
+	}
+
+	res, err := NewAuditService(dst.db, testKey).Verify()
+	if err != nil || !res.OK || res.Checked != 3 {
+		t.Fatalf("audit Verify after restore = %+v, %v", res, err)
+	}
+	restored, err := dst.GetFileByID(file.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := dst.DecryptFile(&out, restored); err != nil || out.String() != "hello backup" {
+		t.Fatalf("restored file = %q, %v", out.String(), err)
+	}
+	if _, err := os.Stat(s3PartPath(dst.dirpath, up.UploadID, 1)); err != nil {
+		t.Fatalf("multipart part not restored: %v", err)
+	}
+}
+
+func TestBackupCoverage(t *testing.T) {
+	db := newTestDB(t)
+	if err := checkBackupCoverage(db); err != nil {
+		t.Fatalf("fully migrated schema not covered: %v", err)
+	}
+	if err := db.Exec("CREATE TABLE extra_things (id integer primary key)").Error; err != nil {
+		t.Fatal(err)
+	}
+	err := checkBackupCoverage(db)
+	if !errors.Is(err, ErrBackupUncovered) || !strings.Contains(err.Error(), "extra_things") {
+		t.Fatalf("checkBackupCoverage = %v, want ErrBackupUncovered naming extra_things", err)
+	}
+
+	files := NewFileService(db, t.TempDir(), testKey)
+	if _, err := NewBackupService(db, files).Backup(&bytes.Buffer{}, testPassphrase, time.Time{}); !errors.Is(err, ErrBackupUncovered) {
+		t.Fatalf("Backup with an uncovered table = %v, want ErrBackupUncovered", err)
+	}
+}
+
+func rowCount(t *testing.T, db *gorm.DB, m any) int64 {
+	t.Helper()
+	var n int64
+	if err := db.Unscoped().Model(m).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+var (
+	ErrCustomerKeyRequired = errors.New("file is encrypted with a customer-provided key")
+	ErrCustomerKeyMismatch = errors.New("customer-provided key does not match the file")
+	ErrCustomerKeyNotUsed  = errors.New("file is not encrypted with a customer-provided key")
+)
+
+// CustomerKey 是请求带来的客户密钥，只在处理这个请求期间留在内存中。
+// String 和 GoString 不输出密钥，误写进日志也不会泄露
+type CustomerKey struct {
+	key []byte
+}
+
+func ParseCustomerKey(s string) (*CustomerKey, error) {
+	key, err := sfbcrypt.ParseCustomerKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return &CustomerKey{key: key}, nil
+}
+
+func (k *CustomerKey) String() string   { return "[customer key]" }
+func (k *CustomerKey) GoString() string { return "[customer key]" }
+
+// KeyUnavailable 报告 err 是否表示服务器现在拿不到文件的密钥（用户密钥没有解开，或者是客户密钥），
+// 巡检和离线校验据此跳过这些文件，而不是记为损坏
+func KeyUnavailable(err error) bool {
+	return errors.Is(err, ErrUserKeyLocked) || errors.Is(err, ErrCustomerKeyRequired)
+}
+
+// customerCipher 先用指纹核对 ck，不对时返回 ErrCustomerKeyMismatch，不解密任何内容
+func (f *FileService) customerCipher(file *model.File, ck *CustomerKey) (*sfbcrypt.BlobCipher, error) {
+	if ck == nil {
+		return nil, ErrCustomerKeyRequired
+	}
+	k := f.k()
+	checkKey := k.raw(&k.customerKey)
+	if checkKey == nil {
+		return nil, f.keyError()
+	}
+	defer clear(checkKey)
+	if !sfbcrypt.CheckCustomerKey(checkKey, ck.key, file.CustomerKeyTag) {
+		return nil, ErrCustomerKeyMismatch
+	}
+	return sfbcrypt.NewBlobCipher(ck.key)
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 去重范围
+const (
+	DedupUser   = "user"
+	DedupTenant = "tenant"
+)
+
+// SetDedup 设置去重范围；"off" 或空字符串表示不去重。
+// 关闭后已经共享的密文仍按引用计数删除。
+func (f *FileService) SetDedup(scope string) {
+	switch scope {
+	case DedupUser, DedupTenant:
+		f.dedup = scope
+	default:
+		f.dedup = ""
+	}
+}
+
+// contentHasher 返回计算明文去重标签的 HMAC，不去重时返回 nil。
+// 范围写在明文之前，所以 user 范围下不同用户的相同内容得到不同的标签。
+// 用用户密钥加密的内容只能与同一用户、同样用用户密钥加密的内容共享密文，与 dedup 范围无关；
+// 用客户密钥加密的内容不去重。
+func (f *FileService) contentHasher(uploaderID string, key contentKey) hash.Hash {
+	if f.dedup == "" || key.customerTag != "" {
+		return nil
+	}
+	k := f.k()
+	mac := k.mac(&k.dedupKey)
+	if mac == nil {
+		return nil
+	}
+	switch {
+	case key.userKeyed:
+		fmt.Fprintf(mac, "userkey\x00%s\x00", uploaderID)
+	case f.dedup == DedupUser:
+		fmt.Fprintf(mac, "user\x00%s\x00", uploaderID)
+	default:
+		mac.Write([]byte("tenant\x00"))
+	}
+	return mac
+}
+
+// dedupBlob 对刚写入的密文去重；不去重（tag 为 nil）或密文已被隔离时原样返回 dst
+func (f *FileService) dedupBlob(tx *gorm.DB, tag hash.Hash, dst string) (string, error) {
+	if tag == nil || f.inQuarantine(dst) {
+		return dst, nil
+	}
+	return f.acquireBlob(tx, hex.EncodeToString(tag.Sum(nil)), dst)
+}
+
+// acquireBlob 在 tx 中为刚写好的密文 dst 登记去重标签，返回文件应当引用的路径：
+// 已有相同内容时引用计数加一并返回已有的密文（调用方在提交后删除 dst），否则 dst 成为新的共享密文。
+// 已有的密文丢失时用 dst 补上。
+func (f *FileService) acquireBlob(tx *gorm.DB, tag string, dst string) (string, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		var blob model.Blob
+		err := tx.Where("content_tag = ?", tag).First(&blob).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			blob = model.Blob{ContentTag: tag, Name: filepath.Base(dst), RefCount: 1}
+			res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&blob)
+			if res.Error != nil {
+				return "", res.Error
+			}
+			if res.RowsAffected == 1 {
+				return dst, nil
+			}
+			// 同时有相同内容的上传登记成功，重新查询
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		// ref_count 为 0 的行正在被最后一个引用者删除，不能再引用
+		res := tx.Model(&model.Blob{}).Where("id = ? AND ref_count > 0", blob.ID).
+			UpdateColumn("ref_count", gorm.Expr("ref_count + 1"))
+		if res.Error != nil {
+			return "", res.Error
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+		path := f.shardedPath(blob.Name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := renameSynced(dst, path); err != nil {
+				return "", err
+			}
+		}
+		return path, nil
+	}
+	return "", errors.New("deduplicated blob changed concurrently, try again")
+}
+
+// releaseBlob 在 tx 中释放 path 的一个引用。返回 true 表示提交后应当删除 path：
+// path 不是共享密文，或者这是最后一个引用。
+func (f *FileService) releaseBlob(tx *gorm.DB, path string) (bool, error) {
+	name := filepath.Base(path)
+	if path != f.shardedPath(name) {
+		return true, nil
+	}
+	var blob model.Blob
+	err := tx.Where("name = ?", name).First(&blob).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Model(&model.Blob{}).Where("id = ?", blob.ID).
+		UpdateColumn("ref_count", gorm.Expr("ref_count - 1")).Error; err != nil {
+		return false, err
+	}
+	res := tx.Where("id = ? AND ref_count <= 0", blob.ID).Delete(&model.Blob{})
+	return res.RowsAffected > 0, res.Error
+}
+
+// isSharedBlob 判断 path 是否是登记过的去重密文
+func (f *FileService) isSharedBlob(path string) (bool, error) {
+	name := filepath.Base(path)
+	if path != f.shardedPath(name) {
+		return false, nil
+	}
+	var n int64
+	err := f.db.Model(&model.Blob{}).Where("name = ?", name).Count(&n).Error
+	return n > 0, err
+}
+
+// recountBlobs 按 tx 中现存的文件行重新计算引用计数，删除已经没有引用的行，
+// 返回这些行的密文路径（提交后由调用方删除）。只能在没有并发写入时使用，例如恢复备份。
+func (f *FileService) recountBlobs(tx *gorm.DB) ([]string, error) {
+	counts := make(map[string]int64)
+	var lastID uint
+	for {
+		var batch []model.File
+		if err := tx.Where("id > ?", lastID).Order("id asc").Limit(500).Find(&batch).Error; err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for i := range batch {
+			lastID = batch[i].ID
+			if err := f.decryptFileMetadata(&batch[i]); err != nil {
+				return nil, fmt.Errorf("file %d: %w", batch[i].ID, err)
+			}
+			counts[filepath.Base(batch[i].StoragePath)]++
+		}
+	}
+
+	var blobs []model.Blob
+	if err := tx.Find(&blobs).Error; err != nil {
+		return nil, err
+	}
+	var unused []string
+	for _, blob := range blobs {
+		n := counts[blob.Name]
+		if n == blob.RefCount {
+			continue
+		}
+		if n == 0 {
+			if err := tx.Delete(&model.Blob{}, blob.ID).Error; err != nil {
+				return nil, err
+			}
+			unused = append(unused, f.shardedPath(blob.Name))
+			continue
+		}
+		if err := tx.Model(&model.Blob{}).Where("id = ?", blob.ID).UpdateColumn("ref_count", n).Error; err != nil {
+			return nil, err
+		}
+	}
+	return unused, nil
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+)
+
+func uploadString(t *testing.T, files *FileService, uploaderID uint, name, content string) *model.File {
+	t.Helper()
+	file, err := files.UploadFile(strings.NewReader(content), name, uploaderID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// readString 重新读出文件行并解密内容
+func readString(t *testing.T, files *FileService, id uint) string {
+	t.Helper()
+	file, err := files.GetFileByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := files.DecryptFile(&buf, file); err != nil {
+		t.Fatalf("file %d: %v", id, err)
+	}
+	return buf.String()
+}
+
+// blobRefs 返回 path 对应的 blobs 行的引用计数，没有这一行时返回 0
+func blobRefs(t *testing.T, files *FileService, path string) int64 {
+	t.Helper()
+	var blob model.Blob
+	if err := files.db.Where("name = ?", filepath.Base(path)).Limit(1).Find(&blob).Error; err != nil {
+		t.Fatal(err)
+	}
+	return blob.RefCount
+}
+
+// storedBlobs 统计存储目录下的密文文件数
+func storedBlobs(t *testing.T, files *FileService) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(files.dirpath, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestDedupTenantSharesBlob(t *testing.T) {
+	files := newTestFileService(t)
+	files.SetDedup(DedupTenant)
+
+	a := uploadString(t, files, 1, "a.txt", "same content")
+	b := uploadString(t, files, 2, "b.txt", "same content")
+	c := uploadString(t, files, 2, "c.txt", "other content")
+	if a.StoragePath != b.StoragePath || a.StoragePath == c.StoragePath {
+		t.Fatalf("paths a=%s b=%s c=%s", a.StoragePath, b.StoragePath, c.StoragePath)
+	}
+	if blobRefs(t, files, a.StoragePath) != 2 || blobRefs(t, files, c.StoragePath) != 1 || storedBlobs(t, files) != 2 {
+		t.Fatalf("refs %d/%d, %d blobs on disk", blobRefs(t, files, a.StoragePath), blobRefs(t, files, c.StoragePath), storedBlobs(t, files))
+	}
+	shared := a.StoragePath
+
+	// 用同样的内容更新，仍然引用同一个密文
+	if _, err := files.UpdateFile(a.ID, strings.NewReader("same content"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := files.GetFileByID(a.ID); got.StoragePath != shared || blobRefs(t, files, shared) != 2 {
+		t.Fatalf("update with the same content: %s, refs %d", got.StoragePath, blobRefs(t, files, shared))
+	}
+
+	// 换成新内容：a 不再引用共享密文，b 仍然读得出来
+	if _, err := files.UpdateFile(a.ID, strings.NewReader("new content"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(shared) || blobRefs(t, files, shared) != 1 || readString(t, files, b.ID) != "same content" || readString(t, files, a.ID) != "new content" {
+		t.Fatalf("after updating a: refs %d", blobRefs(t, files, shared))
+	}
+
+	// 再把 a 改回原来的内容又共享；删除 b 后 a 仍然可读，删除 a 后密文和行一起删除
+	if _, err := files.UpdateFile(a.ID, strings.NewReader("same content"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.DeleteFile(b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(shared) || blobRefs(t, files, shared) != 1 || readString(t, files, a.ID) != "same content" {
+		t.Fatalf("after deleting b: refs %d", blobRefs(t, files, shared))
+	}
+	if err := files.DeleteFile(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if exists(shared) || blobRefs(t, files, shared) != 0 {
+		t.Fatal("shared blob left behind after its last reference was deleted")
+	}
+	if n := storedBlobs(t, files); n != 1 {
+		t.Fatalf("%d blobs on disk, want only c", n)
+	}
+}
+
+func TestDedupUserScope(t *testing.T) {
+	files := newTestFileService(t)
+	files.SetDedup(DedupUser)
+
+	a1 := uploadString(t, files, 1, "a1.txt", "same content")
+	a2 := uploadString(t, files, 1, "a2.txt", "same content")
+	b := uploadString(t, files, 2, "b.txt", "same content")
+	if a1.StoragePath != a2.StoragePath || a1.StoragePath == b.StoragePath {
+		t.Fatalf("paths a1=%s a2=%s b=%s", a1.StoragePath, a2.StoragePath, b.StoragePath)
+	}
+	if blobRefs(t, files, a1.StoragePath) != 2 || blobRefs(t, files, b.StoragePath) != 1 {
+		t.Fatal("wrong reference counts")
+	}
+	if err := files.DeleteFile(b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if exists(b.StoragePath) || !exists(a1.StoragePath) || readString(t, files, a2.ID) != "same content" {
+		t.Fatal("deleting bob's copy touched alice's blob")
+	}
+
+	// 关闭去重后不再共享，已经共享的密文仍按引用计数删除
+	files.SetDedup("off")
+	a3 := uploadString(t, files, 1, "a3.txt", "same content")
+	if a3.StoragePath == a1.StoragePath || blobRefs(t, files, a3.StoragePath) != 0 {
+		t.Fatalf("dedup off shared %s", a3.StoragePath)
+	}
+	if err := files.DeleteFile(a1.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(a2.StoragePath) || readString(t, files, a2.ID) != "same content" {
+		t.Fatal("blob deleted while a2 still references it")
+	}
+}
+
+// 崩溃或恢复备份后引用计数与文件行不一致，recountBlobs 按文件行重算
+func TestRecountBlobs(t *testing.T) {
+	files := newTestFileService(t)
+	files.SetDedup(DedupTenant)
+
+	a := uploadString(t, files, 1, "a.txt", "shared")
+	uploadString(t, files, 2, "b.txt", "shared")
+	gone := uploadString(t, files, 1, "gone.txt", "unreferenced")
+
+	// 计数偏大；另一行的文件记录被直接删掉，只剩下 blobs 行和密文
+	if err := files.db.Model(&model.Blob{}).Where("name = ?", filepath.Base(a.StoragePath)).Update("ref_count", 5).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := files.db.Unscoped().Delete(&model.File{}, gone.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tx := files.db.Begin()
+	unused, err := files.recountBlobs(tx)
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(unused) != 1 || unused[0] != gone.StoragePath {
+		t.Fatalf("unused = %v, want %s", unused, gone.StoragePath)
+	}
+	if blobRefs(t, files, a.StoragePath) != 2 || blobRefs(t, files, gone.StoragePath) != 0 {
+		t.Fatalf("refs after recount: %d, %d", blobRefs(t, files, a.StoragePath), blobRefs(t, files, gone.StoragePath))
+	}
+
+	// 重算后再次运行不做任何修改
+	tx = files.db.Begin()
+	unused, err = files.recountBlobs(tx)
+	tx.Commit()
+	if err != nil || len(unused) != 0 || blobRefs(t, files, a.StoragePath) != 2 {
+		t.Fatalf("second recount: %v, %v", unused, err)
+	}
+}
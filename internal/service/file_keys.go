@@ -0,0 +1,125 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"sync"
+
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+var ErrSealed = errors.New("server is sealed")
+
+// fileKeys 是 FileService 从主密钥派生的全部子密钥。解封时整组换上，封存时整组换成空的，
+// 旧的一组在 mu 的写锁下清零；原始子密钥只能通过 raw 在读锁下复制出来，
+// 所以清零不会让正在进行的请求算出错误的 HMAC。
+// blobs 和 meta 内部的 AES 轮密钥无法清零，只能随旧的一组一起被回收
+type fileKeys struct {
+	mu          sync.RWMutex
+	fileKey     []byte
+	metaKey     []byte
+	tagKey      []byte
+	shareKey    []byte
+	dedupKey    []byte
+	customerKey []byte
+	blobs       *sfbcrypt.BlobCipher
+	meta        *sfbcrypt.MetaCipher
+}
+
+// newFileKeys 接管 keys 中的子密钥；keys 为 nil 时返回空的一组，加解密返回 "file crypto key not configured"
+func newFileKeys(keys *sfbcrypt.Keys) *fileKeys {
+	if keys == nil {
+		return &fileKeys{}
+	}
+	k := &fileKeys{
+		fileKey:     keys.File,
+		metaKey:     keys.Metadata,
+		tagKey:      keys.OwnerIndex,
+		shareKey:    keys.ShareLink,
+		dedupKey:    keys.Dedup,
+		customerKey: keys.Customer,
+	}
+	k.blobs, _ = sfbcrypt.NewBlobCipher(keys.File)
+	k.meta, _ = sfbcrypt.NewMetaCipher(keys.Metadata)
+	return k
+}
+
+// raw 返回 *key 的副本；没有配置或已经清零时返回 nil
+func (k *fileKeys) raw(key *[]byte) []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(*key) == 0 {
+		return nil
+	}
+	return append([]byte(nil), *key...)
+}
+
+// mac 返回以 *key 为密钥的 HMAC-SHA256，没有密钥时返回 nil
+func (k *fileKeys) mac(key *[]byte) hash.Hash {
+	b := k.raw(key)
+	if b == nil {
+		return nil
+	}
+	defer clear(b)
+	return hmac.New(sha256.New, b)
+}
+
+func (k *fileKeys) wipe() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range []*[]byte{&k.fileKey, &k.metaKey, &k.tagKey, &k.shareKey, &k.dedupKey, &k.customerKey} {
+		clear(*key)
+		*key = nil
+	}
+}
+
+// k 返回当前的子密钥；同一个操作中需要多次使用时应只取一次
+func (f *FileService) k() *fileKeys {
+	return f.keys.Load()
+}
+
+// encryptString 和 decryptString 用元数据密钥加解密单个字符串（S3 的对象键、ETag 和访问密钥）
+func (f *FileService) encryptString(s string) (string, error) {
+	meta := f.k().meta
+	if meta == nil {
+		return "", f.keyError()
+	}
+	return meta.EncryptString(s)
+}
+
+func (f *FileService) decryptString(s string) (string, error) {
+	meta := f.k().meta
+	if meta == nil {
+		return "", f.keyError()
+	}
+	return meta.DecryptString(s)
+}
+
+// keyError 是没有密钥时的错误：封存状态下为 ErrSealed
+func (f *FileService) keyError() error {
+	if f.Sealed() {
+		return ErrSealed
+	}
+	return errors.New("file crypto key not configured")
+}
+
+// Sealed 报告 FileService 是否处于封存状态
+func (f *FileService) Sealed() bool {
+	return f.sealed.Load()
+}
+
+// Unseal 换上从主密钥派生的子密钥并解除封存；keys 由 FileService 接管
+func (f *FileService) Unseal(keys *sfbcrypt.Keys) {
+	f.keys.Store(newFileKeys(keys))
+	f.sealed.Store(false)
+}
+
+// Seal 进入封存状态：丢弃并清零全部子密钥，同时清除内存中已解开的用户密钥。
+// 之后读写文件内容和元数据都返回 ErrSealed，直到 Unseal
+func (f *FileService) Seal() {
+	f.sealed.Store(true)
+	f.keys.Swap(&fileKeys{}).wipe()
+	f.userKeys.wipe()
+}
@@ -1,73 +1,115 @@
 package service
 
 import (
-	"bufio"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/binary"
-	"errors"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
-	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Kaikai20040827/graduation/internal/config"
 	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
 	"gorm.io/gorm"
 )
 
 type FileService struct {
 	db      *gorm.DB
 	dirpath string
-	fileKey []byte
-	metaKey []byte
-	fileGCM cipher.AEAD
-	metaGCM cipher.AEAD
-}
-
-const (
-	fileMagicV2     = "SFB2"
-	fileNoncePrefix = 8
-	fileNonceSize   = 12
-	metaNonceSize   = 12
-	chunkSize       = 32 * 1024
-)
+	// keys 是从主密钥派生的子密钥，见 file_keys.go；sealed 为 true 时是空的一组
+	keys   atomic.Pointer[fileKeys]
+	sealed atomic.Bool
+
+	scanner      VirusScanner
+	quarantine   bool
+	scanFailOpen bool
+
+	// userQuota 为每个用户的明文总字节数上限，0 表示不限制
+	userQuota int64
+	// scrubRate 为巡检每秒最多读取的密文字节数，0 表示不限速
+	scrubRate int64
+	// gcGrace 为孤儿密文在 .gc 中保留的时间
+	gcGrace time.Duration
+	// dedup 为去重范围（DedupUser / DedupTenant），空字符串表示不去重
+	dedup string
+	// vaultMu 串行化保险库文件的追加和删除
+	vaultMu sync.Mutex
+	// userKeys 为 nil 时所有内容都用主密钥加密，用户密钥加密的文件无法读取
+	userKeys *UserKeyRing
+
+	hooks []FileHooks
+}
 
-func NewFileService(db *gorm.DB, storagePath string, base64Key string) *FileService {
-	_ = os.MkdirAll(storagePath, 0755)
-	fmt.Println("✓ Creating a new file service done")
+// FileHooks 在文件内容写入数据库之后调用（created 表示新文件），
+// 用来把后续工作交给后台任务；回调在请求路径上执行，不应阻塞
+type FileHooks struct {
+	Stored func(file *model.File, created bool)
+}
 
-	fileKey, metaKey := deriveKeys(base64Key)
-	var fileGCM cipher.AEAD
-	var metaGCM cipher.AEAD
+// AddHooks 注册文件回调，应在开始处理请求之前调用
+func (f *FileService) AddHooks(h FileHooks) {
+	f.hooks = append(f.hooks, h)
+}
 
-	if len(fileKey) == 32 {
-		if block, err := aes.NewCipher(fileKey); err == nil {
-			fileGCM, _ = cipher.NewGCM(block)
-		}
-	}
-	if len(metaKey) == 32 {
-		if block, err := aes.NewCipher(metaKey); err == nil {
-			metaGCM, _ = cipher.NewGCM(block)
+func (f *FileService) fileStored(file *model.File, created bool) {
+	for _, h := range f.hooks {
+		if h.Stored != nil {
+			h.Stored(file, created)
 		}
 	}
+}
+
+func NewFileService(db *gorm.DB, storagePath string, base64Key string) *FileService {
+	_ = os.MkdirAll(storagePath, 0755)
+	fmt.Fprintln(config.Progress, "✓ Creating a new file service done")
+
+	f := &FileService{db: db, dirpath: storagePath}
+	// 密钥无效时使用空的一组子密钥，加解密时返回 "file crypto key not configured"
+	keys, _ := sfbcrypt.NewKeys(base64Key)
+	f.keys.Store(newFileKeys(keys))
+	return f
+}
 
-	return &FileService{db: db, dirpath: storagePath, fileKey: fileKey, metaKey: metaKey, fileGCM: fileGCM, metaGCM: metaGCM}
+// SetUserKeys 设置用户密钥环，之后新上传的内容按 UserKeyRing 的规则选择密钥
+func (f *FileService) SetUserKeys(keys *UserKeyRing) {
+	f.userKeys = keys
 }
 
 func (f *FileService) UploadFile(fileReader io.Reader, filename string, uploaderID uint, description string) (*model.File, error) {
-	storedName, err := randomStorageName()
+	return f.UploadFileWithKey(fileReader, filename, uploaderID, description, nil)
+}
+
+// UploadFileWithKey 与 UploadFile 相同；ck 不为 nil 时内容用客户密钥加密，只保存它的指纹
+func (f *FileService) UploadFileWithKey(fileReader io.Reader, filename string, uploaderID uint, description string, ck *CustomerKey) (*model.File, error) {
+	uploader := strconv.FormatUint(uint64(uploaderID), 10)
+	key, err := f.uploadKey(uploader, ck)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := f.newBlobPath("")
+	if err != nil {
+		return nil, err
+	}
+	fileReader, err = f.limitUpload(fileReader, uploader, 0)
 	if err != nil {
 		return nil, err
 	}
-	dst := filepath.Join(f.dirpath, storedName)
-	size, err := f.encryptToFile(fileReader, dst)
+	tag := f.contentHasher(uploader, key)
+	if tag != nil {
+		fileReader = io.TeeReader(fileReader, tag)
+	}
+	size, outcome, err := f.encryptAndScan(key.blobs, fileReader, dst)
 	if err != nil {
+		_ = os.Remove(dst)
+		return nil, err
+	}
+	if dst, err = f.applyScan(outcome, dst, true); err != nil {
 		return nil, err
 	}
 
@@ -79,26 +121,41 @@ func (f *FileService) UploadFile(fileReader io.Reader, filename string, uploader
 		UploaderID:  fmt.Sprintf("%d", uploaderID),
 		CreatedAt:   time.Now(),
 	}
-	if err := f.encryptFileMetadata(file); err != nil {
+	key.applyTo(file)
+	outcome.applyTo(file)
+	err = f.db.Transaction(func(tx *gorm.DB) error {
+		path, err := f.dedupBlob(tx, tag, dst)
+		if err != nil {
+			return err
+		}
+		file.StoragePath = path
+		if err := f.encryptFileMetadata(file); err != nil {
+			return err
+		}
+		return tx.Create(file).Error
+	})
+	// 失败时，或内容与已有的共享密文相同时，删除刚写入的密文
+	if err != nil || file.StoragePath != dst {
 		_ = os.Remove(dst)
-		return nil, err
 	}
-
-	if err := f.db.Create(file).Error; err != nil {
-		_ = os.Remove(dst)
+	if err != nil {
 		return nil, err
 	}
+	f.fileStored(file, true)
 	return file, nil
 }
 
 func (f *FileService) SaveUserAvatar(fileReader io.Reader, filename string, userID uint) (string, int64, error) {
-	storedName, err := randomStorageName()
+	dst, err := f.newBlobPath(avatarPrefix)
 	if err != nil {
 		return "", 0, err
 	}
-	dst := filepath.Join(f.dirpath, "avatar_"+storedName)
-	size, err := f.encryptToFile(fileReader, dst)
+	size, outcome, err := f.encryptAndScan(f.k().blobs, fileReader, dst)
 	if err != nil {
+		_ = os.Remove(dst)
+		return "", 0, err
+	}
+	if _, err := f.applyScan(outcome, dst, false); err != nil {
 		return "", 0, err
 	}
 	_ = filename
@@ -117,22 +174,47 @@ func (f *FileService) RemoveStoredFile(path string) error {
 }
 
 func (f *FileService) UpdateFile(id uint, fileReader io.Reader, filename *string, description *string) (*model.File, error) {
+	return f.UpdateFileWithKey(id, fileReader, filename, description, nil)
+}
+
+// UpdateFileWithKey 与 UpdateFile 相同；ck 不为 nil 时新内容用客户密钥加密。
+// 只修改描述时不需要密钥，ck 被忽略
+func (f *FileService) UpdateFileWithKey(id uint, fileReader io.Reader, filename *string, description *string, ck *CustomerKey) (*model.File, error) {
 	file, err := f.GetFileByID(id)
 	if err != nil {
 		return nil, err
 	}
 
+	var oldPath, dst string
+	var tag hash.Hash
 	if fileReader != nil {
-		tmpPath := fmt.Sprintf("%s.tmp.%d", file.StoragePath, time.Now().UnixNano())
-		size, err := f.encryptToFile(fileReader, tmpPath)
+		// 新内容按上传者当前的状态和 ck 选择密钥，与旧内容用的密钥无关
+		key, err := f.uploadKey(file.UploaderID, ck)
+		if err != nil {
+			return nil, err
+		}
+		fileReader, err = f.limitUpload(fileReader, file.UploaderID, file.Size)
+		if err != nil {
+			return nil, err
+		}
+		if tag = f.contentHasher(file.UploaderID, key); tag != nil {
+			fileReader = io.TeeReader(fileReader, tag)
+		}
+		// 新内容写到新的路径，记录提交后才删除旧密文；中途崩溃时记录仍指向完整的旧密文
+		if dst, err = f.newBlobPath(""); err != nil {
+			return nil, err
+		}
+		size, outcome, err := f.encryptAndScan(key.blobs, fileReader, dst)
 		if err != nil {
-			_ = os.Remove(tmpPath)
+			_ = os.Remove(dst)
 			return nil, err
 		}
-		if err := os.Rename(tmpPath, file.StoragePath); err != nil {
-			_ = os.Remove(tmpPath)
+		if dst, err = f.applyScan(outcome, dst, true); err != nil {
 			return nil, err
 		}
+		oldPath = file.StoragePath
+		outcome.applyTo(file)
+		key.applyTo(file)
 		file.Size = size
 		if filename != nil && *filename != "" {
 			file.Filename = *filename
@@ -143,25 +225,79 @@ func (f *FileService) UpdateFile(id uint, fileReader io.Reader, filename *string
 		file.Description = *description
 	}
 
-	if err := f.encryptFileMetadata(file); err != nil {
+	removeOld := false
+	err = f.db.Transaction(func(tx *gorm.DB) error {
+		if oldPath == "" {
+			return f.updateFileRow(tx, file)
+		}
+		path, err := f.dedupBlob(tx, tag, dst)
+		if err != nil {
+			return err
+		}
+		file.StoragePath = path
+		if err := f.updateFileRow(tx, file); err != nil {
+			return err
+		}
+		removeOld, err = f.releaseBlob(tx, oldPath)
+		return err
+	})
+	if oldPath != "" && (err != nil || file.StoragePath != dst) {
+		_ = os.Remove(dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if removeOld {
+		_ = os.Remove(oldPath)
+	}
+	if fileReader != nil {
+		f.fileStored(file, false)
+	}
+
+	return file, nil
+}
+
+// RenameFile 只修改文件名，内容不变
+func (f *FileService) RenameFile(id uint, filename string) (*model.File, error) {
+	file, err := f.GetFileByID(id)
+	if err != nil {
+		return nil, err
+	}
+	file.Filename = filename
+	if err := f.saveFileRow(file); err != nil {
 		return nil, err
 	}
-	if err := f.db.Model(&model.File{}).Where("id = ?", id).Updates(map[string]interface{}{
+	return file, nil
+}
+
+// FileETag 在文件内容或名称改变（updated_at 改变）后随之改变；
+// 只用毫秒精度，与数据库读回的时间一致
+func FileETag(file *model.File) string {
+	return fmt.Sprintf("\"%d-%x\"", file.ID, file.UpdatedAt.UnixMilli())
+}
+
+// saveFileRow 重新加密元数据并写回整行
+func (f *FileService) saveFileRow(file *model.File) error {
+	return f.updateFileRow(f.db, file)
+}
+
+func (f *FileService) updateFileRow(tx *gorm.DB, file *model.File) error {
+	if err := f.encryptFileMetadata(file); err != nil {
+		return err
+	}
+	return tx.Model(&model.File{}).Where("id = ?", file.ID).Updates(map[string]interface{}{
 		"enc_filename":     file.EncFilename,
 		"enc_storage_path": file.EncStoragePath,
 		"enc_size":         file.EncSize,
 		"enc_description":  file.EncDescription,
 		"enc_uploader_id":  file.EncUploaderID,
-		"filename":         "",
-		"storage_path":     "",
-		"size":             0,
-		"description":      "",
-		"uploader_id":      "",
-	}).Error; err != nil {
-		return nil, err
-	}
-
-	return file, nil
+		"owner_tag":        file.OwnerTag,
+		"scan_status":      file.ScanStatus,
+		"scan_signature":   file.ScanSignature,
+		"scanned_at":       file.ScannedAt,
+		"user_keyed":       file.UserKeyed,
+		"customer_key_tag": file.CustomerKeyTag,
+	}).Error
 }
 
 func (f *FileService) DeleteFile(id uint) error {
@@ -170,10 +306,24 @@ func (f *FileService) DeleteFile(id uint) error {
 		return err
 	}
 
-	if err := os.Remove(file.StoragePath); err != nil && !os.IsNotExist(err) {
+	// 先删除记录：删除密文失败时只会留下孤儿密文，由 storage gc 回收；
+	// 去重的密文只在最后一个引用删除时才删除
+	remove := false
+	err = f.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&model.File{}, id).Error; err != nil {
+			return err
+		}
+		var err error
+		remove, err = f.releaseBlob(tx, file.StoragePath)
+		return err
+	})
+	if err != nil {
 		return err
 	}
-	return f.db.Delete(&model.File{}, id).Error
+	if remove {
+		_ = os.Remove(file.StoragePath)
+	}
+	return nil
 }
 
 func (f *FileService) GetFileByID(id uint) (*model.File, error) {
@@ -188,11 +338,32 @@ func (f *FileService) GetFileByID(id uint) (*model.File, error) {
 }
 
 func (s *FileService) ListFiles(page, size int) (total int64, files []model.File, err error) {
+	return s.listFiles(s.db.Model(&model.File{}), page, size)
+}
+
+// ListReadableFiles 分页列出 CanRead 允许普通用户读取的文件：自己上传的和匿名公共上传的，按盲索引过滤
+func (s *FileService) ListReadableFiles(page, size int, uploaderID uint) (total int64, files []model.File, err error) {
+	tags := []string{s.ownerTag(strconv.FormatUint(uint64(uploaderID), 10)), s.ownerTag(publicUploaderID)}
+	total, files, err = s.listFiles(s.db.Model(&model.File{}).Where("owner_tag IN ?", tags), page, size)
+	if err != nil {
+		return
+	}
+	// 盲索引被改过的记录以解密后的上传者为准
+	readable := files[:0]
+	for i := range files {
+		if s.CanRead(&files[i], uploaderID, false) {
+			readable = append(readable, files[i])
+		}
+	}
+	return total, readable, nil
+}
+
+func (s *FileService) listFiles(tx *gorm.DB, page, size int) (total int64, files []model.File, err error) {
 	offset := (page - 1) * size
-	if err = s.db.Model(&model.File{}).Count(&total).Error; err != nil {
+	if err = tx.Count(&total).Error; err != nil {
 		return
 	}
-	err = s.db.Order("created_at desc").Limit(size).Offset(offset).Find(&files).Error
+	err = tx.Order("created_at desc").Limit(size).Offset(offset).Find(&files).Error
 	if err != nil {
 		return
 	}
@@ -209,252 +380,275 @@ func (s *FileService) ListFiles(page, size int) (total int64, files []model.File
 	return
 }
 
-func deriveKeys(base64Key string) ([]byte, []byte) {
-	raw, err := base64.RawURLEncoding.DecodeString(base64Key)
-	if err != nil || len(raw) < 32 {
-		return nil, nil
+// ListFilesByOwner 通过盲索引列出某个用户上传的文件
+func (s *FileService) ListFilesByOwner(uploaderID uint) ([]model.File, error) {
+	var files []model.File
+	tag := s.ownerTag(strconv.FormatUint(uint64(uploaderID), 10))
+	if err := s.db.Where("owner_tag = ?", tag).Order("created_at desc").Find(&files).Error; err != nil {
+		return nil, err
 	}
-
-	fileKeyMAC := hmac.New(sha256.New, raw)
-	fileKeyMAC.Write([]byte("file-gcm-aes256"))
-	metaKeyMAC := hmac.New(sha256.New, raw)
-	metaKeyMAC.Write([]byte("db-meta-gcm-aes256"))
-
-	return fileKeyMAC.Sum(nil), metaKeyMAC.Sum(nil)
-}
-
-func (f *FileService) encryptToFile(src io.Reader, dstPath string) (int64, error) {
-	if f.fileGCM == nil {
-		return 0, errors.New("file crypto key not configured")
+	filtered := make([]model.File, 0, len(files))
+	for i := range files {
+		if err := s.decryptFileMetadata(&files[i]); err != nil {
+			continue
+		}
+		filtered = append(filtered, files[i])
 	}
+	return filtered, nil
+}
 
-	out, err := os.Create(dstPath)
+// UserStorageUsage 统计某个用户的文件数量和总大小：普通文件按明文，保险库文件按密文
+func (s *FileService) UserStorageUsage(uploaderID uint) (count int64, bytes int64, err error) {
+	files, err := s.ListFilesByOwner(uploaderID)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	defer out.Close()
-
-	prefix := make([]byte, fileNoncePrefix)
-	if _, err := rand.Read(prefix); err != nil {
-		return 0, err
+	for i := range files {
+		count++
+		bytes += files[i].Size
 	}
-
-	header := append([]byte(fileMagicV2), prefix...)
-	if _, err := out.Write(header); err != nil {
-		return 0, err
+	vaultCount, vaultBytes, err := s.vaultUsage(uploaderID)
+	if err != nil {
+		return 0, 0, err
 	}
+	return count + vaultCount, bytes + vaultBytes, nil
+}
 
-	writer := bufio.NewWriterSize(out, chunkSize*2)
-	buf := make([]byte, chunkSize)
-	var total int64
-	var counter uint32
-
-	for {
-		n, rerr := src.Read(buf)
-		if n > 0 {
-			total += int64(n)
-			nonce := makeChunkNonce(prefix, counter)
-			aad := makeChunkAAD(counter)
-			sealed := f.fileGCM.Seal(nil, nonce, buf[:n], aad)
-
-			if err := binary.Write(writer, binary.BigEndian, uint32(len(sealed))); err != nil {
-				return 0, err
-			}
-			if _, err := writer.Write(sealed); err != nil {
-				return 0, err
-			}
-			counter++
-		}
-		if rerr == io.EOF {
-			break
+// BackfillOwnerTags 为还没有盲索引的旧记录补齐 owner_tag
+func (s *FileService) BackfillOwnerTags() error {
+	var files []model.File
+	if err := s.db.Where("owner_tag = ? OR owner_tag IS NULL", "").Find(&files).Error; err != nil {
+		return err
+	}
+	for i := range files {
+		if err := s.decryptFileMetadata(&files[i]); err != nil {
+			continue
 		}
-		if rerr != nil {
-			return 0, rerr
+		tag := s.ownerTag(files[i].UploaderID)
+		if err := s.db.Model(&model.File{}).Where("id = ?", files[i].ID).Update("owner_tag", tag).Error; err != nil {
+			return err
 		}
 	}
-
-	if err := writer.Flush(); err != nil {
-		return 0, err
-	}
-	return total, nil
+	return nil
 }
 
-func (f *FileService) DecryptToWriter(w io.Writer, srcPath string) error {
-	if f.fileGCM == nil {
-		return errors.New("file crypto key not configured")
+func (s *FileService) ownerTag(uploaderID string) string {
+	k := s.k()
+	mac := k.mac(&k.tagKey)
+	if mac == nil {
+		return ""
 	}
+	mac.Write([]byte(uploaderID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-	in, err := os.Open(srcPath)
+// deriveKey 用 HMAC-SHA256(master, label) 从主密钥派生出用途各不相同的子密钥
+func deriveKey(base64Key string, label string) []byte {
+	master, err := sfbcrypt.ParseMasterKey(base64Key)
 	if err != nil {
-		return err
+		return nil
 	}
-	defer in.Close()
+	return sfbcrypt.DeriveKey(master, label)
+}
 
-	header := make([]byte, len(fileMagicV2)+fileNoncePrefix)
-	if _, err := io.ReadFull(in, header); err != nil {
-		return err
-	}
-	if string(header[:len(fileMagicV2)]) != fileMagicV2 {
-		return errors.New("invalid file magic")
-	}
-	prefix := header[len(fileMagicV2):]
+// contentKey 是新内容使用的密钥：主密钥、上传者的用户密钥或客户密钥
+type contentKey struct {
+	blobs       *sfbcrypt.BlobCipher
+	userKeyed   bool
+	customerTag string
+}
 
-	reader := bufio.NewReaderSize(in, chunkSize*2)
-	var counter uint32
-	for {
-		var n uint32
-		err := binary.Read(reader, binary.BigEndian, &n)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		if n == 0 {
-			return errors.New("invalid encrypted chunk length")
-		}
+func (k contentKey) applyTo(file *model.File) {
+	file.UserKeyed = k.userKeyed
+	file.CustomerKeyTag = k.customerTag
+	file.CustomerKeyed = k.customerTag != ""
+}
 
-		sealed := make([]byte, n)
-		if _, err := io.ReadFull(reader, sealed); err != nil {
-			return err
+// uploadKey 选择 uploaderID 新上传内容的密钥：带了客户密钥时用客户密钥，否则按用户密钥环的规则
+func (f *FileService) uploadKey(uploaderID string, ck *CustomerKey) (contentKey, error) {
+	if ck != nil {
+		k := f.k()
+		checkKey := k.raw(&k.customerKey)
+		if checkKey == nil {
+			return contentKey{}, f.keyError()
 		}
-
-		nonce := makeChunkNonce(prefix, counter)
-		aad := makeChunkAAD(counter)
-		plain, err := f.fileGCM.Open(nil, nonce, sealed, aad)
+		defer clear(checkKey)
+		tag, err := sfbcrypt.CustomerKeyFingerprint(checkKey, ck.key)
 		if err != nil {
-			return errors.New("file integrity check failed")
-		}
-		if _, err := w.Write(plain); err != nil {
-			return err
+			return contentKey{}, err
 		}
-		counter++
+		blobs, err := sfbcrypt.NewBlobCipher(ck.key)
+		return contentKey{blobs: blobs, customerTag: tag}, err
 	}
-
-	return nil
+	blobs, userKeyed, err := f.userKeys.uploadCipher(uploaderID)
+	if err != nil || userKeyed {
+		return contentKey{blobs: blobs, userKeyed: userKeyed}, err
+	}
+	return contentKey{blobs: f.k().blobs}, nil
 }
 
-func makeChunkNonce(prefix []byte, counter uint32) []byte {
-	nonce := make([]byte, fileNonceSize)
-	copy(nonce, prefix)
-	binary.BigEndian.PutUint32(nonce[fileNoncePrefix:], counter)
-	return nonce
+// fileCipher 返回解密 file 内容的加解密器；用户密钥加密的文件在上传者的密钥解开时才能读取，
+// 客户密钥加密的文件返回 ErrCustomerKeyRequired
+func (f *FileService) fileCipher(file *model.File) (*sfbcrypt.BlobCipher, error) {
+	return f.contentCipher(file, nil)
 }
 
-func makeChunkAAD(counter uint32) []byte {
-	aad := make([]byte, 4)
-	binary.BigEndian.PutUint32(aad, counter)
-	return aad
+// contentCipher 与 fileCipher 相同，但客户密钥加密的文件用 ck 解密；
+// 其他文件带了 ck 时返回 ErrCustomerKeyNotUsed，让客户端知道这个文件没有用它的密钥加密
+func (f *FileService) contentCipher(file *model.File, ck *CustomerKey) (*sfbcrypt.BlobCipher, error) {
+	if file.CustomerKeyTag != "" {
+		return f.customerCipher(file, ck)
+	}
+	if ck != nil {
+		return nil, ErrCustomerKeyNotUsed
+	}
+	if file.UserKeyed {
+		return f.userKeys.fileCipher(file.UploaderID)
+	}
+	blobs := f.k().blobs
+	if blobs == nil {
+		return nil, f.keyError()
+	}
+	return blobs, nil
 }
 
-func randomStorageName() (string, error) {
-	randBytes := make([]byte, 16)
-	if _, err := rand.Read(randBytes); err != nil {
-		return "", err
-	}
-	return base64.RawURLEncoding.EncodeToString(randBytes) + ".bin", nil
+// encryptToFile 用主密钥原子地写入密文（见 writeFileAtomic），返回时密文已经落盘，可以提交数据库行
+func (f *FileService) encryptToFile(src io.Reader, dstPath string) (int64, error) {
+	return f.encryptWith(f.k().blobs, src, dstPath)
 }
 
-func (f *FileService) encryptFileMetadata(file *model.File) error {
-	if f.metaGCM == nil {
-		return errors.New("file crypto key not configured")
+func (f *FileService) encryptWith(blobs *sfbcrypt.BlobCipher, src io.Reader, dstPath string) (int64, error) {
+	if blobs == nil {
+		return 0, f.keyError()
 	}
-	var err error
 
-	if file.EncFilename, err = f.encryptString(file.Filename); err != nil {
-		return err
-	}
-	if file.EncStoragePath, err = f.encryptString(file.StoragePath); err != nil {
-		return err
-	}
-	if file.EncSize, err = f.encryptString(strconv.FormatInt(file.Size, 10)); err != nil {
-		return err
-	}
-	if file.EncDescription, err = f.encryptString(file.Description); err != nil {
-		return err
-	}
-	if file.EncUploaderID, err = f.encryptString(file.UploaderID); err != nil {
+	var size int64
+	err := writeFileAtomic(dstPath, func(w io.Writer) error {
+		var err error
+		size, err = blobs.Encrypt(w, src)
 		return err
-	}
-	file.LegacyFilename = ""
-	file.LegacyPath = ""
-	file.LegacySize = 0
-	file.LegacyDesc = ""
-	file.LegacyUploader = ""
-	return nil
+	})
+	return size, err
 }
 
-func (f *FileService) decryptFileMetadata(file *model.File) error {
-	if f.metaGCM == nil {
-		return errors.New("file crypto key not configured")
-	}
-	if file.EncFilename == "" && file.EncStoragePath == "" && file.EncSize == "" && file.EncDescription == "" && file.EncUploaderID == "" {
-		file.Filename = file.LegacyFilename
-		file.StoragePath = file.LegacyPath
-		file.Size = file.LegacySize
-		file.Description = file.LegacyDesc
-		file.UploaderID = file.LegacyUploader
-		return nil
+// DecryptToWriter 解密用主密钥加密的密文（头像、S3 分片）；文件内容用 DecryptFile
+func (f *FileService) DecryptToWriter(w io.Writer, srcPath string) error {
+	blobs := f.k().blobs
+	if blobs == nil {
+		return f.keyError()
 	}
-	var err error
+	return decryptWith(blobs, w, srcPath)
+}
+
+// DecryptFile 解密 file 的内容，按 file.UserKeyed 选择密钥
+func (f *FileService) DecryptFile(w io.Writer, file *model.File) error {
+	return f.DecryptFileWithKey(w, file, nil)
+}
 
-	if file.Filename, err = f.decryptString(file.EncFilename); err != nil {
+// DecryptFileWithKey 与 DecryptFile 相同，客户密钥加密的文件用 ck 解密
+func (f *FileService) DecryptFileWithKey(w io.Writer, file *model.File, ck *CustomerKey) error {
+	blobs, err := f.contentCipher(file, ck)
+	if err != nil {
 		return err
 	}
-	if file.StoragePath, err = f.decryptString(file.EncStoragePath); err != nil {
+	return decryptWith(blobs, w, file.StoragePath)
+}
+
+func decryptWith(blobs *sfbcrypt.BlobCipher, w io.Writer, srcPath string) error {
+	in, err := os.Open(srcPath)
+	if err != nil {
 		return err
 	}
-	sizeText, err := f.decryptString(file.EncSize)
+	defer in.Close()
+	_, err = blobs.Decrypt(w, in)
+	return err
+}
+
+// DecryptFileRange 只解密 file 明文的 [offset, offset+length)，用于 HTTP Range 请求
+func (f *FileService) DecryptFileRange(w io.Writer, file *model.File, offset, length int64) error {
+	return f.DecryptFileRangeWithKey(w, file, nil, offset, length)
+}
+
+// DecryptFileRangeWithKey 与 DecryptFileRange 相同，客户密钥加密的文件用 ck 解密
+func (f *FileService) DecryptFileRangeWithKey(w io.Writer, file *model.File, ck *CustomerKey, offset, length int64) error {
+	blobs, err := f.contentCipher(file, ck)
 	if err != nil {
 		return err
 	}
-	if sizeText == "" {
-		file.Size = 0
-	} else {
-		size, convErr := strconv.ParseInt(sizeText, 10, 64)
-		if convErr != nil {
-			return convErr
-		}
-		file.Size = size
-	}
-	if file.Description, err = f.decryptString(file.EncDescription); err != nil {
+
+	in, err := os.Open(file.StoragePath)
+	if err != nil {
 		return err
 	}
-	if file.UploaderID, err = f.decryptString(file.EncUploaderID); err != nil {
-		return err
+	defer in.Close()
+	n, err := blobs.DecryptRange(w, in, offset, length)
+	if err == nil && n != length {
+		err = fmt.Errorf("%w: got %d of %d bytes", sfbcrypt.ErrTruncated, n, length)
 	}
-	return nil
+	return err
 }
 
-func (f *FileService) encryptString(plain string) (string, error) {
-	nonce := make([]byte, metaNonceSize)
-	if _, err := rand.Read(nonce); err != nil {
+func randomStorageName() (string, error) {
+	randBytes := make([]byte, 16)
+	if _, err := rand.Read(randBytes); err != nil {
 		return "", err
 	}
-	sealed := f.metaGCM.Seal(nil, nonce, []byte(plain), nil)
-	payload := append(nonce, sealed...)
-	return "v1:" + base64.RawURLEncoding.EncodeToString(payload), nil
+	return base64.RawURLEncoding.EncodeToString(randBytes) + ".bin", nil
 }
 
-func (f *FileService) decryptString(ciphertext string) (string, error) {
-	if ciphertext == "" {
-		return "", nil
-	}
-	if len(ciphertext) < 3 || ciphertext[:3] != "v1:" {
-		return "", errors.New("invalid encrypted metadata format")
-	}
-	blob, err := base64.RawURLEncoding.DecodeString(ciphertext[3:])
+func (f *FileService) encryptFileMetadata(file *model.File) error {
+	meta := f.k().meta
+	if meta == nil {
+		return f.keyError()
+	}
+	row, err := meta.EncryptRow(file.ID, &sfbcrypt.FileMetadata{
+		Filename:    file.Filename,
+		StoragePath: file.StoragePath,
+		Size:        file.Size,
+		Description: file.Description,
+		UploaderID:  file.UploaderID,
+	})
 	if err != nil {
-		return "", err
+		return err
 	}
-	if len(blob) < metaNonceSize {
-		return "", errors.New("invalid encrypted metadata payload")
+	file.EncFilename = row.EncFilename
+	file.EncStoragePath = row.EncStoragePath
+	file.EncSize = row.EncSize
+	file.EncDescription = row.EncDescription
+	file.EncUploaderID = row.EncUploaderID
+	// 元数据加密之后刚好被封存时盲索引为空，这一行会从列表中消失，所以不能写入
+	if file.OwnerTag = f.ownerTag(file.UploaderID); file.OwnerTag == "" {
+		return f.keyError()
 	}
-	nonce := blob[:metaNonceSize]
-	sealed := blob[metaNonceSize:]
-	plain, err := f.metaGCM.Open(nil, nonce, sealed, nil)
+	return nil
+}
+
+func (f *FileService) decryptFileMetadata(file *model.File) error {
+	cipher := f.k().meta
+	if cipher == nil {
+		return f.keyError()
+	}
+	meta, err := cipher.DecryptRow(MetadataRowOf(file))
 	if err != nil {
-		return "", errors.New("metadata integrity check failed")
+		return err
+	}
+	file.Filename = meta.Filename
+	file.StoragePath = meta.StoragePath
+	file.Size = meta.Size
+	file.Description = meta.Description
+	file.UploaderID = meta.UploaderID
+	file.CustomerKeyed = file.CustomerKeyTag != ""
+	return nil
+}
+
+// MetadataRowOf 取出一行的加密列，供 sfbdecrypt 离线解密
+func MetadataRowOf(file *model.File) sfbcrypt.MetadataRow {
+	return sfbcrypt.MetadataRow{
+		ID:             file.ID,
+		EncFilename:    file.EncFilename,
+		EncStoragePath: file.EncStoragePath,
+		EncSize:        file.EncSize,
+		EncDescription: file.EncDescription,
+		EncUploaderID:  file.EncUploaderID,
 	}
-	return string(plain), nil
 }
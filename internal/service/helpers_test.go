@@ -0,0 +1,48 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/migrate"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"gorm.io/gorm"
+)
+
+// testKey 是测试用的主密钥（32 个零字节）
+const testKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+// newTestDB 在临时目录中创建 SQLite 数据库并执行全部迁移
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := pkg.NewDatabase(&config.DatabaseConfig{Driver: "sqlite", Path: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate.New(db, testKey).Startup(true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// newTestFileService 返回使用 newTestDB 和临时存储目录的 FileService
+func newTestFileService(t *testing.T) *FileService {
+	t.Helper()
+	return NewFileService(newTestDB(t), t.TempDir(), testKey)
+}
+
+func newTestUser(t *testing.T, users *UserService, name string) *model.User {
+	t.Helper()
+	u, err := users.CreateUser(name, name+"@example.com", "Passw0rd!"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -0,0 +1,593 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrJobNotFound    = errors.New("job not found")
+	ErrUnknownJobType = errors.New("unknown job type")
+	ErrInvalidJob     = errors.New("invalid job payload")
+	ErrJobFinished    = errors.New("job already finished")
+	ErrJobActive      = errors.New("job is still pending or running")
+)
+
+// JobService 是保存在数据库中的后台任务队列。任务按类型注册处理函数，
+// 多个实例可以共用同一个队列：领取任务和触发定时任务都通过条件更新完成。
+type JobService struct {
+	db     *gorm.DB
+	cfg    config.JobsConfig
+	worker string
+	wake   chan struct{}
+
+	mu      sync.Mutex
+	types   map[string]jobType
+	running map[uint]context.CancelFunc
+	// paused 返回 true 时不领取新任务（例如服务器处于封存状态），定时任务照常入队
+	paused func() bool
+}
+
+type jobType struct {
+	run   func(ctx context.Context, payload []byte) error
+	check func(payload []byte) error
+}
+
+// permanentError 表示重试也不会成功的错误，任务直接标记为失败
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// JobPermanent 包装处理函数返回的错误，使任务不再重试
+func JobPermanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// jobClaimBatch 是每次查找可领取任务的数量，领取失败（被其他 worker 抢走）时尝试下一个
+const jobClaimBatch = 10
+
+// jobPruneInterval 是清理过期任务记录的间隔
+const jobPruneInterval = time.Hour
+
+func NewJobService(db *gorm.DB, cfg config.JobsConfig) *JobService {
+	fmt.Fprintln(config.Progress, "✓ Creating a new job service done")
+	host, _ := os.Hostname()
+	suffix, _ := randomHex(4)
+	return &JobService{
+		db:      db,
+		cfg:     cfg,
+		worker:  truncate(fmt.Sprintf("%s-%d-%s", host, os.Getpid(), suffix), 64),
+		wake:    make(chan struct{}, 1),
+		types:   make(map[string]jobType),
+		running: make(map[uint]context.CancelFunc),
+	}
+}
+
+// RegisterJob 注册任务类型 typ 的处理函数，payload 按 JSON 解码为 P。
+// 处理函数应当可以安全地重复执行：租约过期的任务会被重新领取。
+func RegisterJob[P any](s *JobService, typ string, fn func(ctx context.Context, payload P) error) {
+	decode := func(raw []byte) (P, error) {
+		var p P
+		if len(raw) == 0 {
+			return p, nil
+		}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return p, fmt.Errorf("%w: %v", ErrInvalidJob, err)
+		}
+		return p, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.types[typ] = jobType{
+		run: func(ctx context.Context, raw []byte) error {
+			p, err := decode(raw)
+			if err != nil {
+				return JobPermanent(err)
+			}
+			return fn(ctx, p)
+		},
+		check: func(raw []byte) error {
+			_, err := decode(raw)
+			return err
+		},
+	}
+}
+
+// Types 返回已注册的任务类型
+func (s *JobService) Types() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	types := make([]string, 0, len(s.types))
+	for typ := range s.types {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (s *JobService) lookup(typ string) (jobType, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.types[typ]
+	return t, ok
+}
+
+// Enqueue 创建一个立即可以执行的任务；payload 会被编码为 JSON
+func (s *JobService) Enqueue(typ string, payload any) (*model.Job, error) {
+	return s.EnqueueAt(typ, payload, time.Now())
+}
+
+// EnqueueAt 创建一个在 runAt 之后执行的任务
+func (s *JobService) EnqueueAt(typ string, payload any, runAt time.Time) (*model.Job, error) {
+	return s.enqueue(typ, payload, runAt, "")
+}
+
+func (s *JobService) enqueue(typ string, payload any, runAt time.Time, schedule string) (*model.Job, error) {
+	t, ok := s.lookup(typ)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownJobType, typ)
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidJob, err)
+	}
+	if payload == nil {
+		raw = []byte("{}")
+	}
+	if err := t.check(raw); err != nil {
+		return nil, err
+	}
+	job := &model.Job{
+		Type:        typ,
+		Payload:     string(raw),
+		Status:      model.JobPending,
+		RunAt:       runAt,
+		MaxAttempts: s.cfg.MaxAttempts,
+		Schedule:    schedule,
+	}
+	if err := s.db.Create(job).Error; err != nil {
+		return nil, err
+	}
+	s.notify()
+	return job, nil
+}
+
+// notify 唤醒一个空闲的本地 worker，不必等到下一次轮询
+func (s *JobService) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *JobService) Get(id uint) (*model.Job, error) {
+	var job model.Job
+	if err := s.db.First(&job, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrJobNotFound
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *JobService) List(status string, typ string, page, size int) (total int64, jobs []model.Job, err error) {
+	tx := s.db.Model(&model.Job{})
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	if typ != "" {
+		tx = tx.Where("type = ?", typ)
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return
+	}
+	offset := (page - 1) * size
+	err = tx.Order("id desc").Limit(size).Offset(offset).Find(&jobs).Error
+	return
+}
+
+// JobCount 是某个状态的任务数量
+type JobCount struct {
+	Status string `json:"status"`
+	Count  int64  `json:"count"`
+}
+
+// CountByStatus 按状态统计任务数量
+func (s *JobService) CountByStatus() ([]JobCount, error) {
+	var counts []JobCount
+	err := s.db.Model(&model.Job{}).Select("status, COUNT(*) AS count").Group("status").Order("status").Scan(&counts).Error
+	return counts, err
+}
+
+// LastSucceeded 返回某类任务最近一次成功结束的时间，从未成功过时返回 nil
+func (s *JobService) LastSucceeded(typ string) (*time.Time, error) {
+	var job model.Job
+	err := s.db.Where("type = ? AND status = ?", typ, model.JobSucceeded).Order("finished_at desc").Limit(1).Find(&job).Error
+	if err != nil || job.ID == 0 {
+		return nil, err
+	}
+	return job.FinishedAt, nil
+}
+
+// Schedules 列出定时任务及其下一次触发时间
+func (s *JobService) Schedules() ([]model.JobSchedule, error) {
+	var schedules []model.JobSchedule
+	err := s.db.Order("type asc").Find(&schedules).Error
+	return schedules, err
+}
+
+// Cancel 取消等待中或运行中的任务。运行中的任务在本进程内立即收到 ctx 取消，
+// 在其他实例上则在下一次续约时发现
+func (s *JobService) Cancel(id uint) (*model.Job, error) {
+	now := time.Now()
+	res := s.db.Model(&model.Job{}).
+		Where("id = ? AND status IN ?", id, []string{model.JobPending, model.JobRunning}).
+		Updates(map[string]interface{}{"status": model.JobCanceled, "finished_at": &now, "lease_until": nil})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		if _, err := s.Get(id); err != nil {
+			return nil, err
+		}
+		return nil, ErrJobFinished
+	}
+	s.mu.Lock()
+	if cancel, ok := s.running[id]; ok {
+		cancel()
+	}
+	s.mu.Unlock()
+	return s.Get(id)
+}
+
+// Rerun 以相同的类型和参数创建一个新任务；原任务必须已经结束，记录保持不变
+func (s *JobService) Rerun(id uint) (*model.Job, error) {
+	job, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == model.JobPending || job.Status == model.JobRunning {
+		return nil, ErrJobActive
+	}
+	return s.enqueue(job.Type, json.RawMessage(job.Payload), time.Now(), "")
+}
+
+// Run 启动 worker 和定时任务，直到 ctx 取消。配置的定时任务类型未注册或表达式无效时返回错误
+func (s *JobService) Run(ctx context.Context) error {
+	schedules, err := s.parseSchedules()
+	if err != nil {
+		return err
+	}
+	if err := s.syncSchedules(schedules); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(ctx)
+		}()
+	}
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+	for {
+		s.fireSchedules(schedules)
+		if s.cfg.Retention > 0 && time.Since(lastPrune) >= jobPruneInterval {
+			s.prune()
+			lastPrune = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *JobService) work(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil && s.RunNext(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunNext 领取并执行一个到期的任务；没有可执行的任务时返回 false
+func (s *JobService) RunNext(ctx context.Context) bool {
+	if s.paused != nil && s.paused() {
+		return false
+	}
+	job, err := s.claimNext()
+	if err != nil {
+		if pkg.Logger != nil {
+			pkg.Logger.Error("job claim failed", zap.Error(err))
+		}
+		return false
+	}
+	if job == nil {
+		return false
+	}
+	s.execute(ctx, job)
+	return true
+}
+
+// PauseWhile 在 cond 返回 true 期间暂停领取任务，应在 Run 之前调用
+func (s *JobService) PauseWhile(cond func() bool) {
+	s.paused = cond
+}
+
+// claimNext 领取等待中且到期的任务，或者租约已经过期的运行中任务（执行它的进程多半已经退出）
+func (s *JobService) claimNext() (*model.Job, error) {
+	now := time.Now()
+	var candidates []model.Job
+	err := s.db.Where("(status = ? AND run_at <= ?) OR (status = ? AND lease_until < ?)",
+		model.JobPending, now, model.JobRunning, now).
+		Order("run_at asc").Limit(jobClaimBatch).Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		job := &candidates[i]
+		if job.Status == model.JobRunning && job.Attempts >= job.MaxAttempts {
+			// 每次执行都没能结束（例如让进程崩溃）的任务不再重试
+			s.db.Model(&model.Job{}).
+				Where("id = ? AND status = ? AND attempts = ?", job.ID, model.JobRunning, job.Attempts).
+				Updates(map[string]interface{}{
+					"status":      model.JobFailed,
+					"locked_by":   "",
+					"lease_until": nil,
+					"finished_at": &now,
+					"last_error":  fmt.Sprintf("lease expired on attempt %d", job.Attempts),
+				})
+			continue
+		}
+		if s.claim(job, now) {
+			return job, nil
+		}
+	}
+	return nil, nil
+}
+
+// claim 用 attempts 作为版本号做条件更新，多个 worker 同时领取时只有一个成功
+func (s *JobService) claim(job *model.Job, now time.Time) bool {
+	tx := s.db.Model(&model.Job{}).Where("id = ? AND status = ? AND attempts = ?", job.ID, job.Status, job.Attempts)
+	if job.Status == model.JobRunning {
+		tx = tx.Where("lease_until < ?", now)
+	}
+	lease := now.Add(s.cfg.Lease)
+	res := tx.Updates(map[string]interface{}{
+		"status":      model.JobRunning,
+		"attempts":    job.Attempts + 1,
+		"locked_by":   s.worker,
+		"lease_until": &lease,
+		"started_at":  &now,
+	})
+	if res.Error != nil || res.RowsAffected != 1 {
+		return false
+	}
+	job.Status = model.JobRunning
+	job.Attempts++
+	job.LockedBy = s.worker
+	job.LeaseUntil = &lease
+	job.StartedAt = &now
+	return true
+}
+
+// owned 限定只更新本 worker 在这一次尝试中持有的任务
+func (s *JobService) owned(job *model.Job) *gorm.DB {
+	return s.db.Model(&model.Job{}).Where("id = ? AND status = ? AND locked_by = ? AND attempts = ?",
+		job.ID, model.JobRunning, s.worker, job.Attempts)
+}
+
+func (s *JobService) execute(ctx context.Context, job *model.Job) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	s.running[job.ID] = cancel
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, job.ID)
+		s.mu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.heartbeat(job, cancel, done)
+
+	err := s.call(jobCtx, job)
+
+	now := time.Now()
+	updates := map[string]interface{}{"locked_by": "", "lease_until": nil}
+	var perm *permanentError
+	switch {
+	case err == nil:
+		updates["status"] = model.JobSucceeded
+		updates["finished_at"] = &now
+		updates["last_error"] = ""
+	case errors.As(err, &perm) || job.Attempts >= job.MaxAttempts:
+		updates["status"] = model.JobFailed
+		updates["finished_at"] = &now
+		updates["last_error"] = truncate(err.Error(), 512)
+	default:
+		updates["status"] = model.JobPending
+		updates["run_at"] = now.Add(s.backoff(job.Attempts))
+		updates["last_error"] = truncate(err.Error(), 512)
+	}
+	// 任务在执行期间被取消时这里不会更新任何行
+	if res := s.owned(job).Updates(updates); res.Error != nil && pkg.Logger != nil {
+		pkg.Logger.Error("job update failed", zap.Uint("job", job.ID), zap.Error(res.Error))
+	}
+	if err != nil && pkg.Logger != nil {
+		pkg.Logger.Warn("job failed", zap.Uint("job", job.ID), zap.String("type", job.Type),
+			zap.Int("attempt", job.Attempts), zap.Error(err))
+	}
+}
+
+// call 执行处理函数；未注册的类型直接失败，panic 视为一次普通的失败
+func (s *JobService) call(ctx context.Context, job *model.Job) (err error) {
+	t, ok := s.lookup(job.Type)
+	if !ok {
+		return JobPermanent(fmt.Errorf("%w: %q", ErrUnknownJobType, job.Type))
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return t.run(ctx, []byte(job.Payload))
+}
+
+// heartbeat 每隔 Lease/3 续约；续约失败说明任务已被取消或被其他 worker 接管，此时取消 ctx
+func (s *JobService) heartbeat(job *model.Job, cancel context.CancelFunc, done <-chan struct{}) {
+	ticker := time.NewTicker(s.cfg.Lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		lease := time.Now().Add(s.cfg.Lease)
+		res := s.owned(job).Update("lease_until", &lease)
+		if res.Error == nil && res.RowsAffected == 0 {
+			cancel()
+			return
+		}
+	}
+}
+
+func (s *JobService) backoff(attempts int) time.Duration {
+	d := s.cfg.InitialBackoff
+	for i := 1; i < attempts && d < s.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.cfg.MaxBackoff {
+		d = s.cfg.MaxBackoff
+	}
+	return d
+}
+
+func (s *JobService) parseSchedules() (map[string]*pkg.Cron, error) {
+	schedules := make(map[string]*pkg.Cron)
+	for typ, spec := range s.cfg.Schedules {
+		if spec == "" {
+			continue
+		}
+		if _, ok := s.lookup(typ); !ok {
+			return nil, fmt.Errorf("jobs.schedules: %w: %q", ErrUnknownJobType, typ)
+		}
+		c, err := pkg.ParseCron(spec)
+		if err != nil {
+			return nil, fmt.Errorf("jobs.schedules.%s: %w", typ, err)
+		}
+		if c.Next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("jobs.schedules.%s: %q never fires", typ, spec)
+		}
+		schedules[typ] = c
+	}
+	return schedules, nil
+}
+
+// syncSchedules 让 job_schedules 与配置一致：新增或表达式改变的从现在起重新计算，
+// 配置中已删除的一并删除
+func (s *JobService) syncSchedules(schedules map[string]*pkg.Cron) error {
+	var rows []model.JobSchedule
+	if err := s.db.Find(&rows).Error; err != nil {
+		return err
+	}
+	existing := make(map[string]model.JobSchedule, len(rows))
+	for _, row := range rows {
+		if _, ok := schedules[row.Type]; !ok {
+			if err := s.db.Delete(&model.JobSchedule{}, row.ID).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		existing[row.Type] = row
+	}
+	now := time.Now()
+	for typ, c := range schedules {
+		spec := s.cfg.Schedules[typ]
+		row, ok := existing[typ]
+		if ok && row.Spec == spec {
+			continue
+		}
+		var err error
+		if ok {
+			err = s.db.Model(&model.JobSchedule{}).Where("id = ?", row.ID).
+				Updates(map[string]interface{}{"spec": spec, "next_run_at": c.Next(now)}).Error
+		} else {
+			// 多个实例同时启动时唯一索引会拒绝重复的行，忽略即可
+			_ = s.db.Create(&model.JobSchedule{Type: typ, Spec: spec, NextRunAt: c.Next(now)}).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fireSchedules 为到期的定时任务创建任务。同一类型还有未结束的任务时跳过这一次，避免堆积
+func (s *JobService) fireSchedules(schedules map[string]*pkg.Cron) {
+	now := time.Now()
+	var due []model.JobSchedule
+	if err := s.db.Where("next_run_at <= ?", now).Find(&due).Error; err != nil {
+		return
+	}
+	for _, row := range due {
+		c, ok := schedules[row.Type]
+		if !ok {
+			continue
+		}
+		res := s.db.Model(&model.JobSchedule{}).Where("id = ? AND runs = ?", row.ID, row.Runs).
+			Updates(map[string]interface{}{"next_run_at": c.Next(now), "last_run_at": &now, "runs": row.Runs + 1})
+		if res.Error != nil || res.RowsAffected != 1 {
+			continue
+		}
+		var active int64
+		if err := s.db.Model(&model.Job{}).Where("type = ? AND status IN ?", row.Type,
+			[]string{model.JobPending, model.JobRunning}).Count(&active).Error; err != nil || active > 0 {
+			continue
+		}
+		if _, err := s.enqueue(row.Type, nil, now, row.Spec); err != nil && pkg.Logger != nil {
+			pkg.Logger.Error("scheduled job enqueue failed", zap.String("type", row.Type), zap.Error(err))
+		}
+	}
+}
+
+// prune 删除结束超过 Retention 的任务记录
+func (s *JobService) prune() {
+	cutoff := time.Now().Add(-s.cfg.Retention)
+	s.db.Where("status IN ? AND finished_at < ?",
+		[]string{model.JobSucceeded, model.JobFailed, model.JobCanceled}, cutoff).Delete(&model.Job{})
+}
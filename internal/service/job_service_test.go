@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"gorm.io/gorm"
+)
+
+type testJobPayload struct {
+	N int `json:"n"`
+}
+
+// newTestJobs 返回共用一个队列的两个 JobService，相当于两个服务器实例
+func newTestJobs(t *testing.T, lease time.Duration, fn func(ctx context.Context, p testJobPayload) error) (*JobService, *JobService, *gorm.DB) {
+	t.Helper()
+	db := newTestDB(t)
+	cfg := config.JobsConfig{
+		Workers:        1,
+		PollInterval:   10 * time.Millisecond,
+		Lease:          lease,
+		MaxAttempts:    3,
+		InitialBackoff: time.Minute,
+		MaxBackoff:     time.Hour,
+	}
+	a, b := NewJobService(db, cfg), NewJobService(db, cfg)
+	RegisterJob(a, "test", fn)
+	RegisterJob(b, "test", fn)
+	return a, b, db
+}
+
+func getJob(t *testing.T, jobs *JobService, id uint) *model.Job {
+	t.Helper()
+	job, err := jobs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// expireLease 把任务的租约改到过去，相当于领取它的进程崩溃后等了一个租约
+func expireLease(t *testing.T, db *gorm.DB, id uint) {
+	t.Helper()
+	past := time.Now().Add(-time.Second)
+	if err := db.Model(&model.Job{}).Where("id = ?", id).Update("lease_until", &past).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJobLeaseExpiry(t *testing.T) {
+	var runs atomic.Int32
+	a, b, db := newTestJobs(t, time.Hour, func(ctx context.Context, p testJobPayload) error {
+		runs.Add(1)
+		return nil
+	})
+	queued, err := a.Enqueue("test", testJobPayload{N: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a 领取后“崩溃”：不执行也不续约
+	claimed, err := a.claimNext()
+	if err != nil || claimed == nil || claimed.ID != queued.ID || claimed.LockedBy != a.worker {
+		t.Fatalf("claim = %+v, %v", claimed, err)
+	}
+	if b.RunNext(context.Background()) {
+		t.Fatal("b claimed a job whose lease has not expired")
+	}
+
+	expireLease(t, db, queued.ID)
+	if !b.RunNext(context.Background()) {
+		t.Fatal("b did not reclaim the job after its lease expired")
+	}
+	job := getJob(t, b, queued.ID)
+	if job.Status != model.JobSucceeded || job.Attempts != 2 || job.LockedBy != "" || runs.Load() != 1 {
+		t.Fatalf("after reclaim: %+v, %d runs", job, runs.Load())
+	}
+
+	// a 恢复后迟到的更新不能覆盖 b 的结果
+	if res := a.owned(claimed).Update("status", model.JobFailed); res.Error != nil || res.RowsAffected != 0 {
+		t.Fatalf("stale update by a: %d rows, %v", res.RowsAffected, res.Error)
+	}
+}
+
+// 每次执行都让进程崩溃的任务在 MaxAttempts 次之后标记为失败，不再领取
+func TestJobLeaseExpiryMaxAttempts(t *testing.T) {
+	a, b, db := newTestJobs(t, time.Hour, func(ctx context.Context, p testJobPayload) error {
+		t.Error("handler ran")
+		return nil
+	})
+	queued, err := a.Enqueue("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		jobs := []*JobService{a, b}[i%2]
+		if claimed, err := jobs.claimNext(); err != nil || claimed == nil || claimed.Attempts != i {
+			t.Fatalf("claim %d = %+v, %v", i, claimed, err)
+		}
+		expireLease(t, db, queued.ID)
+	}
+	if b.RunNext(context.Background()) {
+		t.Fatal("job claimed after max attempts")
+	}
+	job := getJob(t, a, queued.ID)
+	if job.Status != model.JobFailed || job.Attempts != 3 || !strings.Contains(job.LastError, "lease expired") {
+		t.Fatalf("after max attempts: %+v", job)
+	}
+}
+
+// 两个实例拿着同一个快照同时领取，只有一个成功
+func TestJobClaimRace(t *testing.T) {
+	a, b, _ := newTestJobs(t, time.Hour, func(ctx context.Context, p testJobPayload) error { return nil })
+	queued, err := a.Enqueue("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapA, snapB := *getJob(t, a, queued.ID), *getJob(t, b, queued.ID)
+	now := time.Now()
+	if !a.claim(&snapA, now) || b.claim(&snapB, now) {
+		t.Fatal("both or neither instance claimed the job")
+	}
+	if job := getJob(t, a, queued.ID); job.LockedBy != a.worker || job.Attempts != 1 {
+		t.Fatalf("claimed job: %+v", job)
+	}
+}
+
+// 续约让长时间运行的任务不被接管；在另一个实例上取消后，续约失败并取消处理函数的 ctx
+func TestJobHeartbeat(t *testing.T) {
+	started := make(chan struct{})
+	a, b, _ := newTestJobs(t, 60*time.Millisecond, func(ctx context.Context, p testJobPayload) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	queued, err := a.Enqueue("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.RunNext(context.Background())
+	}()
+	<-started
+
+	time.Sleep(200 * time.Millisecond)
+	if b.RunNext(context.Background()) {
+		t.Fatal("b took over a job that is still being renewed")
+	}
+	if _, err := b.Cancel(queued.ID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not canceled after the job was canceled on another instance")
+	}
+	if job := getJob(t, a, queued.ID); job.Status != model.JobCanceled {
+		t.Fatalf("after cancel: %+v", job)
+	}
+}
+
+func TestJobRetry(t *testing.T) {
+	// RunNext 在当前 goroutine 里执行处理函数，fail 不需要加锁
+	var fail error
+	a, _, _ := newTestJobs(t, time.Hour, func(ctx context.Context, p testJobPayload) error {
+		if fail != nil {
+			return fail
+		}
+		if p.N == 0 {
+			panic("boom")
+		}
+		return nil
+	})
+	ctx := context.Background()
+
+	fail = errors.New("temporary")
+	queued, err := a.Enqueue("test", testJobPayload{N: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	a.RunNext(ctx)
+	job := getJob(t, a, queued.ID)
+	if job.Status != model.JobPending || job.Attempts != 1 || job.LastError != "temporary" || job.RunAt.Before(before.Add(time.Minute)) {
+		t.Fatalf("after a temporary failure: %+v", job)
+	}
+	if a.RunNext(ctx) {
+		t.Fatal("job retried before its backoff")
+	}
+
+	fail = JobPermanent(errors.New("bad input"))
+	permanent, _ := a.Enqueue("test", testJobPayload{N: 1})
+	a.RunNext(ctx)
+	if job := getJob(t, a, permanent.ID); job.Status != model.JobFailed || job.Attempts != 1 {
+		t.Fatalf("after a permanent failure: %+v", job)
+	}
+
+	// panic 按普通失败处理
+	fail = nil
+	panicked, _ := a.Enqueue("test", testJobPayload{})
+	a.RunNext(ctx)
+	if job := getJob(t, a, panicked.ID); job.Status != model.JobPending || !strings.Contains(job.LastError, "panic: boom") {
+		t.Fatalf("after a panic: %+v", job)
+	}
+
+	if _, err := a.Enqueue("nope", nil); !errors.Is(err, ErrUnknownJobType) {
+		t.Fatalf("Enqueue of an unknown type = %v", err)
+	}
+	if _, err := a.Enqueue("test", map[string]string{"n": "x"}); !errors.Is(err, ErrInvalidJob) {
+		t.Fatalf("Enqueue with a bad payload = %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// 内置的后台任务类型
+const (
+	JobStorageGC       = "storage.gc"
+	JobStorageScrub    = "storage.scrub"
+	JobScanFile        = "scan.file"
+	JobScanRescan      = "scan.rescan"
+	JobAuditVerify     = "audit.verify"
+	JobUserPurge       = "user.purge"
+	JobS3ExpireUploads = "s3.expire_uploads"
+	JobVaultExpire     = "vault.expire_uploads"
+	JobWebhookPrune    = "webhook.prune"
+)
+
+// scanRetryDelay 是扫描出错的文件在上传后多久重新扫描
+const scanRetryDelay = time.Minute
+
+// JobDuration 在任务参数中写作 "90m" 这样的字符串
+type JobDuration time.Duration
+
+func (d JobDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *JobDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = JobDuration(v)
+	return nil
+}
+
+type StorageGCJob struct {
+	MinAge JobDuration `json:"min_age,omitempty"` // 默认 1h
+	DryRun bool        `json:"dry_run,omitempty"`
+}
+
+type ScanFileJob struct {
+	FileID uint `json:"file_id"`
+}
+
+type ScanRescanJob struct {
+	OnlyUnscanned bool `json:"only_unscanned,omitempty"`
+}
+
+type UserPurgeJob struct {
+	UserID uint `json:"user_id"`
+}
+
+// RegisterMaintenanceJobs 注册内置的维护任务，并通过 FileService / UserService 的回调
+// 在需要时创建任务。s3 或 webhooks 为 nil 时不注册相关的任务。
+func RegisterMaintenanceJobs(jobs *JobService, files *FileService, users *UserService, s3 *S3Service, audit *AuditService, webhooks *WebhookService) {
+	RegisterJob(jobs, JobStorageGC, func(ctx context.Context, p StorageGCJob) error {
+		minAge := time.Duration(p.MinAge)
+		if minAge <= 0 {
+			minAge = time.Hour
+		}
+		report, err := files.CollectGarbage(minAge, p.DryRun)
+		if report != nil && pkg.Logger != nil {
+			pkg.Logger.Info("storage gc", zap.Int("orphans", len(report.Orphans)), zap.Int64("bytes", report.Bytes),
+				zap.Int("expired", len(report.Expired)), zap.Int("removed", report.Removed),
+				zap.Int("restored", len(report.Restored)), zap.Int("dangling", len(report.Dangling)),
+				zap.Bool("dry_run", p.DryRun))
+		}
+		return err
+	})
+
+	RegisterJob(jobs, JobStorageScrub, func(ctx context.Context, _ struct{}) error {
+		report, err := files.Scrub(ctx)
+		if report != nil && pkg.Logger != nil {
+			pkg.Logger.Info("storage scrub", zap.Int("checked", report.Checked), zap.Int("missing", report.Missing),
+				zap.Int("corrupt", report.Corrupt), zap.Int("bad_metadata", report.BadMetadata),
+				zap.Int("locked", report.Locked))
+		}
+		return err
+	})
+
+	RegisterJob(jobs, JobScanFile, func(ctx context.Context, p ScanFileJob) error {
+		if files.scanner == nil {
+			return JobPermanent(errors.New("scanner not configured"))
+		}
+		// 上传者的用户密钥没有解开时（ErrUserKeyLocked）按退避重试，上传者登录后就能扫描
+		_, err := files.RescanFile(p.FileID)
+		if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, ErrCustomerKeyRequired) {
+			return JobPermanent(err)
+		}
+		return err
+	})
+
+	RegisterJob(jobs, JobScanRescan, func(ctx context.Context, p ScanRescanJob) error {
+		if files.scanner == nil {
+			return JobPermanent(errors.New("scanner not configured"))
+		}
+		scanned, failed := 0, 0
+		err := files.RescanAll(p.OnlyUnscanned, func(id uint, file *model.File, err error) {
+			scanned++
+			if err != nil {
+				failed++
+			}
+		})
+		if err != nil {
+			return err
+		}
+		// 整体重试代价太大，单个文件的失败交给 scan.file 或下一次全量扫描
+		if failed > 0 {
+			return JobPermanent(fmt.Errorf("%d of %d files could not be scanned", failed, scanned))
+		}
+		return nil
+	})
+
+	RegisterJob(jobs, JobAuditVerify, func(ctx context.Context, _ struct{}) error {
+		result, err := audit.Verify()
+		if err != nil {
+			return err
+		}
+		if !result.OK {
+			return JobPermanent(fmt.Errorf("audit chain broken at seq %d: %s", result.BadSeq, result.Reason))
+		}
+		return nil
+	})
+
+	RegisterJob(jobs, JobUserPurge, func(ctx context.Context, p UserPurgeJob) error {
+		return purgeUser(ctx, files, users, s3, p.UserID)
+	})
+
+	if s3 != nil {
+		RegisterJob(jobs, JobS3ExpireUploads, func(ctx context.Context, _ struct{}) error {
+			for ctx.Err() == nil {
+				n, err := s3.AbortStaleUploads()
+				if err != nil || n < 100 {
+					return err
+				}
+			}
+			return ctx.Err()
+		})
+	}
+
+	if webhooks != nil {
+		RegisterJob(jobs, JobWebhookPrune, func(ctx context.Context, _ struct{}) error {
+			n, err := webhooks.PruneDelivered()
+			if n > 0 && pkg.Logger != nil {
+				pkg.Logger.Info("webhook deliveries pruned", zap.Int64("deleted", n))
+			}
+			return err
+		})
+	}
+
+	RegisterJob(jobs, JobVaultExpire, func(ctx context.Context, _ struct{}) error {
+		for ctx.Err() == nil {
+			n, err := files.ExpireVaultUploads()
+			if err != nil || n < 100 {
+				return err
+			}
+		}
+		return ctx.Err()
+	})
+
+	files.AddHooks(FileHooks{
+		Stored: func(file *model.File, created bool) {
+			// clamd 暂时不可用时（fail_open）文件以 error 状态保存，稍后重新扫描
+			if file.ScanStatus == model.ScanError {
+				enqueueLogged(jobs, JobScanFile, ScanFileJob{FileID: file.ID}, time.Now().Add(scanRetryDelay))
+			}
+		},
+	})
+	users.AddHooks(UserHooks{
+		Deleted: func(u *model.User) {
+			enqueueLogged(jobs, JobUserPurge, UserPurgeJob{UserID: u.ID}, time.Now())
+		},
+	})
+}
+
+func enqueueLogged(jobs *JobService, typ string, payload any, runAt time.Time) {
+	if _, err := jobs.EnqueueAt(typ, payload, runAt); err != nil && pkg.Logger != nil {
+		pkg.Logger.Error("job enqueue failed", zap.String("type", typ), zap.Error(err))
+	}
+}
+
+// purgeUser 删除已删除用户的文件、保险库、头像、SSH 公钥和 S3 数据；中途失败重试时从剩下的部分继续
+func purgeUser(ctx context.Context, files *FileService, users *UserService, s3 *S3Service, userID uint) error {
+	var u model.User
+	if err := users.db.Unscoped().First(&u, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return JobPermanent(err)
+		}
+		return err
+	}
+	if !u.DeletedAt.Valid {
+		return JobPermanent(fmt.Errorf("user %d is not deleted", userID))
+	}
+
+	owned, err := files.ListFilesByOwner(userID)
+	if err != nil {
+		return err
+	}
+	for i := range owned {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := files.DeleteFile(owned[i].ID); err != nil {
+			return err
+		}
+	}
+	if err := files.PurgeVault(userID); err != nil {
+		return err
+	}
+	if s3 != nil {
+		if err := s3.PurgeUser(userID); err != nil {
+			return err
+		}
+	}
+	if err := users.db.Where("user_id = ?", userID).Delete(&model.SSHKey{}).Error; err != nil {
+		return err
+	}
+	if u.AvatarPath != "" {
+		if err := files.RemoveStoredFile(u.AvatarPath); err != nil {
+			return err
+		}
+		return users.db.Unscoped().Model(&u).Updates(map[string]interface{}{"avatar_path": "", "avatar_mime": ""}).Error
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// SetUserQuota 设置每个用户可以保存的明文总字节数，0 表示不限制。
+// 匿名公共上传不计入任何用户的配额。
+func (f *FileService) SetUserQuota(bytes int64) {
+	f.userQuota = bytes
+}
+
+func (f *FileService) UserQuota() int64 {
+	return f.userQuota
+}
+
+// limitUpload 包装上传流，写入超出剩余配额时返回 ErrQuotaExceeded，加密随之中止；
+// freed 为被替换的旧内容的大小
+func (f *FileService) limitUpload(r io.Reader, uploaderID string, freed int64) (io.Reader, error) {
+	if f.userQuota <= 0 || uploaderID == "" || uploaderID == publicUploaderID {
+		return r, nil
+	}
+	id, err := strconv.ParseUint(uploaderID, 10, 64)
+	if err != nil {
+		return r, nil
+	}
+	_, used, err := f.UserStorageUsage(uint(id))
+	if err != nil {
+		return nil, err
+	}
+	return &quotaReader{r: r, remaining: f.userQuota - used + freed}, nil
+}
+
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, ErrQuotaExceeded
+	}
+	return n, err
+}
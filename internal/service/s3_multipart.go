@@ -0,0 +1,257 @@
+package service
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNoSuchUpload     = errors.New("multipart upload does not exist")
+	ErrInvalidPart      = errors.New("one or more parts could not be found or the etag does not match")
+	ErrInvalidPartOrder = errors.New("parts must be listed in ascending order")
+	ErrEntityTooSmall   = errors.New("every part except the last must be at least 5 MiB")
+)
+
+const (
+	// 分段密文放在以 "." 开头的目录下，CollectGarbage 不会把它们当成孤儿
+	s3MultipartDir   = ".s3-multipart"
+	s3MaxPartNumber  = 10000
+	s3MinPartSize    = 5 << 20
+	s3UploadLifetime = 7 * 24 * time.Hour
+)
+
+// CompletedPart 是 CompleteMultipartUpload 请求中的一项
+type CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *S3Service) uploadDir(up *model.S3Upload) string {
+	return s3UploadDir(s.files.dirpath, up.UploadID)
+}
+
+func (s *S3Service) partPath(up *model.S3Upload, partNumber int) string {
+	return s3PartPath(s.files.dirpath, up.UploadID, partNumber)
+}
+
+func s3UploadDir(dirpath string, uploadID string) string {
+	return filepath.Join(dirpath, s3MultipartDir, uploadID)
+}
+
+func s3PartPath(dirpath string, uploadID string, partNumber int) string {
+	return filepath.Join(s3UploadDir(dirpath, uploadID), fmt.Sprintf("%05d.part", partNumber))
+}
+
+func (s *S3Service) CreateMultipartUpload(bucket *model.S3Bucket, key string) (*model.S3Upload, error) {
+	if !validObjectKey(key) {
+		return nil, ErrInvalidObjectKey
+	}
+	if s.files.k().meta == nil {
+		return nil, s.files.keyError()
+	}
+	s.abortStaleUploads()
+
+	idBytes := make([]byte, 24)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	encKey, err := s.files.encryptString(key)
+	if err != nil {
+		return nil, err
+	}
+	up := &model.S3Upload{
+		UploadID:  base64.RawURLEncoding.EncodeToString(idBytes),
+		BucketID:  bucket.ID,
+		UserID:    bucket.UserID,
+		EncKey:    encKey,
+		CreatedAt: time.Now(),
+	}
+	if err := os.MkdirAll(s.uploadDir(up), 0700); err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(up).Error; err != nil {
+		_ = os.RemoveAll(s.uploadDir(up))
+		return nil, err
+	}
+	return up, nil
+}
+
+// GetUpload 查找桶中某个键的分段上传；uploadId 与桶或键不匹配时返回 ErrNoSuchUpload
+func (s *S3Service) GetUpload(bucket *model.S3Bucket, key string, uploadID string) (*model.S3Upload, error) {
+	var up model.S3Upload
+	if err := s.db.Where("upload_id = ? AND bucket_id = ?", uploadID, bucket.ID).First(&up).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoSuchUpload
+		}
+		return nil, err
+	}
+	upKey, err := s.files.decryptString(up.EncKey)
+	if err != nil {
+		return nil, err
+	}
+	if upKey != key {
+		return nil, ErrNoSuchUpload
+	}
+	return &up, nil
+}
+
+// UploadPart 加密保存一个分段，同一编号再次上传时替换旧的分段。
+// 所有未完成的分段都计入配额，避免用上传到一半的分段绕过限制。
+func (s *S3Service) UploadPart(up *model.S3Upload, partNumber int, r io.Reader) (*model.S3Part, error) {
+	if partNumber < 1 || partNumber > s3MaxPartNumber {
+		return nil, fmt.Errorf("part number must be between 1 and %d", s3MaxPartNumber)
+	}
+	var pending int64
+	if err := s.db.Model(&model.S3Part{}).
+		Joins("JOIN s3_uploads ON s3_uploads.id = s3_parts.upload_id").
+		Where("s3_uploads.user_id = ? AND NOT (s3_parts.upload_id = ? AND s3_parts.part_number = ?)", up.UserID, up.ID, partNumber).
+		Select("COALESCE(SUM(s3_parts.size), 0)").Scan(&pending).Error; err != nil {
+		return nil, err
+	}
+	r, err := s.files.limitUpload(r, strconv.FormatUint(uint64(up.UserID), 10), -pending)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := md5.New()
+	dst := s.partPath(up, partNumber)
+	// 同一编号重新上传时原子地替换旧的分段
+	size, err := s.files.encryptToFile(io.TeeReader(r, sum), dst)
+	if err != nil {
+		return nil, err
+	}
+
+	part := &model.S3Part{
+		UploadID:   up.ID,
+		PartNumber: partNumber,
+		Size:       size,
+		ETag:       hex.EncodeToString(sum.Sum(nil)),
+		CreatedAt:  time.Now(),
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("upload_id = ? AND part_number = ?", up.ID, partNumber).Delete(&model.S3Part{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(part).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return part, nil
+}
+
+func (s *S3Service) ListParts(up *model.S3Upload) ([]model.S3Part, error) {
+	var parts []model.S3Part
+	if err := s.db.Where("upload_id = ?", up.ID).Order("part_number").Find(&parts).Error; err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// CompleteMultipartUpload 按顺序解密各分段，作为一个整体交给 FileService 重新加密保存。
+// ETag 与 S3 相同：各分段 MD5 拼接后的 MD5，加上 "-分段数"。
+func (s *S3Service) CompleteMultipartUpload(bucket *model.S3Bucket, up *model.S3Upload, completed []CompletedPart) (*S3Object, bool, error) {
+	if len(completed) == 0 {
+		return nil, false, ErrInvalidPart
+	}
+	parts, err := s.ListParts(up)
+	if err != nil {
+		return nil, false, err
+	}
+	byNumber := make(map[int]model.S3Part, len(parts))
+	for _, p := range parts {
+		byNumber[p.PartNumber] = p
+	}
+	for i := 1; i < len(completed); i++ {
+		if completed[i].PartNumber <= completed[i-1].PartNumber {
+			return nil, false, ErrInvalidPartOrder
+		}
+	}
+	sum := md5.New()
+	for i, c := range completed {
+		p, ok := byNumber[c.PartNumber]
+		if !ok || !strings.EqualFold(strings.Trim(c.ETag, `"`), p.ETag) {
+			return nil, false, ErrInvalidPart
+		}
+		if i < len(completed)-1 && p.Size < s3MinPartSize {
+			return nil, false, ErrEntityTooSmall
+		}
+		raw, _ := hex.DecodeString(p.ETag)
+		sum.Write(raw)
+	}
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(sum.Sum(nil)), len(completed))
+
+	key, err := s.files.decryptString(up.EncKey)
+	if err != nil {
+		return nil, false, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		for _, c := range completed {
+			if err := s.files.DecryptToWriter(pw, s.partPath(up, c.PartNumber)); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	obj, replaced, err := s.putObject(bucket, key, pr, func() string { return etag })
+	// 保存失败时让解密的 goroutine 退出
+	_ = pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return obj, replaced, err
+	}
+	if err := s.AbortMultipartUpload(up); err != nil {
+		return obj, replaced, err
+	}
+	return obj, replaced, nil
+}
+
+// AbortMultipartUpload 删除分段密文和记录
+func (s *S3Service) AbortMultipartUpload(up *model.S3Upload) error {
+	if err := os.RemoveAll(s.uploadDir(up)); err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("upload_id = ?", up.ID).Delete(&model.S3Part{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.S3Upload{}, up.ID).Error
+	})
+}
+
+// abortStaleUploads 清理超过 s3UploadLifetime 仍未完成的分段上传
+func (s *S3Service) abortStaleUploads() {
+	_, _ = s.AbortStaleUploads()
+}
+
+// AbortStaleUploads 放弃超过 s3UploadLifetime 仍未完成的分段上传，每次最多 100 个，返回放弃的数量
+func (s *S3Service) AbortStaleUploads() (int, error) {
+	var stale []model.S3Upload
+	if err := s.db.Where("created_at < ?", time.Now().Add(-s3UploadLifetime)).Limit(100).Find(&stale).Error; err != nil {
+		return 0, err
+	}
+	var errs []error
+	aborted := 0
+	for i := range stale {
+		if err := s.AbortMultipartUpload(&stale[i]); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		aborted++
+	}
+	return aborted, errors.Join(errs...)
+}
@@ -0,0 +1,441 @@
+package service
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrS3KeyLimit         = errors.New("too many s3 access keys")
+	ErrS3AccessKeyUnknown = errors.New("unknown s3 access key")
+	ErrNoSuchBucket       = errors.New("bucket does not exist")
+	ErrBucketExists       = errors.New("bucket already exists")
+	ErrBucketNotEmpty     = errors.New("bucket is not empty")
+	ErrInvalidBucketName  = errors.New("invalid bucket name")
+	ErrNoSuchKey          = errors.New("object does not exist")
+	ErrInvalidObjectKey   = errors.New("invalid object key")
+)
+
+const (
+	maxS3KeysPerUser = 10
+	maxS3KeyLength   = 1024
+)
+
+// 与 S3 相同的桶名规则：3-63 个小写字母、数字、"." 或 "-"，首尾为字母或数字
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// S3Service 实现 S3 网关的桶、对象和分段上传。对象内容和对象键（即文件名）
+// 都通过 FileService 加密保存，每个对象对应一个普通的 File，配额同样适用。
+type S3Service struct {
+	db    *gorm.DB
+	files *FileService
+	users *UserService
+}
+
+func NewS3Service(db *gorm.DB, files *FileService, users *UserService) *S3Service {
+	fmt.Fprintln(config.Progress, "✓ Creating a new S3 service done")
+	return &S3Service{db: db, files: files, users: users}
+}
+
+// CreateS3Key 为用户签发一对访问密钥，secret 只在这里返回一次
+func (s *S3Service) CreateS3Key(userID uint, name string) (*model.S3Credential, string, error) {
+	if s.files.k().meta == nil {
+		return nil, "", s.files.keyError()
+	}
+	var count int64
+	if err := s.db.Model(&model.S3Credential{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return nil, "", err
+	}
+	if count >= maxS3KeysPerUser {
+		return nil, "", ErrS3KeyLimit
+	}
+
+	idBytes := make([]byte, 11)
+	secretBytes := make([]byte, 30)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, "", err
+	}
+	// 与 AWS 的格式相近：20 个字符的大写 ID，40 个字符的 secret
+	accessKeyID := "SFB" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(idBytes)[:17]
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	encSecret, err := s.files.encryptString(secret)
+	if err != nil {
+		return nil, "", err
+	}
+
+	name = strings.TrimSpace(name)
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	cred := &model.S3Credential{
+		UserID:      userID,
+		Name:        name,
+		AccessKeyID: accessKeyID,
+		EncSecret:   encSecret,
+		CreatedAt:   time.Now(),
+	}
+	if err := s.db.Create(cred).Error; err != nil {
+		return nil, "", err
+	}
+	return cred, secret, nil
+}
+
+func (s *S3Service) ListS3Keys(userID uint) ([]model.S3Credential, error) {
+	var keys []model.S3Credential
+	if err := s.db.Where("user_id = ?", userID).Order("id").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteS3Key 只能删除自己的密钥；不存在时返回 gorm.ErrRecordNotFound
+func (s *S3Service) DeleteS3Key(userID uint, id uint) error {
+	res := s.db.Where("id = ? AND user_id = ?", id, userID).Delete(&model.S3Credential{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// LookupS3Key 返回访问密钥的所有者和 secret，用于验证签名；所有者必须未被禁用
+func (s *S3Service) LookupS3Key(accessKeyID string) (*model.User, string, error) {
+	var cred model.S3Credential
+	if err := s.db.Where("access_key_id = ?", accessKeyID).First(&cred).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", ErrS3AccessKeyUnknown
+		}
+		return nil, "", err
+	}
+	if s.files.k().meta == nil {
+		return nil, "", s.files.keyError()
+	}
+	secret, err := s.files.decryptString(cred.EncSecret)
+	if err != nil {
+		return nil, "", err
+	}
+	u, err := s.users.CheckActive(cred.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+	// 每个请求都会验证签名，最后使用时间只需要分钟级的精度
+	if now := time.Now(); cred.LastUsedAt == nil || now.Sub(*cred.LastUsedAt) > time.Minute {
+		_ = s.db.Model(&model.S3Credential{}).Where("id = ?", cred.ID).Update("last_used_at", &now).Error
+	}
+	return u, secret, nil
+}
+
+func (s *S3Service) ListBuckets(userID uint) ([]model.S3Bucket, error) {
+	var buckets []model.S3Bucket
+	if err := s.db.Where("user_id = ?", userID).Order("name").Find(&buckets).Error; err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+func (s *S3Service) CreateBucket(userID uint, name string) (*model.S3Bucket, error) {
+	if !bucketNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return nil, ErrInvalidBucketName
+	}
+	if _, err := s.GetBucket(userID, name); err == nil {
+		return nil, ErrBucketExists
+	} else if !errors.Is(err, ErrNoSuchBucket) {
+		return nil, err
+	}
+	bucket := &model.S3Bucket{UserID: userID, Name: name, CreatedAt: time.Now()}
+	if err := s.db.Create(bucket).Error; err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+func (s *S3Service) GetBucket(userID uint, name string) (*model.S3Bucket, error) {
+	var bucket model.S3Bucket
+	if err := s.db.Where("user_id = ? AND name = ?", userID, name).First(&bucket).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoSuchBucket
+		}
+		return nil, err
+	}
+	return &bucket, nil
+}
+
+// DeleteBucket 只能删除空桶，进行中的分段上传会被一并放弃
+func (s *S3Service) DeleteBucket(userID uint, name string) error {
+	bucket, err := s.GetBucket(userID, name)
+	if err != nil {
+		return err
+	}
+	objects, err := s.ListObjects(bucket)
+	if err != nil {
+		return err
+	}
+	if len(objects) > 0 {
+		return ErrBucketNotEmpty
+	}
+	var uploads []model.S3Upload
+	if err := s.db.Where("bucket_id = ?", bucket.ID).Find(&uploads).Error; err != nil {
+		return err
+	}
+	for i := range uploads {
+		if err := s.AbortMultipartUpload(&uploads[i]); err != nil {
+			return err
+		}
+	}
+	if err := s.db.Where("bucket_id = ?", bucket.ID).Delete(&model.S3Object{}).Error; err != nil {
+		return err
+	}
+	return s.db.Delete(&model.S3Bucket{}, bucket.ID).Error
+}
+
+// PurgeUser 删除用户的访问密钥、桶和进行中的分段上传；对象对应的文件由调用方另行删除
+func (s *S3Service) PurgeUser(userID uint) error {
+	var uploads []model.S3Upload
+	if err := s.db.Where("user_id = ?", userID).Find(&uploads).Error; err != nil {
+		return err
+	}
+	for i := range uploads {
+		if err := s.AbortMultipartUpload(&uploads[i]); err != nil {
+			return err
+		}
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		buckets := tx.Model(&model.S3Bucket{}).Select("id").Where("user_id = ?", userID)
+		if err := tx.Where("bucket_id IN (?)", buckets).Delete(&model.S3Object{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&model.S3Bucket{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&model.S3Credential{}).Error
+	})
+}
+
+// S3Object 是一个对象及其对应的文件；Key 与 File.Filename 相同
+type S3Object struct {
+	Key  string
+	ETag string
+	File *model.File
+	row  *model.S3Object
+}
+
+func validObjectKey(key string) bool {
+	return key != "" && len(key) <= maxS3KeyLength && utf8.ValidString(key)
+}
+
+// objectTag 是对象键的盲索引，键本身只以加密的文件名保存
+func (s *S3Service) objectTag(bucketID uint, key string) string {
+	k := s.files.k()
+	mac := k.mac(&k.tagKey)
+	if mac == nil {
+		return ""
+	}
+	mac.Write([]byte("s3-object:" + strconv.FormatUint(uint64(bucketID), 10) + "\x00" + key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// objectOf 组合对象行和它的文件；file 为 nil 表示文件已通过其他方式删除，
+// 此时清理这一行并返回 ErrNoSuchKey
+func (s *S3Service) objectOf(bucket *model.S3Bucket, row *model.S3Object, file *model.File) (*S3Object, error) {
+	if file == nil {
+		_ = s.db.Delete(&model.S3Object{}, row.ID).Error
+		return nil, ErrNoSuchKey
+	}
+	if file.UploaderID != strconv.FormatUint(uint64(bucket.UserID), 10) {
+		return nil, ErrNoSuchKey
+	}
+	if row.FileVersion != file.UpdatedAt.UnixMilli() {
+		// 内容可能已通过 REST、WebDAV 或 SFTP 修改，MD5 不再可信
+		return &S3Object{Key: file.Filename, ETag: strings.Trim(FileETag(file), `"`), File: file, row: row}, nil
+	}
+	etag, err := s.files.decryptString(row.EncETag)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Object{Key: file.Filename, ETag: etag, File: file, row: row}, nil
+}
+
+func (s *S3Service) HeadObject(bucket *model.S3Bucket, key string) (*S3Object, error) {
+	if !validObjectKey(key) {
+		return nil, ErrNoSuchKey
+	}
+	var row model.S3Object
+	if err := s.db.Where("key_tag = ?", s.objectTag(bucket.ID, key)).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoSuchKey
+		}
+		return nil, err
+	}
+	file, err := s.files.GetFileByID(row.FileID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		file, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.objectOf(bucket, &row, file)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Key != key {
+		// 文件被改名，下次列出时索引会更新为新名字
+		return nil, ErrNoSuchKey
+	}
+	return obj, nil
+}
+
+// ListObjects 按键的字节序返回桶中的全部对象。
+// 文件在 REST、WebDAV 或 SFTP 中被改名后，这里会把对象的索引更新为新名字。
+func (s *S3Service) ListObjects(bucket *model.S3Bucket) ([]S3Object, error) {
+	var rows []model.S3Object
+	if err := s.db.Where("bucket_id = ?", bucket.ID).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	ids := make([]uint, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.FileID)
+	}
+	files := make(map[uint]*model.File, len(rows))
+	broken := make(map[uint]bool)
+	for start := 0; start < len(ids); start += 500 {
+		var batch []model.File
+		if err := s.db.Where("id IN ?", ids[start:min(start+500, len(ids))]).Find(&batch).Error; err != nil {
+			return nil, err
+		}
+		for i := range batch {
+			if err := s.files.decryptFileMetadata(&batch[i]); err != nil {
+				broken[batch[i].ID] = true
+				continue
+			}
+			files[batch[i].ID] = &batch[i]
+		}
+	}
+
+	objects := make([]S3Object, 0, len(rows))
+	for i := range rows {
+		if broken[rows[i].FileID] {
+			continue
+		}
+		obj, err := s.objectOf(bucket, &rows[i], files[rows[i].FileID])
+		if err != nil {
+			continue
+		}
+		if tag := s.objectTag(bucket.ID, obj.Key); tag != rows[i].KeyTag {
+			// 新名字已被其他对象占用时保持原样，这个文件只能通过原来的方式访问
+			if s.db.Model(&model.S3Object{}).Where("id = ?", rows[i].ID).Update("key_tag", tag).Error != nil {
+				continue
+			}
+			rows[i].KeyTag = tag
+		}
+		objects = append(objects, *obj)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// PutObject 保存对象，已存在时替换内容（文件 ID 不变）。
+// replaced 表示覆盖了已有对象，调用方据此记录 file.update 而不是 file.upload。
+func (s *S3Service) PutObject(bucket *model.S3Bucket, key string, r io.Reader) (obj *S3Object, replaced bool, err error) {
+	if !validObjectKey(key) {
+		return nil, false, ErrInvalidObjectKey
+	}
+	sum := md5.New()
+	obj, replaced, err = s.putObject(bucket, key, io.TeeReader(r, sum), func() string {
+		return hex.EncodeToString(sum.Sum(nil))
+	})
+	return obj, replaced, err
+}
+
+// putObject 写入内容后记录对象；etag 在内容读完后才被调用
+func (s *S3Service) putObject(bucket *model.S3Bucket, key string, r io.Reader, etag func() string) (*S3Object, bool, error) {
+	existing, err := s.HeadObject(bucket, key)
+	if err != nil && !errors.Is(err, ErrNoSuchKey) {
+		return nil, false, err
+	}
+	var file *model.File
+	if existing != nil {
+		file, err = s.files.UpdateFile(existing.File.ID, r, nil, nil)
+	} else {
+		file, err = s.files.UploadFile(r, key, bucket.UserID, "")
+	}
+	if err != nil {
+		return nil, existing != nil, err
+	}
+	if file.ScanStatus == model.ScanInfected {
+		return &S3Object{Key: key, File: file}, existing != nil, ErrFileQuarantined
+	}
+	// 重新读取，得到数据库中的 updated_at
+	if fresh, err := s.files.GetFileByID(file.ID); err == nil {
+		file = fresh
+	}
+	version := file.UpdatedAt.UnixMilli()
+
+	obj := &S3Object{Key: key, ETag: etag(), File: file}
+	encETag, err := s.files.encryptString(obj.ETag)
+	if err != nil {
+		return nil, existing != nil, err
+	}
+	if existing != nil {
+		err := s.db.Model(&model.S3Object{}).Where("id = ?", existing.row.ID).Updates(map[string]interface{}{
+			"enc_etag":     encETag,
+			"file_version": version,
+		}).Error
+		return obj, true, err
+	}
+
+	row := &model.S3Object{BucketID: bucket.ID, FileID: file.ID, KeyTag: s.objectTag(bucket.ID, key), EncETag: encETag, FileVersion: version}
+	if err := s.db.Create(row).Error; err != nil {
+		// 并发写入同一个键：后完成的上传生效，替换先完成的那个文件
+		var other model.S3Object
+		if s.db.Where("key_tag = ?", row.KeyTag).First(&other).Error != nil {
+			_ = s.files.DeleteFile(file.ID)
+			return nil, false, err
+		}
+		if err := s.db.Model(&model.S3Object{}).Where("id = ?", other.ID).Updates(map[string]interface{}{
+			"file_id":      file.ID,
+			"enc_etag":     encETag,
+			"file_version": version,
+		}).Error; err != nil {
+			_ = s.files.DeleteFile(file.ID)
+			return nil, false, err
+		}
+		_ = s.files.DeleteFile(other.FileID)
+	}
+	return obj, false, nil
+}
+
+// DeleteObject 删除对象和它的文件；对象不存在时返回 (nil, nil)，与 S3 一致
+func (s *S3Service) DeleteObject(bucket *model.S3Bucket, key string) (*model.File, error) {
+	obj, err := s.HeadObject(bucket, key)
+	if errors.Is(err, ErrNoSuchKey) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.files.DeleteFile(obj.File.ID); err != nil {
+		return obj.File, err
+	}
+	return obj.File, s.db.Delete(&model.S3Object{}, obj.row.ID).Error
+}
@@ -0,0 +1,219 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+var (
+	ErrFileInfected    = errors.New("file rejected: malware detected")
+	ErrScanFailed      = errors.New("virus scan failed")
+	ErrFileQuarantined = errors.New("file is quarantined")
+)
+
+// VirusScanner 由 pkg.ClamdClient 实现，也可以替换成测试替身
+type VirusScanner interface {
+	Scan(r io.Reader) (pkg.ScanResult, error)
+}
+
+type scanOutcome struct {
+	status    string
+	signature string
+	at        time.Time
+	err       error
+}
+
+const quarantineDir = "quarantine"
+
+// SetScanner 启用上传扫描；action 为 "quarantine" 时感染文件被隔离而不是拒绝
+func (f *FileService) SetScanner(scanner VirusScanner, action string, failOpen bool) {
+	f.scanner = scanner
+	f.quarantine = action == "quarantine"
+	f.scanFailOpen = failOpen
+	_ = os.MkdirAll(filepath.Join(f.dirpath, quarantineDir), 0700)
+}
+
+// encryptAndScan 在加密的同时把同一份明文流交给扫描器，明文不会落盘
+func (f *FileService) encryptAndScan(blobs *sfbcrypt.BlobCipher, src io.Reader, dst string) (int64, *scanOutcome, error) {
+	if f.scanner == nil {
+		size, err := f.encryptWith(blobs, src, dst)
+		return size, nil, err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan scanOutcome, 1)
+	go func() {
+		done <- f.scan(pr)
+	}()
+
+	size, err := f.encryptWith(blobs, io.TeeReader(src, pw), dst)
+	if err != nil {
+		pw.CloseWithError(err)
+	} else {
+		pw.Close()
+	}
+	outcome := <-done
+	return size, &outcome, err
+}
+
+func (f *FileService) scan(r *io.PipeReader) scanOutcome {
+	res, err := f.scanner.Scan(r)
+	// 扫描器提前结束（连接失败、超过大小限制）时排空管道，保证加密继续进行
+	_, _ = io.Copy(io.Discard, r)
+	outcome := scanOutcome{status: model.ScanClean, at: time.Now()}
+	switch {
+	case err != nil:
+		outcome.status = model.ScanError
+		outcome.err = err
+	case res.Infected:
+		outcome.status = model.ScanInfected
+		outcome.signature = res.Signature
+	}
+	return outcome
+}
+
+// applyScan 根据扫描结果处理刚写好的密文：返回最终存放路径。
+// allowQuarantine 为 false 时（例如头像）感染文件总是被拒绝。
+func (f *FileService) applyScan(outcome *scanOutcome, path string, allowQuarantine bool) (string, error) {
+	if outcome == nil {
+		return path, nil
+	}
+	switch outcome.status {
+	case model.ScanError:
+		if f.scanFailOpen {
+			return path, nil
+		}
+		_ = os.Remove(path)
+		return "", fmt.Errorf("%w: %v", ErrScanFailed, outcome.err)
+	case model.ScanInfected:
+		if !f.quarantine || !allowQuarantine {
+			_ = os.Remove(path)
+			return "", ErrFileInfected
+		}
+		return f.moveToQuarantine(path)
+	}
+	return path, nil
+}
+
+func (f *FileService) inQuarantine(path string) bool {
+	return filepath.Dir(path) == filepath.Join(f.dirpath, quarantineDir)
+}
+
+func (f *FileService) moveToQuarantine(path string) (string, error) {
+	dst := filepath.Join(f.dirpath, quarantineDir, filepath.Base(path))
+	if err := renameSynced(path, dst); err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+	return dst, nil
+}
+
+func (o *scanOutcome) applyTo(file *model.File) {
+	if o == nil {
+		return
+	}
+	at := o.at
+	file.ScanStatus = o.status
+	file.ScanSignature = o.signature
+	file.ScannedAt = &at
+}
+
+// EnsureDownloadable 拒绝下载被判定为感染的文件、上传者的用户密钥没有解开的文件和客户密钥加密的文件；
+// 在输出响应头之前调用，避免解密中途失败只能截断响应
+func (f *FileService) EnsureDownloadable(file *model.File) error {
+	return f.EnsureDownloadableWithKey(file, nil)
+}
+
+// EnsureDownloadableWithKey 与 EnsureDownloadable 相同，客户密钥加密的文件还要核对 ck；
+// 在输出任何内容之前调用，密钥不对时不会解密出明文
+func (f *FileService) EnsureDownloadableWithKey(file *model.File, ck *CustomerKey) error {
+	if file.ScanStatus == model.ScanInfected {
+		return ErrFileQuarantined
+	}
+	if file.UserKeyed || file.CustomerKeyTag != "" || ck != nil {
+		_, err := f.contentCipher(file, ck)
+		return err
+	}
+	return nil
+}
+
+// RescanFile 解密已有的密文并重新扫描，更新扫描状态。
+// 感染文件在 quarantine 模式下会被移入隔离目录；无论哪种模式都会被禁止下载。
+func (f *FileService) RescanFile(id uint) (*model.File, error) {
+	if f.scanner == nil {
+		return nil, errors.New("scanner not configured")
+	}
+	file, err := f.GetFileByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan scanOutcome, 1)
+	go func() {
+		done <- f.scan(pr)
+	}()
+	derr := f.DecryptFile(pw, file)
+	pw.CloseWithError(derr)
+	outcome := <-done
+	if derr != nil {
+		return nil, derr
+	}
+	outcome.applyTo(file)
+
+	if outcome.status == model.ScanInfected && f.quarantine && !f.inQuarantine(file.StoragePath) {
+		// 共享的密文仍被其他文件引用，不移动；感染状态已经阻止下载
+		shared, err := f.isSharedBlob(file.StoragePath)
+		if err != nil {
+			return nil, err
+		}
+		if !shared {
+			newPath, err := f.moveToQuarantine(file.StoragePath)
+			if err != nil {
+				return nil, err
+			}
+			file.StoragePath = newPath
+		}
+	}
+	if err := f.saveFileRow(file); err != nil {
+		return nil, err
+	}
+	return file, outcome.err
+}
+
+// RescanAll 逐个重新扫描文件；onlyUnscanned 为 true 时跳过已经有结论的文件
+func (f *FileService) RescanAll(onlyUnscanned bool, progress func(id uint, file *model.File, err error)) error {
+	var lastID uint
+	for {
+		var batch []model.File
+		tx := f.db.Select("id", "scan_status", "customer_key_tag").Where("id > ?", lastID).Order("id asc").Limit(100)
+		if err := tx.Find(&batch).Error; err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, row := range batch {
+			lastID = row.ID
+			if onlyUnscanned && (row.ScanStatus == model.ScanClean || row.ScanStatus == model.ScanInfected) {
+				continue
+			}
+			// 客户密钥加密的文件只能在上传时扫描，服务器之后再也读不到内容
+			if row.CustomerKeyTag != "" {
+				continue
+			}
+			file, err := f.RescanFile(row.ID)
+			if progress != nil {
+				progress(row.ID, file, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/pkg/clamdtest"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+func setTestScanner(t *testing.T, f *FileService, address, action string, failOpen bool) {
+	t.Helper()
+	client, err := pkg.NewClamdClient(address, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetScanner(client, action, failOpen)
+}
+
+// blobCount 统计存储目录中（不含隔离目录）的密文文件
+func blobCount(t *testing.T, f *FileService) (stored, quarantined int) {
+	t.Helper()
+	err := filepath.WalkDir(f.dirpath, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".bin") {
+			return err
+		}
+		if f.inQuarantine(path) {
+			quarantined++
+		} else {
+			stored++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestScanCleanUpload(t *testing.T) {
+	srv := clamdtest.NewServer(clamdtest.EICAR)
+	defer srv.Close()
+	f := newTestFileService(t)
+	setTestScanner(t, f, srv.Address(), "reject", false)
+
+	file, err := f.UploadFile(strings.NewReader("hello"), "a.txt", 1, "")
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if file.ScanStatus != model.ScanClean || file.ScannedAt == nil {
+		t.Fatalf("scan status = %q, want clean", file.ScanStatus)
+	}
+	// clamd 收到的是明文，磁盘上只有密文
+	if got := string(srv.Data()); got != "hello" {
+		t.Fatalf("clamd received %q", got)
+	}
+}
+
+func TestScanRejectInfected(t *testing.T) {
+	srv := clamdtest.NewServer(clamdtest.EICAR)
+	defer srv.Close()
+	f := newTestFileService(t)
+	setTestScanner(t, f, srv.Address(), "reject", false)
+
+	if _, err := f.UploadFile(strings.NewReader(eicar), "eicar.com", 1, ""); !errors.Is(err, ErrFileInfected) {
+		t.Fatalf("err = %v, want ErrFileInfected", err)
+	}
+	if stored, quarantined := blobCount(t, f); stored != 0 || quarantined != 0 {
+		t.Fatalf("rejected upload left %d blobs and %d quarantined", stored, quarantined)
+	}
+	var n int64
+	f.db.Model(&model.File{}).Count(&n)
+	if n != 0 {
+		t.Fatalf("rejected upload created %d rows", n)
+	}
+}
+
+func TestScanQuarantineInfected(t *testing.T) {
+	srv := clamdtest.NewServer(clamdtest.EICAR)
+	defer srv.Close()
+	f := newTestFileService(t)
+	setTestScanner(t, f, srv.Address(), "quarantine", false)
+
+	file, err := f.UploadFile(strings.NewReader(eicar), "eicar.com", 1, "")
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if file.ScanStatus != model.ScanInfected || file.ScanSignature != "Eicar-Test-Signature" {
+		t.Fatalf("scan = %q %q, want infected", file.ScanStatus, file.ScanSignature)
+	}
+	if stored, quarantined := blobCount(t, f); stored != 0 || quarantined != 1 {
+		t.Fatalf("blobs = %d stored, %d quarantined; want the blob in quarantine", stored, quarantined)
+	}
+	got, err := f.GetFileByID(file.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.EnsureDownloadable(got); !errors.Is(err, ErrFileQuarantined) {
+		t.Fatalf("EnsureDownloadable = %v, want ErrFileQuarantined", err)
+	}
+}
+
+func TestScanUnavailable(t *testing.T) {
+	srv := clamdtest.NewServer(clamdtest.EICAR)
+	addr := srv.Address()
+	srv.Close()
+
+	t.Run("fail closed", func(t *testing.T) {
+		f := newTestFileService(t)
+		setTestScanner(t, f, addr, "reject", false)
+		if _, err := f.UploadFile(strings.NewReader("hello"), "a.txt", 1, ""); !errors.Is(err, ErrScanFailed) {
+			t.Fatalf("err = %v, want ErrScanFailed", err)
+		}
+		if stored, _ := blobCount(t, f); stored != 0 {
+			t.Fatalf("failed scan left %d blobs", stored)
+		}
+	})
+	t.Run("fail open", func(t *testing.T) {
+		f := newTestFileService(t)
+		setTestScanner(t, f, addr, "reject", true)
+		file, err := f.UploadFile(strings.NewReader("hello"), "a.txt", 1, "")
+		if err != nil {
+			t.Fatalf("UploadFile: %v", err)
+		}
+		if file.ScanStatus != model.ScanError {
+			t.Fatalf("scan status = %q, want error so it is rescanned later", file.ScanStatus)
+		}
+	})
+}
+
+func TestRescanQuarantines(t *testing.T) {
+	f := newTestFileService(t)
+	file, err := f.UploadFile(strings.NewReader(eicar), "eicar.com", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := clamdtest.NewServer(clamdtest.EICAR)
+	defer srv.Close()
+	setTestScanner(t, f, srv.Address(), "quarantine", false)
+	got, err := f.RescanFile(file.ID)
+	if err != nil {
+		t.Fatalf("RescanFile: %v", err)
+	}
+	if got.ScanStatus != model.ScanInfected {
+		t.Fatalf("scan status = %q, want infected", got.ScanStatus)
+	}
+	if stored, quarantined := blobCount(t, f); stored != 0 || quarantined != 1 {
+		t.Fatalf("blobs = %d stored, %d quarantined; want the blob in quarantine", stored, quarantined)
+	}
+}
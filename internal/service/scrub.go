@@ -0,0 +1,232 @@
+package service
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+	"gorm.io/gorm/clause"
+)
+
+// ScrubReport 是一次巡检的统计
+type ScrubReport struct {
+	Checked     int `json:"checked"`
+	OK          int `json:"ok"`
+	Missing     int `json:"missing"`
+	Corrupt     int `json:"corrupt"`
+	BadMetadata int `json:"bad_metadata"`
+	Locked      int `json:"locked"`
+}
+
+func (r *ScrubReport) add(status string) {
+	r.Checked++
+	switch status {
+	case model.ScrubOK:
+		r.OK++
+	case model.ScrubMissing:
+		r.Missing++
+	case model.ScrubCorrupt:
+		r.Corrupt++
+	case model.ScrubBadMetadata:
+		r.BadMetadata++
+	case model.ScrubLocked:
+		r.Locked++
+	}
+}
+
+// ScrubCount 是某类密文在某个状态下的数量
+type ScrubCount struct {
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	Count  int64  `json:"count"`
+}
+
+// SetScrubRate 设置巡检每秒最多读取的密文字节数，0 表示不限速
+func (f *FileService) SetScrubRate(bytesPerSecond int64) {
+	f.scrubRate = bytesPerSecond
+}
+
+// Scrub 按 ID 顺序完整解密每个文件和头像的密文（明文直接丢弃），把结果写入 scrub_results。
+// 元数据无法解密的文件行记为 bad_metadata，这些行在文件列表中是看不到的；
+// 用户密钥加密而上传者不在线的文件只检查密文是否存在，记为 locked。
+// 完整跑完一轮后，删除本轮没有访问到（文件或头像已删除）的旧结果。
+func (f *FileService) Scrub(ctx context.Context) (*ScrubReport, error) {
+	blobs := f.k().blobs
+	if blobs == nil {
+		return nil, f.keyError()
+	}
+	// 只保留到秒，避免数据库时间精度低于 Go 时使下面的清理误删本轮的结果
+	started := time.Now().Truncate(time.Second)
+	throttle := &scrubThrottle{rate: f.scrubRate, start: time.Now()}
+	report := &ScrubReport{}
+
+	var lastID uint
+	for {
+		var batch []model.File
+		if err := f.db.Where("id > ?", lastID).Order("id asc").Limit(100).Find(&batch).Error; err != nil {
+			return report, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for i := range batch {
+			file := &batch[i]
+			lastID = file.ID
+			status, cause := model.ScrubBadMetadata, f.decryptFileMetadata(file)
+			if cause == nil {
+				status, cause = f.scrubFile(ctx, throttle, file)
+			}
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			if err := f.recordScrub(model.ScrubKindFile, file.ID, status, cause); err != nil {
+				return report, err
+			}
+			report.add(status)
+		}
+	}
+
+	lastID = 0
+	for {
+		var batch []model.User
+		if err := f.db.Select("id", "avatar_path").Where("id > ? AND avatar_path <> ''", lastID).
+			Order("id asc").Limit(100).Find(&batch).Error; err != nil {
+			return report, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, u := range batch {
+			lastID = u.ID
+			status, cause := f.scrubBlob(ctx, throttle, blobs, u.AvatarPath, -1)
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			if err := f.recordScrub(model.ScrubKindAvatar, u.ID, status, cause); err != nil {
+				return report, err
+			}
+			report.add(status)
+		}
+	}
+
+	err := f.db.Where("checked_at < ?", started).Delete(&model.ScrubResult{}).Error
+	return report, err
+}
+
+func (f *FileService) scrubFile(ctx context.Context, throttle *scrubThrottle, file *model.File) (string, error) {
+	blobs, err := f.fileCipher(file)
+	if KeyUnavailable(err) {
+		if _, serr := os.Stat(file.StoragePath); os.IsNotExist(serr) {
+			return model.ScrubMissing, serr
+		}
+		return model.ScrubLocked, err
+	}
+	if err != nil {
+		return model.ScrubCorrupt, err
+	}
+	return f.scrubBlob(ctx, throttle, blobs, file.StoragePath, file.Size)
+}
+
+// scrubBlob 校验一个密文；size 为 -1 表示不知道明文长度（头像）
+func (f *FileService) scrubBlob(ctx context.Context, throttle *scrubThrottle, blobs *sfbcrypt.BlobCipher, path string, size int64) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return model.ScrubMissing, err
+		}
+		return model.ScrubCorrupt, err
+	}
+	defer in.Close()
+	if err := verifyBlob(blobs, &throttledReader{ctx: ctx, throttle: throttle, r: in}, size); err != nil {
+		return model.ScrubCorrupt, err
+	}
+	return model.ScrubOK, nil
+}
+
+func (f *FileService) recordScrub(kind string, refID uint, status string, cause error) error {
+	now := time.Now()
+	row := model.ScrubResult{Kind: kind, RefID: refID, Status: status, CheckedAt: now}
+	columns := []string{"status", "error", "checked_at"}
+	if status == model.ScrubOK {
+		row.VerifiedAt = &now
+		columns = append(columns, "verified_at")
+	}
+	if cause != nil {
+		row.Error = truncate(cause.Error(), 512)
+	}
+	return f.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "kind"}, {Name: "ref_id"}},
+		DoUpdates: clause.AssignmentColumns(columns),
+	}).Create(&row).Error
+}
+
+// ScrubSummary 按类型和状态统计最近一次巡检的结果
+func (f *FileService) ScrubSummary() ([]ScrubCount, error) {
+	var counts []ScrubCount
+	err := f.db.Model(&model.ScrubResult{}).Select("kind, status, COUNT(*) AS count").
+		Group("kind, status").Order("kind, status").Scan(&counts).Error
+	return counts, err
+}
+
+// ListScrubResults 列出巡检结果；status 为空时只列出有问题的
+func (f *FileService) ListScrubResults(status string, kind string, page, size int) (total int64, results []model.ScrubResult, err error) {
+	tx := f.db.Model(&model.ScrubResult{})
+	if status == "" {
+		tx = tx.Where("status <> ?", model.ScrubOK)
+	} else {
+		tx = tx.Where("status = ?", status)
+	}
+	if kind != "" {
+		tx = tx.Where("kind = ?", kind)
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return
+	}
+	offset := (page - 1) * size
+	err = tx.Order("checked_at desc, id desc").Limit(size).Offset(offset).Find(&results).Error
+	return
+}
+
+// scrubThrottle 把一轮巡检的平均读取速度限制在 rate 字节/秒以内
+type scrubThrottle struct {
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *scrubThrottle) wait(ctx context.Context, n int) error {
+	if t.rate <= 0 {
+		return nil
+	}
+	t.read += int64(n)
+	due := t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+type throttledReader struct {
+	ctx      context.Context
+	throttle *scrubThrottle
+	r        io.Reader
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.throttle.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+// scrubResults 按 kind/ref_id 返回巡检结果
+func scrubResults(t *testing.T, files *FileService) map[string]model.ScrubResult {
+	t.Helper()
+	var rows []model.ScrubResult
+	if err := files.db.Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	results := make(map[string]model.ScrubResult)
+	for _, r := range rows {
+		results[r.Kind+"/"+itoa(r.RefID)] = r
+	}
+	return results
+}
+
+func itoa(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+func corruptFile(t *testing.T, path string, edit func([]byte) []byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, edit(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	files := newTestFileService(t)
+	users := NewUserService(files.db)
+	alice := newTestUser(t, users, "alice")
+	big := strings.Repeat("x", sfbcrypt.ChunkSize+8000)
+
+	ok := uploadString(t, files, alice.ID, "ok.txt", big)
+	flipped := uploadString(t, files, alice.ID, "flipped.txt", big)
+	truncated := uploadString(t, files, alice.ID, "truncated.txt", big)
+	chunkDropped := uploadString(t, files, alice.ID, "dropped.txt", big)
+	missing := uploadString(t, files, alice.ID, "missing.txt", "gone")
+	badMeta := uploadString(t, files, alice.ID, "meta.txt", "meta")
+	avatar, _, err := files.SaveUserAvatar(strings.NewReader("png"), "a.png", alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.UpdateAvatar(alice.ID, avatar, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	corruptFile(t, flipped.StoragePath, func(b []byte) []byte { b[len(b)/2] ^= 1; return b })
+	corruptFile(t, truncated.StoragePath, func(b []byte) []byte { return b[:len(b)-100] })
+	// 去掉整个最后一块：每一块都能通过认证，只能靠明文长度发现
+	corruptFile(t, chunkDropped.StoragePath, func(b []byte) []byte {
+		return b[:sfbcrypt.HeaderSizeV2+4+sfbcrypt.ChunkSize+16]
+	})
+	if err := os.Remove(missing.StoragePath); err != nil {
+		t.Fatal(err)
+	}
+	// 改动加密文件名的一个字符，元数据认证失败
+	var row model.File
+	if err := files.db.First(&row, badMeta.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	enc := []byte(row.EncFilename)
+	enc[len(enc)/2] ^= 'A' ^ 'B'
+	if err := files.db.Model(&model.File{}).Where("id = ?", badMeta.ID).Update("enc_filename", string(enc)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := files.Scrub(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ScrubReport{Checked: 7, OK: 2, Missing: 1, Corrupt: 3, BadMetadata: 1}
+	if *report != want {
+		t.Fatalf("report = %+v, want %+v", *report, want)
+	}
+	results := scrubResults(t, files)
+	for key, status := range map[string]string{
+		"file/" + itoa(ok.ID):           model.ScrubOK,
+		"file/" + itoa(flipped.ID):      model.ScrubCorrupt,
+		"file/" + itoa(truncated.ID):    model.ScrubCorrupt,
+		"file/" + itoa(chunkDropped.ID): model.ScrubCorrupt,
+		"file/" + itoa(missing.ID):      model.ScrubMissing,
+		"file/" + itoa(badMeta.ID):      model.ScrubBadMetadata,
+		"avatar/" + itoa(alice.ID):      model.ScrubOK,
+	} {
+		r := results[key]
+		if r.Status != status || (status == model.ScrubOK) != (r.VerifiedAt != nil) || (status == model.ScrubOK) != (r.Error == "") {
+			t.Errorf("%s: %+v, want %s", key, r, status)
+		}
+	}
+	if total, list, err := files.ListScrubResults("", model.ScrubKindFile, 1, 10); err != nil || total != 5 || len(list) != 5 {
+		t.Fatalf("ListScrubResults = %d, %v", total, err)
+	}
+
+	// 头像损坏也能发现；删除的文件在下一轮结束后不再有结果
+	corruptFile(t, avatar, func(b []byte) []byte { b[len(b)-1] ^= 1; return b })
+	if err := files.DeleteFile(flipped.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.db.Model(&model.ScrubResult{}).Where("1 = 1").Update("checked_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := files.Scrub(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	results = scrubResults(t, files)
+	if _, ok := results["file/"+itoa(flipped.ID)]; ok || len(results) != 6 {
+		t.Fatalf("stale result kept: %d results", len(results))
+	}
+	if r := results["avatar/"+itoa(alice.ID)]; r.Status != model.ScrubCorrupt || r.VerifiedAt == nil {
+		t.Fatalf("corrupted avatar: %+v", r)
+	}
+}
+
+// 限速时 ctx 取消会中断巡检
+func TestScrubThrottleCanceled(t *testing.T) {
+	files := newTestFileService(t)
+	uploadString(t, files, 1, "a.txt", strings.Repeat("x", 4096))
+	files.SetScrubRate(1024)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := files.Scrub(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Scrub = %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Scrub took %v after cancel", d)
+	}
+}
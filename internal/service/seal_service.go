@@ -0,0 +1,164 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+var ErrSealNotSupported = errors.New("master key is not split into key shares; a sealed server could only be unsealed by restarting it")
+
+// SealStatus 是 GET /api/v1/sys/seal-status 的内容
+type SealStatus struct {
+	Sealed    bool `json:"sealed"`
+	Threshold int  `json:"threshold,omitempty"`
+	Shares    int  `json:"shares,omitempty"`
+	// Progress 为本轮已经提交的份额数
+	Progress int `json:"progress"`
+}
+
+// SealService 管理按份额拆分的主密钥（sfbctl key split）。服务器以封存状态启动，文件接口返回 503；
+// 保管人逐份提交份额，凑够 threshold 份后在内存中还原主密钥并解封。已提交的份额只保存在内存中，
+// 还原失败（有份额是伪造或抄错的）时整轮丢弃，需要重新提交。
+// Seal 随时可以重新封存：FileService 和 AuditService 的密钥以及已解开的用户密钥都被清零
+type SealService struct {
+	fileSrv  *FileService
+	auditSrv *AuditService
+	// keyFile 为 nil 表示主密钥在启动时已经解开，不支持封存
+	keyFile []byte
+	sharing *sfbcrypt.KeySharing
+
+	mu       sync.Mutex
+	pending  []*sfbcrypt.KeyShare
+	onUnseal []func()
+}
+
+// NewSealService 在 keyFile 为按份额拆分的密钥文件时让 fs 和 as 进入封存状态；
+// keyFile 为 nil 时什么都不改变
+func NewSealService(fs *FileService, as *AuditService, keyFile []byte) (*SealService, error) {
+	s := &SealService{fileSrv: fs, auditSrv: as}
+	if keyFile != nil {
+		sharing, err := sfbcrypt.MasterKeySharing(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if sharing == nil {
+			return nil, errors.New("master key file is not split into key shares")
+		}
+		s.keyFile, s.sharing = keyFile, sharing
+		fs.Seal()
+		as.Seal()
+	}
+	fmt.Fprintln(config.Progress, "✓ Creating a new seal service done")
+	return s, nil
+}
+
+// Sealed 报告服务器是否处于封存状态
+func (s *SealService) Sealed() bool {
+	return s.fileSrv.Sealed()
+}
+
+// CanSeal 报告封存之后能否再用份额解封
+func (s *SealService) CanSeal() bool {
+	return s.keyFile != nil
+}
+
+// OnUnseal 注册解封之后在后台执行的工作，应在开始处理请求之前调用
+func (s *SealService) OnUnseal(fn func()) {
+	s.onUnseal = append(s.onUnseal, fn)
+}
+
+func (s *SealService) Status() SealStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status()
+}
+
+func (s *SealService) status() SealStatus {
+	st := SealStatus{Sealed: s.Sealed(), Progress: len(s.pending)}
+	if s.sharing != nil {
+		st.Threshold, st.Shares = s.sharing.Threshold, s.sharing.Shares
+	}
+	return st
+}
+
+// Unseal 提交一份份额，unsealed 表示这一份让服务器解封。份额格式不对、属于其他密钥文件或者重复时
+// 返回错误，已提交的份额保留；凑够 threshold 份后还原主密钥，失败时返回 sfbcrypt.ErrKeyShares 并清空本轮。
+// 没有封存时什么都不做
+func (s *SealService) Unseal(text string) (status SealStatus, unsealed bool, err error) {
+	return s.submit(text, false)
+}
+
+// Reset 丢弃本轮已提交的份额，并以 text 开始新的一轮。text 必须是这个密钥文件的份额，
+// 否则返回错误且已提交的份额保留，这样不持有份额的人无法清空保管人的进度
+func (s *SealService) Reset(text string) (status SealStatus, unsealed bool, err error) {
+	return s.submit(text, true)
+}
+
+func (s *SealService) submit(text string, reset bool) (status SealStatus, unsealed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.Sealed() {
+		return s.status(), false, nil
+	}
+	share, err := sfbcrypt.ParseKeyShare(text)
+	if err != nil {
+		return s.status(), false, err
+	}
+	if share.Set != s.sharing.Set {
+		share.Wipe()
+		return s.status(), false, sfbcrypt.ErrKeyShareSet
+	}
+	if reset {
+		s.reset()
+	}
+	for _, p := range s.pending {
+		if p.X == share.X {
+			share.Wipe()
+			return s.status(), false, sfbcrypt.ErrKeyShareDup
+		}
+	}
+	s.pending = append(s.pending, share)
+	if len(s.pending) < s.sharing.Threshold {
+		return s.status(), false, nil
+	}
+
+	master, err := sfbcrypt.OpenMasterKeyShares(s.keyFile, s.pending)
+	s.reset()
+	if err != nil {
+		return s.status(), false, err
+	}
+	keys := sfbcrypt.DeriveKeys(master)
+	clear(master)
+	// 先准备好审计密钥，FileService 解封后请求才会进来
+	s.auditSrv.Unseal(keys)
+	s.fileSrv.Unseal(keys)
+	for _, fn := range s.onUnseal {
+		go fn()
+	}
+	return s.status(), true, nil
+}
+
+func (s *SealService) reset() {
+	for _, p := range s.pending {
+		p.Wipe()
+	}
+	s.pending = nil
+}
+
+// Seal 进入封存状态；主密钥不是按份额拆分时返回 ErrSealNotSupported
+func (s *SealService) Seal() error {
+	if s.keyFile == nil {
+		return ErrSealNotSupported
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+	// 先让 FileService 拒绝新的请求，再清除审计密钥
+	s.fileSrv.Seal()
+	s.auditSrv.Seal()
+	return nil
+}
@@ -0,0 +1,332 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/pkg/sftp"
+)
+
+// 乱序到达的写请求最多缓存这么多字节，超过后上传失败
+const sftpMaxPendingWrite = 8 << 20
+
+var errSFTPNonSequential = errors.New("non-sequential writes are not supported; upload the whole file again")
+
+// SFTPFS 为一个 SFTP 会话实现 pkg/sftp 的 Handlers，目录结构与 DavFS 相同：
+// 根目录下平铺调用者自己的文件，不能创建子目录。
+type SFTPFS struct {
+	files  *FileService
+	userID uint
+	// OnEvent 在上传、替换、重命名、删除和下载之后被调用，用于审计和 webhook；可以为 nil
+	OnEvent func(action string, file *model.File, err error)
+}
+
+func NewSFTPFS(files *FileService, userID uint) *SFTPFS {
+	return &SFTPFS{files: files, userID: userID}
+}
+
+func (s *SFTPFS) Handlers() sftp.Handlers {
+	return sftp.Handlers{FileGet: s, FilePut: s, FileCmd: s, FileList: s}
+}
+
+var _ sftp.PosixRenameFileCmder = (*SFTPFS)(nil)
+
+func (s *SFTPFS) event(action string, file *model.File, err error) {
+	if s.OnEvent != nil {
+		s.OnEvent(action, file, err)
+	}
+}
+
+// lookup 查找根目录下的文件；name 为 "" 表示根目录本身
+func (s *SFTPFS) lookup(p string) (string, *dirEntry, error) {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		return "", nil, nil
+	}
+	if strings.Contains(name, "/") {
+		return name, nil, os.ErrNotExist
+	}
+	entries, err := s.files.ownerDir(s.userID)
+	if err != nil {
+		return name, nil, err
+	}
+	entry, ok := findEntry(entries, name)
+	if !ok {
+		return name, nil, os.ErrNotExist
+	}
+	return name, &entry, nil
+}
+
+func (s *SFTPFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	name, entry, err := s.lookup(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, os.ErrInvalid
+	}
+	if err := s.files.EnsureDownloadable(entry.file); err != nil {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	return &sftpReader{fs: s, stream: rangeStream{files: s.files, file: entry.file}}, nil
+}
+
+func (s *SFTPFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	name, entry, err := s.lookup(r.Filepath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if name == "" {
+		return nil, os.ErrInvalid
+	}
+	flags := r.Pflags()
+	var existing *model.File
+	switch {
+	case entry != nil && flags.Excl:
+		return nil, os.ErrExist
+	case entry != nil && !flags.Trunc && entry.file.Size > 0:
+		// 密文是流式生成的，不能续传或局部修改，只能整体替换
+		return nil, sftp.ErrSSHFxPermissionDenied
+	case entry != nil:
+		name, existing = entry.name, entry.file
+	case !flags.Creat:
+		return nil, os.ErrNotExist
+	case !validEntryName(name):
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	return &sftpWriter{
+		fs:       s,
+		existing: existing,
+		upload:   s.files.startUpload(existing, name, s.userID),
+		pending:  map[int64][]byte{},
+	}, nil
+}
+
+func (s *SFTPFS) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		// 客户端上传后会设置权限和修改时间，这些属性没有意义，直接忽略
+		return nil
+	case "Remove":
+		_, entry, err := s.lookup(r.Filepath)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		err = s.files.DeleteFile(entry.file.ID)
+		s.event(model.AuditFileDelete, entry.file, err)
+		return err
+	case "Rename":
+		return s.rename(r.Filepath, r.Target, false)
+	default:
+		// Mkdir、Rmdir、Link、Symlink：没有子目录和链接
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// PosixRename 与 Rename 相同，但会替换已存在的目标文件（posix-rename@openssh.com）
+func (s *SFTPFS) PosixRename(r *sftp.Request) error {
+	return s.rename(r.Filepath, r.Target, true)
+}
+
+func (s *SFTPFS) rename(from, to string, replace bool) error {
+	_, entry, err := s.lookup(from)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	target, other, err := s.lookup(to)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if !validEntryName(target) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if other != nil && other.file.ID != entry.file.ID {
+		if !replace {
+			return os.ErrExist
+		}
+		err := s.files.DeleteFile(other.file.ID)
+		s.event(model.AuditFileDelete, other.file, err)
+		if err != nil {
+			return err
+		}
+	}
+	file, err := s.files.RenameFile(entry.file.ID, target)
+	if err != nil {
+		file = entry.file
+	}
+	s.event(model.AuditFileUpdate, file, err)
+	return err
+}
+
+func (s *SFTPFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name, entry, err := s.lookup(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		if name != "" {
+			return nil, os.ErrInvalid
+		}
+		entries, err := s.files.ownerDir(s.userID)
+		if err != nil {
+			return nil, err
+		}
+		infos := make(sftpLister, 0, len(entries))
+		for _, e := range entries {
+			infos = append(infos, davFileInfo{name: e.name, file: e.file})
+		}
+		return infos, nil
+	case "Stat", "Lstat":
+		if name == "" {
+			return sftpLister{davRootInfo{}}, nil
+		}
+		return sftpLister{davFileInfo{name: entry.name, file: entry.file}}, nil
+	default:
+		// Readlink：没有符号链接
+		return nil, os.ErrInvalid
+	}
+}
+
+type sftpLister []os.FileInfo
+
+func (l sftpLister) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpReader 的 ReadAt 会被多个 worker 并发调用，偏移大致递增；
+// 加锁后复用同一个解密流，偏移不连续时 rangeStream 会重新定位
+type sftpReader struct {
+	fs     *SFTPFS
+	mu     sync.Mutex
+	stream rangeStream
+	logged bool
+}
+
+func (r *sftpReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.logged && off < r.stream.file.Size {
+		r.logged = true
+		r.fs.event(model.AuditFileDownload, r.stream.file, nil)
+	}
+	total := 0
+	for total < len(p) {
+		n, err := r.stream.read(p[total:], off+int64(total))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (r *sftpReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stream.close()
+	return nil
+}
+
+// sftpWriter 按偏移顺序把数据交给加密流。客户端会同时发出多个写请求，
+// 先到的靠后的数据暂存在内存中（不落盘），等前面的数据到齐后再写入。
+type sftpWriter struct {
+	fs       *SFTPFS
+	existing *model.File
+	upload   *uploadStream
+
+	mu          sync.Mutex
+	pos         int64
+	pending     map[int64][]byte
+	pendingSize int
+	err         error
+	aborted     error
+}
+
+func (w *sftpWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	switch {
+	case off < w.pos:
+		w.err = errSFTPNonSequential
+		return 0, w.err
+	case off > w.pos:
+		if _, dup := w.pending[off]; dup || w.pendingSize+len(p) > sftpMaxPendingWrite {
+			w.err = errSFTPNonSequential
+			return 0, w.err
+		}
+		w.pending[off] = append([]byte(nil), p...)
+		w.pendingSize += len(p)
+		return len(p), nil
+	}
+	if err := w.write(p); err != nil {
+		return 0, err
+	}
+	for {
+		data, ok := w.pending[w.pos]
+		if !ok {
+			return len(p), nil
+		}
+		delete(w.pending, w.pos)
+		w.pendingSize -= len(data)
+		if err := w.write(data); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (w *sftpWriter) write(p []byte) error {
+	n, err := w.upload.Write(p)
+	w.pos += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
+// TransferError 在连接断开而文件仍未关闭时被调用，随后的 Close 会丢弃这次上传
+func (w *sftpWriter) TransferError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.aborted = errUploadAborted
+}
+
+func (w *sftpWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	abort := w.err
+	if abort == nil {
+		abort = w.aborted
+	}
+	if abort == nil && len(w.pending) > 0 {
+		abort = errSFTPNonSequential
+	}
+	file, err := w.upload.finish(abort)
+	action := model.AuditFileUpload
+	if w.existing != nil {
+		action = model.AuditFileUpdate
+	}
+	w.fs.event(action, file, err)
+	return err
+}
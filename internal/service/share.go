@@ -0,0 +1,75 @@
+package service
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+)
+
+var (
+	ErrShareInvalid = errors.New("invalid share link")
+	ErrShareExpired = errors.New("share link expired")
+	ErrShareTTL     = errors.New("share link lifetime out of range")
+)
+
+const (
+	DefaultShareTTL = 24 * time.Hour
+	MaxShareTTL     = 30 * 24 * time.Hour
+)
+
+// ShareToken 生成无状态的分享令牌：<文件 ID>.<过期 Unix 秒>.<HMAC>。
+// 服务器不保存令牌，删除文件即让所有链接失效；更换 file_crypto.key 同样会让它们失效。
+func (f *FileService) ShareToken(file *model.File, ttl time.Duration) (string, time.Time, error) {
+	if ttl <= 0 || ttl > MaxShareTTL {
+		return "", time.Time{}, ErrShareTTL
+	}
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	payload := strconv.FormatUint(uint64(file.ID), 10) + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	sig := f.shareSignature(payload)
+	if sig == "" {
+		return "", time.Time{}, f.keyError()
+	}
+	return payload + "." + sig, expiresAt, nil
+}
+
+// ResolveShareToken 校验签名和有效期，返回被分享的文件
+func (f *FileService) ResolveShareToken(token string) (*model.File, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return nil, ErrShareInvalid
+	}
+	payload, sig := token[:i], token[i+1:]
+	want := f.shareSignature(payload)
+	if want == "" || !hmac.Equal([]byte(sig), []byte(want)) {
+		return nil, ErrShareInvalid
+	}
+	idStr, expStr, ok := strings.Cut(payload, ".")
+	if !ok {
+		return nil, ErrShareInvalid
+	}
+	id, err1 := strconv.ParseUint(idStr, 10, 64)
+	exp, err2 := strconv.ParseInt(expStr, 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, ErrShareInvalid
+	}
+	if time.Now().Unix() >= exp {
+		return nil, ErrShareExpired
+	}
+	return f.GetFileByID(uint(id))
+}
+
+// shareSignature 在没有密钥时返回空字符串
+func (f *FileService) shareSignature(payload string) string {
+	k := f.k()
+	mac := k.mac(&k.shareKey)
+	if mac == nil {
+		return ""
+	}
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
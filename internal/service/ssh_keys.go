@@ -0,0 +1,100 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSSHKeyInvalid = errors.New("invalid ssh public key")
+	ErrSSHKeyExists  = errors.New("ssh public key already registered")
+	ErrSSHKeyLimit   = errors.New("too many ssh public keys")
+)
+
+const maxSSHKeysPerUser = 20
+
+// AddSSHKey 登记一把 authorized_keys 格式的公钥；name 为空时使用公钥的注释
+func (s *UserService) AddSSHKey(userID uint, name string, authorizedKey string) (*model.SSHKey, error) {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(authorizedKey)))
+	if err != nil {
+		return nil, ErrSSHKeyInvalid
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = comment
+	}
+	if len(name) > 100 {
+		name = name[:100]
+	}
+
+	var count int64
+	if err := s.db.Model(&model.SSHKey{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count >= maxSSHKeysPerUser {
+		return nil, ErrSSHKeyLimit
+	}
+	key := &model.SSHKey{
+		UserID:      userID,
+		Name:        name,
+		Fingerprint: ssh.FingerprintSHA256(pub),
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+		CreatedAt:   time.Now(),
+	}
+	var existing int64
+	if err := s.db.Model(&model.SSHKey{}).Where("fingerprint = ?", key.Fingerprint).Count(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing > 0 {
+		return nil, ErrSSHKeyExists
+	}
+	if err := s.db.Create(key).Error; err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *UserService) ListSSHKeys(userID uint) ([]model.SSHKey, error) {
+	var keys []model.SSHKey
+	if err := s.db.Where("user_id = ?", userID).Order("id").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteSSHKey 只能删除自己的公钥；不存在时返回 gorm.ErrRecordNotFound
+func (s *UserService) DeleteSSHKey(userID uint, id uint) error {
+	res := s.db.Where("id = ? AND user_id = ?", id, userID).Delete(&model.SSHKey{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// AuthenticateSSHKey 查找公钥的所有者，用户必须存在且未被禁用
+func (s *UserService) AuthenticateSSHKey(pub ssh.PublicKey) (*model.User, error) {
+	var key model.SSHKey
+	if err := s.db.Where("fingerprint = ?", ssh.FingerprintSHA256(pub)).First(&key).Error; err != nil {
+		return nil, err
+	}
+	stored, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.PublicKey))
+	if err != nil || !bytes.Equal(stored.Marshal(), pub.Marshal()) {
+		return nil, ErrSSHKeyInvalid
+	}
+	u, err := s.CheckActive(key.UserID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	_ = s.db.Model(&model.SSHKey{}).Where("id = ?", key.ID).Update("last_used_at", &now).Error
+	return u, nil
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+)
+
+// 密文按存储名分两级目录存放：abcdef....bin 存为 ab/cd/abcdef....bin，
+// 头像 avatar_abcdef....bin 按 avatar_ 之后的部分分目录。隔离区和 S3 分段不分目录。
+const avatarPrefix = "avatar_"
+
+// shardedPath 返回存储名在 storage 目录下的分级路径
+func (f *FileService) shardedPath(name string) string {
+	key := strings.TrimPrefix(name, avatarPrefix)
+	if len(key) < 4 {
+		return filepath.Join(f.dirpath, name)
+	}
+	return filepath.Join(f.dirpath, key[:2], key[2:4], name)
+}
+
+// newBlobPath 生成一个新的随机存储路径，prefix 为空或 avatarPrefix
+func (f *FileService) newBlobPath(prefix string) (string, error) {
+	name, err := randomStorageName()
+	if err != nil {
+		return "", err
+	}
+	return f.shardedPath(prefix + name), nil
+}
+
+// writeFileAtomic 先写入同目录下的 <path>.tmp.<纳秒>，fsync 后改名为 path 并 fsync 目录。
+// 返回 nil 时内容已经落盘；中途崩溃只会留下临时文件，由 storage gc 回收。
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := mkdirAllSynced(dir); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp.%d", path, time.Now().UnixNano())
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = write(out)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// renameSynced 改名并 fsync 涉及的目录，保证改名在返回前已经落盘
+func renameSynced(src, dst string) error {
+	if err := mkdirAllSynced(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if filepath.Dir(src) != filepath.Dir(dst) {
+		return syncDir(filepath.Dir(src))
+	}
+	return nil
+}
+
+// mkdirAllSynced 与 os.MkdirAll 相同，但每新建一级目录都 fsync 它的上级目录
+func mkdirAllSynced(dir string) error {
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := mkdirAllSynced(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return syncDir(parent)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ShardReport 是一次目录迁移的统计；Skipped 是已经分级或在隔离区等位置、不需要迁移的记录，
+// Missing 是密文已经不存在、无法迁移的记录
+type ShardReport struct {
+	Files   int          `json:"files"`
+	Avatars int          `json:"avatars"`
+	Skipped int          `json:"skipped"`
+	Missing []GCDangling `json:"missing"`
+	DryRun  bool         `json:"dry_run"`
+}
+
+// ShardStorage 把仍在 storage 根目录下的文件和头像密文移到分级目录并更新记录。
+// 每条记录单独处理：先改名再按旧值条件更新，中断后重新运行会从剩下的部分继续；
+// 更新时记录已被修改的，移过去的密文成为孤儿，由 storage gc 回收。
+func (f *FileService) ShardStorage(dryRun bool) (*ShardReport, error) {
+	report := &ShardReport{Missing: []GCDangling{}, DryRun: dryRun}
+
+	var lastID uint
+	for {
+		var batch []model.File
+		if err := f.db.Where("id > ?", lastID).Order("id asc").Limit(500).Find(&batch).Error; err != nil {
+			return report, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for i := range batch {
+			file := &batch[i]
+			lastID = file.ID
+			if err := f.decryptFileMetadata(file); err != nil {
+				return report, fmt.Errorf("file %d: %w", file.ID, err)
+			}
+			dst, ok, err := f.shardBlob(file.StoragePath, dryRun)
+			if err != nil {
+				return report, fmt.Errorf("file %d: %w", file.ID, err)
+			}
+			switch {
+			case dst == "":
+				report.Skipped++
+				continue
+			case !ok:
+				report.Missing = append(report.Missing, GCDangling{Kind: model.ScrubKindFile, ID: file.ID, Path: file.StoragePath})
+				continue
+			}
+			report.Files++
+			if dryRun {
+				continue
+			}
+			oldEnc := file.EncStoragePath
+			file.StoragePath = dst
+			if err := f.encryptFileMetadata(file); err != nil {
+				return report, err
+			}
+			if err := f.db.Model(&model.File{}).Where("id = ? AND enc_storage_path = ?", file.ID, oldEnc).
+				Update("enc_storage_path", file.EncStoragePath).Error; err != nil {
+				return report, err
+			}
+		}
+	}
+
+	lastID = 0
+	for {
+		var batch []model.User
+		if err := f.db.Unscoped().Select("id", "avatar_path").Where("id > ? AND avatar_path <> ''", lastID).
+			Order("id asc").Limit(500).Find(&batch).Error; err != nil {
+			return report, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, u := range batch {
+			lastID = u.ID
+			dst, ok, err := f.shardBlob(u.AvatarPath, dryRun)
+			if err != nil {
+				return report, fmt.Errorf("user %d avatar: %w", u.ID, err)
+			}
+			switch {
+			case dst == "":
+				report.Skipped++
+				continue
+			case !ok:
+				report.Missing = append(report.Missing, GCDangling{Kind: model.ScrubKindAvatar, ID: u.ID, Path: u.AvatarPath})
+				continue
+			}
+			report.Avatars++
+			if dryRun {
+				continue
+			}
+			if err := f.db.Unscoped().Model(&model.User{}).Where("id = ? AND avatar_path = ?", u.ID, u.AvatarPath).
+				Update("avatar_path", dst).Error; err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// shardBlob 把 storage 根目录下的一个密文移到分级路径。dst 为空表示不需要迁移
+// （已经分级、在隔离区或不在 storage 下）；ok 为 false 表示新旧位置都没有这个密文。
+// 上次在改名之后、更新记录之前中断时，密文已经在新位置，直接返回 ok。
+func (f *FileService) shardBlob(path string, dryRun bool) (dst string, ok bool, err error) {
+	if filepath.Dir(filepath.Clean(path)) != filepath.Clean(f.dirpath) {
+		return "", false, nil
+	}
+	dst = f.shardedPath(filepath.Base(path))
+	if dst == filepath.Clean(path) {
+		return "", false, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		if !os.IsNotExist(err) {
+			return "", false, err
+		}
+		if _, err := os.Stat(dst); err != nil {
+			if os.IsNotExist(err) {
+				return dst, false, nil
+			}
+			return "", false, err
+		}
+		return dst, true, nil
+	}
+	if dryRun {
+		return dst, true, nil
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return "", false, fmt.Errorf("both %s and %s exist", path, dst)
+	}
+	return dst, true, renameSynced(path, dst)
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+)
+
+// flattenFile 把文件密文移回 storage 根目录并改写记录，模拟分级之前的旧布局。
+// moveBlob 为 false 时只改记录，相当于上次迁移在改名之后、更新记录之前中断
+func flattenFile(t *testing.T, files *FileService, id uint, moveBlob bool) string {
+	t.Helper()
+	file, err := files.GetFileByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat := filepath.Join(files.dirpath, filepath.Base(file.StoragePath))
+	if moveBlob {
+		if err := os.Rename(file.StoragePath, flat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.StoragePath = flat
+	if err := files.encryptFileMetadata(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.db.Model(&model.File{}).Where("id = ?", id).Update("enc_storage_path", file.EncStoragePath).Error; err != nil {
+		t.Fatal(err)
+	}
+	return flat
+}
+
+func TestShardStorage(t *testing.T) {
+	files := newTestFileService(t)
+	users := NewUserService(files.db)
+	alice := newTestUser(t, users, "alice")
+
+	legacy := uploadString(t, files, alice.ID, "legacy.txt", "legacy")
+	interrupted := uploadString(t, files, alice.ID, "interrupted.txt", "interrupted")
+	sharded := uploadString(t, files, alice.ID, "sharded.txt", "sharded")
+	lost := uploadString(t, files, alice.ID, "lost.txt", "lost")
+	avatar, _, err := files.SaveUserAvatar(strings.NewReader("png"), "a.png", alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flatAvatar := filepath.Join(files.dirpath, filepath.Base(avatar))
+	if err := os.Rename(avatar, flatAvatar); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.UpdateAvatar(alice.ID, flatAvatar, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	flatLegacy := flattenFile(t, files, legacy.ID, true)
+	flattenFile(t, files, interrupted.ID, false)
+	flatLost := flattenFile(t, files, lost.ID, true)
+	if err := os.Remove(flatLost); err != nil {
+		t.Fatal(err)
+	}
+
+	// 演练只统计，不移动也不改记录
+	report, err := files.ShardStorage(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 2 || report.Avatars != 1 || report.Skipped != 1 || len(report.Missing) != 1 || !exists(flatLegacy) {
+		t.Fatalf("dry run: %+v", report)
+	}
+
+	report, err = files.ShardStorage(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 2 || report.Avatars != 1 || report.Skipped != 1 ||
+		len(report.Missing) != 1 || report.Missing[0].ID != lost.ID || report.Missing[0].Path != flatLost {
+		t.Fatalf("shard: %+v", report)
+	}
+	for _, f := range []*model.File{legacy, interrupted, sharded} {
+		got, err := files.GetFileByID(f.ID)
+		if err != nil || got.StoragePath != f.StoragePath {
+			t.Fatalf("file %d: %v, path %s, want %s", f.ID, err, got.StoragePath, f.StoragePath)
+		}
+		if readString(t, files, f.ID) != strings.TrimSuffix(f.Filename, ".txt") {
+			t.Fatalf("file %d content changed", f.ID)
+		}
+	}
+	if exists(flatLegacy) {
+		t.Fatal("legacy blob left in the storage root")
+	}
+	u, err := users.GetByID(alice.ID)
+	if err != nil || u.AvatarPath != avatar || !exists(avatar) {
+		t.Fatalf("avatar path %s, want %s", u.AvatarPath, avatar)
+	}
+
+	// 再运行一次不做任何修改，丢失的密文仍然报告出来
+	report, err = files.ShardStorage(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 0 || report.Avatars != 0 || report.Skipped != 4 || len(report.Missing) != 1 {
+		t.Fatalf("second run: %+v", report)
+	}
+}
+
+// 新旧位置都有密文时不覆盖任何一个
+func TestShardStorageConflict(t *testing.T) {
+	files := newTestFileService(t)
+	file := uploadString(t, files, 1, "a.txt", "a")
+	flat := flattenFile(t, files, file.ID, false)
+	if err := os.WriteFile(flat, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := files.ShardStorage(false); err == nil || !strings.Contains(err.Error(), "both") {
+		t.Fatalf("ShardStorage = %v", err)
+	}
+	if got, _ := os.ReadFile(flat); string(got) != "other" || !exists(file.StoragePath) {
+		t.Fatal("conflicting blobs were touched")
+	}
+}
+
+// 写入失败时不留下临时文件，也不替换原有的内容
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ab", "cd", "blob.bin")
+	write := func(content string, fail error) error {
+		return writeFileAtomic(path, func(w io.Writer) error {
+			if _, err := io.WriteString(w, content); err != nil {
+				return err
+			}
+			return fail
+		})
+	}
+	if err := write("first", nil); err != nil {
+		t.Fatal(err)
+	}
+	boom := errors.New("boom")
+	if err := write("second", boom); !errors.Is(err, boom) {
+		t.Fatalf("writeFileAtomic = %v", err)
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != "first" {
+		t.Fatalf("content %q, %v", got, err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("%d entries left in the directory, %v", len(entries), err)
+	}
+}
@@ -0,0 +1,349 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+)
+
+// VerifyFile 完整解密一次文件（丢弃明文），用于发现缺失、截断或被篡改的密文
+func (f *FileService) VerifyFile(id uint) error {
+	file, err := f.GetFileByID(id)
+	if err != nil {
+		return err
+	}
+	blobs, err := f.fileCipher(file)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(file.StoragePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return verifyBlob(blobs, in, file.Size)
+}
+
+// verifyBlob 完整解密一次密文并丢弃明文；size 为 -1 时不检查明文长度
+func verifyBlob(blobs *sfbcrypt.BlobCipher, in io.Reader, size int64) error {
+	info, err := blobs.Decrypt(io.Discard, in)
+	if err != nil {
+		return err
+	}
+	// SFB2 没有结束标记，整块丢失时只能通过大小发现
+	if size >= 0 && info.PlainBytes != size {
+		return fmt.Errorf("%w: decrypted %d bytes, metadata says %d", sfbcrypt.ErrTruncated, info.PlainBytes, size)
+	}
+	return nil
+}
+
+// VerifyAll 逐个校验所有文件，结果通过 progress 回调返回
+func (f *FileService) VerifyAll(progress func(id uint, err error)) error {
+	var lastID uint
+	for {
+		var batch []model.File
+		if err := f.db.Select("id").Where("id > ?", lastID).Order("id asc").Limit(100).Find(&batch).Error; err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, row := range batch {
+			lastID = row.ID
+			progress(row.ID, f.VerifyFile(row.ID))
+		}
+	}
+}
+
+type GCCandidate struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// GCDangling 是引用的密文已经不存在的记录；Kind 为 file 时 ID 是文件 ID，为 avatar 时是用户 ID，
+// 为 blob 时是 blobs 的 ID
+type GCDangling struct {
+	Kind string `json:"kind"`
+	ID   uint   `json:"id"`
+	Path string `json:"path"`
+}
+
+// GCReport 中 Orphans 是本次移入 .gc 的密文，Expired 是在 .gc 中超过宽限期被删除的，
+// Restored 是在宽限期内又被引用、移回原处的；DryRun 时只报告不改动
+type GCReport struct {
+	Scanned    int           `json:"scanned"`
+	Referenced int           `json:"referenced"`
+	Orphans    []GCCandidate `json:"orphans"`
+	Bytes      int64         `json:"bytes"`
+	Expired    []GCCandidate `json:"expired"`
+	Removed    int           `json:"removed"`
+	Restored   []string      `json:"restored"`
+	Dangling   []GCDangling  `json:"dangling"`
+	Grace      JobDuration   `json:"grace"`
+	DryRun     bool          `json:"dry_run"`
+}
+
+// gcKindBlob 表示只被 blobs 表引用的去重密文，ID 是 blobs 的 ID；
+// gcKindVault 是保险库文件，ID 是 vault_files 的 ID。两者都不记入 scrub_results
+const (
+	gcKindBlob  = "blob"
+	gcKindVault = "vault"
+)
+
+// gcDir 是等待删除的孤儿密文所在的目录，保持原来的相对路径；移入时把修改时间设为当前时间
+const gcDir = ".gc"
+
+// SetGCGrace 设置孤儿密文在 .gc 中保留多久才删除，0 表示立即删除
+func (f *FileService) SetGCGrace(grace time.Duration) {
+	f.gcGrace = grace
+}
+
+// gcReference 是一条引用了密文的记录
+type gcReference struct {
+	kind string
+	id   uint
+}
+
+// CollectGarbage 对照 files、users.avatar_path 和 vault_files 检查 storage 目录：
+// 没有被引用的密文（包括写入中断时留下的 *.tmp.* 文件）先移入 .gc，超过宽限期后才删除，
+// 在此期间重新被引用的会被移回原处；引用的密文不存在的记录列在 Dangling 中。
+// 新于 minAge 的文件会被跳过（上传时密文先于数据库行写入）。
+// 只要有一行元数据无法解密就放弃，因为无法确定它引用的路径。
+func (f *FileService) CollectGarbage(minAge time.Duration, dryRun bool) (*GCReport, error) {
+	referenced := make(map[string]gcReference)
+
+	var lastID uint
+	for {
+		var batch []model.File
+		if err := f.db.Where("id > ?", lastID).Order("id asc").Limit(500).Find(&batch).Error; err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for i := range batch {
+			lastID = batch[i].ID
+			if err := f.decryptFileMetadata(&batch[i]); err != nil {
+				return nil, fmt.Errorf("file %d: %w; refusing to collect garbage", batch[i].ID, err)
+			}
+			referenced[filepath.Clean(batch[i].StoragePath)] = gcReference{model.ScrubKindFile, batch[i].ID}
+		}
+	}
+	var avatars []model.User
+	// 软删除的用户的头像由 user.purge 任务删除，在那之前仍算被引用
+	if err := f.db.Unscoped().Select("id", "avatar_path").Where("avatar_path <> ''").Find(&avatars).Error; err != nil {
+		return nil, err
+	}
+	for _, u := range avatars {
+		referenced[filepath.Clean(u.AvatarPath)] = gcReference{model.ScrubKindAvatar, u.ID}
+	}
+	// 有登记的去重密文即使暂时没有文件引用也不回收，引用计数由删除文件时维护
+	var blobs []model.Blob
+	if err := f.db.Select("id", "name").Find(&blobs).Error; err != nil {
+		return nil, err
+	}
+	for _, b := range blobs {
+		path := f.shardedPath(b.Name)
+		if _, ok := referenced[path]; !ok {
+			referenced[path] = gcReference{gcKindBlob, b.ID}
+		}
+	}
+	// 保险库文件上传中的内容在隐藏目录下；最后一块移到分级目录后、记录更新前的也算引用
+	var vaultFiles []model.VaultFile
+	if err := f.db.Select("id", "name", "status").Find(&vaultFiles).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range vaultFiles {
+		path := f.shardedPath(v.Name)
+		if v.Status == model.VaultComplete || fileExists(path) {
+			referenced[path] = gcReference{gcKindVault, v.ID}
+		}
+	}
+
+	report := &GCReport{
+		Referenced: len(referenced),
+		Orphans:    []GCCandidate{},
+		Expired:    []GCCandidate{},
+		Restored:   []string{},
+		Dangling:   []GCDangling{},
+		Grace:      JobDuration(f.gcGrace),
+		DryRun:     dryRun,
+	}
+	var errs []error
+	now := time.Now()
+
+	// 先处理 .gc：宽限期内又被引用的移回原处，过期的删除
+	holding := filepath.Join(f.dirpath, gcDir)
+	restored := make(map[string]bool)
+	err := filepath.WalkDir(holding, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(holding, path)
+		if err != nil {
+			return err
+		}
+		original := filepath.Join(f.dirpath, rel)
+		// 原处已经有同名文件时不移回，等过期后删除
+		if _, ok := referenced[original]; ok && !fileExists(original) {
+			report.Restored = append(report.Restored, original)
+			restored[original] = true
+			if !dryRun {
+				errs = append(errs, renameSynced(path, original))
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if now.Sub(info.ModTime()) < f.gcGrace {
+			return nil
+		}
+		report.Expired = append(report.Expired, GCCandidate{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+		if !dryRun {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+				return nil
+			}
+			report.Removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := now.Add(-minAge)
+	err = filepath.WalkDir(f.dirpath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// 跳过 .gc、分段上传、恢复时的临时目录等隐藏目录
+			if path != f.dirpath && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !isBlobName(d.Name()) {
+			return nil
+		}
+		report.Scanned++
+		if _, ok := referenced[filepath.Clean(path)]; ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		report.Orphans = append(report.Orphans, GCCandidate{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+		report.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range report.Orphans {
+		if dryRun {
+			continue
+		}
+		if f.gcGrace <= 0 {
+			if err := os.Remove(c.Path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+				continue
+			}
+			report.Removed++
+			continue
+		}
+		errs = append(errs, f.moveToGC(c.Path, now))
+	}
+
+	for path, ref := range referenced {
+		if restored[path] {
+			continue
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			continue
+		}
+		report.Dangling = append(report.Dangling, GCDangling{Kind: ref.kind, ID: ref.id, Path: path})
+		if !dryRun && ref.kind != gcKindBlob && ref.kind != gcKindVault {
+			errs = append(errs, f.recordScrub(ref.kind, ref.id, model.ScrubMissing, errors.New("blob missing (found by gc)")))
+		}
+	}
+	sort.Slice(report.Dangling, func(i, j int) bool {
+		a, b := report.Dangling[i], report.Dangling[j]
+		return a.Kind < b.Kind || (a.Kind == b.Kind && a.ID < b.ID)
+	})
+	return report, errors.Join(errs...)
+}
+
+// isBlobName 判断是否是这里写入的密文：*.bin 以及写入中断时留下的临时文件 *.bin.tmp.<纳秒>
+func isBlobName(name string) bool {
+	return filepath.Ext(name) == ".bin" || strings.Contains(name, ".bin.tmp.")
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// moveToGC 把孤儿密文移入 .gc 并以修改时间记录移入的时刻
+func (f *FileService) moveToGC(path string, now time.Time) error {
+	rel, err := filepath.Rel(f.dirpath, path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(f.dirpath, gcDir, rel)
+	if err := renameSynced(path, dst); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, now, now)
+}
+
+// ExportMetadataRows 按 ID 顺序输出每一行的加密列（不解密），供离线解密时使用
+func (f *FileService) ExportMetadataRows(id uint, fn func(sfbcrypt.MetadataRow) error) error {
+	if id != 0 {
+		var file model.File
+		if err := f.db.First(&file, id).Error; err != nil {
+			return err
+		}
+		return fn(MetadataRowOf(&file))
+	}
+	var lastID uint
+	for {
+		var batch []model.File
+		if err := f.db.Where("id > ?", lastID).Order("id asc").Limit(500).Find(&batch).Error; err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for i := range batch {
+			lastID = batch[i].ID
+			if err := fn(MetadataRowOf(&batch[i])); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 软删除用户的头像在 user.purge 任务删除之前不能被当作孤儿回收
+func TestCollectGarbageKeepsDeletedUsersAvatar(t *testing.T) {
+	files := newTestFileService(t)
+	users := NewUserService(files.db)
+	bob := newTestUser(t, users, "bob")
+
+	avatar, _, err := files.SaveUserAvatar(strings.NewReader("png"), "a.png", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.UpdateAvatar(bob.ID, avatar, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.DeleteUserByID(0, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(files.dirpath, "zz", "zz", "zzzzorphan.bin")
+	if err := os.MkdirAll(filepath.Dir(orphan), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(orphan, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := files.CollectGarbage(0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, c := range report.Orphans {
+		if filepath.Clean(c.Path) == filepath.Clean(avatar) {
+			t.Fatalf("avatar of a soft-deleted user reported as orphan: %s", c.Path)
+		}
+		found = found || c.Path == orphan
+	}
+	if !found {
+		t.Fatalf("orphans = %+v, want %s", report.Orphans, orphan)
+	}
+}
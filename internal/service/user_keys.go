@@ -0,0 +1,303 @@
+package service
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUserKeyLocked = errors.New("user key is locked; log in with your password again")
+	// ErrUserKeyReset 表示重置密码会丢掉用户密钥：新密码解不开旧的包装，服务器上又没有恢复私钥
+	ErrUserKeyReset = errors.New("resetting the password discards the user key and makes files encrypted with it unreadable")
+	ErrNoUserKey    = errors.New("user has no user key")
+	ErrNoKeyEscrow  = errors.New("user key has no recovery copy")
+)
+
+// UserKeyRing 保存已经解开的用户密钥。密码登录时解开，有效期与会话相同（jwt.ttl），
+// 刷新 token 或再次登录时延长；进程重启后全部丢失，用户需要重新登录。
+// 用户密钥只在内存中，主密钥和数据库一起泄露也读不到用用户密钥加密的文件。
+type UserKeyRing struct {
+	db *gorm.DB
+	// enabled 为 false 时不再创建新的用户密钥，新上传的内容也用主密钥加密；
+	// 已有的用户密钥照常在登录时解开，原来的文件仍然可以读取
+	enabled    bool
+	recovery   *ecdh.PublicKey
+	recoveryID string
+	lifetime   time.Duration
+
+	mu       sync.Mutex
+	unlocked map[uint]unlockedUserKey
+}
+
+type unlockedUserKey struct {
+	key []byte
+	// expires 为零值表示不过期（jwt.ttl 为 0）
+	expires time.Time
+}
+
+// NewUserKeyRing 创建用户密钥环；recoveryPublicKey 为空表示不托管，lifetime 为 0 表示解开后一直有效
+func NewUserKeyRing(db *gorm.DB, enabled bool, recoveryPublicKey string, lifetime time.Duration) (*UserKeyRing, error) {
+	r := &UserKeyRing{db: db, enabled: enabled, lifetime: lifetime, unlocked: map[uint]unlockedUserKey{}}
+	if recoveryPublicKey != "" {
+		pub, err := sfbcrypt.ParseRecoveryPublicKey(recoveryPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		r.recovery, r.recoveryID = pub, sfbcrypt.RecoveryKeyID(pub)
+	}
+	fmt.Fprintln(config.Progress, "✓ Creating a new user key ring done")
+	return r, nil
+}
+
+// Enabled 报告新上传的内容是否用用户密钥加密
+func (r *UserKeyRing) Enabled() bool {
+	return r != nil && r.enabled
+}
+
+// newKeyColumns 生成新的用户密钥并用 password 包装，返回要写入 users 的列；未启用时返回 nil
+func (r *UserKeyRing) newKeyColumns(password string) ([]byte, map[string]interface{}, error) {
+	if !r.Enabled() {
+		return nil, nil, nil
+	}
+	key, err := sfbcrypt.NewVaultKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	cols, err := r.keyColumns(key, password)
+	return key, cols, err
+}
+
+// keyColumns 用 password 重新包装 key，并在配置了恢复公钥时生成托管副本
+func (r *UserKeyRing) keyColumns(key []byte, password string) (map[string]interface{}, error) {
+	wrapped, err := sfbcrypt.WrapUserKey([]byte(password), key)
+	if err != nil {
+		return nil, err
+	}
+	escrow, err := r.escrow(key)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"user_key": wrapped, "user_key_escrow": escrow}, nil
+}
+
+func (r *UserKeyRing) escrow(key []byte) (string, error) {
+	if r == nil || r.recovery == nil {
+		return "", nil
+	}
+	return sfbcrypt.EscrowUserKey(r.recovery, key)
+}
+
+// unlock 在密码验证通过后调用：解开 u 的用户密钥放入内存，还没有用户密钥时（启用之前注册的用户）
+// 创建一个；托管副本缺失或属于旧的恢复公钥时顺便补上
+func (r *UserKeyRing) unlock(u *model.User, password string) error {
+	if r == nil {
+		return nil
+	}
+	if u.UserKey == "" {
+		key, cols, err := r.newKeyColumns(password)
+		if err != nil || cols == nil {
+			return err
+		}
+		if err := r.db.Model(u).Updates(cols).Error; err != nil {
+			return err
+		}
+		r.put(u.ID, key)
+		return nil
+	}
+	if r.extend(u.ID) {
+		return nil
+	}
+	key, err := sfbcrypt.UnwrapUserKey([]byte(password), u.UserKey)
+	if err != nil {
+		return err
+	}
+	if r.recovery != nil && sfbcrypt.EscrowKeyID(u.UserKeyEscrow) != r.recoveryID {
+		escrow, err := r.escrow(key)
+		if err != nil {
+			return err
+		}
+		if err := r.db.Model(u).Update("user_key_escrow", escrow).Error; err != nil {
+			return err
+		}
+	}
+	r.put(u.ID, key)
+	return nil
+}
+
+// rewrap 在修改密码时用新密码重新包装用户密钥，返回要写入 users 的列；
+// 用户还没有用户密钥且已启用时顺便创建一个
+func (r *UserKeyRing) rewrap(u *model.User, oldPassword, newPassword string) (map[string]interface{}, error) {
+	if u.UserKey == "" {
+		key, cols, err := r.newKeyColumns(newPassword)
+		if cols != nil {
+			r.put(u.ID, key)
+		}
+		return cols, err
+	}
+	key, err := sfbcrypt.UnwrapUserKey([]byte(oldPassword), u.UserKey)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := r.keyColumns(key, newPassword)
+	if err != nil {
+		return nil, err
+	}
+	r.put(u.ID, key)
+	return cols, nil
+}
+
+// recoverKey 用恢复私钥解开 u 的托管副本，并用 newPassword 重新包装，返回要写入 users 的列
+func (r *UserKeyRing) recoverKey(u *model.User, priv *ecdh.PrivateKey, newPassword string) (map[string]interface{}, error) {
+	if u.UserKey == "" {
+		return nil, ErrNoUserKey
+	}
+	if u.UserKeyEscrow == "" {
+		return nil, ErrNoKeyEscrow
+	}
+	key, err := sfbcrypt.RecoverUserKey(priv, u.UserKeyEscrow)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := sfbcrypt.WrapUserKey([]byte(newPassword), key)
+	if err != nil {
+		return nil, err
+	}
+	// 托管副本不变：仍然是同一个用户密钥
+	return map[string]interface{}{"user_key": wrapped}, nil
+}
+
+func (r *UserKeyRing) put(userID uint, key []byte) {
+	if r == nil {
+		return
+	}
+	var expires time.Time
+	if r.lifetime > 0 {
+		expires = time.Now().Add(r.lifetime)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unlocked[userID] = unlockedUserKey{key: key, expires: expires}
+}
+
+// extend 把已解开的密钥的有效期延长到一个完整的会话，密钥不在内存中时返回 false
+func (r *UserKeyRing) extend(userID uint) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.lookup(userID)
+	if !ok {
+		return false
+	}
+	if r.lifetime > 0 {
+		entry.expires = time.Now().Add(r.lifetime)
+	}
+	r.unlocked[userID] = entry
+	return true
+}
+
+// Extend 在刷新 token 时调用；密钥已经不在内存中时返回 ErrUserKeyLocked
+func (r *UserKeyRing) Extend(userID uint) error {
+	if r == nil || r.extend(userID) {
+		return nil
+	}
+	return ErrUserKeyLocked
+}
+
+// Unlocked 报告 u 能否读取自己的文件：没有用户密钥，或者密钥已经解开
+func (r *UserKeyRing) Unlocked(u *model.User) bool {
+	if u.UserKey == "" {
+		return true
+	}
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.lookup(u.ID)
+	return ok
+}
+
+// forget 丢弃内存中的密钥，用于删除用户或丢弃用户密钥之后
+func (r *UserKeyRing) forget(userID uint) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.unlocked, userID)
+}
+
+// wipe 清零并丢弃所有已解开的用户密钥，用于封存；之后每个用户要重新登录
+func (r *UserKeyRing) wipe() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, entry := range r.unlocked {
+		clear(entry.key)
+		delete(r.unlocked, id)
+	}
+}
+
+// lookup 必须持有 r.mu；顺便删除已经过期的密钥
+func (r *UserKeyRing) lookup(userID uint) (unlockedUserKey, bool) {
+	entry, ok := r.unlocked[userID]
+	if !ok {
+		return entry, false
+	}
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(r.unlocked, userID)
+		return entry, false
+	}
+	return entry, true
+}
+
+// fileCipher 返回 uploaderID 的用户文件加解密器；密钥不在内存中时返回 ErrUserKeyLocked
+func (r *UserKeyRing) fileCipher(uploaderID string) (*sfbcrypt.BlobCipher, error) {
+	id, err := strconv.ParseUint(uploaderID, 10, 64)
+	if r == nil || err != nil {
+		return nil, ErrUserKeyLocked
+	}
+	// 在锁内派生内容密钥，wipe 可能随时清零 entry.key
+	r.mu.Lock()
+	entry, ok := r.lookup(uint(id))
+	var key []byte
+	if ok {
+		key = sfbcrypt.UserFileKey(entry.key)
+	}
+	r.mu.Unlock()
+	if !ok {
+		return nil, ErrUserKeyLocked
+	}
+	return sfbcrypt.NewBlobCipher(key)
+}
+
+// uploadCipher 选择 uploaderID 新上传内容的加解密器：启用了用户密钥且该用户已经有用户密钥时
+// 用用户密钥（返回 true），密钥没有解开时返回 ErrUserKeyLocked；其他情况返回 nil，使用主密钥
+func (r *UserKeyRing) uploadCipher(uploaderID string) (*sfbcrypt.BlobCipher, bool, error) {
+	if !r.Enabled() {
+		return nil, false, nil
+	}
+	var u model.User
+	err := r.db.Select("id", "user_key").Where("id = ?", uploaderID).Take(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if u.UserKey == "" {
+		return nil, false, nil
+	}
+	c, err := r.fileCipher(uploaderID)
+	return c, c != nil, err
+}
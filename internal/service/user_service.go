@@ -1,29 +1,74 @@
 package service
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"github.com/Kaikai20040827/graduation/internal/config"
 	"github.com/Kaikai20040827/graduation/internal/model"
 	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+var (
+	ErrUserDisabled  = errors.New("user is disabled")
+	ErrInvalidRole   = errors.New("invalid role")
+	ErrAdminSelfLock = errors.New("admins cannot disable, demote or delete themselves")
+)
+
+// 邮箱和用户名按不区分大小写比较。MySQL 的默认排序规则本来就是这样，
+// PostgreSQL 和 SQLite 区分大小写，这里显式 LOWER 使三种数据库的行为一致
+const (
+	emailEquals    = "LOWER(email) = LOWER(?)"
+	usernameEquals = "LOWER(username) = LOWER(?)"
+)
+
 type UserService struct {
-	db *gorm.DB
+	db    *gorm.DB
+	keys  *UserKeyRing
+	hooks []UserHooks
+}
+
+// UserHooks 在用户被删除之后调用，用于清理该用户的数据；回调不应阻塞
+type UserHooks struct {
+	Deleted func(u *model.User)
+}
+
+// AddHooks 注册用户回调，应在开始处理请求之前调用
+func (s *UserService) AddHooks(h UserHooks) {
+	s.hooks = append(s.hooks, h)
 }
 
 func NewUserService(db *gorm.DB) *UserService {
-	fmt.Println("✓ Creating a new user service done")
+	fmt.Fprintln(config.Progress, "✓ Creating a new user service done")
 	return &UserService{db: db}
 
 }
 
+// SetUserKeys 设置用户密钥环，密码登录时解开用户密钥，修改密码时重新包装
+func (s *UserService) SetUserKeys(keys *UserKeyRing) {
+	s.keys = keys
+}
+
+// UserKeyUnlocked 供鉴权中间件使用：u 有用户密钥但不在内存中（会话过期或服务重启）时返回 false
+func (s *UserService) UserKeyUnlocked(u *model.User) bool {
+	return s.keys.Unlocked(u)
+}
+
+// ExtendUserKey 在刷新 token 时把内存中用户密钥的有效期延长到新的会话
+func (s *UserService) ExtendUserKey(id uint) error {
+	return s.keys.Extend(id)
+}
+
 func (s *UserService) CreateUser(username string, email string, password string) (*model.User, error) {
 	//检查邮箱是否注册
 	var count int64
-	s.db.Model(&model.User{}).Where("email = ?", email).Count(&count)
+	s.db.Model(&model.User{}).Where(emailEquals, email).Count(&count)
 
 	//邮箱已注册
 	if count > 0 {
@@ -41,13 +86,25 @@ func (s *UserService) CreateUser(username string, email string, password string)
 		Email:     email,
 		Username:  username,
 		Password:  hashedPwd,
+		Role:      model.RoleUser,
 		CreatedAt: time.Now(),
 	}
+	key, cols, err := s.keys.newKeyColumns(password)
+	if err != nil {
+		return nil, err
+	}
+	if cols != nil {
+		user.UserKey = cols["user_key"].(string)
+		user.UserKeyEscrow = cols["user_key_escrow"].(string)
+	}
 
 	//数据库创建用户
 	if err := s.db.Create(user).Error; err != nil {
 		return nil, err
 	}
+	if key != nil {
+		s.keys.put(user.ID, key)
+	}
 
 	// 将返回给调用方的用户对象中的密码字段清空，
 	// 以避免将密码（即使是哈希后的密码）暴露给外部调用者
@@ -57,24 +114,40 @@ func (s *UserService) CreateUser(username string, email string, password string)
 }
 
 func (s *UserService) DeleteUser(username string, inputPassword string) error {
-	var count int64
-	s.db.Model(&model.User{}).Where("Username = ?", username).Count(&count)
-
-	if count == 0 {
+	var user model.User
+	if err := s.db.Where(usernameEquals, username).First(&user).Error; err != nil {
 		return errors.New("user does not exist")
 	}
-
-	var user *model.User
-	s.db.Model(&model.User{}).Where("Username = ?", username).Find(&user)
-	hashedPassword, _ := pkg.HashPassword(inputPassword)
-	if user.Password != hashedPassword {
+	if err := pkg.CheckPassword(user.Password, inputPassword); err != nil {
 		return errors.New("incorrect password")
 	}
+	return s.deleteUser(&user)
+}
 
-	if err := s.db.Delete(user); err != nil {
-		return errors.New("failed to delete")
+// DeleteUserByID 由管理员删除用户；actorID 为执行操作的管理员，不能删除自己
+func (s *UserService) DeleteUserByID(actorID uint, id uint) error {
+	if actorID == id {
+		return ErrAdminSelfLock
 	}
+	var user model.User
+	if err := s.db.First(&user, id).Error; err != nil {
+		return err
+	}
+	return s.deleteUser(&user)
+}
 
+// deleteUser 软删除用户，文件等数据由 Deleted 回调交给后台任务清理
+func (s *UserService) deleteUser(user *model.User) error {
+	if err := s.db.Delete(user).Error; err != nil {
+		return errors.New("failed to delete")
+	}
+	user.Password = ""
+	s.keys.forget(user.ID)
+	for _, h := range s.hooks {
+		if h.Deleted != nil {
+			h.Deleted(user)
+		}
+	}
 	return nil
 }
 
@@ -93,8 +166,18 @@ func (s *UserService) ChangePassword(userID uint, oldPassword string, newPasswor
 	if err != nil {
 		return err
 	}
+	// 用户密钥用新密码重新包装，文件不需要重新加密
+	cols, err := s.keys.rewrap(&user, oldPassword, newPassword)
+	if err != nil {
+		return fmt.Errorf("rewrap user key: %w", err)
+	}
+	if cols != nil {
+		user.UserKey = cols["user_key"].(string)
+		user.UserKeyEscrow = cols["user_key_escrow"].(string)
+	}
 
 	user.Password = newHashedPassword
+	user.MustResetPassword = false
 	user.UpdatedAt = time.Now()
 
 	return s.db.Save(&user).Error
@@ -102,14 +185,14 @@ func (s *UserService) ChangePassword(userID uint, oldPassword string, newPasswor
 
 func (s *UserService) ChangeUsername(email string, newUsername string) error {
 	var count int64
-	s.db.Model(&model.User{}).Where("Username = ?", newUsername).Count(&count)
+	s.db.Model(&model.User{}).Where(usernameEquals, newUsername).Count(&count)
 
 	if count == 0 {
 		return errors.New("user does not exist")
 	}
 
 	var user *model.User
-	s.db.Model(&model.User{}).Where("email = ?", email).Find(&user)
+	s.db.Model(&model.User{}).Where(emailEquals, email).Find(&user)
 
 	user.Username = newUsername
 	user.UpdatedAt = time.Now()
@@ -119,16 +202,35 @@ func (s *UserService) ChangeUsername(email string, newUsername string) error {
 
 func (s *UserService) Authenticate(email, password string) (*model.User, error) {
 	var u model.User
-	if err := s.db.Where("email = ?", email).First(&u).Error; err != nil {
+	if err := s.db.Where(emailEquals, email).First(&u).Error; err != nil {
 		return nil, err
 	}
 	if err := pkg.CheckPassword(u.Password, password); err != nil {
 		return nil, errors.New("invalid credentials")
 	}
+	if u.Disabled {
+		return nil, ErrUserDisabled
+	}
+	// 密码只在这里出现，顺便解开用户密钥；REST、WebDAV 和 SFTP 的密码登录都经过这里
+	if err := s.keys.unlock(&u, password); err != nil {
+		return nil, fmt.Errorf("unlock user key: %w", err)
+	}
 	u.Password = ""
 	return &u, nil
 }
 
+// CheckActive 供鉴权中间件使用：用户必须存在且未被禁用
+func (s *UserService) CheckActive(id uint) (*model.User, error) {
+	u, err := s.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, ErrUserDisabled
+	}
+	return u, nil
+}
+
 func (s *UserService) GetByID(id uint) (*model.User, error) {
 	var u model.User
 	if err := s.db.First(&u, id).Error; err != nil {
@@ -141,7 +243,16 @@ func (s *UserService) GetByID(id uint) (*model.User, error) {
 
 func (s *UserService) GetByUsername(username string) (*model.User, error) {
 	var u model.User
-	if err := s.db.Where("username = ?", username).First(&u).Error; err != nil {
+	if err := s.db.Where(usernameEquals, username).First(&u).Error; err != nil {
+		return nil, err
+	}
+	u.Password = ""
+	return &u, nil
+}
+
+func (s *UserService) GetByEmail(email string) (*model.User, error) {
+	var u model.User
+	if err := s.db.Where(emailEquals, email).First(&u).Error; err != nil {
 		return nil, err
 	}
 	u.Password = ""
@@ -156,7 +267,7 @@ func (s *UserService) UpdateProfile(id uint, username string, email string) (*mo
 	u.Username = username
 	if email != "" && email != u.Email {
 		var existing model.User
-		if err := s.db.Where("email = ?", email).First(&existing).Error; err == nil {
+		if err := s.db.Where(emailEquals+" AND id <> ?", email, u.ID).First(&existing).Error; err == nil {
 			return nil, errors.New("email already in use")
 		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, err
@@ -186,3 +297,156 @@ func (s *UserService) UpdateAvatar(id uint, avatarPath string, avatarMime string
 	u.Password = ""
 	return &u, nil
 }
+
+// ListUsers 分页列出用户，query 非空时按邮箱或用户名模糊搜索
+func (s *UserService) ListUsers(page, size int, query string) (total int64, users []model.User, err error) {
+	tx := s.db.Model(&model.User{})
+	if query = strings.TrimSpace(query); query != "" {
+		like := "%" + strings.ToLower(query) + "%"
+		tx = tx.Where("LOWER(email) LIKE ? OR LOWER(username) LIKE ?", like, like)
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return
+	}
+	offset := (page - 1) * size
+	if err = tx.Order("id asc").Limit(size).Offset(offset).Find(&users).Error; err != nil {
+		return
+	}
+	for i := range users {
+		users[i].Password = ""
+	}
+	return
+}
+
+// SetDisabled 禁用或启用用户；actorID 为执行操作的管理员
+func (s *UserService) SetDisabled(actorID uint, id uint, disabled bool) (*model.User, error) {
+	if disabled && actorID == id {
+		return nil, ErrAdminSelfLock
+	}
+	var u model.User
+	if err := s.db.First(&u, id).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&u).Update("disabled", disabled).Error; err != nil {
+		return nil, err
+	}
+	u.Disabled = disabled
+	u.Password = ""
+	return &u, nil
+}
+
+// SetRole 修改用户角色
+func (s *UserService) SetRole(actorID uint, id uint, role string) (*model.User, error) {
+	if role != model.RoleUser && role != model.RoleAdmin {
+		return nil, ErrInvalidRole
+	}
+	if actorID == id && role != model.RoleAdmin {
+		return nil, ErrAdminSelfLock
+	}
+	var u model.User
+	if err := s.db.First(&u, id).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&u).Update("role", role).Error; err != nil {
+		return nil, err
+	}
+	u.Role = role
+	u.Password = ""
+	return &u, nil
+}
+
+// ResetPassword 为用户生成一个临时密码，并要求其下次登录后立即修改。
+// 临时密码只返回这一次，不会被保存为明文。
+// 用户有用户密钥时新密码解不开它：discardKey 为 false 时返回 ErrUserKeyReset，
+// 为 true 时丢弃用户密钥，用它加密的文件再也无法读取（有托管副本时应改用 RecoverPassword）。
+func (s *UserService) ResetPassword(id uint, discardKey bool) (string, error) {
+	var u model.User
+	if err := s.db.First(&u, id).Error; err != nil {
+		return "", err
+	}
+	if u.UserKey != "" && !discardKey {
+		return "", ErrUserKeyReset
+	}
+	tempPassword, err := randomPassword()
+	if err != nil {
+		return "", err
+	}
+	hashedPwd, err := pkg.HashPassword(tempPassword)
+	if err != nil {
+		return "", err
+	}
+	if err := s.db.Model(&u).Updates(map[string]interface{}{
+		"password":            hashedPwd,
+		"must_reset_password": true,
+		"user_key":            "",
+		"user_key_escrow":     "",
+	}).Error; err != nil {
+		return "", err
+	}
+	s.keys.forget(id)
+	return tempPassword, nil
+}
+
+// RecoverPassword 与 ResetPassword 相同，但先用恢复私钥解开用户密钥的托管副本，
+// 再用临时密码重新包装，用户的文件仍然可以读取。只由 sfbctl 调用，私钥不经过服务器
+func (s *UserService) RecoverPassword(id uint, recoveryPrivateKey string) (string, error) {
+	priv, err := sfbcrypt.ParseRecoveryPrivateKey(recoveryPrivateKey)
+	if err != nil {
+		return "", err
+	}
+	var u model.User
+	if err := s.db.First(&u, id).Error; err != nil {
+		return "", err
+	}
+	tempPassword, err := randomPassword()
+	if err != nil {
+		return "", err
+	}
+	cols, err := s.keys.recoverKey(&u, priv, tempPassword)
+	if err != nil {
+		return "", err
+	}
+	hashedPwd, err := pkg.HashPassword(tempPassword)
+	if err != nil {
+		return "", err
+	}
+	cols["password"] = hashedPwd
+	cols["must_reset_password"] = true
+	if err := s.db.Model(&u).Updates(cols).Error; err != nil {
+		return "", err
+	}
+	return tempPassword, nil
+}
+
+// EnsureAdmin 引导第一个管理员：邮箱不存在时新建管理员账号；已存在则原样返回，
+// 不改角色、密码和禁用状态，每次启动都执行也不会把降级或禁用的账号恢复回来
+func (s *UserService) EnsureAdmin(email string, username string, password string) (*model.User, error) {
+	var u model.User
+	err := s.db.Where(emailEquals, email).First(&u).Error
+	if err == nil {
+		u.Password = ""
+		return &u, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if len(password) < 6 {
+		return nil, errors.New("admin password must be at least 6 characters")
+	}
+	if username == "" {
+		username = "admin"
+	}
+	created, err := s.CreateUser(username, email, password)
+	if err != nil {
+		return nil, err
+	}
+	return s.SetRole(0, created.ID, model.RoleAdmin)
+}
+
+func randomPassword() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
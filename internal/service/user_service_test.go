@@ -0,0 +1,110 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+)
+
+// 邮箱和用户名的查询在 SQLite 上也不区分大小写，与 MySQL 一致
+func TestUserLookupCaseInsensitive(t *testing.T) {
+	users := NewUserService(newTestDB(t))
+	alice := newTestUser(t, users, "alice")
+
+	if _, err := users.CreateUser("alice2", "ALICE@example.com", "Passw0rd!x"); err == nil {
+		t.Fatal("CreateUser with the same email in upper case succeeded")
+	}
+	if u, err := users.GetByEmail("Alice@Example.com"); err != nil || u.ID != alice.ID {
+		t.Fatalf("GetByEmail = %+v, %v", u, err)
+	}
+	if u, err := users.GetByUsername("ALICE"); err != nil || u.ID != alice.ID || u.Password != "" {
+		t.Fatalf("GetByUsername = %+v, %v", u, err)
+	}
+	if u, err := users.Authenticate("ALICE@example.com", "Passw0rd!alice"); err != nil || u.ID != alice.ID {
+		t.Fatalf("Authenticate = %+v, %v", u, err)
+	}
+	if _, err := users.Authenticate("alice@example.com", "wrong"); err == nil {
+		t.Fatal("Authenticate with a wrong password succeeded")
+	}
+
+	newTestUser(t, users, "bob")
+	if _, err := users.UpdateProfile(alice.ID, "alice", "BOB@example.com"); err == nil {
+		t.Fatal("UpdateProfile to another user's email in upper case succeeded")
+	}
+	total, list, err := users.ListUsers(1, 10, "BO")
+	if err != nil || total != 1 || len(list) != 1 || list[0].Username != "bob" {
+		t.Fatalf("ListUsers(BO) = %d, %+v, %v", total, list, err)
+	}
+}
+
+func TestUserAdminOperations(t *testing.T) {
+	users := NewUserService(newTestDB(t))
+	admin, err := users.EnsureAdmin("admin@example.com", "admin", "Passw0rd!admin")
+	if err != nil || admin.Role != model.RoleAdmin {
+		t.Fatalf("EnsureAdmin = %+v, %v", admin, err)
+	}
+	alice := newTestUser(t, users, "alice")
+
+	if _, err := users.SetDisabled(admin.ID, admin.ID, true); !errors.Is(err, ErrAdminSelfLock) {
+		t.Fatalf("admin disabling themselves = %v, want ErrAdminSelfLock", err)
+	}
+	if _, err := users.SetDisabled(admin.ID, alice.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Authenticate("alice@example.com", "Passw0rd!alice"); !errors.Is(err, ErrUserDisabled) {
+		t.Fatalf("Authenticate a disabled user = %v, want ErrUserDisabled", err)
+	}
+	if _, err := users.CheckActive(alice.ID); !errors.Is(err, ErrUserDisabled) {
+		t.Fatalf("CheckActive a disabled user = %v, want ErrUserDisabled", err)
+	}
+
+	if _, err := users.SetRole(admin.ID, alice.ID, "root"); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("SetRole(root) = %v, want ErrInvalidRole", err)
+	}
+	if u, err := users.SetRole(admin.ID, alice.ID, model.RoleAdmin); err != nil || u.Role != model.RoleAdmin {
+		t.Fatalf("SetRole(admin) = %+v, %v", u, err)
+	}
+
+	if err := users.DeleteUserByID(admin.ID, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.GetByID(alice.ID); err == nil {
+		t.Fatal("GetByID after delete succeeded")
+	}
+}
+
+// EnsureAdmin 每次启动都会执行：已有的账号不能被重新提升或启用
+func TestEnsureAdminLeavesExistingUser(t *testing.T) {
+	users := NewUserService(newTestDB(t))
+	admin, err := users.EnsureAdmin("admin@example.com", "", "Passw0rd!admin")
+	if err != nil || admin.Role != model.RoleAdmin || admin.Username != "admin" {
+		t.Fatalf("EnsureAdmin = %+v, %v", admin, err)
+	}
+	if _, err := users.EnsureAdmin("root@example.com", "root", "short"); err == nil {
+		t.Fatal("EnsureAdmin with a short password succeeded")
+	}
+
+	alice := newTestUser(t, users, "alice")
+	if u, err := users.EnsureAdmin("alice@example.com", "alice", "Passw0rd!other"); err != nil || u.ID != alice.ID || u.Role != model.RoleUser {
+		t.Fatalf("EnsureAdmin on an existing user = %+v, %v", u, err)
+	}
+
+	// 被降级、禁用的管理员重启后保持原样，密码也不变
+	if _, err := users.SetRole(alice.ID, admin.ID, model.RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.SetDisabled(alice.ID, admin.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.EnsureAdmin("admin@example.com", "admin", "Passw0rd!changed")
+	if err != nil || u.ID != admin.ID || u.Role != model.RoleUser || !u.Disabled || u.Password != "" {
+		t.Fatalf("EnsureAdmin on a demoted admin = %+v, %v", u, err)
+	}
+	if _, err := users.SetDisabled(alice.ID, admin.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Authenticate("admin@example.com", "Passw0rd!admin"); err != nil {
+		t.Fatalf("password changed by EnsureAdmin: %v", err)
+	}
+}
@@ -0,0 +1,361 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/sfbcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrVaultNotFound     = errors.New("vault not initialized")
+	ErrVaultExists       = errors.New("vault already initialized")
+	ErrVaultVersion      = errors.New("vault key was changed by another client")
+	ErrVaultKeyMaterial  = errors.New("invalid vault key material")
+	ErrVaultFileNotFound = errors.New("vault file not found")
+	ErrVaultFileMeta     = errors.New("invalid encrypted vault file name or key")
+	ErrVaultChunkOrder   = errors.New("unexpected chunk index")
+	ErrVaultComplete     = errors.New("vault file upload already complete")
+	ErrVaultIncomplete   = errors.New("vault file upload is not complete")
+)
+
+const (
+	// 上传中的保险库文件放在以 "." 开头的目录下，CollectGarbage 不会把它们当成孤儿
+	vaultUploadDir      = ".vault-uploads"
+	vaultUploadLifetime = 24 * time.Hour
+	vaultMaxEncName     = 2048
+	vaultMaxEncKey      = 256
+)
+
+// VaultKeyMaterial 是客户端保存在服务器上的密钥材料，服务器只校验格式
+type VaultKeyMaterial struct {
+	KDF        sfbcrypt.VaultKDF `json:"kdf"`
+	WrappedKey string            `json:"wrapped_key"`
+	Version    uint              `json:"version"`
+}
+
+func vaultKeyMaterial(k *model.VaultKey) *VaultKeyMaterial {
+	return &VaultKeyMaterial{
+		KDF: sfbcrypt.VaultKDF{
+			Alg:       k.KDF,
+			Time:      k.KDFTime,
+			MemoryKiB: k.KDFMemory,
+			Threads:   k.KDFThreads,
+			Salt:      k.Salt,
+		},
+		WrappedKey: k.WrappedKey,
+		Version:    k.Version,
+	}
+}
+
+func (f *FileService) GetVaultKey(userID uint) (*VaultKeyMaterial, error) {
+	var k model.VaultKey
+	if err := f.db.Where("user_id = ?", userID).First(&k).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrVaultNotFound
+		}
+		return nil, err
+	}
+	return vaultKeyMaterial(&k), nil
+}
+
+// PutVaultKey 创建（Version 为 0）或替换用户的密钥材料。替换时 Version 必须等于当前版本，
+// 否则返回 ErrVaultVersion，避免两个客户端同时修改口令时一方的包装被覆盖。
+func (f *FileService) PutVaultKey(userID uint, m *VaultKeyMaterial) (*VaultKeyMaterial, error) {
+	if m.KDF.Validate() != nil || len(m.WrappedKey) > vaultMaxEncKey ||
+		!sfbcrypt.ValidWrapped(m.WrappedKey, sfbcrypt.VaultKeySize) {
+		return nil, ErrVaultKeyMaterial
+	}
+	k := model.VaultKey{
+		UserID:     userID,
+		KDF:        m.KDF.Alg,
+		KDFTime:    m.KDF.Time,
+		KDFMemory:  m.KDF.MemoryKiB,
+		KDFThreads: m.KDF.Threads,
+		Salt:       m.KDF.Salt,
+		WrappedKey: m.WrappedKey,
+		Version:    m.Version + 1,
+	}
+	if m.Version == 0 {
+		var n int64
+		if err := f.db.Model(&model.VaultKey{}).Where("user_id = ?", userID).Count(&n).Error; err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, ErrVaultExists
+		}
+		// 并发创建时由唯一索引拒绝后一个
+		if err := f.db.Create(&k).Error; err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrVaultExists, err)
+		}
+		return vaultKeyMaterial(&k), nil
+	}
+	res := f.db.Model(&model.VaultKey{}).Where("user_id = ? AND version = ?", userID, m.Version).Updates(map[string]interface{}{
+		"kdf":         k.KDF,
+		"kdf_time":    k.KDFTime,
+		"kdf_memory":  k.KDFMemory,
+		"kdf_threads": k.KDFThreads,
+		"salt":        k.Salt,
+		"wrapped_key": k.WrappedKey,
+		"version":     k.Version,
+	})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		if _, err := f.GetVaultKey(userID); err != nil {
+			return nil, err
+		}
+		return nil, ErrVaultVersion
+	}
+	return vaultKeyMaterial(&k), nil
+}
+
+// CreateVaultFile 登记一个新的保险库文件，之后用 AppendVaultChunk 按顺序上传内容
+func (f *FileService) CreateVaultFile(userID uint, encName, encKey string) (*model.VaultFile, error) {
+	if len(encName) > vaultMaxEncName || !sfbcrypt.ValidWrapped(encName, 0) ||
+		len(encKey) > vaultMaxEncKey || !sfbcrypt.ValidWrapped(encKey, sfbcrypt.VaultKeySize) {
+		return nil, ErrVaultFileMeta
+	}
+	if _, err := f.GetVaultKey(userID); err != nil {
+		return nil, err
+	}
+	_, _ = f.ExpireVaultUploads()
+
+	name, err := randomStorageName()
+	if err != nil {
+		return nil, err
+	}
+	file := &model.VaultFile{
+		UserID:  userID,
+		EncName: encName,
+		EncKey:  encKey,
+		Name:    name,
+		Status:  model.VaultUploading,
+	}
+	if err := f.db.Create(file).Error; err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// ListVaultFiles 列出用户的保险库文件，包括还在上传中的
+func (f *FileService) ListVaultFiles(userID uint) ([]model.VaultFile, error) {
+	var files []model.VaultFile
+	if err := f.db.Where("user_id = ?", userID).Order("created_at desc").Find(&files).Error; err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (f *FileService) GetVaultFile(userID, id uint) (*model.VaultFile, error) {
+	var file model.VaultFile
+	if err := f.db.Where("id = ? AND user_id = ?", id, userID).First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrVaultFileNotFound
+		}
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (f *FileService) vaultUploadPath(name string) string {
+	return filepath.Join(f.dirpath, vaultUploadDir, name)
+}
+
+// AppendVaultChunk 追加第 index 块。index 必须等于已上传的块数，重试同一块时先截断到记录的大小，
+// 所以中断的写入不会留下半块。收到最后一块（flag 为 1）时把文件移到分级目录并标记为完成。
+func (f *FileService) AppendVaultChunk(userID, id uint, index uint32, chunk []byte) (*model.VaultFile, error) {
+	final, err := sfbcrypt.VaultChunkFinal(chunk)
+	if err != nil {
+		return nil, err
+	}
+	f.vaultMu.Lock()
+	defer f.vaultMu.Unlock()
+
+	file, err := f.GetVaultFile(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if file.Status != model.VaultUploading {
+		return nil, ErrVaultComplete
+	}
+	if index != file.Chunks {
+		return nil, fmt.Errorf("%w: expected chunk %d", ErrVaultChunkOrder, file.Chunks)
+	}
+	size := file.Size
+	if size == 0 {
+		size = int64(len(sfbcrypt.VaultMagic))
+	}
+	size += 4 + int64(len(chunk))
+	if f.userQuota > 0 {
+		_, used, err := f.UserStorageUsage(userID)
+		if err != nil {
+			return nil, err
+		}
+		if used-file.Size+size > f.userQuota {
+			return nil, ErrQuotaExceeded
+		}
+	}
+
+	path := f.vaultUploadPath(file.Name)
+	// 上次在移到分级目录之后、更新记录之前失败，先移回来
+	if !fileExists(path) && file.Size > 0 && fileExists(f.shardedPath(file.Name)) {
+		if err := renameSynced(f.shardedPath(file.Name), path); err != nil {
+			return nil, err
+		}
+	}
+	if err := appendVaultFrame(path, file.Size, chunk); err != nil {
+		return nil, err
+	}
+	updates := map[string]interface{}{"chunks": index + 1, "size": size, "updated_at": time.Now()}
+	if final {
+		if err := renameSynced(path, f.shardedPath(file.Name)); err != nil {
+			return nil, err
+		}
+		updates["status"] = model.VaultComplete
+	}
+	res := f.db.Model(&model.VaultFile{}).Where("id = ? AND chunks = ? AND status = ?", id, index, model.VaultUploading).Updates(updates)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, fmt.Errorf("%w: upload changed concurrently", ErrVaultChunkOrder)
+	}
+	return f.GetVaultFile(userID, id)
+}
+
+// appendVaultFrame 把 path 截断到 size（去掉上次失败时写了一半的块）后追加一块并 fsync
+func appendVaultFrame(path string, size int64, chunk []byte) error {
+	dir := filepath.Dir(path)
+	if err := mkdirAllSynced(dir); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		info, err := out.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() < size {
+			return fmt.Errorf("vault upload %s is shorter than recorded (%d < %d)", path, info.Size(), size)
+		}
+		if err := out.Truncate(size); err != nil {
+			return err
+		}
+		if _, err := out.Seek(size, 0); err != nil {
+			return err
+		}
+		if size == 0 {
+			if _, err := out.Write([]byte(sfbcrypt.VaultMagic)); err != nil {
+				return err
+			}
+		}
+		if err := sfbcrypt.AppendVaultFrame(out, chunk); err != nil {
+			return err
+		}
+		return out.Sync()
+	}()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size == 0 {
+		err = syncDir(dir)
+	}
+	return err
+}
+
+// OpenVaultContent 打开已完成的保险库文件，调用方负责关闭
+func (f *FileService) OpenVaultContent(userID, id uint) (*model.VaultFile, *os.File, error) {
+	file, err := f.GetVaultFile(userID, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file.Status != model.VaultComplete {
+		return nil, nil, ErrVaultIncomplete
+	}
+	content, err := os.Open(f.shardedPath(file.Name))
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, content, nil
+}
+
+// DeleteVaultFile 先删除记录再删除内容；删除内容失败时留下的孤儿由 storage gc 回收
+func (f *FileService) DeleteVaultFile(userID, id uint) error {
+	f.vaultMu.Lock()
+	defer f.vaultMu.Unlock()
+
+	file, err := f.GetVaultFile(userID, id)
+	if err != nil {
+		return err
+	}
+	if err := f.db.Delete(&model.VaultFile{}, file.ID).Error; err != nil {
+		return err
+	}
+	return f.removeVaultContent(file)
+}
+
+func (f *FileService) removeVaultContent(file *model.VaultFile) error {
+	return errors.Join(f.RemoveStoredFile(f.shardedPath(file.Name)), f.RemoveStoredFile(f.vaultUploadPath(file.Name)))
+}
+
+// ExpireVaultUploads 删除超过 vaultUploadLifetime 没有新块的上传，每次最多 100 个，返回删除的数量
+func (f *FileService) ExpireVaultUploads() (int, error) {
+	f.vaultMu.Lock()
+	defer f.vaultMu.Unlock()
+
+	cutoff := time.Now().Add(-vaultUploadLifetime)
+	var stale []model.VaultFile
+	if err := f.db.Where("status = ? AND updated_at < ?", model.VaultUploading, cutoff).Limit(100).Find(&stale).Error; err != nil {
+		return 0, err
+	}
+	var errs []error
+	expired := 0
+	for i := range stale {
+		res := f.db.Where("id = ? AND status = ? AND updated_at < ?", stale[i].ID, model.VaultUploading, cutoff).Delete(&model.VaultFile{})
+		if res.Error != nil {
+			errs = append(errs, res.Error)
+			continue
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+		errs = append(errs, f.removeVaultContent(&stale[i]))
+		expired++
+	}
+	return expired, errors.Join(errs...)
+}
+
+// PurgeVault 删除用户的全部保险库文件和密钥材料
+func (f *FileService) PurgeVault(userID uint) error {
+	files, err := f.ListVaultFiles(userID)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		if err := f.DeleteVaultFile(userID, files[i].ID); err != nil && !errors.Is(err, ErrVaultFileNotFound) {
+			return err
+		}
+	}
+	return f.db.Where("user_id = ?", userID).Delete(&model.VaultKey{}).Error
+}
+
+// vaultUsage 统计用户保险库文件的数量和密文总大小（包括上传中的）
+func (f *FileService) vaultUsage(userID uint) (count int64, bytes int64, err error) {
+	var row struct {
+		Count int64
+		Bytes int64
+	}
+	err = f.db.Model(&model.VaultFile{}).Where("user_id = ?", userID).
+		Select("COUNT(*) AS count, COALESCE(SUM(size), 0) AS bytes").Scan(&row).Error
+	return row.Count, row.Bytes, err
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+)
+
+// 虚拟目录：WebDAV 和 SFTP 都把用户自己上传的文件显示为一个平铺的目录
+
+type dirEntry struct {
+	name string
+	file *model.File
+}
+
+// ownerDir 返回用户的文件，按 ID 升序分配显示名，保证重名时编号稳定
+func (f *FileService) ownerDir(uploaderID uint) ([]dirEntry, error) {
+	files, err := f.ListFilesByOwner(uploaderID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+	used := make(map[string]bool, len(files))
+	entries := make([]dirEntry, 0, len(files))
+	for i := range files {
+		// owner_tag 只是索引，按解密出的上传者再确认一次，避免用别人的用户密钥解密
+		if !f.CanModify(&files[i], uploaderID, false) {
+			continue
+		}
+		entries = append(entries, dirEntry{name: uniqueEntryName(&files[i], used), file: &files[i]})
+	}
+	return entries, nil
+}
+
+// findEntry 按显示名查找，不区分大小写（与 uniqueEntryName 的去重规则一致）
+func findEntry(entries []dirEntry, name string) (dirEntry, bool) {
+	for _, entry := range entries {
+		if strings.EqualFold(entry.name, name) {
+			return entry, true
+		}
+	}
+	return dirEntry{}, false
+}
+
+// validEntryName 拒绝空名、路径和以 "." 开头的名字。
+// uniqueEntryName 会去掉开头的点，这样的文件上传后无法再用原名找到。
+func validEntryName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\\") && !strings.HasPrefix(name, ".")
+}
+
+// rangeStream 从指定位置开始按顺序解密文件；位置不连续时重新打开，
+// DecryptRange 只读取之前各块的长度字段，所以重新定位的代价很小
+type rangeStream struct {
+	files *FileService
+	file  *model.File
+	r     *io.PipeReader
+	pos   int64
+}
+
+func (s *rangeStream) read(p []byte, off int64) (int, error) {
+	if off >= s.file.Size {
+		return 0, io.EOF
+	}
+	if s.r == nil || s.pos != off {
+		s.close()
+		pr, pw := io.Pipe()
+		files, file := s.files, s.file
+		go func() {
+			pw.CloseWithError(files.DecryptFileRange(pw, file, off, file.Size-off))
+		}()
+		s.r, s.pos = pr, off
+	}
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *rangeStream) close() {
+	if s.r != nil {
+		_ = s.r.CloseWithError(io.ErrClosedPipe)
+		s.r = nil
+	}
+}
+
+// uploadStream 把写入的内容通过管道交给 UploadFile / UpdateFile 边收边加密，
+// 明文不会落盘；finish 传入非 nil 的 abort 时丢弃这次上传
+type uploadStream struct {
+	files    *FileService
+	existing *model.File
+	pw       *io.PipeWriter
+	done     chan struct{}
+	result   *model.File
+	err      error
+}
+
+// startUpload 开始上传新文件；existing 非 nil 时替换它的内容
+func (f *FileService) startUpload(existing *model.File, filename string, uploaderID uint) *uploadStream {
+	pr, pw := io.Pipe()
+	u := &uploadStream{files: f, existing: existing, pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(u.done)
+		var file *model.File
+		var err error
+		if existing != nil {
+			file, err = f.UpdateFile(existing.ID, pr, nil, nil)
+		} else {
+			file, err = f.UploadFile(pr, filename, uploaderID, "")
+		}
+		if err == nil && file.ScanStatus == model.ScanInfected {
+			err = ErrFileQuarantined
+		}
+		// 上传失败时让后续的 Write 立即返回错误
+		_ = pr.CloseWithError(err)
+		u.result, u.err = file, err
+	}()
+	return u
+}
+
+func (u *uploadStream) Write(p []byte) (int, error) {
+	return u.pw.Write(p)
+}
+
+// finish 结束上传并等待保存完成；返回的文件从数据库重新读取，updated_at（ETag）与之后的读取一致
+func (u *uploadStream) finish(abort error) (*model.File, error) {
+	if abort != nil {
+		_ = u.pw.CloseWithError(abort)
+	} else {
+		_ = u.pw.Close()
+	}
+	<-u.done
+	if u.err == nil && abort != nil {
+		u.err = abort
+	}
+	if u.err != nil {
+		if u.result == nil {
+			u.result = u.existing
+		}
+		return u.result, u.err
+	}
+	if file, err := u.files.GetFileByID(u.result.ID); err == nil {
+		u.result = file
+	}
+	return u.result, nil
+}
+
+var errUploadAborted = errors.New("upload aborted")
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+)
+
+// owner_tag 被改成别人的索引时，WebDAV 和 SFTP 的目录里也不会出现不属于自己的文件
+func TestOwnerDirChecksUploader(t *testing.T) {
+	files := newTestFileService(t)
+	users := NewUserService(files.db)
+	alice := newTestUser(t, users, "alice")
+	bob := newTestUser(t, users, "bob")
+
+	file, err := files.UploadFile(strings.NewReader("bob's"), "b.txt", bob.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := files.db.Model(&model.File{}).Where("id = ?", file.ID).Update("owner_tag", files.ownerTag(strconv.FormatUint(uint64(alice.ID), 10))).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := files.ownerDir(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("alice's directory lists %d entries, want none", len(entries))
+	}
+}
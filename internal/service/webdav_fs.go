@@ -0,0 +1,366 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"golang.org/x/net/webdav"
+)
+
+// DavRequest 描述一次 WebDAV 请求的调用者，由 handler 通过 WithDavRequest 放进 context
+type DavRequest struct {
+	UserID uint
+	// BodyErr 返回读取请求体时遇到的错误；PUT 中途断开时用它丢弃不完整的上传
+	BodyErr func() error
+}
+
+type davRequestKey struct{}
+
+func WithDavRequest(ctx context.Context, req *DavRequest) context.Context {
+	return context.WithValue(ctx, davRequestKey{}, req)
+}
+
+func davRequestFrom(ctx context.Context) (*DavRequest, error) {
+	req, ok := ctx.Value(davRequestKey{}).(*DavRequest)
+	if !ok || req.UserID == 0 {
+		return nil, os.ErrPermission
+	}
+	return req, nil
+}
+
+// DavFS 把调用者自己上传的文件映射为 WebDAV 根目录下的平铺列表。
+// 服务器没有目录的概念，所以不能创建子目录；同名文件按上传顺序显示为 "name (2).ext"。
+// 文件名以 "." 开头的写入会被拒绝（.DS_Store、._* 之类由客户端生成的文件）。
+type DavFS struct {
+	files *FileService
+	// OnEvent 在上传、替换、重命名、删除和下载之后被调用，用于审计和 webhook；可以为 nil
+	OnEvent func(ctx context.Context, action string, file *model.File, err error)
+}
+
+func NewDavFS(files *FileService) *DavFS {
+	return &DavFS{files: files}
+}
+
+var _ webdav.FileSystem = (*DavFS)(nil)
+
+func (d *DavFS) event(ctx context.Context, action string, file *model.File, err error) {
+	if d.OnEvent != nil {
+		d.OnEvent(ctx, action, file, err)
+	}
+}
+
+// list 返回调用者的文件
+func (d *DavFS) list(ctx context.Context) ([]dirEntry, error) {
+	req, err := davRequestFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return d.files.ownerDir(req.UserID)
+}
+
+// lookup 查找根目录下的文件；name 为 "" 表示根目录本身
+func (d *DavFS) lookup(ctx context.Context, name string) (dirEntry, error) {
+	name, err := davName(name)
+	if err != nil || name == "" {
+		return dirEntry{}, err
+	}
+	entries, err := d.list(ctx)
+	if err != nil {
+		return dirEntry{}, err
+	}
+	entry, ok := findEntry(entries, name)
+	if !ok {
+		return dirEntry{}, os.ErrNotExist
+	}
+	return entry, nil
+}
+
+// davName 把 WebDAV 路径转换为根目录下的文件名；子目录中的路径一律不存在
+func davName(name string) (string, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if strings.Contains(name, "/") {
+		return "", os.ErrNotExist
+	}
+	return name, nil
+}
+
+func (d *DavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (d *DavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	req, err := davRequestFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := d.lookup(ctx, name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	exists := err == nil
+	if exists && entry.file == nil {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, os.ErrPermission
+		}
+		return &davDir{fs: d, ctx: ctx}, nil
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if !exists {
+			return nil, os.ErrNotExist
+		}
+		if err := d.files.EnsureDownloadable(entry.file); err != nil {
+			return nil, os.ErrPermission
+		}
+		return &davReader{fs: d, ctx: ctx, name: entry.name, stream: rangeStream{files: d.files, file: entry.file}}, nil
+	}
+
+	// 写入：密文是流式生成的，只支持整体替换
+	switch {
+	case exists && flag&os.O_EXCL != 0:
+		return nil, os.ErrExist
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, os.ErrNotExist
+	case exists && flag&os.O_TRUNC == 0:
+		return nil, os.ErrPermission
+	}
+	w := &davWriter{fs: d, ctx: ctx, req: req}
+	if exists {
+		w.name, w.existing = entry.name, entry.file
+	} else {
+		w.name, _ = davName(name)
+		if !validEntryName(w.name) {
+			return nil, os.ErrPermission
+		}
+	}
+	w.upload = d.files.startUpload(w.existing, w.name, req.UserID)
+	return w, nil
+}
+
+func (d *DavFS) RemoveAll(ctx context.Context, name string) error {
+	entry, err := d.lookup(ctx, name)
+	if err != nil {
+		return err
+	}
+	if entry.file == nil {
+		return os.ErrPermission
+	}
+	err = d.files.DeleteFile(entry.file.ID)
+	d.event(ctx, model.AuditFileDelete, entry.file, err)
+	return err
+}
+
+func (d *DavFS) Rename(ctx context.Context, oldName, newName string) error {
+	entry, err := d.lookup(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if entry.file == nil {
+		return os.ErrPermission
+	}
+	target, err := davName(newName)
+	if err != nil {
+		return err
+	}
+	if !validEntryName(target) {
+		return os.ErrPermission
+	}
+	if other, err := d.lookup(ctx, target); err == nil && other.file.ID != entry.file.ID {
+		return os.ErrExist
+	}
+	file, err := d.files.RenameFile(entry.file.ID, target)
+	if err != nil {
+		file = entry.file
+	}
+	d.event(ctx, model.AuditFileUpdate, file, err)
+	return err
+}
+
+func (d *DavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	entry, err := d.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.file == nil {
+		return davRootInfo{}, nil
+	}
+	return davFileInfo{name: entry.name, file: entry.file}, nil
+}
+
+// davFileInfo 同时实现 webdav.ContentTyper 和 webdav.ETager，
+// 避免 PROPFIND 为了猜测类型而解密文件
+type davFileInfo struct {
+	name string
+	file *model.File
+}
+
+func (i davFileInfo) Name() string       { return i.name }
+func (i davFileInfo) Size() int64        { return i.file.Size }
+func (i davFileInfo) Mode() os.FileMode  { return 0644 }
+func (i davFileInfo) ModTime() time.Time { return i.file.UpdatedAt }
+func (i davFileInfo) IsDir() bool        { return false }
+func (i davFileInfo) Sys() any           { return nil }
+
+func (i davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(i.name)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+func (i davFileInfo) ETag(ctx context.Context) (string, error) {
+	return FileETag(i.file), nil
+}
+
+type davRootInfo struct{}
+
+func (davRootInfo) Name() string       { return "/" }
+func (davRootInfo) Size() int64        { return 0 }
+func (davRootInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (davRootInfo) ModTime() time.Time { return time.Time{} }
+func (davRootInfo) IsDir() bool        { return true }
+func (davRootInfo) Sys() any           { return nil }
+
+// davDir 是根目录
+type davDir struct {
+	fs      *DavFS
+	ctx     context.Context
+	entries []dirEntry
+	loaded  bool
+}
+
+func (d *davDir) Close() error                                 { return nil }
+func (d *davDir) Read(p []byte) (int, error)                   { return 0, fs.ErrInvalid }
+func (d *davDir) Write(p []byte) (int, error)                  { return 0, fs.ErrInvalid }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, fs.ErrInvalid }
+func (d *davDir) Stat() (os.FileInfo, error)                   { return davRootInfo{}, nil }
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.loaded {
+		entries, err := d.fs.list(d.ctx)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.loaded = entries, true
+	}
+	n := len(d.entries)
+	if count > 0 {
+		if n == 0 {
+			return nil, io.EOF
+		}
+		n = min(n, count)
+	}
+	infos := make([]os.FileInfo, 0, n)
+	for _, entry := range d.entries[:n] {
+		infos = append(infos, davFileInfo{name: entry.name, file: entry.file})
+	}
+	d.entries = d.entries[n:]
+	return infos, nil
+}
+
+// davReader 支持 Seek：http.ServeContent 处理 Range 时会先 Seek 到末尾取大小，
+// 再 Seek 到起点。真正的解密在 Read 时从当前位置流式进行。
+type davReader struct {
+	fs     *DavFS
+	ctx    context.Context
+	name   string
+	offset int64
+	stream rangeStream
+	logged bool
+}
+
+func (r *davReader) Read(p []byte) (int, error) {
+	if !r.logged && r.offset < r.stream.file.Size {
+		r.logged = true
+		r.fs.event(r.ctx, model.AuditFileDownload, r.stream.file, nil)
+	}
+	n, err := r.stream.read(p, r.offset)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *davReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.stream.file.Size
+	default:
+		return 0, fs.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *davReader) Close() error {
+	r.stream.close()
+	return nil
+}
+
+func (r *davReader) Readdir(count int) ([]os.FileInfo, error) { return nil, fs.ErrInvalid }
+func (r *davReader) Write(p []byte) (int, error)              { return 0, fs.ErrPermission }
+func (r *davReader) Stat() (os.FileInfo, error) {
+	return davFileInfo{name: r.name, file: r.stream.file}, nil
+}
+
+// davWriter 边收边加密。webdav 在 Close 之前会调用 Stat，
+// 所以 Stat 就完成上传，以便返回正确的 ETag。
+type davWriter struct {
+	fs       *DavFS
+	ctx      context.Context
+	req      *DavRequest
+	name     string
+	existing *model.File
+	upload   *uploadStream
+
+	once   sync.Once
+	result *model.File
+	err    error
+}
+
+func (w *davWriter) Write(p []byte) (int, error) {
+	return w.upload.Write(p)
+}
+
+func (w *davWriter) finish() error {
+	w.once.Do(func() {
+		var bodyErr error
+		if w.req.BodyErr != nil {
+			// 请求体不完整：UploadFile / UpdateFile 不会保存任何内容
+			bodyErr = w.req.BodyErr()
+		}
+		w.result, w.err = w.upload.finish(bodyErr)
+		action := model.AuditFileUpload
+		if w.existing != nil {
+			action = model.AuditFileUpdate
+		}
+		w.fs.event(w.ctx, action, w.result, w.err)
+	})
+	return w.err
+}
+
+func (w *davWriter) Stat() (os.FileInfo, error) {
+	if err := w.finish(); err != nil {
+		return nil, err
+	}
+	return davFileInfo{name: w.name, file: w.result}, nil
+}
+
+func (w *davWriter) Close() error { return w.finish() }
+
+func (w *davWriter) Read(p []byte) (int, error)                   { return 0, fs.ErrPermission }
+func (w *davWriter) Seek(offset int64, whence int) (int64, error) { return 0, fs.ErrInvalid }
+func (w *davWriter) Readdir(count int) ([]os.FileInfo, error)     { return nil, fs.ErrInvalid }
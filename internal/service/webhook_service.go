@@ -0,0 +1,477 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidWebhook  = errors.New("invalid webhook")
+	ErrWebhookNotFound = errors.New("webhook not found")
+)
+
+// WebhookService 的签名密钥和 payload 都用 files 的元数据密钥加密后保存
+type WebhookService struct {
+	db     *gorm.DB
+	cfg    config.WebhookConfig
+	files  *FileService
+	client *http.Client
+}
+
+// WebhookInput 是注册 webhook 的参数；Secret 为空时由服务生成
+type WebhookInput struct {
+	URL              string
+	Secret           string
+	Events           []string
+	IncludeFilenames bool
+	Global           bool
+}
+
+// FileEvent 描述文件事件的数据，Filename 只有在 webhook 允许时才会出现在 payload 中
+type FileEvent struct {
+	FileID     uint
+	Filename   string
+	Size       int64
+	UploaderID string
+}
+
+var webhookEvents = []string{
+	model.EventFileUploaded,
+	model.EventFileUpdated,
+	model.EventFileDeleted,
+	model.EventUserRegistered,
+	model.EventUserPasswordChanged,
+	model.EventUserPasswordReset,
+	model.EventUserDisabled,
+	model.EventUserEnabled,
+	model.EventUserRoleChanged,
+}
+
+const webhookBatch = 20
+
+func NewWebhookService(db *gorm.DB, cfg config.WebhookConfig, files *FileService) *WebhookService {
+	fmt.Fprintln(config.Progress, "✓ Creating a new webhook service done")
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivateNetworks {
+		// 在连接时检查解析后的 IP，防止借 webhook 访问内网（DNS rebinding 也能拦住）
+		dialer.Control = denyPrivateNetworks
+	}
+	client := &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &WebhookService{db: db, cfg: cfg, files: files, client: client}
+}
+
+// Create 注册 webhook，返回值中的 secret 只在创建时返回一次
+func (s *WebhookService) Create(ownerID uint, isAdmin bool, in WebhookInput) (*model.Webhook, string, error) {
+	u, err := url.Parse(in.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", fmt.Errorf("%w: url must be an absolute http(s) url", ErrInvalidWebhook)
+	}
+	if in.Global && !isAdmin {
+		return nil, "", fmt.Errorf("%w: only admins can register global webhooks", ErrInvalidWebhook)
+	}
+	if len(in.Events) == 0 {
+		return nil, "", fmt.Errorf("%w: events required", ErrInvalidWebhook)
+	}
+	for _, pattern := range in.Events {
+		if !validEventPattern(pattern) {
+			return nil, "", fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, pattern)
+		}
+	}
+	secret := in.Secret
+	if secret == "" {
+		if secret, err = randomHex(32); err != nil {
+			return nil, "", err
+		}
+	}
+
+	encSecret, err := s.files.encryptString(secret)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hook := &model.Webhook{
+		OwnerID:          ownerID,
+		Global:           in.Global,
+		URL:              in.URL,
+		EncSecret:        encSecret,
+		Events:           strings.Join(in.Events, ","),
+		IncludeFilenames: in.IncludeFilenames,
+		Active:           true,
+	}
+	if err := s.db.Create(hook).Error; err != nil {
+		return nil, "", err
+	}
+	return hook, secret, nil
+}
+
+// List 普通用户只能看到自己的 webhook，管理员可以看到全部
+func (s *WebhookService) List(ownerID uint, isAdmin bool) ([]model.Webhook, error) {
+	var hooks []model.Webhook
+	tx := s.db.Order("id asc")
+	if !isAdmin {
+		tx = tx.Where("owner_id = ?", ownerID)
+	}
+	err := tx.Find(&hooks).Error
+	return hooks, err
+}
+
+func (s *WebhookService) Get(id uint, ownerID uint, isAdmin bool) (*model.Webhook, error) {
+	var hook model.Webhook
+	if err := s.db.First(&hook, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, err
+	}
+	if !isAdmin && hook.OwnerID != ownerID {
+		return nil, ErrWebhookNotFound
+	}
+	return &hook, nil
+}
+
+func (s *WebhookService) Delete(id uint, ownerID uint, isAdmin bool) error {
+	hook, err := s.Get(id, ownerID, isAdmin)
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", hook.ID).Delete(&model.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(hook).Error
+	})
+}
+
+// ListDeliveries 分页列出投递记录；payload 解密失败的行标记为 payload_unreadable，不影响其余的行
+func (s *WebhookService) ListDeliveries(webhookID uint, status string, page, size int) (total int64, deliveries []model.WebhookDelivery, err error) {
+	tx := s.db.Model(&model.WebhookDelivery{})
+	if webhookID != 0 {
+		tx = tx.Where("webhook_id = ?", webhookID)
+	}
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return
+	}
+	offset := (page - 1) * size
+	if err = tx.Order("id desc").Limit(size).Offset(offset).Find(&deliveries).Error; err != nil {
+		return
+	}
+	for i := range deliveries {
+		payload, derr := s.files.decryptString(deliveries[i].EncPayload)
+		if derr != nil {
+			deliveries[i].Unreadable = true
+			if pkg.Logger != nil {
+				pkg.Logger.Warn("webhook delivery payload unreadable", zap.Uint("delivery_id", deliveries[i].ID), zap.Error(derr))
+			}
+			continue
+		}
+		deliveries[i].Payload = payload
+	}
+	return
+}
+
+// Redeliver 把一条投递（通常是死信）重新放回队列
+func (s *WebhookService) Redeliver(deliveryID uint, ownerID uint, isAdmin bool) (*model.WebhookDelivery, error) {
+	var delivery model.WebhookDelivery
+	if err := s.db.First(&delivery, deliveryID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, err
+	}
+	if _, err := s.Get(delivery.WebhookID, ownerID, isAdmin); err != nil {
+		return nil, err
+	}
+	delivery.Status = model.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now()
+	delivery.LastError = ""
+	if err := s.db.Save(&delivery).Error; err != nil {
+		return nil, err
+	}
+	payload, err := s.files.decryptString(delivery.EncPayload)
+	if err != nil {
+		return nil, err
+	}
+	delivery.Payload = payload
+	return &delivery, nil
+}
+
+// EmitFile 为文件事件生成投递记录；ownerID 为文件所属用户
+func (s *WebhookService) EmitFile(event string, ownerID uint, file FileEvent) {
+	data := map[string]interface{}{
+		"file_id":     file.FileID,
+		"size":        file.Size,
+		"uploader_id": file.UploaderID,
+	}
+	s.emit(event, ownerID, data, file.Filename)
+}
+
+// EmitUser 为用户事件生成投递记录
+func (s *WebhookService) EmitUser(event string, userID uint) {
+	s.emit(event, userID, map[string]interface{}{"user_id": userID}, "")
+}
+
+func (s *WebhookService) emit(event string, ownerID uint, data map[string]interface{}, filename string) {
+	if err := s.enqueue(event, ownerID, data, filename); err != nil && pkg.Logger != nil {
+		pkg.Logger.Error("webhook enqueue failed", zap.String("event", event), zap.Error(err))
+	}
+}
+
+func (s *WebhookService) enqueue(event string, ownerID uint, data map[string]interface{}, filename string) error {
+	var hooks []model.Webhook
+	if err := s.db.Where("active = ? AND (owner_id = ? OR global = ?)", true, ownerID, true).Find(&hooks).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, hook := range hooks {
+		if !eventMatches(hook.Events, event) {
+			continue
+		}
+		eventID, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+		hookData := make(map[string]interface{}, len(data)+1)
+		for k, v := range data {
+			hookData[k] = v
+		}
+		if filename != "" && hook.IncludeFilenames {
+			hookData["filename"] = filename
+		}
+		payload, err := json.Marshal(map[string]interface{}{
+			"id":          eventID,
+			"event":       event,
+			"occurred_at": now.UTC().Format(time.RFC3339),
+			"data":        hookData,
+		})
+		if err != nil {
+			return err
+		}
+		encPayload, err := s.files.encryptString(string(payload))
+		if err != nil {
+			return err
+		}
+		delivery := &model.WebhookDelivery{
+			WebhookID:     hook.ID,
+			Event:         event,
+			EncPayload:    encPayload,
+			Status:        model.DeliveryPending,
+			NextAttemptAt: now,
+		}
+		if err := s.db.Create(delivery).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run 是后台投递循环，直到 ctx 取消
+func (s *WebhookService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		s.DeliverDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue 投递所有到期的事件；封存期间无法解密，什么都不做
+func (s *WebhookService) DeliverDue() {
+	if s.files.Sealed() {
+		return
+	}
+	var due []model.WebhookDelivery
+	now := time.Now()
+	if err := s.db.Where("status = ? AND next_attempt_at <= ?", model.DeliveryPending, now).
+		Order("next_attempt_at asc").Limit(webhookBatch).Find(&due).Error; err != nil {
+		return
+	}
+	for i := range due {
+		if !s.claim(&due[i], now) {
+			continue
+		}
+		s.deliver(&due[i])
+	}
+}
+
+// claim 通过条件更新把 next_attempt_at 推后，避免多个实例重复投递同一条
+func (s *WebhookService) claim(d *model.WebhookDelivery, now time.Time) bool {
+	lease := now.Add(2 * s.cfg.Timeout)
+	res := s.db.Model(&model.WebhookDelivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at <= ?", d.ID, model.DeliveryPending, now).
+		Update("next_attempt_at", lease)
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+func (s *WebhookService) deliver(d *model.WebhookDelivery) {
+	var hook model.Webhook
+	if err := s.db.First(&hook, d.WebhookID).Error; err != nil {
+		s.db.Model(d).Updates(map[string]interface{}{"status": model.DeliveryDead, "last_error": "webhook deleted"})
+		return
+	}
+
+	statusCode, err := s.post(&hook, d)
+	d.Attempts++
+	updates := map[string]interface{}{
+		"attempts":         d.Attempts,
+		"last_status_code": statusCode,
+	}
+	if err == nil {
+		now := time.Now()
+		updates["status"] = model.DeliveryDelivered
+		updates["delivered_at"] = &now
+		updates["last_error"] = ""
+	} else if d.Attempts >= s.cfg.MaxAttempts || !hook.Active {
+		updates["status"] = model.DeliveryDead
+		updates["last_error"] = truncate(err.Error(), 512)
+	} else {
+		updates["next_attempt_at"] = time.Now().Add(s.backoff(d.Attempts))
+		updates["last_error"] = truncate(err.Error(), 512)
+	}
+	s.db.Model(&model.WebhookDelivery{}).Where("id = ?", d.ID).Updates(updates)
+}
+
+func (s *WebhookService) post(hook *model.Webhook, d *model.WebhookDelivery) (int, error) {
+	secret, err := s.files.decryptString(hook.EncSecret)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := s.files.decryptString(d.EncPayload)
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader([]byte(payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "secure-file-box-webhook/1")
+	req.Header.Set("X-SFB-Event", d.Event)
+	req.Header.Set("X-SFB-Delivery", strconv.FormatUint(uint64(d.ID), 10))
+	req.Header.Set("X-SFB-Timestamp", timestamp)
+	req.Header.Set("X-SFB-Signature", "sha256="+SignWebhook(secret, timestamp, []byte(payload)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// PruneDelivered 删除投递成功超过 webhook.retention 的记录，返回删除的条数；retention 为 0 时保留
+func (s *WebhookService) PruneDelivered() (int64, error) {
+	if s.cfg.Retention <= 0 {
+		return 0, nil
+	}
+	res := s.db.Where("status = ? AND delivered_at < ?", model.DeliveryDelivered, time.Now().Add(-s.cfg.Retention)).
+		Delete(&model.WebhookDelivery{})
+	return res.RowsAffected, res.Error
+}
+
+func (s *WebhookService) backoff(attempts int) time.Duration {
+	d := s.cfg.InitialBackoff
+	for i := 1; i < attempts && d < s.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.cfg.MaxBackoff {
+		d = s.cfg.MaxBackoff
+	}
+	return d
+}
+
+// SignWebhook 计算 X-SFB-Signature：HMAC-SHA256(secret, timestamp + "." + body) 的十六进制
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validEventPattern(pattern string) bool {
+	if pattern == "*" || pattern == "file.*" || pattern == "user.*" {
+		return true
+	}
+	for _, e := range webhookEvents {
+		if e == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func eventMatches(patterns string, event string) bool {
+	for _, p := range strings.Split(patterns, ",") {
+		p = strings.TrimSpace(p)
+		if p == "*" || p == event {
+			return true
+		}
+		if strings.HasSuffix(p, ".*") && strings.HasPrefix(event, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func denyPrivateNetworks(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("webhook target %s is not allowed", host)
+	}
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/model"
+)
+
+func testWebhookConfig(allowPrivate bool) config.WebhookConfig {
+	return config.WebhookConfig{
+		MaxAttempts:          2,
+		InitialBackoff:       10 * time.Second,
+		MaxBackoff:           time.Minute,
+		Timeout:              5 * time.Second,
+		PollInterval:         time.Second,
+		AllowPrivateNetworks: allowPrivate,
+	}
+}
+
+// newTestWebhook 注册一个接收全部事件的 webhook 并产生一条投递
+func newTestWebhook(t *testing.T, s *WebhookService, url string) (*model.Webhook, string) {
+	t.Helper()
+	hook, secret, err := s.Create(1, false, WebhookInput{URL: url, Events: []string{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.EmitUser(model.EventUserRegistered, 1)
+	return hook, secret
+}
+
+func onlyDelivery(t *testing.T, s *WebhookService) model.WebhookDelivery {
+	t.Helper()
+	var deliveries []model.WebhookDelivery
+	if err := s.db.Find(&deliveries).Error; err != nil || len(deliveries) != 1 {
+		t.Fatalf("deliveries = %+v, %v", deliveries, err)
+	}
+	return deliveries[0]
+}
+
+func TestSignWebhook(t *testing.T) {
+	// HMAC-SHA256("whsec-test", "1700000000." + body)，用 Python hmac 模块独立算出
+	got := SignWebhook("whsec-test", "1700000000", []byte(`{"event":"file.uploaded"}`))
+	if got != "188464f7a764d8a5b8d5bc8366bca982aef12a2825160c623ca97ea41360fcbc" {
+		t.Fatalf("SignWebhook = %s", got)
+	}
+}
+
+func TestDenyPrivateNetworks(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:80", "10.1.2.3:443", "192.168.0.1:80", "169.254.169.254:80", "0.0.0.0:80", "[::1]:8080", "[fd00::1]:80", "224.0.0.1:80"} {
+		if err := denyPrivateNetworks("tcp", addr, nil); err == nil {
+			t.Errorf("%s allowed", addr)
+		}
+	}
+	for _, addr := range []string{"93.184.216.34:443", "[2606:2800:220:1::1]:443"} {
+		if err := denyPrivateNetworks("tcp", addr, nil); err != nil {
+			t.Errorf("%s: %v", addr, err)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer target.Close()
+
+	files := newTestFileService(t)
+	blocked := NewWebhookService(files.db, testWebhookConfig(false), files)
+	_, secret := newTestWebhook(t, blocked, target.URL)
+
+	// 默认不允许连接内网地址，httptest 监听在 127.0.0.1
+	blocked.DeliverDue()
+	d := onlyDelivery(t, blocked)
+	if received != nil || d.Status != model.DeliveryPending || d.Attempts != 1 || !strings.Contains(d.LastError, "not allowed") {
+		t.Fatalf("delivery to a private address = %+v", d)
+	}
+
+	if _, err := blocked.Redeliver(d.ID, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	allowed := NewWebhookService(files.db, testWebhookConfig(true), files)
+	allowed.DeliverDue()
+	d = onlyDelivery(t, allowed)
+	if received == nil || d.Status != model.DeliveryDelivered || d.LastStatusCode != http.StatusOK || d.DeliveredAt == nil {
+		t.Fatalf("delivery = %+v", d)
+	}
+	ts := received.Header.Get("X-SFB-Timestamp")
+	if received.Header.Get("X-SFB-Signature") != "sha256="+SignWebhook(secret, ts, body) ||
+		received.Header.Get("X-SFB-Event") != model.EventUserRegistered || !strings.Contains(string(body), `"user_id":1`) {
+		t.Fatalf("request headers %v, body %s", received.Header, body)
+	}
+}
+
+// 租约：认领后其他实例认领不到，租约过期后可以再次认领
+func TestWebhookClaim(t *testing.T) {
+	files := newTestFileService(t)
+	s := NewWebhookService(files.db, testWebhookConfig(false), files)
+	newTestWebhook(t, s, "https://hooks.example.com/sfb")
+	d := onlyDelivery(t, s)
+
+	now := time.Now()
+	if !s.claim(&d, now) {
+		t.Fatal("first claim failed")
+	}
+	if s.claim(&d, now) || s.claim(&d, now.Add(s.cfg.Timeout)) {
+		t.Fatal("claimed a delivery under lease")
+	}
+	if !s.claim(&d, now.Add(3*s.cfg.Timeout)) {
+		t.Fatal("claim after the lease expired failed")
+	}
+	if err := s.db.Model(&d).Update("status", model.DeliveryDelivered).Error; err != nil {
+		t.Fatal(err)
+	}
+	if s.claim(&d, now.Add(time.Hour)) {
+		t.Fatal("claimed a delivered delivery")
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	files := newTestFileService(t)
+	s := NewWebhookService(files.db, testWebhookConfig(true), files)
+	for attempts, want := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second, 4: time.Minute, 20: time.Minute} {
+		if got := s.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+	newTestWebhook(t, s, target.URL)
+
+	before := time.Now()
+	s.DeliverDue()
+	d := onlyDelivery(t, s)
+	if d.Status != model.DeliveryPending || d.Attempts != 1 || d.LastStatusCode != http.StatusServiceUnavailable ||
+		d.NextAttemptAt.Before(before.Add(10*time.Second)) || d.NextAttemptAt.After(time.Now().Add(10*time.Second)) {
+		t.Fatalf("after the first failure: %+v", d)
+	}
+	// 未到期的投递不会被取出
+	s.DeliverDue()
+	if d = onlyDelivery(t, s); d.Attempts != 1 {
+		t.Fatalf("delivered before next_attempt_at: %+v", d)
+	}
+
+	if err := s.db.Model(&d).Update("next_attempt_at", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	s.DeliverDue()
+	if d = onlyDelivery(t, s); d.Status != model.DeliveryDead || d.Attempts != 2 {
+		t.Fatalf("after max_attempts: %+v", d)
+	}
+}
+
+func TestListDeliveriesUnreadablePayload(t *testing.T) {
+	files := newTestFileService(t)
+	s := NewWebhookService(files.db, testWebhookConfig(false), files)
+	hook, _ := newTestWebhook(t, s, "https://hooks.example.com/sfb")
+	s.EmitUser(model.EventUserDisabled, 1)
+
+	bad := onlyDeliveryByEvent(t, s, model.EventUserRegistered)
+	if err := s.db.Model(&bad).Update("enc_payload", "not-a-ciphertext").Error; err != nil {
+		t.Fatal(err)
+	}
+	total, deliveries, err := s.ListDeliveries(hook.ID, "", 1, 10)
+	if err != nil || total != 2 || len(deliveries) != 2 {
+		t.Fatalf("ListDeliveries = %d, %+v, %v", total, deliveries, err)
+	}
+	for _, d := range deliveries {
+		if d.ID == bad.ID {
+			if !d.Unreadable || d.Payload != "" {
+				t.Errorf("corrupt row: %+v", d)
+			}
+		} else if d.Unreadable || !strings.Contains(d.Payload, model.EventUserDisabled) {
+			t.Errorf("intact row: %+v", d)
+		}
+	}
+}
+
+func onlyDeliveryByEvent(t *testing.T, s *WebhookService, event string) model.WebhookDelivery {
+	t.Helper()
+	var d model.WebhookDelivery
+	if err := s.db.Where("event = ?", event).First(&d).Error; err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
@@ -0,0 +1,126 @@
+// Package testserver 在进程内启动与 cmd/server 相同装配的 API 服务，供测试使用：
+// SQLite 数据库和 storage 目录都在 t.TempDir() 下，测试结束时关闭。
+//
+//	srv := testserver.New(t, testserver.Options{})
+//	resp, _ := http.Get(srv.URL + "/api/v1/ping")
+package testserver
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Kaikai20040827/graduation/internal/config"
+	"github.com/Kaikai20040827/graduation/internal/handler"
+	"github.com/Kaikai20040827/graduation/internal/middleware"
+	"github.com/Kaikai20040827/graduation/internal/migrate"
+	"github.com/Kaikai20040827/graduation/internal/pkg"
+	"github.com/Kaikai20040827/graduation/internal/routes"
+	"github.com/Kaikai20040827/graduation/internal/service"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Key 是测试用的主密钥（32 个零字节）
+const Key = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+type Options struct {
+	// UserKeys 打开每用户密钥（file_crypto.user_keys）
+	UserKeys bool
+	// JWTTTL 为 token 有效期，0 表示一小时
+	JWTTTL time.Duration
+	// TrustedProxies 对应 server.trusted_proxies
+	TrustedProxies []string
+	// KeyFile 为按份额拆分的密钥文件（主密钥须为 Key）时服务器以封存状态启动
+	KeyFile []byte
+}
+
+type Server struct {
+	URL   string
+	DB    *gorm.DB
+	Files *service.FileService
+	Users *service.UserService
+	Audit *service.AuditService
+	JWT   *config.JWTConfig
+}
+
+func New(t testing.TB, opts Options) *Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db, err := pkg.NewDatabase(&config.DatabaseConfig{Driver: "sqlite", Path: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate.New(db, Key).Startup(true); err != nil {
+		t.Fatal(err)
+	}
+	if opts.JWTTTL == 0 {
+		opts.JWTTTL = time.Hour
+	}
+	jwtCfg := &config.JWTConfig{Secret: "test-secret", Issuer: "sfb-test", Audience: "sfb-test", TTL: opts.JWTTTL}
+
+	userSrv := service.NewUserService(db)
+	auditSrv := service.NewAuditService(db, Key)
+	fileSrv := service.NewFileService(db, t.TempDir(), Key)
+	webhookSrv := service.NewWebhookService(db, config.WebhookConfig{MaxAttempts: 1}, fileSrv)
+	userKeys, err := service.NewUserKeyRing(db, opts.UserKeys, "", jwtCfg.TTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userSrv.SetUserKeys(userKeys)
+	fileSrv.SetUserKeys(userKeys)
+	jobSrv := service.NewJobService(db, config.JobsConfig{})
+	sealSrv, err := service.NewSealService(fileSrv, auditSrv, opts.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileH := handler.NewFileHandler(fileSrv, auditSrv, webhookSrv)
+	r := routes.SetupRouter()
+	if err := middleware.TrustProxies(r, opts.TrustedProxies); err != nil {
+		t.Fatal(err)
+	}
+	r.Use(middleware.SealGate(sealSrv))
+	routes.RegisterAPIRoutes(r,
+		handler.NewAuthHandler(userSrv, auditSrv, webhookSrv, jwtCfg),
+		handler.NewUserHandler(userSrv, fileSrv, auditSrv, webhookSrv),
+		fileH,
+		handler.NewAdminHandler(userSrv, fileSrv, auditSrv, webhookSrv),
+		handler.NewAuditHandler(auditSrv),
+		handler.NewWebhookHandler(webhookSrv),
+		handler.NewJobHandler(jobSrv, auditSrv),
+		handler.NewVaultHandler(fileSrv, auditSrv),
+		handler.NewSealHandler(sealSrv, auditSrv),
+		userSrv, jwtCfg)
+	routes.RegisterDAVRoutes(r, handler.NewWebDAVHandler(fileH), userSrv, jwtCfg)
+
+	hs := httptest.NewServer(r)
+	t.Cleanup(func() {
+		hs.Close()
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return &Server{URL: hs.URL, DB: db, Files: fileSrv, Users: userSrv, Audit: auditSrv, JWT: jwtCfg}
+}
+
+// CreateUser 直接在数据库中创建用户，密码为 password
+func (s *Server) CreateUser(t testing.TB, username, email, password string) uint {
+	t.Helper()
+	u, err := s.Users.CreateUser(username, email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.ID
+}
+
+// CreateAdmin 创建管理员账号
+func (s *Server) CreateAdmin(t testing.TB, email, password string) uint {
+	t.Helper()
+	u, err := s.Users.EnsureAdmin(email, "admin", password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.ID
+}
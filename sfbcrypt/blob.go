@@ -0,0 +1,288 @@
+package sfbcrypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	MagicV2       = "SFB2"
+	NoncePrefix   = 8
+	NonceSize     = 12
+	ChunkSize     = 32 * 1024
+	HeaderSizeV2  = len(MagicV2) + NoncePrefix
+	chunkOverhead = 16
+)
+
+var (
+	ErrBadMagic      = errors.New("invalid file magic")
+	ErrIntegrity     = errors.New("file integrity check failed")
+	ErrTruncated     = errors.New("file is truncated")
+	ErrChunkLength   = errors.New("invalid encrypted chunk length")
+	ErrHeaderMissing = errors.New("file is shorter than the header")
+)
+
+// ChunkError 指出出错的块：Chunk 为块序号，Offset 为该块长度字段在密文文件中的偏移
+type ChunkError struct {
+	Chunk  uint32
+	Offset int64
+	Err    error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("%v: chunk %d at offset %d", e.Err, e.Chunk, e.Offset)
+}
+
+func (e *ChunkError) Unwrap() error { return e.Err }
+
+// BlobInfo 描述一次加解密处理过的数据量；解密失败时为出错前已经成功的部分
+type BlobInfo struct {
+	Format      string `json:"format"`
+	Chunks      uint32 `json:"chunks"`
+	PlainBytes  int64  `json:"plain_bytes"`
+	CipherBytes int64  `json:"cipher_bytes"`
+}
+
+type BlobCipher struct {
+	gcm cipher.AEAD
+}
+
+// NewBlobCipher 使用 Keys.File（32 字节）创建文件加解密器
+func NewBlobCipher(fileKey []byte) (*BlobCipher, error) {
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobCipher{gcm: gcm}, nil
+}
+
+// Encrypt 把 src 加密为 SFB2 写入 dst，返回明文字节数
+func (c *BlobCipher) Encrypt(dst io.Writer, src io.Reader) (int64, error) {
+	prefix := make([]byte, NoncePrefix)
+	if _, err := rand.Read(prefix); err != nil {
+		return 0, err
+	}
+	writer := bufio.NewWriterSize(dst, ChunkSize*2)
+	if _, err := writer.WriteString(MagicV2); err != nil {
+		return 0, err
+	}
+	if _, err := writer.Write(prefix); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, ChunkSize)
+	var total int64
+	var counter uint32
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			total += int64(n)
+			sealed := c.gcm.Seal(nil, ChunkNonce(prefix, counter), buf[:n], chunkAAD(counter))
+			if err := binary.Write(writer, binary.BigEndian, uint32(len(sealed))); err != nil {
+				return 0, err
+			}
+			if _, err := writer.Write(sealed); err != nil {
+				return 0, err
+			}
+			counter++
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return 0, rerr
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// Decrypt 校验并解密 SFB2 流，逐块写入 dst。
+// 块认证失败或截断时返回 *ChunkError，此前已写入 dst 的明文都通过了认证。
+func (c *BlobCipher) Decrypt(dst io.Writer, src io.Reader) (*BlobInfo, error) {
+	info := &BlobInfo{}
+	header := make([]byte, HeaderSizeV2)
+	if n, err := io.ReadFull(src, header); err != nil {
+		info.CipherBytes = int64(n)
+		if n >= len(MagicV2) && string(header[:len(MagicV2)]) != MagicV2 {
+			return info, ErrBadMagic
+		}
+		return info, ErrHeaderMissing
+	}
+	if string(header[:len(MagicV2)]) != MagicV2 {
+		return info, ErrBadMagic
+	}
+	info.Format = MagicV2
+	info.CipherBytes = int64(HeaderSizeV2)
+	prefix := header[len(MagicV2):]
+
+	reader := bufio.NewReaderSize(src, ChunkSize*2)
+	sealed := make([]byte, ChunkSize+chunkOverhead)
+	for {
+		offset := info.CipherBytes
+		fail := func(err error) (*BlobInfo, error) {
+			return info, &ChunkError{Chunk: info.Chunks, Offset: offset, Err: err}
+		}
+
+		var lenBuf [4]byte
+		n, err := io.ReadFull(reader, lenBuf[:])
+		if err == io.EOF {
+			return info, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return fail(ErrTruncated)
+		}
+		if err != nil {
+			return info, err
+		}
+		size := binary.BigEndian.Uint32(lenBuf[:])
+		if size <= chunkOverhead || size > ChunkSize+chunkOverhead {
+			return fail(ErrChunkLength)
+		}
+		if m, err := io.ReadFull(reader, sealed[:size]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				info.CipherBytes += int64(n + m)
+				return fail(ErrTruncated)
+			}
+			return info, err
+		}
+
+		plain, err := c.gcm.Open(sealed[:0], ChunkNonce(prefix, info.Chunks), sealed[:size], chunkAAD(info.Chunks))
+		if err != nil {
+			return fail(ErrIntegrity)
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return info, err
+		}
+		info.Chunks++
+		info.PlainBytes += int64(len(plain))
+		info.CipherBytes += int64(4 + size)
+	}
+}
+
+// ChunkNonce 返回 prefix || uint32 BE(counter)
+func ChunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, NonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[NoncePrefix:], counter)
+	return nonce
+}
+
+func chunkAAD(counter uint32) []byte {
+	aad := make([]byte, 4)
+	binary.BigEndian.PutUint32(aad, counter)
+	return aad
+}
+
+// DecryptRange 只把明文 [offset, offset+length) 写入 dst，length < 0 表示直到结尾。
+// 起始块之前的块只读取长度字段并跳过，不做认证；src 实现 io.Seeker 时直接 Seek。
+// 返回写入的字节数；范围超出明文末尾时只写到末尾为止。
+func (c *BlobCipher) DecryptRange(dst io.Writer, src io.Reader, offset, length int64) (int64, error) {
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	header := make([]byte, HeaderSizeV2)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return 0, ErrHeaderMissing
+	}
+	if string(header[:len(MagicV2)]) != MagicV2 {
+		return 0, ErrBadMagic
+	}
+	prefix := header[len(MagicV2):]
+	reader := bufio.NewReaderSize(src, ChunkSize*2)
+
+	var (
+		counter  uint32
+		plainAt  int64 // 当前块第一个明文字节的位置
+		cipherAt = int64(HeaderSizeV2)
+		written  int64
+	)
+	sealed := make([]byte, ChunkSize+chunkOverhead)
+	for length < 0 || written < length {
+		fail := func(err error) (int64, error) {
+			return written, &ChunkError{Chunk: counter, Offset: cipherAt, Err: err}
+		}
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(reader, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return fail(ErrTruncated)
+			}
+			return written, err
+		}
+		size := int64(binary.BigEndian.Uint32(lenBuf[:]))
+		if size <= chunkOverhead || size > ChunkSize+chunkOverhead {
+			return fail(ErrChunkLength)
+		}
+		plainLen := size - chunkOverhead
+
+		if plainAt+plainLen <= offset {
+			// 整块都在范围之前
+			if err := skip(reader, src, size); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return fail(ErrTruncated)
+				}
+				return written, err
+			}
+		} else {
+			if _, err := io.ReadFull(reader, sealed[:size]); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return fail(ErrTruncated)
+				}
+				return written, err
+			}
+			plain, err := c.gcm.Open(sealed[:0], ChunkNonce(prefix, counter), sealed[:size], chunkAAD(counter))
+			if err != nil {
+				return fail(ErrIntegrity)
+			}
+			if offset > plainAt {
+				plain = plain[offset-plainAt:]
+			}
+			if length >= 0 && int64(len(plain)) > length-written {
+				plain = plain[:length-written]
+			}
+			n, err := dst.Write(plain)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+		counter++
+		plainAt += plainLen
+		cipherAt += 4 + size
+	}
+	return written, nil
+}
+
+// skip 跳过 reader 中接下来的 n 个字节；缓冲区之外的部分在 src 可以 Seek 时直接 Seek。
+// Seek 越过文件末尾不会报错，这种截断要等读取下一个长度字段时才会发现。
+func skip(reader *bufio.Reader, src io.Reader, n int64) error {
+	buffered := int64(reader.Buffered())
+	seeker, ok := src.(io.Seeker)
+	if !ok || n <= buffered {
+		_, err := io.CopyN(io.Discard, reader, n)
+		return err
+	}
+	if _, err := reader.Discard(int(buffered)); err != nil {
+		return err
+	}
+	if _, err := seeker.Seek(n-buffered, io.SeekCurrent); err != nil {
+		return err
+	}
+	reader.Reset(src)
+	return nil
+}
@@ -0,0 +1,71 @@
+package sfbcrypt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// 客户提供的密钥（与 S3 的 SSE-C 类似）：客户端每个请求都带上 32 字节的密钥，服务器直接用它
+// 代替 Keys.File 加密内容（仍是 SFB2 格式），用完即丢，只保存一个带密钥的指纹用于校验：
+//
+//	"c1:" || hex(salt(16)) || ":" || hex(HMAC-SHA256(Keys.Customer, salt || 客户密钥))
+//
+// salt 每个文件随机生成，同一个客户密钥在不同文件上的指纹不同；没有主密钥无法用指纹检验猜测的密钥。
+const (
+	CustomerKeySize           = 32
+	customerKeySaltSize       = 16
+	customerFingerprintPrefix = "c1:"
+)
+
+var ErrCustomerKey = errors.New("customer key must be standard base64 and decode to 32 bytes")
+
+// ParseCustomerKey 解码请求中的客户密钥（标准 base64，与 S3 相同）
+func ParseCustomerKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != CustomerKeySize {
+		return nil, ErrCustomerKey
+	}
+	return key, nil
+}
+
+// CustomerKeyFingerprint 用新的 salt 计算 key 的指纹；checkKey 为 Keys.Customer
+func CustomerKeyFingerprint(checkKey, key []byte) (string, error) {
+	salt := make([]byte, customerKeySaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return customerFingerprintPrefix + hex.EncodeToString(salt) + ":" + hex.EncodeToString(customerKeyMAC(checkKey, salt, key)), nil
+}
+
+// CheckCustomerKey 报告 key 是否与 fingerprint 相符，比较时间与内容无关
+func CheckCustomerKey(checkKey, key []byte, fingerprint string) bool {
+	rest, ok := strings.CutPrefix(fingerprint, customerFingerprintPrefix)
+	if !ok {
+		return false
+	}
+	saltHex, macHex, ok := strings.Cut(rest, ":")
+	if !ok {
+		return false
+	}
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return false
+	}
+	mac, err := hex.DecodeString(macHex)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(mac, customerKeyMAC(checkKey, salt, key))
+}
+
+func customerKeyMAC(checkKey, salt, key []byte) []byte {
+	mac := hmac.New(sha256.New, checkKey)
+	mac.Write(salt)
+	mac.Write(key)
+	return mac.Sum(nil)
+}
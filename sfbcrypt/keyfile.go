@@ -0,0 +1,185 @@
+package sfbcrypt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// 密封的主密钥文件（file_crypto.key_file）：主密钥用口令派生的密钥包装后保存，服务器启动时解开。
+//
+//	{"version": 1, "kdf": {...}, "wrapped_key": Wrap(KEK, "sfb-master-key", 主密钥)}
+//
+// KDF 参数格式与 VaultKDF 相同，默认用 NewVaultKDF（t=3、64 MiB、p=4），只在启动时派生一次。
+// 换口令只重新包装，主密钥不变，已有数据不需要重新加密。
+//
+// 另一种密钥文件不用口令，而是用随机的 KEK 包装主密钥，KEK 按 Shamir 拆成份额交给多个人保管（见 shamir.go）：
+//
+//	{"version": 1, "shares": {"set": ..., "threshold": K, "shares": N}, "wrapped_key": Wrap(KEK, "sfb-master-key", 主密钥)}
+const (
+	MasterKeyFileVersion = 1
+	labelMasterKey       = "sfb-master-key"
+)
+
+var (
+	ErrMasterKeyPassphrase = errors.New("wrong master key passphrase")
+	ErrMasterKeyFile       = errors.New("invalid master key file")
+	ErrMasterKeyShared     = errors.New("master key file is split into key shares")
+	ErrKeyShares           = errors.New("key shares do not reconstruct the master key")
+)
+
+type masterKeyFile struct {
+	Version    int         `json:"version"`
+	KDF        *VaultKDF   `json:"kdf,omitempty"`
+	Shares     *KeySharing `json:"shares,omitempty"`
+	WrappedKey string      `json:"wrapped_key"`
+}
+
+// KeySharing 描述按份额拆分的密钥文件：Shares 份中任意 Threshold 份可以解开
+type KeySharing struct {
+	Set       string `json:"set"`
+	Threshold int    `json:"threshold"`
+	Shares    int    `json:"shares"`
+}
+
+// SealMasterKey 用新的 salt 从 passphrase 派生密钥并包装 master，返回密钥文件的内容
+func SealMasterKey(passphrase []byte, master []byte) ([]byte, error) {
+	if len(master) < MinMasterKeySize {
+		return nil, ErrInvalidMasterKey
+	}
+	kdf, err := NewVaultKDF()
+	if err != nil {
+		return nil, err
+	}
+	kek, err := kdf.DeriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := vaultSeal(kek, labelMasterKey, master)
+	if err != nil {
+		return nil, err
+	}
+	return marshalMasterKeyFile(masterKeyFile{Version: MasterKeyFileVersion, KDF: kdf, WrappedKey: wrapped})
+}
+
+func marshalMasterKeyFile(f masterKeyFile) ([]byte, error) {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func parseMasterKeyFile(data []byte) (*masterKeyFile, error) {
+	var f masterKeyFile
+	if err := json.Unmarshal(data, &f); err != nil || f.Version != MasterKeyFileVersion || (f.KDF == nil) == (f.Shares == nil) {
+		return nil, ErrMasterKeyFile
+	}
+	return &f, nil
+}
+
+// OpenMasterKey 是 SealMasterKey 的逆操作；口令不对时返回 ErrMasterKeyPassphrase，
+// 按份额拆分的密钥文件返回 ErrMasterKeyShared
+func OpenMasterKey(passphrase []byte, data []byte) ([]byte, error) {
+	f, err := parseMasterKeyFile(data)
+	if err != nil {
+		return nil, err
+	}
+	if f.KDF == nil {
+		return nil, ErrMasterKeyShared
+	}
+	kek, err := f.KDF.DeriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	master, err := openMasterKey(kek, f.WrappedKey)
+	if errors.Is(err, ErrMetaIntegrity) {
+		return nil, ErrMasterKeyPassphrase
+	}
+	return master, err
+}
+
+func openMasterKey(kek []byte, wrapped string) ([]byte, error) {
+	master, err := vaultOpen(kek, labelMasterKey, wrapped)
+	if errors.Is(err, ErrMetaIntegrity) {
+		return nil, err
+	}
+	if err != nil || len(master) < MinMasterKeySize {
+		return nil, ErrMasterKeyFile
+	}
+	return master, nil
+}
+
+// SplitMasterKey 用新的随机 KEK 包装 master，把 KEK 拆成 n 份（任意 k 份可以解开），
+// 返回密钥文件的内容和各份额的文本；份额只在这里出现一次，之后由各自的保管人提交
+func SplitMasterKey(master []byte, n, k int) ([]byte, []string, error) {
+	if len(master) < MinMasterKeySize {
+		return nil, nil, ErrInvalidMasterKey
+	}
+	kek, err := NewVaultKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer clear(kek)
+	shares, err := splitSecret(kek, n, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := vaultSeal(kek, labelMasterKey, master)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := marshalMasterKeyFile(masterKeyFile{
+		Version:    MasterKeyFileVersion,
+		Shares:     &KeySharing{Set: shares[0].Set, Threshold: k, Shares: n},
+		WrappedKey: wrapped,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	texts := make([]string, n)
+	for i, s := range shares {
+		texts[i] = s.encode()
+		s.Wipe()
+	}
+	return data, texts, nil
+}
+
+// MasterKeySharing 返回按份额拆分的密钥文件的参数；口令密封的密钥文件返回 nil
+func MasterKeySharing(data []byte) (*KeySharing, error) {
+	f, err := parseMasterKeyFile(data)
+	if err != nil {
+		return nil, err
+	}
+	return f.Shares, nil
+}
+
+// OpenMasterKeyShares 用至少 threshold 份份额还原 KEK 并解开主密钥；
+// 份额凑齐但还原出的 KEK 不对（有份额是伪造或抄错的）时返回 ErrKeyShares
+func OpenMasterKeyShares(data []byte, shares []*KeyShare) ([]byte, error) {
+	f, err := parseMasterKeyFile(data)
+	if err != nil {
+		return nil, err
+	}
+	if f.Shares == nil {
+		return nil, ErrMasterKeyFile
+	}
+	if len(shares) < f.Shares.Threshold {
+		return nil, fmt.Errorf("%w: need %d, got %d", ErrKeyShares, f.Shares.Threshold, len(shares))
+	}
+	for _, s := range shares {
+		if s.Set != f.Shares.Set {
+			return nil, ErrKeyShareSet
+		}
+	}
+	kek, err := combineShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(kek)
+	master, err := openMasterKey(kek, f.WrappedKey)
+	if errors.Is(err, ErrMetaIntegrity) {
+		return nil, ErrKeyShares
+	}
+	return master, err
+}
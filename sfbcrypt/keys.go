@@ -0,0 +1,98 @@
+// Package sfbcrypt 实现 Secure File Box 的存储加密格式，不依赖服务器、数据库或配置文件。
+// 只要有主密钥（config.yaml 中的 file_crypto.key），就能用它离线解密 storage/*.bin
+// 和数据库中的 enc_* 列。
+//
+// 密钥派生：子密钥 = HMAC-SHA256(主密钥原始字节, 用途标签)，主密钥为 base64url（无填充）
+// 编码、至少 32 字节的随机数。
+//
+// 文件格式 SFB2（服务器写出的唯一版本）：
+//
+//	"SFB2" || nonce prefix(8)
+//	重复：uint32 BE 密文长度 || AES-256-GCM(明文块)
+//
+// 第 i 块（从 0 开始）的 nonce 为 prefix || uint32 BE(i)，AAD 为 uint32 BE(i)。
+// 明文块最长 32 KiB，但可以更短。SFB2 没有结束标记，恰好在块边界处的截断只能
+// 通过与元数据中的明文大小比较来发现。
+//
+// 元数据 v1：
+//
+//	"v1:" || base64url(nonce(12) || AES-256-GCM(明文))，无 AAD；空字符串表示空值
+//
+// 保险库（客户端加密）格式见 vault.go，与主密钥无关。
+// 启用用户密钥后，用户文件的内容密钥由用户密钥派生（见 userkey.go），只有主密钥解不开。
+// 用客户提供的密钥上传的文件由客户密钥直接加密（见 customerkey.go）。
+// 主密钥本身可以用口令密封在密钥文件中，或者由多人各持一份份额（见 keyfile.go、shamir.go）。
+package sfbcrypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// 子密钥的用途标签
+const (
+	LabelFile       = "file-gcm-aes256"
+	LabelMetadata   = "db-meta-gcm-aes256"
+	LabelOwnerIndex = "db-owner-index-hmac"
+	LabelAuditChain = "audit-chain-hmac"
+	LabelShareLink  = "share-link-hmac"
+	LabelDedup      = "dedup-content-hmac"
+	LabelCustomer   = "customer-key-fingerprint-hmac"
+)
+
+const MinMasterKeySize = 32
+
+var ErrInvalidMasterKey = errors.New("master key must be base64url and decode to at least 32 bytes")
+
+// ParseMasterKey 解码 file_crypto.key；容忍首尾空白和 base64 填充
+func ParseMasterKey(base64Key string) ([]byte, error) {
+	key := strings.TrimRight(strings.TrimSpace(base64Key), "=")
+	raw, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil || len(raw) < MinMasterKeySize {
+		return nil, ErrInvalidMasterKey
+	}
+	return raw, nil
+}
+
+// DeriveKey 从主密钥派生出某个用途的 32 字节子密钥
+func DeriveKey(master []byte, label string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Keys 是服务器使用的全部子密钥
+type Keys struct {
+	File       []byte
+	Metadata   []byte
+	OwnerIndex []byte
+	AuditChain []byte
+	ShareLink  []byte
+	Dedup      []byte
+	// Customer 用于计算客户密钥的指纹
+	Customer []byte
+}
+
+func NewKeys(base64Key string) (*Keys, error) {
+	master, err := ParseMasterKey(base64Key)
+	if err != nil {
+		return nil, err
+	}
+	return DeriveKeys(master), nil
+}
+
+// DeriveKeys 从主密钥的原始字节派生全部子密钥，供解封时使用，主密钥不经过 base64 字符串
+func DeriveKeys(master []byte) *Keys {
+	return &Keys{
+		File:       DeriveKey(master, LabelFile),
+		Metadata:   DeriveKey(master, LabelMetadata),
+		OwnerIndex: DeriveKey(master, LabelOwnerIndex),
+		AuditChain: DeriveKey(master, LabelAuditChain),
+		ShareLink:  DeriveKey(master, LabelShareLink),
+		Dedup:      DeriveKey(master, LabelDedup),
+		Customer:   DeriveKey(master, LabelCustomer),
+	}
+}
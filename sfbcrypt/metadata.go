@@ -0,0 +1,159 @@
+package sfbcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	MetaPrefixV1  = "v1:"
+	MetaNonceSize = 12
+)
+
+var (
+	ErrMetaFormat    = errors.New("invalid encrypted metadata format")
+	ErrMetaPayload   = errors.New("invalid encrypted metadata payload")
+	ErrMetaIntegrity = errors.New("metadata integrity check failed")
+	ErrLegacyRow     = errors.New("row has no encrypted metadata (legacy plaintext columns)")
+)
+
+type MetaCipher struct {
+	gcm cipher.AEAD
+}
+
+// NewMetaCipher 使用 Keys.Metadata（32 字节）创建元数据加解密器
+func NewMetaCipher(metaKey []byte) (*MetaCipher, error) {
+	block, err := aes.NewCipher(metaKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &MetaCipher{gcm: gcm}, nil
+}
+
+func (m *MetaCipher) EncryptString(plain string) (string, error) {
+	nonce := make([]byte, MetaNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := m.gcm.Seal(nil, nonce, []byte(plain), nil)
+	payload := append(nonce, sealed...)
+	return MetaPrefixV1 + base64.RawURLEncoding.EncodeToString(payload), nil
+}
+
+func (m *MetaCipher) DecryptString(ciphertext string) (string, error) {
+	if ciphertext == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(ciphertext, MetaPrefixV1) {
+		return "", ErrMetaFormat
+	}
+	blob, err := base64.RawURLEncoding.DecodeString(ciphertext[len(MetaPrefixV1):])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMetaPayload, err)
+	}
+	if len(blob) < MetaNonceSize {
+		return "", ErrMetaPayload
+	}
+	plain, err := m.gcm.Open(nil, blob[:MetaNonceSize], blob[MetaNonceSize:], nil)
+	if err != nil {
+		return "", ErrMetaIntegrity
+	}
+	return string(plain), nil
+}
+
+// MetadataRow 是 files 表中的加密列，JSON 字段名与列名一致，可以直接用
+// SELECT JSON_OBJECT(...) 或 sfbctl file export-meta 导出
+type MetadataRow struct {
+	ID             uint   `json:"id"`
+	EncFilename    string `json:"enc_filename"`
+	EncStoragePath string `json:"enc_storage_path"`
+	EncSize        string `json:"enc_size"`
+	EncDescription string `json:"enc_description"`
+	EncUploaderID  string `json:"enc_uploader_id"`
+}
+
+type FileMetadata struct {
+	Filename    string `json:"filename"`
+	StoragePath string `json:"storage_path"`
+	Size        int64  `json:"size"`
+	Description string `json:"description"`
+	UploaderID  string `json:"uploader_id"`
+}
+
+// FieldError 指出哪一列解密失败
+type FieldError struct {
+	Column string
+	Err    error
+}
+
+func (e *FieldError) Error() string { return e.Column + ": " + e.Err.Error() }
+
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// DecryptRow 解密一行的全部 enc_* 列
+func (m *MetaCipher) DecryptRow(row MetadataRow) (*FileMetadata, error) {
+	if row.EncFilename == "" && row.EncStoragePath == "" && row.EncSize == "" && row.EncDescription == "" && row.EncUploaderID == "" {
+		return nil, ErrLegacyRow
+	}
+	meta := &FileMetadata{}
+	fields := []struct {
+		column string
+		in     string
+		out    *string
+	}{
+		{"enc_filename", row.EncFilename, &meta.Filename},
+		{"enc_storage_path", row.EncStoragePath, &meta.StoragePath},
+		{"enc_description", row.EncDescription, &meta.Description},
+		{"enc_uploader_id", row.EncUploaderID, &meta.UploaderID},
+	}
+	for _, field := range fields {
+		v, err := m.DecryptString(field.in)
+		if err != nil {
+			return nil, &FieldError{Column: field.column, Err: err}
+		}
+		*field.out = v
+	}
+	sizeText, err := m.DecryptString(row.EncSize)
+	if err != nil {
+		return nil, &FieldError{Column: "enc_size", Err: err}
+	}
+	if sizeText != "" {
+		if meta.Size, err = strconv.ParseInt(sizeText, 10, 64); err != nil {
+			return nil, &FieldError{Column: "enc_size", Err: err}
+		}
+	}
+	return meta, nil
+}
+
+// EncryptRow 是 DecryptRow 的逆操作
+func (m *MetaCipher) EncryptRow(id uint, meta *FileMetadata) (*MetadataRow, error) {
+	row := &MetadataRow{ID: id}
+	fields := []struct {
+		in  string
+		out *string
+	}{
+		{meta.Filename, &row.EncFilename},
+		{meta.StoragePath, &row.EncStoragePath},
+		{strconv.FormatInt(meta.Size, 10), &row.EncSize},
+		{meta.Description, &row.EncDescription},
+		{meta.UploaderID, &row.EncUploaderID},
+	}
+	for _, field := range fields {
+		v, err := m.EncryptString(field.in)
+		if err != nil {
+			return nil, err
+		}
+		*field.out = v
+	}
+	return row, nil
+}
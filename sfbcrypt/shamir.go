@@ -0,0 +1,160 @@
+package sfbcrypt
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Shamir 秘密共享：秘密的每个字节各自是 GF(2^8) 上一个 threshold-1 次随机多项式的常数项，
+// 第 i 份是所有多项式在 x=i 处的值。任意 threshold 份用拉格朗日插值还原常数项，
+// 少于 threshold 份得不到秘密的任何信息。份额的文本格式：
+//
+//	"sfbs1:" || 份额组(8 个十六进制字符) || ":" || base64url(x || y)
+//
+// 份额组随密钥文件生成，用来在合并之前发现混进来的其他密钥文件的份额。
+const (
+	keyShareVersion = "sfbs1"
+	MaxKeyShares    = 255
+	keyShareSetSize = 4
+)
+
+var (
+	ErrKeyShare    = errors.New("invalid key share")
+	ErrKeyShareSet = errors.New("key share belongs to a different key file")
+	ErrKeySharing  = errors.New("key shares: need 2 <= threshold <= shares <= 255")
+	ErrKeyShareDup = errors.New("duplicate key share")
+)
+
+// KeyShare 是解析后的一份份额
+type KeyShare struct {
+	Set string
+	X   byte
+	Y   []byte
+}
+
+// Wipe 清零份额内容
+func (s *KeyShare) Wipe() {
+	clear(s.Y)
+}
+
+func (s *KeyShare) encode() string {
+	return keyShareVersion + ":" + s.Set + ":" + base64.RawURLEncoding.EncodeToString(append([]byte{s.X}, s.Y...))
+}
+
+// ParseKeyShare 解析 sfbctl key split 输出的一份份额，容忍首尾空白
+func ParseKeyShare(s string) (*KeyShare, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 || parts[0] != keyShareVersion || len(parts[1]) != 2*keyShareSetSize {
+		return nil, ErrKeyShare
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return nil, ErrKeyShare
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(raw) < 2 || raw[0] == 0 {
+		return nil, ErrKeyShare
+	}
+	return &KeyShare{Set: parts[1], X: raw[0], Y: raw[1:]}, nil
+}
+
+// splitSecret 把 secret 拆成 n 份，任意 k 份可以还原
+func splitSecret(secret []byte, n, k int) ([]*KeyShare, error) {
+	if k < 2 || k > n || n > MaxKeyShares {
+		return nil, ErrKeySharing
+	}
+	setID := make([]byte, keyShareSetSize)
+	if _, err := rand.Read(setID); err != nil {
+		return nil, err
+	}
+	set := hex.EncodeToString(setID)
+	shares := make([]*KeyShare, n)
+	for i := range shares {
+		shares[i] = &KeyShare{Set: set, X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+	coeffs := make([]byte, k)
+	defer clear(coeffs)
+	for j, b := range secret {
+		// coeffs[0] 是秘密本身，其余为随机系数
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		coeffs[0] = b
+		for _, s := range shares {
+			s.Y[j] = gfEval(coeffs, s.X)
+		}
+	}
+	return shares, nil
+}
+
+// combineShares 用拉格朗日插值求 x=0 处的值；份额必须来自同一组、x 互不相同、长度相同
+func combineShares(shares []*KeyShare) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrKeyShare
+	}
+	size := len(shares[0].Y)
+	for i, s := range shares {
+		if s.Set != shares[0].Set {
+			return nil, ErrKeyShareSet
+		}
+		if len(s.Y) != size || s.X == 0 {
+			return nil, ErrKeyShare
+		}
+		for _, t := range shares[:i] {
+			if t.X == s.X {
+				return nil, ErrKeyShareDup
+			}
+		}
+	}
+	secret := make([]byte, size)
+	for i, s := range shares {
+		// l_i(0) = Π x_j / (x_j - x_i)，GF(2^8) 中减法就是异或
+		basis := byte(1)
+		for j, t := range shares {
+			if i != j {
+				basis = gfMul(basis, gfMul(t.X, gfInv(t.X^s.X)))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(basis, s.Y[b])
+		}
+	}
+	return secret, nil
+}
+
+// gfEval 用 Horner 法求 coeffs（低次在前）在 x 处的值
+func gfEval(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// gfMul 是 GF(2^8)（AES 的既约多项式 x^8+x^4+x^3+x+1）上的乘法，不查表，运行时间与输入无关
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv 求乘法逆元 a^254；a 为 0 时返回 0
+func gfInv(a byte) byte {
+	b := gfMul(a, a)   // a^2
+	c := gfMul(a, b)   // a^3
+	b = gfMul(c, c)    // a^6
+	b = gfMul(b, b)    // a^12
+	c = gfMul(b, c)    // a^15
+	b = gfMul(b, b)    // a^24
+	b = gfMul(b, b)    // a^48
+	b = gfMul(b, c)    // a^63
+	b = gfMul(b, b)    // a^126
+	b = gfMul(a, b)    // a^127
+	return gfMul(b, b) // a^254
+}
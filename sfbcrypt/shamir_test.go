@@ -0,0 +1,130 @@
+package sfbcrypt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// subsets 返回 shares 中所有大小为 k 的子集
+func subsets(shares []*KeyShare, k int) [][]*KeyShare {
+	if k == 0 {
+		return [][]*KeyShare{nil}
+	}
+	var out [][]*KeyShare
+	for i := 0; i+k <= len(shares); i++ {
+		for _, rest := range subsets(shares[i+1:], k-1) {
+			out = append(out, append([]*KeyShare{shares[i]}, rest...))
+		}
+	}
+	return out
+}
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := gfMul(byte(a), gfInv(byte(a))); got != 1 {
+			t.Fatalf("%d * inv(%d) = %d", a, a, got)
+		}
+	}
+	if gfInv(0) != 0 {
+		t.Fatal("inv(0) != 0")
+	}
+}
+
+func TestSplitCombineEverySubset(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x00, 0x5a, 0xff, 0x01}, 8)
+	for n := 2; n <= 6; n++ {
+		for k := 2; k <= n; k++ {
+			shares, err := splitSecret(secret, n, k)
+			if err != nil {
+				t.Fatalf("split %d-of-%d: %v", k, n, err)
+			}
+			for size := k; size <= n; size++ {
+				for _, sub := range subsets(shares, size) {
+					got, err := combineShares(sub)
+					if err != nil || !bytes.Equal(got, secret) {
+						t.Fatalf("%d-of-%d, %d shares: %x, %v", k, n, size, got, err)
+					}
+				}
+			}
+			// 少于 k 份插值出来的是另一个多项式的常数项，不是秘密
+			if k > 2 {
+				for _, sub := range subsets(shares, k-1) {
+					if got, err := combineShares(sub); err != nil || bytes.Equal(got, secret) {
+						t.Fatalf("%d-of-%d: %d shares reconstructed the secret (%v)", k, n, k-1, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSplitSecretBounds(t *testing.T) {
+	for _, c := range [][2]int{{1, 1}, {3, 1}, {2, 3}, {256, 2}} {
+		if _, err := splitSecret([]byte("secret"), c[0], c[1]); !errors.Is(err, ErrKeySharing) {
+			t.Errorf("split n=%d k=%d: %v", c[0], c[1], err)
+		}
+	}
+	if shares, err := splitSecret([]byte("secret"), MaxKeyShares, 2); err != nil || shares[MaxKeyShares-1].X != MaxKeyShares {
+		t.Fatalf("split into %d shares: %v", MaxKeyShares, err)
+	}
+}
+
+func TestCombineSharesRejects(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := splitSecret(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := splitSecret(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup := *shares[0]
+	zero := *shares[1]
+	zero.X = 0
+	short := *shares[1]
+	short.Y = short.Y[:16]
+
+	tests := []struct {
+		name   string
+		shares []*KeyShare
+		want   error
+	}{
+		{"one share", shares[:1], ErrKeyShare},
+		{"duplicate x", []*KeyShare{shares[0], &dup}, ErrKeyShareDup},
+		{"duplicate x among more", []*KeyShare{shares[0], shares[1], &dup}, ErrKeyShareDup},
+		{"zero x", []*KeyShare{shares[0], &zero}, ErrKeyShare},
+		{"zero x first", []*KeyShare{&zero, shares[0]}, ErrKeyShare},
+		{"different length", []*KeyShare{shares[0], &short}, ErrKeyShare},
+		{"different set", []*KeyShare{shares[0], other[1]}, ErrKeyShareSet},
+	}
+	for _, tt := range tests {
+		if _, err := combineShares(tt.shares); !errors.Is(err, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseKeyShare(t *testing.T) {
+	shares, err := splitSecret([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ParseKeyShare("  " + shares[2].encode() + "\n")
+	if err != nil || s.Set != shares[2].Set || s.X != 3 || !bytes.Equal(s.Y, shares[2].Y) {
+		t.Fatalf("ParseKeyShare = %+v, %v", s, err)
+	}
+	for _, bad := range []string{
+		"",
+		"sfbs2:" + shares[0].Set + ":AQID",
+		"sfbs1:zzzzzzzz:AQID",
+		"sfbs1:" + shares[0].Set + ":AA", // x 为 0
+		"sfbs1:" + shares[0].Set + ":AQ", // 没有 y
+		"sfbs1:" + shares[0].Set + ":!!",
+	} {
+		if _, err := ParseKeyShare(bad); !errors.Is(err, ErrKeyShare) {
+			t.Errorf("ParseKeyShare(%q) = %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package sfbcrypt
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// 用户密钥（服务器端的每用户密钥）。与保险库不同，服务器在用户登录时解开它，
+// 所以服务器运行时能读取用户文件；但只拿到主密钥和数据库时读不到：
+//
+//	密码密钥 = Argon2id(登录密码, salt, ...)，参数格式与 VaultKDF 相同
+//	用户密钥 = 32 字节随机数，以 Wrap(密码密钥, "sfb-user-key") 保存在 users.user_key
+//	内容密钥 = HMAC-SHA256(用户密钥, LabelFile)，用法与 Keys.File 相同（SFB2）
+//
+// 可选的托管副本用管理员的 X25519 恢复公钥加密，私钥不在服务器上：
+//
+//	"e1:" || 恢复公钥 ID || ":" || base64url(临时公钥(32) || nonce(12) || AES-256-GCM(用户密钥))
+//
+// GCM 密钥为 HMAC-SHA256(X25519(临时私钥, 恢复公钥), "sfb-user-key-escrow" || 临时公钥 || 恢复公钥)，
+// AAD 为 "sfb-user-key-escrow"；恢复公钥 ID 为 SHA-256(恢复公钥) 前 8 字节的十六进制。
+const (
+	labelUserKey       = "sfb-user-key"
+	labelUserKeyEscrow = "sfb-user-key-escrow"
+	escrowPrefixV1     = "e1:"
+)
+
+var (
+	ErrUserKeyPassword = errors.New("password does not unwrap the user key")
+	ErrUserKeyFormat   = errors.New("invalid user key material")
+	ErrRecoveryKey     = errors.New("invalid recovery key")
+	ErrEscrowMismatch  = errors.New("escrowed user key belongs to a different recovery key")
+)
+
+// UserKeyMaterial 是保存在 users.user_key 中的 KDF 参数和包装后的用户密钥
+type UserKeyMaterial struct {
+	KDF        VaultKDF `json:"kdf"`
+	WrappedKey string   `json:"wrapped_key"`
+}
+
+// NewUserKeyKDF 返回服务器端的默认参数（t=2、19 MiB、p=1，OWASP 的建议值）和新的随机 salt。
+// 每次登录都要派生一次，所以比客户端保险库的默认值轻
+func NewUserKeyKDF() (*VaultKDF, error) {
+	salt := make([]byte, VaultSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &VaultKDF{Alg: VaultKDFArgon2id, Time: 2, MemoryKiB: 19 * 1024, Threads: 1, Salt: salt}, nil
+}
+
+// WrapUserKey 用新的 salt 从 password 派生密钥并包装 userKey，返回 JSON 编码的 UserKeyMaterial
+func WrapUserKey(password []byte, userKey []byte) (string, error) {
+	kdf, err := NewUserKeyKDF()
+	if err != nil {
+		return "", err
+	}
+	kek, err := kdf.DeriveKey(password)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := vaultSeal(kek, labelUserKey, userKey)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(UserKeyMaterial{KDF: *kdf, WrappedKey: wrapped})
+	return string(b), err
+}
+
+// UnwrapUserKey 是 WrapUserKey 的逆操作；密码不对时返回 ErrUserKeyPassword
+func UnwrapUserKey(password []byte, material string) ([]byte, error) {
+	var m UserKeyMaterial
+	if err := json.Unmarshal([]byte(material), &m); err != nil {
+		return nil, ErrUserKeyFormat
+	}
+	kek, err := m.KDF.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	key, err := vaultOpen(kek, labelUserKey, m.WrappedKey)
+	if errors.Is(err, ErrMetaIntegrity) {
+		return nil, ErrUserKeyPassword
+	}
+	if err == nil && len(key) != VaultKeySize {
+		return nil, ErrUserKeyFormat
+	}
+	return key, err
+}
+
+// UserFileKey 从用户密钥派生出该用户文件内容的加密密钥，用于 NewBlobCipher
+func UserFileKey(userKey []byte) []byte {
+	return DeriveKey(userKey, LabelFile)
+}
+
+// NewRecoveryKey 生成管理员恢复密钥对，返回 base64url 编码的公钥和私钥
+func NewRecoveryKey() (publicKey string, privateKey string, err error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(priv.PublicKey().Bytes()), enc.EncodeToString(priv.Bytes()), nil
+}
+
+// ParseRecoveryPublicKey 解码 file_crypto.recovery_public_key
+func ParseRecoveryPublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, ErrRecoveryKey
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, ErrRecoveryKey
+	}
+	return pub, nil
+}
+
+// ParseRecoveryPrivateKey 解码 NewRecoveryKey 生成的私钥
+func ParseRecoveryPrivateKey(s string) (*ecdh.PrivateKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, ErrRecoveryKey
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, ErrRecoveryKey
+	}
+	return priv, nil
+}
+
+// RecoveryKeyID 标识一个恢复公钥，更换恢复密钥后据此判断哪些托管副本需要重新生成
+func RecoveryKeyID(pub *ecdh.PublicKey) string {
+	sum := sha256.Sum256(pub.Bytes())
+	return hex.EncodeToString(sum[:8])
+}
+
+// EscrowUserKey 用恢复公钥加密用户密钥
+func EscrowUserKey(pub *ecdh.PublicKey, userKey []byte) (string, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return "", err
+	}
+	kek := escrowKEK(shared, eph.PublicKey().Bytes(), pub.Bytes())
+	sealed, err := vaultSeal(kek, labelUserKeyEscrow, userKey)
+	if err != nil {
+		return "", err
+	}
+	raw, _ := base64.RawURLEncoding.DecodeString(sealed[len(MetaPrefixV1):])
+	out := append(eph.PublicKey().Bytes(), raw...)
+	return escrowPrefixV1 + RecoveryKeyID(pub) + ":" + base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// EscrowKeyID 返回托管副本使用的恢复公钥 ID，格式不对时返回空字符串
+func EscrowKeyID(escrowed string) string {
+	rest, ok := strings.CutPrefix(escrowed, escrowPrefixV1)
+	if !ok {
+		return ""
+	}
+	id, _, ok := strings.Cut(rest, ":")
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// RecoverUserKey 用恢复私钥解开托管副本
+func RecoverUserKey(priv *ecdh.PrivateKey, escrowed string) ([]byte, error) {
+	id := EscrowKeyID(escrowed)
+	if id == "" {
+		return nil, ErrUserKeyFormat
+	}
+	if id != RecoveryKeyID(priv.PublicKey()) {
+		return nil, ErrEscrowMismatch
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(escrowed[len(escrowPrefixV1)+len(id)+1:])
+	if err != nil || len(raw) < 32 {
+		return nil, ErrUserKeyFormat
+	}
+	ephPub, err := ecdh.X25519().NewPublicKey(raw[:32])
+	if err != nil {
+		return nil, ErrUserKeyFormat
+	}
+	shared, err := priv.ECDH(ephPub)
+	if err != nil {
+		return nil, ErrUserKeyFormat
+	}
+	kek := escrowKEK(shared, ephPub.Bytes(), priv.PublicKey().Bytes())
+	key, err := vaultOpen(kek, labelUserKeyEscrow, MetaPrefixV1+base64.RawURLEncoding.EncodeToString(raw[32:]))
+	if errors.Is(err, ErrMetaIntegrity) {
+		return nil, ErrRecoveryKey
+	}
+	if err == nil && len(key) != VaultKeySize {
+		return nil, ErrUserKeyFormat
+	}
+	return key, err
+}
+
+// escrowKEK 由 X25519 共享密钥、临时公钥和恢复公钥派生 GCM 密钥
+func escrowKEK(shared, ephPub, recipientPub []byte) []byte {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte(labelUserKeyEscrow))
+	mac.Write(ephPub)
+	mac.Write(recipientPub)
+	return mac.Sum(nil)
+}
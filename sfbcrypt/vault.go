@@ -0,0 +1,335 @@
+package sfbcrypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// 保险库（端到端加密）格式。所有密钥只在客户端出现，服务器只保存密文、
+// 包装后的密钥和 KDF 参数。
+//
+//	口令密钥   = Argon2id(口令, salt, time, memory, threads)，32 字节
+//	保险库密钥 = 32 字节随机数，以 Wrap(口令密钥, "sfb-vault-key") 保存在服务器
+//	文件密钥   = 每个文件 32 字节随机数，以 Wrap(保险库密钥, "sfb-vault-file-key") 保存
+//	文件名     = Wrap(文件密钥, "sfb-vault-name")
+//
+// Wrap 与元数据 v1 相同（"v1:" || base64url(nonce(12) || AES-256-GCM)），AAD 为标签。
+// 修改口令只需要重新包装保险库密钥，文件不用重新加密。
+//
+// 内容按块加密，每块单独上传：
+//
+//	块 = flag(1) || nonce(12) || AES-256-GCM(文件密钥, 明文, AAD = uint32 BE(序号) || flag)
+//
+// flag 为 1 表示最后一块，之后不能再有块，因此截断和追加都能发现。服务器保存的文件为
+//
+//	"SFV1" || 重复：uint32 BE 块长度 || 块
+const (
+	VaultKDFArgon2id = "argon2id"
+	VaultKeySize     = 32
+	VaultSaltSize    = 16
+	VaultMagic       = "SFV1"
+	// VaultChunkSize 是客户端默认的明文块大小
+	VaultChunkSize = 1 << 20
+	// VaultMaxChunk 是服务器接受的最大块（含 flag、nonce 和 tag）
+	VaultMaxChunk = 4<<20 + vaultChunkHeader + chunkOverhead
+	// VaultMinChunk 是空明文块的长度
+	VaultMinChunk = vaultChunkHeader + chunkOverhead
+
+	vaultChunkHeader = 1 + NonceSize
+
+	// VaultMinMemoryKiB 等参数下限参考 OWASP 对 Argon2id 的最低建议（19 MiB、t=2）
+	VaultMinMemoryKiB = 19 * 1024
+	VaultMaxMemoryKiB = 1 << 20
+	VaultMinTime      = 2
+	VaultMaxTime      = 16
+
+	labelVaultKey     = "sfb-vault-key"
+	labelVaultFileKey = "sfb-vault-file-key"
+	labelVaultName    = "sfb-vault-name"
+)
+
+var (
+	ErrVaultKDF        = errors.New("unsupported or too weak vault kdf parameters")
+	ErrVaultPassphrase = errors.New("wrong vault passphrase")
+	ErrVaultWrapped    = errors.New("invalid wrapped vault key")
+	ErrVaultChunk      = errors.New("invalid vault chunk")
+	ErrVaultFinal      = errors.New("data after the final vault chunk")
+)
+
+// VaultKDF 是从口令派生密钥的参数，原样保存在服务器上
+type VaultKDF struct {
+	Alg       string `json:"alg"`
+	Time      uint32 `json:"time"`
+	MemoryKiB uint32 `json:"memory_kib"`
+	Threads   uint8  `json:"threads"`
+	Salt      []byte `json:"salt"`
+}
+
+// NewVaultKDF 返回默认参数（t=3、64 MiB、p=4）和新的随机 salt
+func NewVaultKDF() (*VaultKDF, error) {
+	salt := make([]byte, VaultSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &VaultKDF{Alg: VaultKDFArgon2id, Time: 3, MemoryKiB: 64 * 1024, Threads: 4, Salt: salt}, nil
+}
+
+// Validate 检查参数。客户端在派生之前也要检查，防止服务器下发很弱的参数
+func (k *VaultKDF) Validate() error {
+	switch {
+	case k.Alg != VaultKDFArgon2id,
+		k.Time < VaultMinTime || k.Time > VaultMaxTime,
+		k.MemoryKiB < VaultMinMemoryKiB || k.MemoryKiB > VaultMaxMemoryKiB,
+		k.Threads == 0,
+		len(k.Salt) < VaultSaltSize || len(k.Salt) > 64:
+		return ErrVaultKDF
+	}
+	return nil
+}
+
+// DeriveKey 从口令派生出包装保险库密钥用的 32 字节密钥
+func (k *VaultKDF) DeriveKey(passphrase []byte) ([]byte, error) {
+	if err := k.Validate(); err != nil {
+		return nil, err
+	}
+	return argon2.IDKey(passphrase, k.Salt, k.Time, k.MemoryKiB, k.Threads, VaultKeySize), nil
+}
+
+// NewVaultKey 生成新的保险库密钥
+func NewVaultKey() ([]byte, error) {
+	key := make([]byte, VaultKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapVaultKey 用口令密钥包装保险库密钥
+func WrapVaultKey(kek, vaultKey []byte) (string, error) {
+	return vaultSeal(kek, labelVaultKey, vaultKey)
+}
+
+// UnwrapVaultKey 是 WrapVaultKey 的逆操作；认证失败时返回 ErrVaultPassphrase
+func UnwrapVaultKey(kek []byte, wrapped string) ([]byte, error) {
+	key, err := vaultOpen(kek, labelVaultKey, wrapped)
+	if errors.Is(err, ErrMetaIntegrity) {
+		return nil, ErrVaultPassphrase
+	}
+	if err == nil && len(key) != VaultKeySize {
+		return nil, ErrVaultWrapped
+	}
+	return key, err
+}
+
+// ValidWrapped 只检查包装格式，服务器用它拒绝明显无效的输入
+func ValidWrapped(wrapped string, minPlain int) bool {
+	if !strings.HasPrefix(wrapped, MetaPrefixV1) {
+		return false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(wrapped[len(MetaPrefixV1):])
+	return err == nil && len(raw) >= MetaNonceSize+chunkOverhead+minPlain
+}
+
+func vaultSeal(key []byte, label string, plain []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, MetaNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plain, []byte(label))
+	return MetaPrefixV1 + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func vaultOpen(key []byte, label string, wrapped string) ([]byte, error) {
+	if !strings.HasPrefix(wrapped, MetaPrefixV1) {
+		return nil, ErrMetaFormat
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(wrapped[len(MetaPrefixV1):])
+	if err != nil || len(raw) < MetaNonceSize {
+		return nil, ErrMetaPayload
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, raw[:MetaNonceSize], raw[MetaNonceSize:], []byte(label))
+	if err != nil {
+		return nil, ErrMetaIntegrity
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// VaultFile 是一个保险库文件的密钥
+type VaultFile struct {
+	key []byte
+	gcm cipher.AEAD
+}
+
+// NewVaultFile 生成新的文件密钥，返回它和用保险库密钥包装后的形式
+func NewVaultFile(vaultKey []byte) (*VaultFile, string, error) {
+	key, err := NewVaultKey()
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := vaultSeal(vaultKey, labelVaultFileKey, key)
+	if err != nil {
+		return nil, "", err
+	}
+	file, err := newVaultFile(key)
+	return file, wrapped, err
+}
+
+// OpenVaultFile 解开服务器保存的文件密钥
+func OpenVaultFile(vaultKey []byte, wrapped string) (*VaultFile, error) {
+	key, err := vaultOpen(vaultKey, labelVaultFileKey, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != VaultKeySize {
+		return nil, ErrVaultWrapped
+	}
+	return newVaultFile(key)
+}
+
+func newVaultFile(key []byte) (*VaultFile, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &VaultFile{key: key, gcm: gcm}, nil
+}
+
+func (v *VaultFile) EncryptName(name string) (string, error) {
+	return vaultSeal(v.key, labelVaultName, []byte(name))
+}
+
+func (v *VaultFile) DecryptName(encName string) (string, error) {
+	name, err := vaultOpen(v.key, labelVaultName, encName)
+	return string(name), err
+}
+
+// SealChunk 加密第 index 块；final 表示这是最后一块
+func (v *VaultFile) SealChunk(index uint32, plain []byte, final bool) ([]byte, error) {
+	chunk := make([]byte, vaultChunkHeader, vaultChunkHeader+len(plain)+chunkOverhead)
+	if final {
+		chunk[0] = 1
+	}
+	if _, err := rand.Read(chunk[1:vaultChunkHeader]); err != nil {
+		return nil, err
+	}
+	return v.gcm.Seal(chunk, chunk[1:vaultChunkHeader], plain, vaultChunkAAD(index, chunk[0])), nil
+}
+
+// OpenChunk 解密第 index 块，返回明文和它是否是最后一块
+func (v *VaultFile) OpenChunk(index uint32, chunk []byte) ([]byte, bool, error) {
+	final, err := VaultChunkFinal(chunk)
+	if err != nil {
+		return nil, false, err
+	}
+	plain, err := v.gcm.Open(nil, chunk[1:vaultChunkHeader], chunk[vaultChunkHeader:], vaultChunkAAD(index, chunk[0]))
+	if err != nil {
+		return nil, false, ErrIntegrity
+	}
+	return plain, final, nil
+}
+
+// VaultChunkFinal 只检查块的结构并返回 flag，不做认证；服务器用它判断上传是否结束
+func VaultChunkFinal(chunk []byte) (bool, error) {
+	if len(chunk) < VaultMinChunk || len(chunk) > VaultMaxChunk || chunk[0] > 1 {
+		return false, ErrVaultChunk
+	}
+	return chunk[0] == 1, nil
+}
+
+func vaultChunkAAD(index uint32, flag byte) []byte {
+	aad := make([]byte, 5)
+	binary.BigEndian.PutUint32(aad, index)
+	aad[4] = flag
+	return aad
+}
+
+// AppendVaultFrame 写出一块在服务器文件中的形式：uint32 BE 长度 || 块
+func AppendVaultFrame(dst io.Writer, chunk []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(chunk)))
+	if _, err := dst.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := dst.Write(chunk)
+	return err
+}
+
+// Decrypt 校验并解密服务器保存的 SFV1 文件，逐块写入 dst，返回明文字节数。
+// 出错时返回 *ChunkError，此前已写入 dst 的明文都通过了认证。
+func (v *VaultFile) Decrypt(dst io.Writer, src io.Reader) (int64, error) {
+	reader := bufio.NewReaderSize(src, VaultChunkSize+vaultChunkHeader+chunkOverhead+4)
+	magic := make([]byte, len(VaultMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return 0, ErrHeaderMissing
+	}
+	if string(magic) != VaultMagic {
+		return 0, ErrBadMagic
+	}
+	var (
+		index  uint32
+		total  int64
+		offset = int64(len(VaultMagic))
+		length [4]byte
+		final  bool
+	)
+	for {
+		_, err := io.ReadFull(reader, length[:])
+		if err == io.EOF {
+			if !final {
+				return total, &ChunkError{Chunk: index, Offset: offset, Err: ErrTruncated}
+			}
+			return total, nil
+		}
+		if err != nil {
+			return total, &ChunkError{Chunk: index, Offset: offset, Err: ErrTruncated}
+		}
+		if final {
+			return total, &ChunkError{Chunk: index, Offset: offset, Err: ErrVaultFinal}
+		}
+		n := binary.BigEndian.Uint32(length[:])
+		if n < VaultMinChunk || n > VaultMaxChunk {
+			return total, &ChunkError{Chunk: index, Offset: offset, Err: ErrChunkLength}
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return total, &ChunkError{Chunk: index, Offset: offset, Err: ErrTruncated}
+		}
+		plain, last, err := v.OpenChunk(index, chunk)
+		if err != nil {
+			return total, &ChunkError{Chunk: index, Offset: offset, Err: err}
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return total, fmt.Errorf("write plaintext: %w", err)
+		}
+		total += int64(len(plain))
+		offset += 4 + int64(n)
+		final = last
+		index++
+	}
+}
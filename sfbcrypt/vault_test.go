@@ -0,0 +1,181 @@
+package sfbcrypt
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testVaultKDF 是 Validate 允许的最低参数，派生得比默认参数快
+func testVaultKDF() *VaultKDF {
+	return &VaultKDF{Alg: VaultKDFArgon2id, Time: VaultMinTime, MemoryKiB: VaultMinMemoryKiB, Threads: 1, Salt: bytes.Repeat([]byte{7}, VaultSaltSize)}
+}
+
+func TestVaultKeyWrap(t *testing.T) {
+	kdf := testVaultKDF()
+	kek, err := kdf.DeriveKey([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := kdf.DeriveKey([]byte("correct horse"))
+	other, _ := kdf.DeriveKey([]byte("correct horsE"))
+	if len(kek) != VaultKeySize || !bytes.Equal(kek, again) || bytes.Equal(kek, other) {
+		t.Fatal("DeriveKey is not a deterministic function of the passphrase")
+	}
+
+	key, err := NewVaultKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := WrapVaultKey(kek, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ValidWrapped(wrapped, VaultKeySize) || ValidWrapped(wrapped, VaultKeySize+1) {
+		t.Fatalf("ValidWrapped(%q)", wrapped)
+	}
+	if got, err := UnwrapVaultKey(kek, wrapped); err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("UnwrapVaultKey = %x, %v", got, err)
+	}
+	if _, err := UnwrapVaultKey(other, wrapped); !errors.Is(err, ErrVaultPassphrase) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+
+	// 改动包装的任意位置都无法解开
+	raw := []byte(wrapped)
+	for _, i := range []int{len(MetaPrefixV1), len(raw) / 2, len(raw) - 1} {
+		tampered := bytes.Clone(raw)
+		tampered[i] ^= 'A' ^ 'B'
+		if _, err := UnwrapVaultKey(kek, string(tampered)); err == nil {
+			t.Fatalf("tampered at %d: unwrapped", i)
+		}
+	}
+	// 用作文件密钥的包装不能当作保险库密钥解开（标签不同）
+	_, fileKey, err := NewVaultFile(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnwrapVaultKey(kek, fileKey); !errors.Is(err, ErrVaultPassphrase) {
+		t.Fatalf("file key unwrapped as a vault key: %v", err)
+	}
+}
+
+func TestVaultKDFValidate(t *testing.T) {
+	if err := testVaultKDF().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewVaultKDF()
+	if err != nil || def.Validate() != nil {
+		t.Fatalf("default parameters: %v", err)
+	}
+	for name, edit := range map[string]func(k *VaultKDF){
+		"alg":        func(k *VaultKDF) { k.Alg = "scrypt" },
+		"time":       func(k *VaultKDF) { k.Time = 1 },
+		"memory":     func(k *VaultKDF) { k.MemoryKiB = 1024 },
+		"huge":       func(k *VaultKDF) { k.MemoryKiB = VaultMaxMemoryKiB + 1 },
+		"threads":    func(k *VaultKDF) { k.Threads = 0 },
+		"short salt": func(k *VaultKDF) { k.Salt = k.Salt[:8] },
+	} {
+		k := testVaultKDF()
+		edit(k)
+		if _, err := k.DeriveKey([]byte("x")); !errors.Is(err, ErrVaultKDF) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+// sealVaultFile 把 chunks 加密成服务器保存的 SFV1 格式，最后一块带结束标记
+func sealVaultFile(t *testing.T, file *VaultFile, chunks []string) ([][]byte, []byte) {
+	t.Helper()
+	var sealed [][]byte
+	var buf bytes.Buffer
+	buf.WriteString(VaultMagic)
+	for i, plain := range chunks {
+		chunk, err := file.SealChunk(uint32(i), []byte(plain), i == len(chunks)-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed = append(sealed, chunk)
+		if err := AppendVaultFrame(&buf, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sealed, buf.Bytes()
+}
+
+func frames(chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(VaultMagic)
+	for _, c := range chunks {
+		AppendVaultFrame(&buf, c)
+	}
+	return buf.Bytes()
+}
+
+func TestVaultFileChunks(t *testing.T) {
+	vaultKey, _ := NewVaultKey()
+	file, encKey, err := NewVaultFile(vaultKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenVaultFile(vaultKey, encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encName, _ := file.EncryptName("税单 2026.pdf")
+	if name, err := opened.DecryptName(encName); err != nil || name != "税单 2026.pdf" {
+		t.Fatalf("DecryptName = %q, %v", name, err)
+	}
+
+	sealed, content := sealVaultFile(t, file, []string{"alpha", "", "charlie"})
+	var out bytes.Buffer
+	if n, err := opened.Decrypt(&out, bytes.NewReader(content)); err != nil || n != 12 || out.String() != "alphacharlie" {
+		t.Fatalf("Decrypt = %d %q, %v", n, out.String(), err)
+	}
+	if final, err := VaultChunkFinal(sealed[2]); err != nil || !final {
+		t.Fatalf("VaultChunkFinal = %v, %v", final, err)
+	}
+
+	flipped := bytes.Clone(content)
+	flipped[len(flipped)-3] ^= 1
+	extra, _ := file.SealChunk(3, []byte("delta"), true)
+	notFinal, _ := file.SealChunk(2, []byte("charlie"), false)
+	flagged := bytes.Clone(sealed[0])
+	flagged[0] = 1
+	otherFile, _, _ := NewVaultFile(vaultKey)
+	foreign, _ := otherFile.SealChunk(0, []byte("alpha"), false)
+	tests := []struct {
+		name    string
+		content []byte
+		want    error
+	}{
+		{"flipped byte", flipped, ErrIntegrity},
+		{"dropped final chunk", frames(sealed[0], sealed[1]), ErrTruncated},
+		{"final flag cleared", frames(sealed[0], sealed[1], notFinal), ErrTruncated},
+		{"truncated chunk", content[:len(content)-5], ErrTruncated},
+		{"reordered", frames(sealed[1], sealed[0], sealed[2]), ErrIntegrity},
+		{"final flag set early", frames(flagged, sealed[1], sealed[2]), ErrIntegrity},
+		{"appended after final", append(bytes.Clone(content), frames(extra)[len(VaultMagic):]...), ErrVaultFinal},
+		{"chunk of another file", frames(foreign, sealed[1], sealed[2]), ErrIntegrity},
+		{"bad magic", append([]byte("SFV2"), content[len(VaultMagic):]...), ErrBadMagic},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if _, err := opened.Decrypt(&out, bytes.NewReader(tt.content)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+		if !strings.HasPrefix("alphacharlie", out.String()) {
+			t.Errorf("%s: unauthenticated plaintext %q written", tt.name, out.String())
+		}
+	}
+
+	for _, chunk := range [][]byte{nil, make([]byte, VaultMinChunk-1), append([]byte{2}, sealed[0][1:]...)} {
+		if _, err := VaultChunkFinal(chunk); !errors.Is(err, ErrVaultChunk) {
+			t.Errorf("VaultChunkFinal(%d bytes) = %v", len(chunk), err)
+		}
+	}
+	if _, err := OpenVaultFile(bytes.Repeat([]byte{1}, VaultKeySize), encKey); err == nil {
+		t.Fatal("file key opened with another vault key")
+	}
+}